@@ -0,0 +1,74 @@
+// Command acl_convert converts a v1 egress ACL file to the v2 format and
+// prints it. Included files are left as they are, since v2 files may
+// include v1 files.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
+	"gopkg.in/yaml.v2"
+)
+
+func main() {
+	flags := flag.NewFlagSet("acl_convert", flag.ExitOnError)
+	format := flags.String("format", "yaml", "Print the converted ACL as `FORMAT`: yaml or json.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: acl_convert [options] FILE\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() != 1 || (*format != "yaml" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	out, err := convert(flags.Arg(0), *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(out)
+}
+
+func convert(path, format string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg acl.YAMLConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Version != "v1" {
+		return nil, fmt.Errorf("%s: expected version \"v1\" got %#v", path, cfg.Version)
+	}
+
+	v2 := aclv2.ConvertV1(&cfg)
+	if format == "json" {
+		out, err := json.MarshalIndent(v2, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	}
+	out, err := yaml.Marshal(v2)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), out...), nil
+}
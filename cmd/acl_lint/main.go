@@ -0,0 +1,101 @@
+// Command acl_lint reports likely mistakes in an egress ACL file or
+// directory, such as duplicate or shadowed domains and globs on public
+// suffixes. It exits with status 1 when it finds errors (or warnings, with
+// -strict), and 2 on usage errors.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
+)
+
+type report struct {
+	Valid    bool              `json:"valid"`
+	Findings []acl.LintFinding `json:"findings"`
+}
+
+func main() {
+	flags := flag.NewFlagSet("acl_lint", flag.ExitOnError)
+	format := flags.String("format", "text", "Print findings as `FORMAT`: text or json.")
+	strict := flags.Bool("strict", false, "Fail on warnings too.")
+	pslFile := flags.String("public-suffix-list-file", "", "Read the Public Suffix List from `FILE` instead of using the embedded one.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: acl_lint [options] FILE\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var findings []acl.LintFinding
+	var a *acl.ACL
+	var err error
+	if aclv2.HasV2Files(flags.Arg(0)) {
+		err = errors.New("v2 ACLs are not supported: acl_lint checks v1 files only")
+	} else {
+		a, err = acl.NewLoader(flags.Arg(0)).Load()
+	}
+	if err == nil && *pslFile != "" {
+		a.PublicSuffixCheck.List, err = acl.LoadPublicSuffixList(*pslFile)
+	}
+	if err == nil {
+		err = a.Validate()
+	}
+	if err != nil {
+		findings = append(findings, acl.LintFinding{
+			Severity: acl.LintError,
+			Check:    "load",
+			Location: flags.Arg(0),
+			Message:  err.Error(),
+		})
+	} else {
+		findings = a.Lint()
+	}
+
+	valid := true
+	for _, f := range findings {
+		if f.Severity == acl.LintError || (*strict && f.Severity == acl.LintWarning) {
+			valid = false
+		}
+	}
+
+	switch *format {
+	case "json":
+		r := report{Valid: valid, Findings: findings}
+		if r.Findings == nil {
+			r.Findings = []acl.LintFinding{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	default:
+		printText(os.Stdout, findings)
+	}
+
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+func printText(w io.Writer, findings []acl.LintFinding) {
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "No findings.")
+		return
+	}
+	for _, f := range findings {
+		fmt.Fprintln(w, f)
+	}
+}
@@ -0,0 +1,155 @@
+// Command acl_sign signs egress ACL files for smokescreen's acl_signature
+// verification, writing the detached signature of FILE to FILE.sig. With
+// -cert, the signature is a PEM bundle with the signer's certificate chain;
+// otherwise the key must be Ed25519. -generate-key creates an Ed25519 key
+// pair instead.
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/signature"
+)
+
+func main() {
+	flags := flag.NewFlagSet("acl_sign", flag.ExitOnError)
+	keyFile := flags.String("key", "", "Sign with the PKCS #8 PEM private key in `FILE`.")
+	certFile := flags.String("cert", "", "Include the PEM certificate chain in `FILE`, starting with the key's certificate.")
+	generate := flags.String("generate-key", "", "Write a new Ed25519 private key to `NAME`.key and its public key to NAME.pub.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: acl_sign -key KEY [-cert CHAIN] FILE...\n       acl_sign -generate-key NAME\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	var err error
+	switch {
+	case *generate != "" && flags.NArg() == 0:
+		err = generateKey(*generate)
+	case *generate == "" && *keyFile != "" && flags.NArg() > 0:
+		err = sign(*keyFile, *certFile, flags.Args())
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generateKey(name string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(name+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s.key and %s.pub (%s)\n", name, name, signature.Fingerprint(pub))
+	return nil
+}
+
+func sign(keyFile, certFile string, files []string) error {
+	key, err := readKey(keyFile)
+	if err != nil {
+		return err
+	}
+	var certs []*x509.Certificate
+	if certFile != "" {
+		certs, err = readCerts(certFile)
+		if err != nil {
+			return err
+		}
+	}
+	edKey, isEd25519 := key.(ed25519.PrivateKey)
+	if certs == nil && !isEd25519 {
+		return errors.New("signing without -cert requires an Ed25519 key")
+	}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var sig []byte
+		if certs != nil {
+			sig, err = signature.SignBundle(key, certs, data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f, err)
+			}
+		} else {
+			sig = signature.Sign(edKey, data)
+		}
+		err = ioutil.WriteFile(f+signature.Suffix, sig, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM PRIVATE KEY block", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key %T", file, key)
+	}
+	return signer, nil
+}
+
+func readCerts(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return certs, nil
+}
@@ -1,26 +1,113 @@
+// Command check_config validates a smokescreen configuration file, along with
+// the SMOKESCREEN_* environment variables, and the files it refers to. It
+// exits with status 1 when it finds errors (or warnings, with -strict), and
+// 2 on usage errors.
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stripe/smokescreen/pkg/smokescreen"
 )
 
+type report struct {
+	Valid    bool                                `json:"valid"`
+	Findings []smokescreen.ConfigFinding         `json:"findings"`
+	Config   map[string]interface{}              `json:"config"`
+	Sources  map[string]smokescreen.ConfigSource `json:"sources"`
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("missing argument: filePath")
-		os.Exit(1)
+	flags := flag.NewFlagSet("check_config", flag.ExitOnError)
+	format := flags.String("format", "text", "Print findings as `FORMAT`: text or json.  The json report includes the effective configuration.")
+	printConfig := flags.Bool("print-config", false, "Also print the effective configuration as YAML, with the source of each value (text format).")
+	strict := flags.Bool("strict", false, "Fail on warnings too.")
+	checkResolvers := flags.Bool("check-resolvers", false, "Check that the resolver answers DNS queries.")
+	resolverHost := flags.String("resolver-check-host", smokescreen.DefaultResolverCheckHost, "Look up `HOST` to check the resolver.")
+	expiryWarning := flags.Duration("expiry-warning", smokescreen.DefaultExpiryWarning, "Warn about certificates expiring within `DURATION`.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: check_config [options] FILE\n\n")
+		flags.PrintDefaults()
 	}
-	filePath := os.Args[1]
+	flags.Parse(os.Args[1:])
 
-	config, err := smokescreen.LoadConfig(filePath)
-	if err != nil {
-		fmt.Printf("Failed to load config: %v\n", err)
-		os.Exit(1)
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	filePath := flags.Arg(0)
+
+	// Messages logged while loading the configuration are kept out of the
+	// report.
+	logger := logrus.New()
+	logger.Out = os.Stderr
+
+	builder := smokescreen.NewConfigBuilder()
+	builder.Log = logger
+	var findings []smokescreen.ConfigFinding
+	if err := builder.AddFile(filePath); err != nil {
+		findings = append(findings, smokescreen.ErrorFindings(err)...)
+	} else if err := builder.AddEnv(os.Environ()); err != nil {
+		findings = append(findings, smokescreen.ErrorFindings(err)...)
+	} else {
+		findings = builder.Check(smokescreen.CheckOptions{
+			CheckResolvers:    *checkResolvers,
+			ResolverCheckHost: *resolverHost,
+			ExpiryWarning:     *expiryWarning,
+		})
+	}
+
+	valid := true
+	for _, f := range findings {
+		if f.Severity == smokescreen.FindingError || *strict {
+			valid = false
+		}
+	}
+
+	switch *format {
+	case "json":
+		r := report{
+			Valid:    valid,
+			Findings: findings,
+			Config:   builder.Values(),
+			Sources:  builder.Sources(),
+		}
+		if r.Findings == nil {
+			r.Findings = []smokescreen.ConfigFinding{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	default:
+		printText(os.Stdout, findings)
+		if *printConfig {
+			fmt.Fprintln(os.Stdout)
+			if err := builder.WriteYAML(os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
 	}
 
-	fmt.Printf("Parsed configuration:\n\n%#v\n\n", *config)
+	if !valid {
+		os.Exit(1)
+	}
+}
 
-	os.Exit(0)
+func printText(w io.Writer, findings []smokescreen.ConfigFinding) {
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "Configuration is valid.")
+		return
+	}
+	for _, f := range findings {
+		fmt.Fprintln(w, f)
+	}
 }
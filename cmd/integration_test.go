@@ -625,3 +625,57 @@ func startSmokescreen(t *testing.T, useTLS bool, logHook logrus.Hook) (*smokescr
 
 	return conf, server, nil
 }
+
+func TestNewConfigurationPrecedence(t *testing.T) {
+	r := require.New(t)
+
+	file, err := ioutil.TempFile(t.TempDir(), "config-*.yaml")
+	r.NoError(err)
+	_, err = file.WriteString("port: 4751\nconnect_timeout: 5s\ndeny_ranges: [10.0.0.0/8, 172.16.0.0/12]\n")
+	r.NoError(err)
+	r.NoError(file.Close())
+
+	conf, err := NewConfiguration([]string{
+		"smokescreen",
+		"--config-file=" + file.Name(),
+		"--timeout=2s",
+		"--deny-range=192.168.0.0/16",
+		"--metric-tag=acl.allow=zone:a",
+	}, nil)
+	r.NoError(err)
+	r.Equal(uint16(4751), conf.Port)
+	r.Equal(2*time.Second, conf.ConnectTimeout)
+	r.Len(conf.DenyRanges, 1)
+	r.Equal([]string{"zone:a"}, conf.MetricsClient.GetMetricTags("acl.allow"))
+
+	_, err = NewConfiguration([]string{
+		"smokescreen",
+		"--config-file=" + file.Name(),
+		"--listen-port=70000",
+	}, nil)
+	r.Error(err)
+	r.Contains(err.Error(), "--listen-port: port: ")
+}
+
+func TestNewConfigurationEnv(t *testing.T) {
+	r := require.New(t)
+
+	file, err := ioutil.TempFile(t.TempDir(), "config-*.yaml")
+	r.NoError(err)
+	_, err = file.WriteString("port: 4751\nconnect_timeout: 5s\n")
+	r.NoError(err)
+	r.NoError(file.Close())
+
+	t.Setenv("SMOKESCREEN_CONFIG_FILE", file.Name())
+	t.Setenv("SMOKESCREEN_PORT", "4752")
+	t.Setenv("SMOKESCREEN_CONNECT_TIMEOUT", "3s")
+
+	conf, err := NewConfiguration([]string{"smokescreen", "--timeout=2s"}, nil)
+	r.NoError(err)
+	r.Equal(uint16(4752), conf.Port)
+	r.Equal(2*time.Second, conf.ConnectTimeout)
+
+	t.Setenv("SMOKESCREEN_LISTEN_PORT", "4753")
+	_, err = NewConfiguration([]string{"smokescreen"}, nil)
+	r.EqualError(err, "$SMOKESCREEN_LISTEN_PORT: unknown environment variable")
+}
@@ -3,9 +3,8 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"math"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/carlmjohnson/versioninfo"
@@ -44,8 +43,13 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Usage: "Show this help text.",
 		},
 		cli.StringFlag{
-			Name:  "config-file",
-			Usage: "Load configuration from `FILE`.  Command line options override values in the file.",
+			Name:   "config-file",
+			Usage:  "Load configuration from `FILE`.  Environment variables and command line options override values in the file.",
+			EnvVar: smokescreen.ConfigFileEnvVar,
+		},
+		cli.BoolFlag{
+			Name:  "print-config",
+			Usage: "Print the effective configuration, with the source of each value, and exit.",
 		},
 		cli.StringFlag{
 			Name:  "listen-ip",
@@ -56,6 +60,42 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Value: 4750,
 			Usage: "Listen on port `PORT`.\n\t\tThis argument is ignored when running under Einhorn.",
 		},
+		cli.StringFlag{
+			Name:  "listen-unix",
+			Usage: "Also listen on a Unix domain socket at `PATH`.",
+		},
+		cli.StringFlag{
+			Name:  "listen-unix-file-mode",
+			Usage: "Set the filemode to `FILE_MODE` on the Unix domain socket.",
+		},
+		cli.StringFlag{
+			Name:  "listen-unix-owner",
+			Usage: "Set the owner of the Unix domain socket to `USER[:GROUP]`.",
+		},
+		cli.StringFlag{
+			Name:  "socks5-listen-ip",
+			Usage: "Listen for SOCKS5 clients on interface with address `IP`. (default: any)",
+		},
+		cli.UintFlag{
+			Name:  "socks5-listen-port",
+			Usage: "Listen for SOCKS5 clients on port `PORT`. The SOCKS5 listener is disabled unless this is set.",
+		},
+		cli.BoolFlag{
+			Name:  "socks5-username-as-role",
+			Usage: "Use the username presented by SOCKS5 clients as their role, once its password is verified.  Requires proxy authentication.",
+		},
+		cli.StringFlag{
+			Name:  "transparent-listen-ip",
+			Usage: "Accept redirected connections on interface with address `IP`. (default: any)",
+		},
+		cli.UintFlag{
+			Name:  "transparent-listen-port",
+			Usage: "Accept connections redirected by iptables on port `PORT`. The transparent listener is disabled unless this is set.",
+		},
+		cli.StringFlag{
+			Name:  "transparent-mode",
+			Usage: "Recover the original destination of redirected connections using `MODE` (\"redirect\" or \"tproxy\"). (default: \"redirect\")",
+		},
 		cli.DurationFlag{
 			Name:  "timeout",
 			Value: time.Duration(10) * time.Second,
@@ -65,6 +105,18 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "proxy-protocol",
 			Usage: "Enable PROXY protocol support.",
 		},
+		cli.BoolFlag{
+			Name:  "proxy-protocol-strict",
+			Usage: "Require a PROXY protocol header on every connection, and refuse connections from untrusted sources.",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxy-protocol-trusted-range",
+			Usage: "Only accept PROXY protocol headers from `RANGE` (in CIDR notation).  Repeatable.",
+		},
+		cli.BoolFlag{
+			Name:  "verify-sni",
+			Usage: "Close CONNECT tunnels whose TLS SNI does not match the CONNECT host and is not allowed by the ACL.",
+		},
 		cli.StringSliceFlag{
 			Name:  "deny-range",
 			Usage: "Add `RANGE`(in CIDR notation) to list of blocked IP ranges.  Repeatable.",
@@ -83,7 +135,36 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 		},
 		cli.StringFlag{
 			Name:  "egress-acl-file",
-			Usage: "Validate egress traffic against `FILE`",
+			Usage: "Validate egress traffic against `FILE`: a YAML or JSON ACL, or a directory of them",
+		},
+		cli.StringFlag{
+			Name:  "egress-acl-url",
+			Usage: "Fetch the egress ACL from `URL`, caching it in --egress-acl-cache-file",
+		},
+		cli.StringFlag{
+			Name:  "egress-acl-cache-file",
+			Usage: "Keep the last egress ACL fetched from --egress-acl-url in `FILE`, used when the URL is unavailable",
+		},
+		cli.DurationFlag{
+			Name:  "egress-acl-poll-interval",
+			Usage: "Fetch the egress ACL from --egress-acl-url every `DURATION` (default: 1m)",
+		},
+		cli.StringSliceFlag{
+			Name:  "acl-signing-key-file",
+			Usage: "Require egress ACL files to be signed by the Ed25519 public key in `FILE`, or another trusted signer.  Repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "acl-signing-ca-file",
+			Usage: "Require egress ACL files to be signed by a certificate issued by the CA in `FILE`, or another trusted signer.  Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "acl-revocation-action",
+			Value: "close",
+			Usage: "`ACTION` taken on tunnels denied by a reloaded egress ACL: close or flag",
+		},
+		cli.DurationFlag{
+			Name:  "acl-revocation-grace-period",
+			Usage: "Close tunnels denied by a reloaded egress ACL after `DURATION`",
 		},
 		cli.StringSliceFlag{
 			Name:  "resolver-address",
@@ -94,6 +175,39 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Value: "127.0.0.1:8200",
 			Usage: "Send metrics to statsd at `ADDRESS` (IP:port).",
 		},
+		cli.StringFlag{
+			Name:  "statsd-namespace",
+			Usage: "Prefix the name of metrics sent to statsd with `NAMESPACE`. (default: \"smokescreen.\")",
+		},
+		cli.StringSliceFlag{
+			Name:  "metric-tag",
+			Usage: "Add the tag `METRIC=TAG` to every report of a metric.  Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "prometheus-listen-address",
+			Usage: "Serve Prometheus metrics on `ADDRESS` (IP:port)",
+		},
+		cli.StringFlag{
+			Name:  "prometheus-path",
+			Value: "/metrics",
+			Usage: "Serve Prometheus metrics at `PATH`",
+		},
+		cli.BoolFlag{
+			Name:  "prometheus-stats-socket",
+			Usage: "Also serve Prometheus metrics on the statistics socket",
+		},
+		cli.StringSliceFlag{
+			Name:  "prometheus-drop-label",
+			Usage: "Do not report the `LABEL` tag as a Prometheus label.  Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "Export traces of proxy requests to the OTLP/HTTP collector at `URL`",
+		},
+		cli.StringSliceFlag{
+			Name:  "otlp-header",
+			Usage: "Send the `NAME:VALUE` header with trace exports.  Repeatable.",
+		},
 		cli.StringFlag{
 			Name:  "tls-server-bundle-file",
 			Usage: "Authenticate to clients using key and certs from `FILE`",
@@ -106,6 +220,34 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "tls-crl-file",
 			Usage: "Verify validity of client certificates against Certificate Revocation List from `FILE`",
 		},
+		cli.BoolFlag{
+			Name:  "http2",
+			Usage: "Offer HTTP/2 to clients of the TLS listener.",
+		},
+		cli.StringSliceFlag{
+			Name:  "role-strategy",
+			Usage: "Determine client roles using `STRATEGY` (cn, ou, dns_san, uri_san[:PREFIX], spiffe:TRUST_DOMAIN, header[:NAME], unix_uid or proxy_tlv:TYPE).  Repeatable; strategies are tried in order.",
+		},
+		cli.StringFlag{
+			Name:  "proxy-auth-htpasswd-file",
+			Usage: "Authenticate clients presenting Basic proxy credentials against the htpasswd `FILE`.  The username is the client's role.",
+		},
+		cli.StringFlag{
+			Name:  "proxy-auth-jwks-file",
+			Usage: "Authenticate clients presenting Bearer proxy credentials by verifying JWTs with the keys in `FILE`",
+		},
+		cli.StringFlag{
+			Name:  "proxy-auth-issuer",
+			Usage: "Require JWT proxy credentials to be issued by `ISSUER`",
+		},
+		cli.StringFlag{
+			Name:  "proxy-auth-audience",
+			Usage: "Require JWT proxy credentials to be intended for `AUDIENCE`",
+		},
+		cli.StringFlag{
+			Name:  "proxy-auth-role-claim",
+			Usage: "Use the JWT `CLAIM` as the client's role (default: sub)",
+		},
 		cli.StringFlag{
 			Name:  "additional-error-message-on-deny",
 			Usage: "Display `MESSAGE` in the HTTP response if proxying request is denied",
@@ -114,6 +256,14 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Name:  "disable-acl-policy-action",
 			Usage: "Disable usage of a `POLICY ACTION` such as \"open\" in the egress ACL",
 		},
+		cli.BoolFlag{
+			Name:  "reject-public-suffix-globs",
+			Usage: "Refuse egress ACLs with domain globs matching every domain under a public suffix, such as *.com,\n\t\tunless allowed with allow_public_suffix. By default they are logged.",
+		},
+		cli.StringFlag{
+			Name:  "public-suffix-list-file",
+			Usage: "Read the Public Suffix List from `FILE` instead of using the embedded one",
+		},
 		cli.StringFlag{
 			Name:  "stats-socket-dir",
 			Usage: "Enable connection tracking. Will expose one UDS in `DIR` going by the name of \"track-{pid}.sock\".\n\t\tThis should be an absolute path with all symlinks, if any, resolved.",
@@ -123,6 +273,42 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			Value: "700",
 			Usage: "Set the filemode to `FILE_MODE` on the statistics socket",
 		},
+		cli.StringFlag{
+			Name:  "admin-listen-address",
+			Usage: "Also serve the statistics socket's admin API on `ADDRESS` (IP:port), over mutual TLS",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-server-bundle-file",
+			Usage: "Authenticate to admin API clients using key and certs from `FILE`",
+		},
+		cli.StringSliceFlag{
+			Name:  "admin-tls-client-ca-file",
+			Usage: "Validate admin API client certificates using Certificate Authority from `FILE`",
+		},
+		cli.DurationFlag{
+			Name:  "max-conn-lifetime",
+			Usage: "Close tunnels after `DURATION`, regardless of activity",
+		},
+		cli.StringSliceFlag{
+			Name:  "role-max-conn-lifetime",
+			Usage: "Close tunnels of a role after a duration, given as `ROLE=DURATION`.  Repeatable.",
+		},
+		cli.Float64Flag{
+			Name:  "max-conn-lifetime-jitter",
+			Usage: "Shorten the lifetime of each tunnel by a random `FRACTION` of up to this value",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrent-conns",
+			Usage: "Reject new tunnels and HTTP requests with a 503 once `NUMBER` are in flight",
+		},
+		cli.Float64Flag{
+			Name:  "max-request-rate",
+			Usage: "Reject new tunnels and HTTP requests with a 503 when more than `RATE` arrive per second",
+		},
+		cli.IntFlag{
+			Name:  "request-burst",
+			Usage: "Allow bursts of up to `NUMBER` new tunnels and HTTP requests above the request rate",
+		},
 		cli.BoolFlag{
 			Name:  "unsafe-allow-private-ranges",
 			Usage: "Allow private ip ranges by default",
@@ -138,138 +324,198 @@ func NewConfiguration(args []string, logger *log.Logger) (*smokescreen.Config, e
 			return errors.New("Received unexpected non-option argument(s)")
 		}
 
-		var conf *smokescreen.Config
+		builder := smokescreen.NewConfigBuilder()
+		if logger != nil {
+			builder.Log = logger
+		}
+
 		if file := c.String("config-file"); file != "" {
-			var err error
-			conf, err = smokescreen.LoadConfig(file)
-			if err != nil {
+			if err := builder.AddFile(file); err != nil {
 				return fmt.Errorf("Couldn't load file \"%s\" specified by --config-file: %v", file, err)
 			}
-		} else {
-			conf = smokescreen.NewConfig()
 		}
 
-		if logger != nil {
-			conf.Log = logger
+		if err := builder.AddEnv(os.Environ()); err != nil {
+			return err
 		}
 
-		if c.IsSet("listen-ip") {
-			conf.Ip = c.String("listen-ip")
+		if err := setFlags(builder, c, app.Flags); err != nil {
+			return err
 		}
 
-		if c.IsSet("listen-port") {
-			port := c.Uint("listen-port")
-			if port > math.MaxUint16 {
-				return fmt.Errorf("Invalid listen-port: %d", port)
-			}
-			conf.Port = uint16(port)
+		if c.Bool("print-config") {
+			return builder.WriteYAML(c.App.Writer) // configToReturn will not be set
 		}
 
-		if c.IsSet("timeout") {
-			conf.ConnectTimeout = c.Duration("timeout")
+		conf, err := builder.Build()
+		if err != nil {
+			return err
 		}
 
-		if c.IsSet("proxy-protocol") {
-			conf.SupportProxyProtocol = c.Bool("proxy-protocol")
-		}
+		// Setup the connection tracker
+		conf.ConnTracker = conntrack.NewTracker(conf.IdleTimeout, conf.MetricsClient.Sink(), conf.Log, conf.ShuttingDown)
 
-		if c.IsSet("additional-error-message-on-deny") {
-			conf.AdditionalErrorMessageOnDeny = c.String("additional-error-message-on-deny")
-		}
+		configToReturn = conf
+		return nil
+	}
 
-		if c.IsSet("disable-acl-policy-action") {
-			conf.DisabledAclPolicyActions = c.StringSlice("disable-acl-policy-action")
-		}
+	err := app.Run(args)
 
-		if c.IsSet("stats-socket-dir") {
-			conf.StatsSocketDir = c.String("stats-socket-dir")
-		}
+	return configToReturn, err
+}
 
-		if c.IsSet("stats-socket-file-mode") {
-			filemode, err := strconv.ParseInt(c.String("stats-socket-file-mode"), 8, 9)
-			if err != nil {
-				return err
-			}
-			conf.StatsSocketFileMode = os.FileMode(filemode)
-		}
+// flagKeys maps command line options to the configuration file keys they
+// set. Options taking several values replace the whole list of the file.
+var flagKeys = map[string]string{
+	"listen-ip":                        "ip",
+	"listen-port":                      "port",
+	"listen-unix":                      "listen_unix.path",
+	"listen-unix-file-mode":            "listen_unix.file_mode",
+	"listen-unix-owner":                "listen_unix.owner",
+	"socks5-listen-ip":                 "socks5.ip",
+	"socks5-listen-port":               "socks5.port",
+	"socks5-username-as-role":          "socks5.username_as_role",
+	"transparent-listen-ip":            "transparent.ip",
+	"transparent-listen-port":          "transparent.port",
+	"transparent-mode":                 "transparent.mode",
+	"timeout":                          "connect_timeout",
+	"proxy-protocol":                   "support_proxy_protocol",
+	"proxy-protocol-strict":            "proxy_protocol_strict",
+	"proxy-protocol-trusted-range":     "proxy_protocol_trusted_ranges",
+	"verify-sni":                       "verify_sni",
+	"deny-range":                       "deny_ranges",
+	"allow-range":                      "allow_ranges",
+	"deny-address":                     "deny_addresses",
+	"allow-address":                    "allow_addresses",
+	"egress-acl-file":                  "acl_file",
+	"egress-acl-url":                   "acl_source.url",
+	"egress-acl-cache-file":            "acl_source.cache_file",
+	"egress-acl-poll-interval":         "acl_source.poll_interval",
+	"acl-signing-key-file":             "acl_signature.public_key_files",
+	"acl-signing-ca-file":              "acl_signature.ca_files",
+	"acl-revocation-action":            "acl_revocation.action",
+	"acl-revocation-grace-period":      "acl_revocation.grace_period",
+	"resolver-address":                 "resolver_addresses",
+	"statsd-address":                   "statsd_address",
+	"statsd-namespace":                 "statsd_namespace",
+	"prometheus-listen-address":        "prometheus.listen_address",
+	"prometheus-path":                  "prometheus.path",
+	"prometheus-stats-socket":          "prometheus.stats_socket",
+	"prometheus-drop-label":            "prometheus.drop_labels",
+	"otlp-endpoint":                    "tracing.otlp_endpoint",
+	"tls-client-ca-file":               "tls.client_ca_files",
+	"tls-crl-file":                     "tls.crl_files",
+	"http2":                            "tls.http2",
+	"role-strategy":                    "role_from_request",
+	"proxy-auth-htpasswd-file":         "proxy_auth.htpasswd_file",
+	"proxy-auth-jwks-file":             "proxy_auth.jwks_file",
+	"proxy-auth-issuer":                "proxy_auth.issuer",
+	"proxy-auth-audience":              "proxy_auth.audience",
+	"proxy-auth-role-claim":            "proxy_auth.role_claim",
+	"additional-error-message-on-deny": "deny_message_extra",
+	"disable-acl-policy-action":        "disable_acl_policy_actions",
+	"reject-public-suffix-globs":       "reject_public_suffix_globs",
+	"public-suffix-list-file":          "public_suffix_list_file",
+	"stats-socket-dir":                 "stats_socket_dir",
+	"stats-socket-file-mode":           "stats_socket_file_mode",
+	"admin-listen-address":             "admin.listen_address",
+	"admin-tls-client-ca-file":         "admin.tls.client_ca_files",
+	"max-conn-lifetime":                "max_conn_lifetime",
+	"max-conn-lifetime-jitter":         "max_conn_lifetime_jitter",
+	"max-concurrent-conns":             "max_concurrent_conns",
+	"max-request-rate":                 "max_request_rate",
+	"request-burst":                    "request_burst",
+	"unsafe-allow-private-ranges":      "unsafe_allow_private_ranges",
+}
 
-		if c.IsSet("deny-range") {
-			if err := conf.SetDenyRanges(c.StringSlice("deny-range")); err != nil {
-				return err
-			}
-		}
+// setFlags sets the configuration keys of the options given on the command
+// line, overriding the configuration file.
+func setFlags(builder *smokescreen.ConfigBuilder, c *cli.Context, flags []cli.Flag) error {
+	flagSource := func(name string) smokescreen.ConfigSource {
+		return smokescreen.ConfigSource{Kind: smokescreen.ConfigSourceFlag, Name: name}
+	}
 
-		if c.IsSet("allow-range") {
-			if err := conf.SetAllowRanges(c.StringSlice("allow-range")); err != nil {
-				return err
-			}
+	for _, flag := range flags {
+		name := flag.GetName()
+		key, ok := flagKeys[name]
+		if !ok || !c.IsSet(name) {
+			continue
 		}
-
-		if c.IsSet("deny-address") {
-			if err := conf.SetDenyAddresses(c.StringSlice("deny-address")); err != nil {
-				return err
-			}
+		var value interface{}
+		switch flag.(type) {
+		case cli.BoolFlag:
+			value = c.Bool(name)
+		case cli.UintFlag:
+			value = c.Uint(name)
+		case cli.IntFlag:
+			value = c.Int(name)
+		case cli.Float64Flag:
+			value = c.Float64(name)
+		case cli.DurationFlag:
+			value = c.Duration(name).String()
+		case cli.StringSliceFlag:
+			value = c.StringSlice(name)
+		default:
+			value = c.String(name)
 		}
+		builder.Set(key, value, flagSource(name))
+	}
 
-		if c.IsSet("resolver-address") {
-			if err := conf.SetResolverAddresses(c.StringSlice("resolver-address")); err != nil {
-				return err
-			}
-		}
+	// A new request rate comes with its own default burst.
+	if c.IsSet("max-request-rate") && !c.IsSet("request-burst") {
+		builder.Set("request_burst", 0, flagSource("max-request-rate"))
+	}
 
-		if c.IsSet("allow-address") {
-			if err := conf.SetAllowAddresses(c.StringSlice("allow-address")); err != nil {
-				return err
-			}
-		}
+	// Originally, we assumed a single file with both cert and key
+	// concatenated.  That setup will continue to work, but the configuration
+	// now takes separate cert and key files, so we pass the filename twice.
+	if c.IsSet("tls-server-bundle-file") {
+		bundleFile := c.String("tls-server-bundle-file")
+		builder.Set("tls.cert_file", bundleFile, flagSource("tls-server-bundle-file"))
+		builder.Set("tls.key_file", bundleFile, flagSource("tls-server-bundle-file"))
+	}
 
-		if c.IsSet("statsd-address") {
-			if err := conf.SetupStatsd(c.String("statsd-address")); err != nil {
-				return err
-			}
-		}
+	if c.IsSet("admin-tls-server-bundle-file") {
+		bundleFile := c.String("admin-tls-server-bundle-file")
+		builder.Set("admin.tls.cert_file", bundleFile, flagSource("admin-tls-server-bundle-file"))
+		builder.Set("admin.tls.key_file", bundleFile, flagSource("admin-tls-server-bundle-file"))
+	}
 
-		if c.IsSet("egress-acl-file") {
-			if err := conf.SetupEgressAcl(c.String("egress-acl-file")); err != nil {
-				return err
+	if c.IsSet("role-max-conn-lifetime") {
+		lifetimes := make(map[string]string)
+		for _, v := range c.StringSlice("role-max-conn-lifetime") {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid role max connection lifetime %q: expected ROLE=DURATION", v)
 			}
+			lifetimes[parts[0]] = parts[1]
 		}
+		builder.Set("role_max_conn_lifetime", lifetimes, flagSource("role-max-conn-lifetime"))
+	}
 
-		if c.IsSet("tls-crl-file") {
-			if err := conf.SetupCrls(c.StringSlice("tls-crl-file")); err != nil {
-				return err
+	if c.IsSet("otlp-header") {
+		headers := make(map[string]string)
+		for _, h := range c.StringSlice("otlp-header") {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid OTLP header %q: expected NAME:VALUE", h)
 			}
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 		}
+		builder.Set("tracing.headers", headers, flagSource("otlp-header"))
+	}
 
-		if c.IsSet("unsafe-allow-private-ranges") {
-			conf.UnsafeAllowPrivateRanges = c.Bool("unsafe-allow-private-ranges")
-		}
-
-		// FIXME: mixing and matching parts of TLS config between cli and file
-		// hasn't been thought through and likely won't work
-
-		if c.IsSet("tls-server-bundle-file") {
-			// Originally, we assumed a single file with both cert and key
-			// concatenated.  That setup will continue to work, but SetupTLS now
-			// takes separate args for cert and key, so we pass the filename twice
-			// here.
-			bundleFile := c.String("tls-server-bundle-file")
-			if err := conf.SetupTls(
-				bundleFile,
-				bundleFile,
-				c.StringSlice("tls-client-ca-file")); err != nil {
-				return err
+	if c.IsSet("metric-tag") {
+		tags := make(map[string][]string)
+		for _, v := range c.StringSlice("metric-tag") {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid metric tag %q: expected METRIC=TAG", v)
 			}
+			tags[parts[0]] = append(tags[parts[0]], parts[1])
 		}
-
-		// Setup the connection tracker
-		conf.ConnTracker = conntrack.NewTracker(conf.IdleTimeout, conf.MetricsClient.StatsdClient, conf.Log, conf.ShuttingDown)
-
-		configToReturn = conf
-		return nil
+		builder.Set("metric_tags", tags, flagSource("metric-tag"))
 	}
 
-	err := app.Run(args)
-
-	return configToReturn, err
+	return nil
 }
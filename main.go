@@ -28,7 +28,10 @@ func main() {
 	if err != nil {
 		logrus.Fatalf("Could not create configuration: %v", err)
 	} else if conf != nil {
-		conf.RoleFromRequest = defaultRoleFromRequest
+		// Role strategies selected in the configuration take precedence.
+		if conf.RoleFromRequest == nil {
+			conf.RoleFromRequest = defaultRoleFromRequest
+		}
 
 		conf.Log.Formatter = &logrus.JSONFormatter{}
 
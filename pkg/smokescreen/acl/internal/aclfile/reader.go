@@ -0,0 +1,200 @@
+// Package aclfile reads ACL configuration files, the files they include and
+// the files of ACL directories, for the ACL packages, which decode and merge
+// them.
+package aclfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Unmarshal decodes a configuration file, such as yaml.Unmarshal or
+// json.Unmarshal.
+type Unmarshal func(data []byte, v interface{}) error
+
+// UnmarshalFor returns how to decode the file at path, going by its
+// extension.
+func UnmarshalFor(path string) Unmarshal {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return json.Unmarshal
+	}
+	return yaml.Unmarshal
+}
+
+// Files returns the YAML (.yaml or .yml) and JSON (.json) files of dir,
+// sorted. Hidden files are skipped.
+func Files(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	return files, nil
+}
+
+// Verifier checks the contents of files before they are decoded.
+type Verifier interface {
+	VerifyFile(path string, data []byte) error
+}
+
+// Decoder decodes the file at path and merges it. includerVersion is the
+// version of the file including it, or empty if it is not included. It
+// returns the version of the file, which the files it includes inherit, and
+// the patterns of the files it includes.
+type Decoder func(path string, data []byte, unmarshal Unmarshal, includerVersion string) (version string, include []string, err error)
+
+// Reader reads configuration files, and the files they include, with a
+// Decoder. A file which the verifier, if set, refuses is an error, as is a
+// service or the default rule defined by two files.
+//
+// Signatures cover the contents of files but not which files a directory
+// holds or a pattern matches: signed files could be removed, or old ones
+// added. With a verifier, directories and included patterns are refused.
+type Reader struct {
+	decode       Decoder
+	verifier     Verifier
+	loaded       map[string]bool
+	serviceFiles map[string]string
+	defaultFile  string
+}
+
+func NewReader(decode Decoder, verifier Verifier) *Reader {
+	return &Reader{
+		decode:       decode,
+		verifier:     verifier,
+		loaded:       make(map[string]bool),
+		serviceFiles: make(map[string]string),
+	}
+}
+
+// ReadFile reads the file at path and the files it includes. Errors of
+// included files are prefixed with their path, as are those of every file
+// when prefixPath is set.
+func (r *Reader) ReadFile(path string, unmarshal Unmarshal, prefixPath bool) error {
+	return r.read(path, unmarshal, prefixPath, "", "")
+}
+
+// ReadDir reads the files of dir, in the order of their names, as if
+// included by one file.
+func (r *Reader) ReadDir(dir string) error {
+	if r.verifier != nil {
+		return fmt.Errorf("%s: signed ACLs cannot be directories", dir)
+	}
+	files, err := Files(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s: no acl configuration files", dir)
+	}
+	for _, f := range files {
+		err = r.ReadFile(f, UnmarshalFor(f), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefineService records that the file at path defines the service name. It
+// fails if another file defines it; a file defining it twice is left to the
+// caller.
+func (r *Reader) DefineService(path, name string) error {
+	if other, ok := r.serviceFiles[name]; ok && other != path {
+		return fmt.Errorf("service %q is already defined in %s", name, other)
+	}
+	r.serviceFiles[name] = path
+	return nil
+}
+
+// DefineDefault records that the file at path defines the default rule. It
+// fails if a file already does.
+func (r *Reader) DefineDefault(path string) error {
+	if r.defaultFile != "" {
+		return fmt.Errorf("default rule is already defined in %s", r.defaultFile)
+	}
+	r.defaultFile = path
+	return nil
+}
+
+// read reads the file at path, which is included by the file includedBy
+// with version includerVersion, if any.
+func (r *Reader) read(path string, unmarshal Unmarshal, prefixPath bool, includedBy, includerVersion string) error {
+	included := includedBy != ""
+	fail := func(err error) error {
+		if prefixPath || included {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fail(err)
+	}
+	// Files included more than once, or in a cycle, are read once.
+	if r.loaded[abs] {
+		return nil
+	}
+	r.loaded[abs] = true
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if included {
+			return fmt.Errorf("%s: %v", includedBy, err)
+		}
+		return err
+	}
+
+	if r.verifier != nil {
+		err = r.verifier.VerifyFile(path, data)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	version, include, err := r.decode(path, data, unmarshal, includerVersion)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, pattern := range include {
+		if r.verifier != nil && strings.ContainsAny(pattern, "*?[") {
+			return fail(fmt.Errorf("include %q: signed ACLs cannot include patterns", pattern))
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fail(fmt.Errorf("include %q: %v", pattern, err))
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			matches = []string{pattern}
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			err = r.read(m, UnmarshalFor(m), prefixPath, path, version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Package remote fetches egress ACLs over HTTP(S). A Source polls a URL with
+// conditional requests, and keeps the last ACL it fetched and accepted in a
+// cache file, which stands in for the URL whenever it is unavailable.
+package remote
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/signature"
+)
+
+// MaxSize is the largest ACL a Source fetches.
+const MaxSize = 32 << 20
+
+// Source is an ACL served at URL and cached in CacheFile.
+type Source struct {
+	URL string
+	// CacheFile holds the last ACL fetched and accepted. Its directory must
+	// exist. Includes of the ACL are resolved relative to it.
+	CacheFile string
+	// SignatureURL, when set, serves the detached signature of the ACL. It
+	// is fetched with every new ACL, and cached next to it with the suffix
+	// of acl/signature.
+	SignatureURL string
+	Client       *http.Client
+
+	mu sync.Mutex
+	// Validators of the cached ACL, sent with conditional requests.
+	etag, lastModified string
+	status             Status
+}
+
+// Status is the outcome of the fetches of a Source.
+type Status struct {
+	LastAttempt time.Time
+	// LastSuccess is the time of the last fetch which succeeded, including
+	// those which found the ACL unchanged.
+	LastSuccess time.Time
+	// LastUpdate is the time the cache file was last replaced.
+	LastUpdate time.Time
+	// LastError is the error of the last fetch, or nil if it succeeded.
+	LastError error
+}
+
+// Stale reports whether the last fetch failed, in which case the cache file
+// may be out of date.
+func (s Status) Stale() bool {
+	return s.LastError != nil
+}
+
+// NewSource returns a Source of the ACL at url cached in cacheFile. Requests
+// use tlsConfig, which may be nil, and time out after timeout unless it is
+// zero.
+func NewSource(url, cacheFile string, tlsConfig *tls.Config, timeout time.Duration) *Source {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Source{
+		URL:       url,
+		CacheFile: cacheFile,
+		Client:    &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// ClientTLSConfig returns the TLS configuration of a client presenting the
+// certificate and key in certFile and keyFile, if set, and trusting the CAs
+// in caFiles, or the system roots if there are none.
+func ClientTLSConfig(certFile, keyFile string, caFiles []string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both certificate and key files must be specified for client certificates")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(caFiles) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		for _, caFile := range caFiles {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Status returns the outcome of the fetches so far.
+func (s *Source) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Fetch fetches the ACL, unless the server reports it unchanged since the
+// last fetch. A new ACL is written to a temporary file next to the cache
+// file, with the same extension, and replaces the cache file only once
+// accept, if set, returns nil for it. Fetch reports whether the cache file
+// was replaced; on error, it is left as it was.
+func (s *Source) Fetch(accept func(path string) error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.status.LastAttempt = now
+	changed, err := s.fetch(accept)
+	s.status.LastError = err
+	if err == nil {
+		s.status.LastSuccess = now
+		if changed {
+			s.status.LastUpdate = now
+		}
+	}
+	return changed, err
+}
+
+func (s *Source) fetch(accept func(path string) error) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: unexpected status %s", s.URL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxSize+1))
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", s.URL, err)
+	}
+	if len(data) > MaxSize {
+		return false, fmt.Errorf("%s: ACL larger than %d bytes", s.URL, MaxSize)
+	}
+
+	// Servers without validators send the same ACL again.
+	if cached, err := ioutil.ReadFile(s.CacheFile); err == nil && bytes.Equal(cached, data) {
+		s.etag, s.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		return false, nil
+	}
+
+	err = s.replaceCache(data, accept)
+	if err != nil {
+		return false, err
+	}
+	s.etag, s.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+func (s *Source) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// fetchSignature fetches the signature at SignatureURL.
+func (s *Source) fetchSignature() ([]byte, error) {
+	resp, err := s.client().Get(s.SignatureURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", s.SignatureURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, MaxSize))
+}
+
+func (s *Source) replaceCache(data []byte, accept func(path string) error) error {
+	var sig []byte
+	if s.SignatureURL != "" {
+		var err error
+		sig, err = s.fetchSignature()
+		if err != nil {
+			return err
+		}
+	}
+
+	dir, base := filepath.Split(s.CacheFile)
+	f, err := ioutil.TempFile(dir, "."+base+".*"+filepath.Ext(base))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if sig != nil {
+		defer os.Remove(tmp + signature.Suffix)
+		err = ioutil.WriteFile(tmp+signature.Suffix, sig, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	if accept != nil {
+		if err := accept(tmp); err != nil {
+			return fmt.Errorf("%s: %v", s.URL, err)
+		}
+	}
+	if sig != nil {
+		err = os.Rename(tmp+signature.Suffix, s.CacheFile+signature.Suffix)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, s.CacheFile)
+}
@@ -0,0 +1,152 @@
+//go:build !nounit
+// +build !nounit
+
+package remote
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testACL = `
+version: v1
+services:
+  - name: srv
+    project: security
+    action: enforce
+    allowed_domains:
+      - example.com
+`
+
+// aclServer serves an ACL with an ETag, and counts the requests by status.
+type aclServer struct {
+	mu       sync.Mutex
+	acl      string
+	etag     string
+	down     bool
+	statuses []int
+}
+
+func (s *aclServer) set(acl, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl, s.etag = acl, etag
+}
+
+func (s *aclServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := http.StatusOK
+	switch {
+	case s.down:
+		status = http.StatusServiceUnavailable
+	case s.etag != "" && req.Header.Get("If-None-Match") == s.etag:
+		status = http.StatusNotModified
+	}
+	s.statuses = append(s.statuses, status)
+
+	if s.etag != "" {
+		rw.Header().Set("ETag", s.etag)
+	}
+	rw.WriteHeader(status)
+	if status == http.StatusOK {
+		rw.Write([]byte(s.acl))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	a := assert.New(t)
+
+	handler := &aclServer{acl: testACL, etag: `"1"`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "acl.yaml")
+	src := NewSource(server.URL, cacheFile, nil, 0)
+
+	changed, err := src.Fetch(nil)
+	a.NoError(err)
+	a.True(changed)
+	cached, err := ioutil.ReadFile(cacheFile)
+	a.NoError(err)
+	a.Equal(testACL, string(cached))
+	status := src.Status()
+	a.False(status.Stale())
+	a.Equal(status.LastAttempt, status.LastUpdate)
+
+	// Unchanged ACLs are not downloaded again.
+	changed, err = src.Fetch(nil)
+	a.NoError(err)
+	a.False(changed)
+	a.Equal([]int{http.StatusOK, http.StatusNotModified}, handler.statuses)
+
+	// Nor replaced when sent again by servers without validators.
+	handler.set(testACL, "")
+	changed, err = src.Fetch(nil)
+	a.NoError(err)
+	a.False(changed)
+
+	// Rejected ACLs leave the cache as it was.
+	handler.set("services: [", `"2"`)
+	changed, err = src.Fetch(func(path string) error {
+		a.Equal(".yaml", filepath.Ext(path))
+		return errors.New("invalid")
+	})
+	a.EqualError(err, server.URL+": invalid")
+	a.False(changed)
+	cached, err = ioutil.ReadFile(cacheFile)
+	a.NoError(err)
+	a.Equal(testACL, string(cached))
+	a.True(src.Status().Stale())
+
+	// Rejected ACLs are fetched again, not found unchanged.
+	handler.set(testACL+"\n", `"2"`)
+	changed, err = src.Fetch(func(string) error { return nil })
+	a.NoError(err)
+	a.True(changed)
+
+	handler.mu.Lock()
+	handler.down = true
+	handler.mu.Unlock()
+	_, err = src.Fetch(nil)
+	a.EqualError(err, server.URL+": unexpected status 503 Service Unavailable")
+
+	files, err := ioutil.ReadDir(filepath.Dir(cacheFile))
+	a.NoError(err)
+	a.Len(files, 1)
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewTLSServer(&aclServer{acl: testACL})
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	a.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	// The test server's certificate is not trusted by default.
+	_, err := NewSource(server.URL, filepath.Join(dir, "acl.yaml"), nil, 0).Fetch(nil)
+	a.Error(err)
+
+	tlsConfig, err := ClientTLSConfig("", "", []string{caFile})
+	a.NoError(err)
+	changed, err := NewSource(server.URL, filepath.Join(dir, "acl.yaml"), tlsConfig, 0).Fetch(nil)
+	a.NoError(err)
+	a.True(changed)
+
+	_, err = ClientTLSConfig(caFile, "", nil)
+	a.Error(err)
+	_, err = ClientTLSConfig("", "", []string{filepath.Join(dir, "acl.yaml")})
+	a.EqualError(err, "no certificates found in "+filepath.Join(dir, "acl.yaml"))
+}
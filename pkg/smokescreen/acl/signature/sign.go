@@ -0,0 +1,50 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Sign returns the signature of data by the Ed25519 key, in the format read
+// by Verify.
+func Sign(key ed25519.PrivateKey, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n")
+}
+
+// SignBundle returns the signature of data by key as a PEM bundle with
+// certs, which start with the certificate of key followed by any
+// intermediates.
+func SignBundle(key crypto.Signer, certs []*x509.Certificate, data []byte) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no signer certificate")
+	}
+
+	var sig []byte
+	var err error
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := certs[0].CheckSignature(signatureAlgorithm(certs[0]), data, sig); err != nil {
+		return nil, fmt.Errorf("key does not match the signer certificate: %v", err)
+	}
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: pemSignature, Bytes: sig})
+	for _, c := range certs {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return bundle, nil
+}
@@ -0,0 +1,245 @@
+// Package signature verifies detached signatures of ACL files, so that only
+// trusted signers can change egress rules. The signature of a file is in the
+// file of the same name with ".sig" appended, and is either
+//
+//   - an Ed25519 signature of the file, base64-encoded, made with one of the
+//     trusted Ed25519 keys; or
+//   - a PEM bundle of a SIGNATURE block followed by the signer's CERTIFICATE
+//     and any intermediates, which must chain to a trusted CA and allow code
+//     signing. The signature is an Ed25519, ECDSA with SHA-256 or RSA PKCS #1
+//     v1.5 with SHA-256 signature of the file.
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Suffix is appended to the path of a file to get the path of its signature.
+const Suffix = ".sig"
+
+// PEM block type of signatures in certificate bundles.
+const pemSignature = "SIGNATURE"
+
+// Log fields of signature verifications.
+const (
+	LogFieldFile   = "acl_file"
+	LogFieldSigner = "signer"
+)
+
+// ErrUnsigned is returned for files without a signature file.
+var ErrUnsigned = errors.New("file is not signed")
+
+type signerKey struct {
+	name string
+	key  ed25519.PublicKey
+}
+
+// Verifier verifies the signatures of ACL files. It implements acl/v1's
+// FileVerifier.
+type Verifier struct {
+	keys  []signerKey
+	roots *x509.CertPool
+	// Logger, when set, logs the signer of every file verified.
+	Logger *logrus.Logger
+}
+
+// NewVerifier returns a Verifier trusting the Ed25519 public keys in
+// keyFiles, and the CAs in caFiles for certificate bundles. A key file holds
+// a PEM PUBLIC KEY block, or the base64-encoded 32 bytes of the key.
+func NewVerifier(keyFiles, caFiles []string, logger *logrus.Logger) (*Verifier, error) {
+	if len(keyFiles) == 0 && len(caFiles) == 0 {
+		return nil, errors.New("no trusted keys or CAs")
+	}
+
+	v := &Verifier{Logger: logger}
+	for _, f := range keyFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		v.AddKey(filepath.Base(f), key)
+	}
+
+	if len(caFiles) > 0 {
+		v.roots = x509.NewCertPool()
+		for _, f := range caFiles {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if !v.roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", f)
+			}
+		}
+	}
+	return v, nil
+}
+
+// ParsePublicKey parses an Ed25519 public key from a PEM PUBLIC KEY block,
+// or from its base64 encoding.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an Ed25519 public key: %T", key)
+		}
+		return edKey, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("expected a PEM public key or a base64-encoded Ed25519 key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// AddKey trusts the Ed25519 public key, identified in logs by name.
+func (v *Verifier) AddKey(name string, key ed25519.PublicKey) {
+	v.keys = append(v.keys, signerKey{name: name, key: key})
+}
+
+// Fingerprint identifies an Ed25519 public key by the start of its SHA-256
+// hash.
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + hex.EncodeToString(sum[:8])
+}
+
+// VerifyFile verifies the signature of the file at path, whose contents are
+// data, and logs its signer.
+func (v *Verifier) VerifyFile(path string, data []byte) error {
+	sig, err := ioutil.ReadFile(path + Suffix)
+	if os.IsNotExist(err) {
+		return ErrUnsigned
+	}
+	if err != nil {
+		return err
+	}
+
+	signer, err := v.Verify(data, sig)
+	if err != nil {
+		return err
+	}
+	if v.Logger != nil {
+		v.Logger.WithFields(logrus.Fields{
+			LogFieldFile:   path,
+			LogFieldSigner: signer,
+		}).Info("verified egress ACL signature")
+	}
+	return nil
+}
+
+// Verify verifies the signature sig of data, and returns the identity of
+// its signer.
+func (v *Verifier) Verify(data, sig []byte) (string, error) {
+	if bytes.Contains(sig, []byte("-----BEGIN ")) {
+		return v.verifyBundle(data, sig)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return "", errors.New("invalid signature: expected a base64-encoded Ed25519 signature or a PEM bundle")
+	}
+	for _, k := range v.keys {
+		if ed25519.Verify(k.key, data, raw) {
+			return fmt.Sprintf("%s (%s)", k.name, Fingerprint(k.key)), nil
+		}
+	}
+	return "", errors.New("signature does not verify with any trusted key")
+}
+
+func (v *Verifier) verifyBundle(data, bundle []byte) (string, error) {
+	if v.roots == nil {
+		return "", errors.New("certificate signatures are not trusted: no CA configured")
+	}
+
+	var sig []byte
+	var certs []*x509.Certificate
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case pemSignature:
+			if sig != nil {
+				return "", errors.New("invalid signature bundle: more than one signature")
+			}
+			sig = block.Bytes
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return "", fmt.Errorf("invalid signature bundle: %v", err)
+			}
+			certs = append(certs, cert)
+		default:
+			return "", fmt.Errorf("invalid signature bundle: unexpected PEM block %q", block.Type)
+		}
+	}
+	if sig == nil || len(certs) == 0 {
+		return "", errors.New("invalid signature bundle: expected a SIGNATURE and a CERTIFICATE")
+	}
+
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return "", fmt.Errorf("untrusted signer %q: %v", leaf.Subject, err)
+	}
+
+	algo := signatureAlgorithm(leaf)
+	if algo == x509.UnknownSignatureAlgorithm {
+		return "", fmt.Errorf("unsupported signer key %T", leaf.PublicKey)
+	}
+	if err := leaf.CheckSignature(algo, data, sig); err != nil {
+		return "", fmt.Errorf("signature does not verify with the certificate of %q: %v", leaf.Subject, err)
+	}
+	return fmt.Sprintf("%s (serial %s)", leaf.Subject, leaf.SerialNumber), nil
+}
+
+// signatureAlgorithm returns the algorithm of signatures by the key of cert.
+func signatureAlgorithm(cert *x509.Certificate) x509.SignatureAlgorithm {
+	switch cert.PublicKey.(type) {
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	}
+	return x509.UnknownSignatureAlgorithm
+}
@@ -0,0 +1,195 @@
+//go:build !nounit
+// +build !nounit
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+var testData = []byte("version: v1\nservices: []\n")
+
+func newCert(t *testing.T, name string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer, usage []x509.ExtKeyUsage) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParsePublicKey(t *testing.T) {
+	a := assert.New(t)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	a.NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	a.NoError(err)
+
+	key, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	a.NoError(err)
+	a.Equal(pub, key)
+
+	key, err = ParsePublicKey([]byte(base64.StdEncoding.EncodeToString(pub) + "\n"))
+	a.NoError(err)
+	a.Equal(pub, key)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	der, err = x509.MarshalPKIXPublicKey(ecKey.Public())
+	a.NoError(err)
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	a.Error(err)
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	a.Error(err)
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	a := assert.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	a.NoError(err)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	a.NoError(err)
+
+	v := &Verifier{}
+	v.AddKey("release", pub)
+
+	signer, err := v.Verify(testData, Sign(priv, testData))
+	a.NoError(err)
+	a.Equal("release ("+Fingerprint(pub)+")", signer)
+
+	_, err = v.Verify(append(testData, '#'), Sign(priv, testData))
+	a.Error(err)
+
+	_, err = v.Verify(testData, Sign(otherPriv, testData))
+	a.Error(err)
+
+	_, err = v.Verify(testData, []byte("garbage"))
+	a.Error(err)
+}
+
+func TestVerifyBundle(t *testing.T) {
+	a := assert.New(t)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	ca := newCert(t, "ACL CA", caKey, nil, nil, nil)
+	_, leafKey, err := ed25519.GenerateKey(rand.Reader)
+	a.NoError(err)
+	leaf := newCert(t, "acl-signer", leafKey, ca, caKey, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning})
+	ecLeafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	ecLeaf := newCert(t, "ec-signer", ecLeafKey, ca, caKey, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning})
+	serverLeaf := newCert(t, "server", leafKey, ca, caKey, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+
+	v := &Verifier{roots: x509.NewCertPool()}
+	v.roots.AddCert(ca)
+
+	bundle, err := SignBundle(leafKey, []*x509.Certificate{leaf}, testData)
+	a.NoError(err)
+	signer, err := v.Verify(testData, bundle)
+	a.NoError(err)
+	a.Contains(signer, "CN=acl-signer")
+
+	ecBundle, err := SignBundle(ecLeafKey, []*x509.Certificate{ecLeaf}, testData)
+	a.NoError(err)
+	signer, err = v.Verify(testData, ecBundle)
+	a.NoError(err)
+	a.Contains(signer, "CN=ec-signer")
+
+	// Tampered data
+	_, err = v.Verify(append(testData, '#'), bundle)
+	a.Error(err)
+
+	// Certificate not allowed to sign code
+	serverBundle, err := SignBundle(leafKey, []*x509.Certificate{serverLeaf}, testData)
+	a.NoError(err)
+	_, err = v.Verify(testData, serverBundle)
+	a.Error(err)
+
+	// Key not matching the certificate
+	_, err = SignBundle(ecLeafKey, []*x509.Certificate{leaf}, testData)
+	a.Error(err)
+
+	// No trusted CA
+	_, err = (&Verifier{}).Verify(testData, bundle)
+	a.Error(err)
+
+	// CA not trusted
+	otherCA := newCert(t, "Other CA", caKey, nil, nil, nil)
+	other := &Verifier{roots: x509.NewCertPool()}
+	other.roots.AddCert(otherCA)
+	_, err = other.Verify(testData, bundle)
+	a.Error(err)
+}
+
+func TestVerifyFile(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	a.NoError(err)
+	keyFile := writeFile(t, filepath.Join(dir, "release.pub"), []byte(base64.StdEncoding.EncodeToString(pub)))
+
+	logger, hook := test.NewNullLogger()
+	v, err := NewVerifier([]string{keyFile}, nil, logger)
+	a.NoError(err)
+
+	signed := writeFile(t, filepath.Join(dir, "signed.yaml"), testData)
+	writeFile(t, signed+Suffix, Sign(priv, testData))
+	a.NoError(v.VerifyFile(signed, testData))
+	entry := hook.LastEntry()
+	if a.NotNil(entry) {
+		a.Equal(signed, entry.Data[LogFieldFile])
+		a.Equal("release.pub ("+Fingerprint(pub)+")", entry.Data[LogFieldSigner])
+	}
+
+	unsigned := writeFile(t, filepath.Join(dir, "unsigned.yaml"), testData)
+	a.Equal(ErrUnsigned, v.VerifyFile(unsigned, testData))
+
+	_, err = NewVerifier(nil, nil, logger)
+	a.Error(err)
+	_, err = NewVerifier([]string{filepath.Join(dir, "missing.pub")}, nil, logger)
+	a.Error(err)
+}
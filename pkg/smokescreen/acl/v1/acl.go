@@ -2,6 +2,8 @@ package acl
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -11,12 +13,30 @@ type Decider interface {
 	Decide(service, host string) (Decision, error)
 }
 
+// PortDecider is a Decider which also takes the destination port into
+// account.
+type PortDecider interface {
+	Decider
+	DecidePort(service, host string, port int) (Decision, error)
+}
+
+// AddrDecider is a PortDecider which also takes the address the destination
+// host resolved to into account.
+type AddrDecider interface {
+	PortDecider
+	DecideAddr(service, host string, ip net.IP, port int) (Decision, error)
+}
+
 type ACL struct {
 	Rules            map[string]Rule
 	DefaultRule      *Rule
 	GlobalDenyList   []string
 	GlobalAllowList  []string
 	DisabledPolicies []EnforcementPolicy
+	// GlobalAllowPublicSuffixGlobs are the globs of GlobalAllowList
+	// explicitly allowed to match every domain under a public suffix.
+	GlobalAllowPublicSuffixGlobs []string
+	PublicSuffixCheck            PublicSuffixCheck
 	*logrus.Logger
 }
 
@@ -24,6 +44,9 @@ type Rule struct {
 	Project     string
 	Policy      EnforcementPolicy
 	DomainGlobs []string
+	// PublicSuffixGlobs are the globs of DomainGlobs explicitly allowed to
+	// match every domain under a public suffix.
+	PublicSuffixGlobs []string
 }
 
 type Decision struct {
@@ -33,7 +56,18 @@ type Decision struct {
 	Project string
 }
 
+// Options are the optional settings of an ACL made by NewWithOptions.
+type Options struct {
+	// PublicSuffixCheck configures how globs on public suffixes are treated.
+	PublicSuffixCheck PublicSuffixCheck
+}
+
 func New(logger *logrus.Logger, loader Loader, disabledActions []string) (*ACL, error) {
+	return NewWithOptions(logger, loader, disabledActions, Options{})
+}
+
+// NewWithOptions is New, with the optional settings of opts.
+func NewWithOptions(logger *logrus.Logger, loader Loader, disabledActions []string, opts Options) (*ACL, error) {
 	acl, err := loader.Load()
 	if err != nil {
 		return nil, err
@@ -44,13 +78,14 @@ func New(logger *logrus.Logger, loader Loader, disabledActions []string) (*ACL,
 		return nil, err
 	}
 
+	acl.Logger = logger
+	acl.PublicSuffixCheck = opts.PublicSuffixCheck
+
 	err = acl.Validate()
 	if err != nil {
 		return nil, err
 	}
 
-	acl.Logger = logger
-
 	if acl.DefaultRule == nil {
 		acl.Warn("no default rule set. any services without a rule will be denied.")
 	}
@@ -98,7 +133,7 @@ func (acl *ACL) Decide(service, host string) (Decision, error) {
 
 	// if the host matches any of the rule's allowed domains, allow
 	for _, dg := range rule.DomainGlobs {
-		if hostMatchesGlob(host, dg) {
+		if HostMatchesGlob(host, dg) {
 			d.Result, d.Reason = Allow, "host matched allowed domain in rule"
 			return d, nil
 		}
@@ -106,7 +141,7 @@ func (acl *ACL) Decide(service, host string) (Decision, error) {
 
 	// if the host matches any of the global deny list, deny
 	for _, dg := range acl.GlobalDenyList {
-		if hostMatchesGlob(host, dg) {
+		if HostMatchesGlob(host, dg) {
 			d.Result, d.Reason = Deny, "host matched rule in global deny list"
 			return d, nil
 		}
@@ -114,7 +149,7 @@ func (acl *ACL) Decide(service, host string) (Decision, error) {
 
 	// if the host matches any of the global allow list, allow
 	for _, dg := range acl.GlobalAllowList {
-		if hostMatchesGlob(host, dg) {
+		if HostMatchesGlob(host, dg) {
 			d.Result, d.Reason = Allow, "host matched rule in global allow list"
 			return d, nil
 		}
@@ -155,7 +190,8 @@ func (acl *ACL) DisablePolicies(actions []string) error {
 }
 
 // Validate checks that the ACL that every rule has a conformant domain glob
-// and is not utilizing a disabled enforcement policy.
+// and is not utilizing a disabled enforcement policy, and checks globs on
+// public suffixes as configured by PublicSuffixCheck.
 func (acl *ACL) Validate() error {
 	for svc, r := range acl.Rules {
 		err := acl.ValidateDomainGlobs(svc, r.DomainGlobs)
@@ -167,9 +203,62 @@ func (acl *ACL) Validate() error {
 			return err
 		}
 	}
+	return acl.ValidatePublicSuffixes()
+}
+
+// ValidatePublicSuffixes checks the domain globs of the rules and of the
+// global allow list which match every domain under a public suffix, such as
+// *.com or *.amazonaws.com, and are not explicitly allowed to. Such globs
+// are an error if PublicSuffixCheck.Reject is set, and are logged otherwise.
+func (acl *ACL) ValidatePublicSuffixes() error {
+	var services []string
+	for svc := range acl.Rules {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	for _, svc := range services {
+		r := acl.Rules[svc]
+		err := acl.checkPublicSuffixes(svc, r.DomainGlobs, r.PublicSuffixGlobs)
+		if err != nil {
+			return err
+		}
+	}
+	if acl.DefaultRule != nil {
+		err := acl.checkPublicSuffixes("default", acl.DefaultRule.DomainGlobs, acl.DefaultRule.PublicSuffixGlobs)
+		if err != nil {
+			return err
+		}
+	}
+	return acl.checkPublicSuffixes("global allow list", acl.GlobalAllowList, acl.GlobalAllowPublicSuffixGlobs)
+}
+
+func (acl *ACL) checkPublicSuffixes(svc string, globs, allowed []string) error {
+	for _, glob := range globs {
+		suffix, ok := acl.PublicSuffixCheck.list().GlobSuffix(glob)
+		if !ok || containsGlob(allowed, glob) {
+			continue
+		}
+		err := fmt.Errorf("%v: %v: domain glob matches every domain under the public suffix %v", svc, glob, suffix)
+		if acl.PublicSuffixCheck.Reject {
+			return err
+		}
+		if acl.Logger != nil {
+			acl.Warn(err)
+		}
+	}
 	return nil
 }
 
+func containsGlob(globs []string, glob string) bool {
+	for _, g := range globs {
+		if canonicalGlob(g) == canonicalGlob(glob) {
+			return true
+		}
+	}
+	return false
+}
+
 // ValidateDomainGlobs takes a slice of domain globs and verifies they conform to smokescreen's
 // domain glob policy.
 //
@@ -225,11 +314,11 @@ func (acl *ACL) Rule(service string) *Rule {
 	return acl.DefaultRule
 }
 
-// hostMatchesGlob matches a hostname string against a domain glob after
+// HostMatchesGlob matches a hostname string against a domain glob after
 // converting both to a canonical form (lowercase with trailing dots removed).
 //
 // domainGlob should already have been passed through ACL.Validate().
-func hostMatchesGlob(host string, domainGlob string) bool {
+func HostMatchesGlob(host string, domainGlob string) bool {
 	if host == "" {
 		return false
 	}
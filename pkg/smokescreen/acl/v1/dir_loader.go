@@ -0,0 +1,24 @@
+package acl
+
+// DirectoryLoader loads an ACL from the YAML (.yaml or .yml) and JSON
+// (.json) files of a directory, typically one per service, in the order of
+// their names. The files are merged as if included by one file: a service or
+// the default rule may only be defined once, and the global lists are
+// concatenated.
+type DirectoryLoader struct {
+	path     string
+	verifier FileVerifier
+}
+
+func NewDirectoryLoader(path string) *DirectoryLoader {
+	return &DirectoryLoader{path: path}
+}
+
+func (dl *DirectoryLoader) Load() (*ACL, error) {
+	r := newConfigReader(dl.verifier)
+	err := r.ReadDir(dl.path)
+	if err != nil {
+		return nil, err
+	}
+	return r.merged.Load()
+}
@@ -0,0 +1,97 @@
+//go:build ignore
+// +build ignore
+
+// gen_public_suffix_list writes the Public Suffix List embedded by
+// DefaultPublicSuffixList, keeping only its rules.
+//
+//	go run gen_public_suffix_list.go [-url URL | -file FILE] -o public_suffix_list_data.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+func main() {
+	url := flag.String("url", "https://publicsuffix.org/list/public_suffix_list.dat", "Download the list from `URL`.")
+	file := flag.String("file", "", "Read the list from `FILE` instead of downloading it.")
+	out := flag.String("o", "public_suffix_list_data.go", "Write the Go source to `FILE`.")
+	flag.Parse()
+
+	var r io.Reader
+	source := *url
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r, source = f, *file
+	} else {
+		resp, err := http.Get(*url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("%s: %s", *url, resp.Status)
+		}
+		r = resp.Body
+	}
+
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := fields[0]
+		prefix := ""
+		for _, p := range []string{"!", "*."} {
+			if strings.HasPrefix(rule, p) {
+				prefix, rule = p, rule[len(p):]
+				break
+			}
+		}
+		ascii, err := idna.ToASCII(strings.ToLower(rule))
+		if err != nil {
+			log.Fatalf("%s: %v", fields[0], err)
+		}
+		rules = append(rules, prefix+ascii)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if len(rules) == 0 {
+		log.Fatalf("%s: no rules", source)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_public_suffix_list.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "// The Public Suffix List is subject to the terms of the Mozilla Public\n")
+	fmt.Fprintf(&b, "// License, v. 2.0. If a copy of the MPL was not distributed with this\n")
+	fmt.Fprintf(&b, "// file, You can obtain one at https://mozilla.org/MPL/2.0/.\n\n")
+	fmt.Fprintf(&b, "package acl\n\n")
+	fmt.Fprintf(&b, "// publicSuffixListData holds the %d rules of\n// https://publicsuffix.org/list/public_suffix_list.dat, in ASCII.\n", len(rules))
+	fmt.Fprintf(&b, "const publicSuffixListData = `\n%s\n`\n", strings.Join(rules, "\n"))
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
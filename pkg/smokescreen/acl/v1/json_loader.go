@@ -0,0 +1,27 @@
+package acl
+
+import "encoding/json"
+
+// JSONLoader loads an ACL from a JSON file, which has the keys of the YAML
+// format.
+type JSONLoader struct {
+	path     string
+	verifier FileVerifier
+}
+
+func NewJSONLoader(path string) *JSONLoader {
+	return &JSONLoader{path: path}
+}
+
+func (jl *JSONLoader) Load() (*ACL, error) {
+	r := newConfigReader(jl.verifier)
+	err := r.ReadFile(jl.path, jsonUnmarshal, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.merged.Load()
+}
+
+func jsonUnmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,201 @@
+package acl
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Severities of LintFinding.
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+	LintInfo    = "info"
+)
+
+// Checks reporting a LintFinding.
+const (
+	LintDuplicate    = "duplicate"
+	LintShadowed     = "shadowed"
+	LintGlobalAllow  = "global-allow"
+	LintGlobalDeny   = "global-deny"
+	LintDefault      = "default"
+	LintPublicSuffix = "public-suffix"
+)
+
+// LintFinding is a likely mistake found by ACL.Lint. Errors are entries
+// allowing far more than intended, warnings are entries which do not do what
+// they appear to, and infos are entries which could be removed.
+type LintFinding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	// Service is empty for findings on the default rule or the global lists.
+	Service string `json:"service,omitempty"`
+	// Location is where the entry is: a service, the default rule or one of
+	// the global lists.
+	Location string `json:"location"`
+	Domain   string `json:"domain,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (f LintFinding) String() string {
+	if f.Domain == "" {
+		return fmt.Sprintf("%s: %s: %s", f.Severity, f.Location, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", f.Severity, f.Location, f.Domain, f.Message)
+}
+
+type linter struct {
+	acl      *ACL
+	findings []LintFinding
+}
+
+func (l *linter) add(severity, check, svc, location, domain, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{
+		Severity: severity,
+		Check:    check,
+		Service:  svc,
+		Location: location,
+		Domain:   domain,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Lint reports duplicate and shadowed domains, rule entries which are
+// already allowed by the global allow list or which override the global deny
+// list, rules identical to the default rule, and globs matching every domain
+// under a public suffix, such as *.co.uk, which are not explicitly allowed
+// to. Findings are sorted by service, then the default rule and the global
+// lists.
+func (acl *ACL) Lint() []LintFinding {
+	l := &linter{acl: acl}
+
+	var services []string
+	for svc := range acl.Rules {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	for _, svc := range services {
+		rule := acl.Rules[svc]
+		location := fmt.Sprintf("service %q", svc)
+		l.lintRule(svc, location, rule)
+		if acl.DefaultRule != nil && sameRule(rule, *acl.DefaultRule) {
+			l.add(LintInfo, LintDefault, svc, location, "", "rule is identical to the default rule")
+		}
+	}
+	if acl.DefaultRule != nil {
+		l.lintRule("", "default rule", *acl.DefaultRule)
+	}
+
+	allowed := l.lintGlobs("", "global_allow_list", acl.GlobalAllowList, true, acl.GlobalAllowPublicSuffixGlobs)
+	denied := l.lintGlobs("", "global_deny_list", acl.GlobalDenyList, false, nil)
+	// The global deny list is checked before the global allow list.
+	for _, a := range allowed {
+		for _, d := range denied {
+			if globCovers(d, a) {
+				l.add(LintWarning, LintGlobalDeny, "", "global_allow_list", a,
+					"has no effect: it is denied by global deny list entry %q", d)
+				break
+			}
+		}
+	}
+
+	return l.findings
+}
+
+func (l *linter) lintRule(svc, location string, rule Rule) {
+	globs := l.lintGlobs(svc, location, rule.DomainGlobs, true, rule.PublicSuffixGlobs)
+
+	for _, g := range globs {
+		// The domains of a rule are checked before the global deny list,
+		// which in turn is checked before the global allow list.
+		var deniedBy string
+		for _, d := range l.acl.GlobalDenyList {
+			if d = canonicalGlob(d); globCovers(d, g) || globCovers(g, d) {
+				deniedBy = d
+				break
+			}
+		}
+		if deniedBy != "" {
+			l.add(LintWarning, LintGlobalDeny, svc, location, g,
+				"overrides global deny list entry %q", deniedBy)
+			continue
+		}
+
+		for _, a := range l.acl.GlobalAllowList {
+			if a = canonicalGlob(a); globCovers(a, g) {
+				l.add(LintInfo, LintGlobalAllow, svc, location, g,
+					"is already allowed by global allow list entry %q", a)
+				break
+			}
+		}
+	}
+}
+
+// lintGlobs reports duplicate and shadowed globs and, when allowing, globs
+// on public suffixes which are not in publicSuffixGlobs. It returns the
+// globs in canonical form, without duplicates.
+func (l *linter) lintGlobs(svc, location string, globs []string, allowing bool, publicSuffixGlobs []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, g := range globs {
+		g = canonicalGlob(g)
+		if seen[g] {
+			l.add(LintWarning, LintDuplicate, svc, location, g, "is listed more than once")
+			continue
+		}
+		seen[g] = true
+		unique = append(unique, g)
+	}
+
+	for i, g := range unique {
+		for j, other := range unique {
+			if i != j && globCovers(other, g) {
+				l.add(LintWarning, LintShadowed, svc, location, g, "is already covered by %q", other)
+				break
+			}
+		}
+		if allowing && !containsGlob(publicSuffixGlobs, g) {
+			if suffix, ok := l.acl.PublicSuffixCheck.list().GlobSuffix(g); ok {
+				l.add(LintError, LintPublicSuffix, svc, location, g,
+					"matches every domain under the public suffix %q", suffix)
+			}
+		}
+	}
+	return unique
+}
+
+// canonicalGlob puts a domain glob in the canonical form used by
+// HostMatchesGlob.
+func canonicalGlob(glob string) string {
+	return strings.TrimRight(strings.ToLower(glob), ".")
+}
+
+// globCovers reports whether every host matched by glob is also matched by
+// other. Both must be in canonical form.
+func globCovers(other, glob string) bool {
+	if other == glob {
+		return true
+	}
+	if !strings.HasPrefix(other, "*.") {
+		return false
+	}
+	return strings.HasSuffix(strings.TrimPrefix(glob, "*"), other[1:])
+}
+
+// sameRule reports whether two rules have the same project, policy and set
+// of domains.
+func sameRule(a, b Rule) bool {
+	return a.Project == b.Project && a.Policy == b.Policy &&
+		reflect.DeepEqual(globSet(a.DomainGlobs), globSet(b.DomainGlobs))
+}
+
+func globSet(globs []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, g := range globs {
+		set[canonicalGlob(g)] = true
+	}
+	return set
+}
@@ -0,0 +1,55 @@
+//go:build !nounit
+// +build !nounit
+
+package acl
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLLint(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := New(logrus.New(), NewYAMLLoader("testdata/lint_config.yaml"), []string{})
+	a.NoError(err)
+
+	var findings []string
+	for _, f := range acl.Lint() {
+		findings = append(findings, f.String())
+	}
+	a.Equal([]string{
+		`warning: service "default-srv": status.example.net: overrides global deny list entry "*.example.net"`,
+		`info: service "default-srv": rule is identical to the default rule`,
+		`warning: service "dup-srv": api.example.com: is listed more than once`,
+		`warning: service "dup-srv": api.example.com: is already covered by "*.example.com"`,
+		`warning: service "dup-srv": www.example.com: is already covered by "*.example.com"`,
+		`info: service "global-srv": api.github.com: is already allowed by global allow list entry "*.github.com"`,
+		`warning: service "global-srv": bad.example.org: overrides global deny list entry "bad.example.org"`,
+		`error: service "suffix-srv": *.co.uk: matches every domain under the public suffix "co.uk"`,
+		`warning: service "suffix-srv": *.corp.internal: is already covered by "*.internal"`,
+		`warning: service "suffix-srv": *.s3.amazonaws.com: is already covered by "*.amazonaws.com"`,
+		`error: service "suffix-srv": *.amazonaws.com: matches every domain under the public suffix "*.compute.amazonaws.com"`,
+		`warning: default rule: status.example.net: overrides global deny list entry "*.example.net"`,
+		`error: global_allow_list: *.appspot.com: matches every domain under the public suffix "appspot.com"`,
+		`warning: global_deny_list: *.example.net: is listed more than once`,
+		`warning: global_allow_list: cdn.example.net: has no effect: it is denied by global deny list entry "*.example.net"`,
+	}, findings)
+
+	acl, err = New(logrus.New(), NewYAMLLoader("testdata/sample_config.yaml"), []string{})
+	a.NoError(err)
+	a.Empty(acl.Lint())
+}
+
+func TestGlobCovers(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(globCovers("*.example.com", "api.example.com"))
+	a.True(globCovers("*.example.com", "*.api.example.com"))
+	a.True(globCovers("api.example.com", "api.example.com"))
+	a.False(globCovers("*.example.com", "example.com"))
+	a.False(globCovers("*.example.com", "api.badexample.com"))
+	a.False(globCovers("api.example.com", "*.example.com"))
+}
@@ -1,6 +1,38 @@
 package acl
 
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
 // Loader is an interface used to return a parsed ACL from an abstract source
 type Loader interface {
 	Load() (*ACL, error)
 }
+
+// FileVerifier checks the contents of ACL files before they are parsed, such
+// as by verifying their signature.
+type FileVerifier interface {
+	VerifyFile(path string, data []byte) error
+}
+
+// NewLoader returns the loader for path: a DirectoryLoader for a directory,
+// a JSONLoader for a .json file and a YAMLLoader otherwise.
+func NewLoader(path string) Loader {
+	return NewVerifiedLoader(path, nil)
+}
+
+// NewVerifiedLoader is NewLoader, except that every file read, including
+// included files, must pass verifier unless it is nil. Directories and
+// included patterns are then refused, since signatures do not cover which
+// files they match.
+func NewVerifiedLoader(path string, verifier FileVerifier) Loader {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return &DirectoryLoader{path: path, verifier: verifier}
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return &JSONLoader{path: path, verifier: verifier}
+	}
+	return &YAMLLoader{path: path, verifier: verifier}
+}
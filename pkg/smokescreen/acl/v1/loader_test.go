@@ -0,0 +1,121 @@
+//go:build !nounit
+// +build !nounit
+
+package acl
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeACLFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestJSONLoader(t *testing.T) {
+	a := assert.New(t)
+
+	fromYAML, err := New(logrus.New(), NewYAMLLoader("testdata/sample_config.yaml"), []string{})
+	a.NoError(err)
+	fromJSON, err := New(logrus.New(), NewJSONLoader("testdata/sample_config.json"), []string{})
+	a.NoError(err)
+	a.Equal(fromYAML.Rules, fromJSON.Rules)
+	a.Equal(fromYAML.DefaultRule, fromJSON.DefaultRule)
+	a.Equal(fromYAML.GlobalAllowList, fromJSON.GlobalAllowList)
+	a.Equal(fromYAML.GlobalDenyList, fromJSON.GlobalDenyList)
+
+	// JSON files are validated like YAML files.
+	dir := writeACLFiles(t, map[string]string{
+		"middle_glob.json": `{"version": "v1", "services": [{"name": "srv", "action": "enforce", "allowed_domains": ["api.*.example.com"]}]}`,
+		"version.json":     `{"version": "v2", "services": []}`,
+		"broken.json":      `{"version": "v1", "services": [}`,
+	})
+	_, err = New(logrus.New(), NewJSONLoader(filepath.Join(dir, "middle_glob.json")), []string{})
+	a.EqualError(err, "srv: api.*.example.com: domain globs are only supported as prefix")
+	_, err = New(logrus.New(), NewJSONLoader(filepath.Join(dir, "version.json")), []string{})
+	a.EqualError(err, `expected version "v1" got "v2"`)
+	_, err = New(logrus.New(), NewJSONLoader(filepath.Join(dir, "broken.json")), []string{})
+	a.Error(err)
+}
+
+func TestYAMLLoaderInclude(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := NewWithOptions(logrus.New(), NewYAMLLoader("testdata/include/main.yaml"), []string{}, Options{PublicSuffixCheck: PublicSuffixCheck{Reject: true}})
+	a.NoError(err)
+	a.Len(acl.Rules, 3)
+	a.Equal("phony", acl.Rules["dummy-glob"].Project)
+	a.Equal([]string{"*.s3.amazonaws.com"}, acl.Rules["dummy-glob"].PublicSuffixGlobs)
+	a.Equal(Report, acl.Rules["report-dummy-srv"].Policy)
+	a.Equal([]string{"default.example.com"}, acl.DefaultRule.DomainGlobs)
+	a.Equal([]string{"goodexample1.com"}, acl.GlobalAllowList)
+	a.Equal([]string{"badexample1.com"}, acl.GlobalDenyList)
+
+	dir := writeACLFiles(t, map[string]string{
+		"missing.yaml":   "version: v1\nservices: []\ninclude: [nope.yaml]\n",
+		"conflict.yaml":  "version: v1\nservices: [{name: srv, action: open}]\ninclude: [srv.yaml]\n",
+		"srv.yaml":       "services: [{name: srv, action: enforce}]\n",
+		"default.yaml":   "version: v1\nservices: []\ndefault: {action: open}\ninclude: [default2.yaml]\n",
+		"default2.yaml":  "default: {action: enforce}\n",
+		"version.yaml":   "version: v1\nservices: []\ninclude: [version2.yaml]\n",
+		"version2.yaml":  "version: v2\n",
+		"glob.yaml":      "version: v1\ninclude: [\"none/*.yaml\"]\n",
+		"duplicate.yaml": "version: v1\nservices: [{name: srv, action: open}, {name: srv, action: open}]\n",
+	})
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for name, errMsg := range map[string]string{
+		"missing.yaml":   path("missing.yaml") + ": open " + path("nope.yaml") + ": no such file or directory",
+		"conflict.yaml":  path("srv.yaml") + `: service "srv" is already defined in ` + path("conflict.yaml"),
+		"default.yaml":   path("default2.yaml") + ": default rule is already defined in " + path("default.yaml"),
+		"version.yaml":   path("version2.yaml") + `: expected version "v1" got "v2"`,
+		"glob.yaml":      "Top level list 'services' is missing",
+		"duplicate.yaml": "rule already exists for service srv",
+	} {
+		_, err := NewYAMLLoader(path(name)).Load()
+		a.EqualError(err, errMsg, name)
+	}
+}
+
+func TestDirectoryLoader(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := NewWithOptions(logrus.New(), NewDirectoryLoader("testdata/dir"), []string{}, Options{PublicSuffixCheck: PublicSuffixCheck{Reject: true}})
+	a.NoError(err)
+	a.Len(acl.Rules, 2)
+	a.Equal(Enforce, acl.Rules["billing"].Policy)
+	a.Equal([]string{"*.github.io"}, acl.Rules["search"].DomainGlobs)
+	a.Equal(Enforce, acl.DefaultRule.Policy)
+	a.Equal([]string{"badexample1.com"}, acl.GlobalDenyList)
+
+	_, err = NewDirectoryLoader("testdata/conflict_dir").Load()
+	a.EqualError(err, `testdata/conflict_dir/b.yaml: service "billing" is already defined in testdata/conflict_dir/a.yaml`)
+
+	dir := writeACLFiles(t, map[string]string{"README.md": "Not an ACL file."})
+	_, err = NewDirectoryLoader(dir).Load()
+	a.EqualError(err, dir+": no acl configuration files")
+
+	dir = writeACLFiles(t, map[string]string{"srv.yaml": "services: []\n"})
+	_, err = NewDirectoryLoader(dir).Load()
+	a.EqualError(err, filepath.Join(dir, "srv.yaml")+`: expected version "v1" got ""`)
+}
+
+func TestNewLoader(t *testing.T) {
+	a := assert.New(t)
+
+	a.IsType(&DirectoryLoader{}, NewLoader("testdata/dir"))
+	a.IsType(&JSONLoader{}, NewLoader("testdata/sample_config.json"))
+	a.IsType(&YAMLLoader{}, NewLoader("testdata/sample_config.yaml"))
+	a.IsType(&YAMLLoader{}, NewLoader("testdata/nonexistent"))
+}
@@ -0,0 +1,68 @@
+package acl
+
+import (
+	"fmt"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/internal/aclfile"
+)
+
+// configReader reads configuration files, and the files they include, into
+// one YAMLConfig. A service or the default rule defined by two files is an
+// error, as is a file which verifier, if set, refuses.
+type configReader struct {
+	*aclfile.Reader
+	merged YAMLConfig
+}
+
+func newConfigReader(verifier FileVerifier) *configReader {
+	r := &configReader{}
+	r.Reader = aclfile.NewReader(r.decode, verifier)
+	return r
+}
+
+// decode merges a file. Included files may omit the version.
+func (r *configReader) decode(path string, data []byte, unmarshal aclfile.Unmarshal, includerVersion string) (string, []string, error) {
+	cfg := YAMLConfig{}
+	err := unmarshal(data, &cfg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cfg.Version != "v1" && !(includerVersion != "" && cfg.Version == "") {
+		return "", nil, fmt.Errorf("expected version \"v1\" got %#v", cfg.Version)
+	}
+
+	err = r.merge(path, &cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	return "v1", cfg.Include, nil
+}
+
+func (r *configReader) merge(path string, cfg *YAMLConfig) error {
+	m := &r.merged
+	m.Version = "v1"
+
+	if cfg.Services != nil && m.Services == nil {
+		m.Services = []YAMLRule{}
+	}
+	for _, svc := range cfg.Services {
+		// Services defined twice in the same file are refused by ACL.Add.
+		if err := r.DefineService(path, svc.Name); err != nil {
+			return err
+		}
+		m.Services = append(m.Services, svc)
+	}
+
+	if cfg.Default != nil {
+		if err := r.DefineDefault(path); err != nil {
+			return err
+		}
+		m.Default = cfg.Default
+	}
+
+	m.GlobalDenyList = append(m.GlobalDenyList, cfg.GlobalDenyList...)
+	m.GlobalAllowList = append(m.GlobalAllowList, cfg.GlobalAllowList...)
+	m.GlobalAllowPublicSuffixList = append(m.GlobalAllowPublicSuffixList, cfg.GlobalAllowPublicSuffixList...)
+	return nil
+}
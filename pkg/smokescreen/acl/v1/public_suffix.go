@@ -0,0 +1,194 @@
+package acl
+
+//go:generate go run gen_public_suffix_list.go -o public_suffix_list_data.go
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/idna"
+)
+
+// PublicSuffixList is a parsed Public Suffix List (https://publicsuffix.org),
+// used to find domain globs which match every domain under a public suffix,
+// such as *.com, *.co.uk or *.amazonaws.com.
+type PublicSuffixList struct {
+	// rules holds the rules of the list as written, such as "co.uk",
+	// "*.compute.amazonaws.com" or "!www.ck".
+	rules map[string]bool
+	// parents maps the domains above a public suffix to one of the
+	// suffixes under them.
+	parents map[string]string
+}
+
+var (
+	defaultPublicSuffixList     *PublicSuffixList
+	defaultPublicSuffixListOnce sync.Once
+)
+
+// DefaultPublicSuffixList returns the Public Suffix List embedded in
+// smokescreen. It is updated with go generate; LoadPublicSuffixList reads a
+// newer copy at run time.
+func DefaultPublicSuffixList() *PublicSuffixList {
+	defaultPublicSuffixListOnce.Do(func() {
+		l, err := ParsePublicSuffixList(strings.NewReader(publicSuffixListData))
+		if err != nil {
+			panic(fmt.Sprintf("embedded public suffix list: %v", err))
+		}
+		defaultPublicSuffixList = l
+	})
+	return defaultPublicSuffixList
+}
+
+// LoadPublicSuffixList reads a Public Suffix List in the format of
+// https://publicsuffix.org/list/public_suffix_list.dat.
+func LoadPublicSuffixList(path string) (*PublicSuffixList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l, err := ParsePublicSuffixList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return l, nil
+}
+
+// ParsePublicSuffixList reads a Public Suffix List in the format of
+// https://publicsuffix.org/list/public_suffix_list.dat.
+func ParsePublicSuffixList(r io.Reader) (*PublicSuffixList, error) {
+	l := &PublicSuffixList{
+		rules:   make(map[string]bool),
+		parents: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		rule := fields[0]
+		prefix := ""
+		for _, p := range []string{"!", "*."} {
+			if strings.HasPrefix(rule, p) {
+				prefix, rule = p, rule[len(p):]
+				break
+			}
+		}
+		domain, err := idna.ToASCII(strings.ToLower(rule))
+		if err != nil || !validSuffix(domain) {
+			return nil, fmt.Errorf("line %d: invalid rule %q", line, fields[0])
+		}
+		rule = prefix + domain
+		l.rules[rule] = true
+
+		switch prefix {
+		case "!":
+			continue
+		case "*.":
+			// Every domain under the wildcard is a public suffix.
+			l.addParent(domain, rule)
+		}
+		for d := domain; strings.Contains(d, "."); {
+			d = d[strings.Index(d, ".")+1:]
+			l.addParent(d, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return l, nil
+}
+
+// validSuffix reports whether domain is made of non-empty labels of
+// letters, digits and hyphens.
+func validSuffix(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (l *PublicSuffixList) addParent(domain, rule string) {
+	if _, ok := l.parents[domain]; !ok {
+		l.parents[domain] = rule
+	}
+}
+
+// PublicSuffix returns the public suffix of domain, and whether it is
+// listed. Domains under no rule have their top level label as suffix, which
+// is not listed.
+func (l *PublicSuffixList) PublicSuffix(domain string) (string, bool) {
+	domain = strings.TrimRight(strings.ToLower(domain), ".")
+	for d := domain; ; {
+		dot := strings.Index(d, ".")
+		switch {
+		case l.rules["!"+d]:
+			return d[dot+1:], true
+		case l.rules[d]:
+			return d, true
+		case dot >= 0 && l.rules["*."+d[dot+1:]]:
+			return d, true
+		case dot < 0:
+			return d, false
+		}
+		d = d[dot+1:]
+	}
+}
+
+// GlobSuffix reports whether glob matches every domain under a public
+// suffix: the glob is either on a public suffix, as *.co.uk, or above one,
+// as *.amazonaws.com. It returns the public suffix, or a rule of the list
+// under the glob.
+func (l *PublicSuffixList) GlobSuffix(glob string) (string, bool) {
+	glob = canonicalGlob(glob)
+	if !strings.HasPrefix(glob, "*.") {
+		return "", false
+	}
+	domain := glob[2:]
+	if suffix, listed := l.PublicSuffix(domain); listed && suffix == domain {
+		return suffix, true
+	}
+	if rule, ok := l.parents[domain]; ok {
+		return rule, true
+	}
+	return "", false
+}
+
+// PublicSuffixCheck configures how ACL.Validate treats domain globs
+// matching every domain under a public suffix. Such globs are rejected or
+// logged unless they are explicitly allowed by the rule or the global allow
+// list listing them.
+type PublicSuffixCheck struct {
+	// List defaults to DefaultPublicSuffixList.
+	List *PublicSuffixList
+	// Reject fails validation instead of logging a warning.
+	Reject bool
+}
+
+func (psc PublicSuffixCheck) list() *PublicSuffixList {
+	if psc.List != nil {
+		return psc.List
+	}
+	return DefaultPublicSuffixList()
+}
@@ -0,0 +1,101 @@
+//go:build !nounit
+// +build !nounit
+
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicSuffix(t *testing.T) {
+	a := assert.New(t)
+
+	l, err := ParsePublicSuffixList(strings.NewReader(`
+// ===BEGIN ICANN DOMAINS===
+com
+uk
+co.uk
+*.ck
+!www.ck
+公司.cn
+
+// ===BEGIN PRIVATE DOMAINS===
+s3.amazonaws.com
+*.compute.amazonaws.com
+`))
+	a.NoError(err)
+
+	for domain, want := range map[string]string{
+		"example.com":               "com",
+		"www.example.co.uk.":        "co.uk",
+		"Example.UK":                "uk",
+		"x.ck":                      "x.ck",
+		"a.x.ck":                    "x.ck",
+		"www.ck":                    "ck",
+		"example.xn--55qx5d.cn":     "xn--55qx5d.cn",
+		"bucket.s3.amazonaws.com":   "s3.amazonaws.com",
+		"a.b.compute.amazonaws.com": "b.compute.amazonaws.com",
+	} {
+		suffix, listed := l.PublicSuffix(domain)
+		a.True(listed, domain)
+		a.Equal(want, suffix, domain)
+	}
+	suffix, listed := l.PublicSuffix("corp.internal")
+	a.False(listed)
+	a.Equal("internal", suffix)
+
+	for glob, want := range map[string]string{
+		"*.com":                     "com",
+		"*.co.uk":                   "co.uk",
+		"*.ck":                      "*.ck",
+		"*.x.ck":                    "x.ck",
+		"*.amazonaws.com":           "s3.amazonaws.com",
+		"*.compute.amazonaws.com":   "*.compute.amazonaws.com",
+		"*.b.compute.amazonaws.com": "b.compute.amazonaws.com",
+	} {
+		suffix, ok := l.GlobSuffix(glob)
+		a.True(ok, glob)
+		a.Equal(want, suffix, glob)
+	}
+	for _, glob := range []string{"*.example.com", "*.internal", "co.uk", "*.www.ck", "*.bucket.s3.amazonaws.com"} {
+		_, ok := l.GlobSuffix(glob)
+		a.False(ok, glob)
+	}
+
+	_, err = ParsePublicSuffixList(strings.NewReader("com\nfoo.*.example\n"))
+	a.EqualError(err, `line 2: invalid rule "foo.*.example"`)
+	_, err = ParsePublicSuffixList(strings.NewReader("// nothing\n"))
+	a.Error(err)
+
+	// The embedded list has the usual suspects.
+	for _, glob := range []string{"*.com", "*.co.uk", "*.amazonaws.com", "*.github.io"} {
+		_, ok := DefaultPublicSuffixList().GlobSuffix(glob)
+		a.True(ok, glob)
+	}
+	_, ok := DefaultPublicSuffixList().GlobSuffix("*.stripe.com")
+	a.False(ok)
+}
+
+func TestACLPublicSuffixCheck(t *testing.T) {
+	a := assert.New(t)
+
+	acl, err := New(logrus.New(), NewYAMLLoader("testdata/public_suffix.yaml"), []string{})
+	a.NoError(err)
+	a.Equal([]string{"api.example.com", "*.s3.amazonaws.com"}, acl.Rules["bucket-srv"].DomainGlobs)
+	a.Equal([]string{"*.s3.amazonaws.com"}, acl.Rules["bucket-srv"].PublicSuffixGlobs)
+	a.Equal([]string{"*.github.io"}, acl.GlobalAllowList)
+	a.Equal([]string{"*.github.io"}, acl.GlobalAllowPublicSuffixGlobs)
+
+	_, err = NewWithOptions(logrus.New(), NewYAMLLoader("testdata/public_suffix.yaml"), []string{}, Options{PublicSuffixCheck: PublicSuffixCheck{Reject: true}})
+	a.EqualError(err, "uk-srv: *.co.uk: domain glob matches every domain under the public suffix co.uk")
+
+	// A list without co.uk lets the glob through.
+	l, err := ParsePublicSuffixList(strings.NewReader("com\n"))
+	a.NoError(err)
+	_, err = NewWithOptions(logrus.New(), NewYAMLLoader("testdata/public_suffix.yaml"), []string{}, Options{PublicSuffixCheck: PublicSuffixCheck{List: l, Reject: true}})
+	a.NoError(err)
+}
@@ -1,20 +1,19 @@
 package acl
 
 import (
+	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"os"
 
 	"gopkg.in/yaml.v2"
 )
 
 type YAMLLoader struct {
-	path string
+	path     string
+	verifier FileVerifier
 }
 
 func NewYAMLLoader(path string) *YAMLLoader {
-	return &YAMLLoader{path}
+	return &YAMLLoader{path: path}
 }
 
 type YAMLConfig struct {
@@ -23,6 +22,13 @@ type YAMLConfig struct {
 	Version         string     `yaml:"version"`
 	GlobalDenyList  []string   `yaml:"global_deny_list"`  // domains which will be blocked even in report mode
 	GlobalAllowList []string   `yaml:"global_allow_list"` // domains which will be allowed for every host type
+
+	// Globs of GlobalAllowList given with allow_public_suffix.
+	GlobalAllowPublicSuffixList []string `yaml:"-"`
+
+	// Files merged into this one, relative to its directory. Patterns such
+	// as "services/*.yaml" include every matching file.
+	Include []string `yaml:"include"`
 }
 
 type YAMLRule struct {
@@ -30,36 +36,171 @@ type YAMLRule struct {
 	Project      string   `yaml:"project"` // owner
 	Action       string   `yaml:"action"`
 	AllowedHosts []string `yaml:"allowed_domains"`
+
+	// Globs of AllowedHosts given with allow_public_suffix.
+	AllowedPublicSuffixHosts []string `yaml:"-"`
 }
 
-func (yc *YAMLConfig) ValidateConfig() error {
-	_, err := yc.Load()
-	return err
+// configFile is the form of YAMLConfig in a YAML or JSON file.
+type configFile struct {
+	Services        []YAMLRule      `yaml:"services" json:"services"`
+	Default         *YAMLRule       `yaml:"default" json:"default"`
+	Version         string          `yaml:"version" json:"version"`
+	GlobalDenyList  []string        `yaml:"global_deny_list" json:"global_deny_list"`
+	GlobalAllowList yamlDomainGlobs `yaml:"global_allow_list" json:"global_allow_list"`
+	Include         []string        `yaml:"include" json:"include"`
 }
 
-func (yl *YAMLLoader) Load() (*ACL, error) {
-	f, err := os.Open(yl.path)
-	if err != nil {
-		return nil, err
+func (f *configFile) config() YAMLConfig {
+	return YAMLConfig{
+		Services:                    f.Services,
+		Default:                     f.Default,
+		Version:                     f.Version,
+		GlobalDenyList:              f.GlobalDenyList,
+		GlobalAllowList:             f.GlobalAllowList.globs,
+		GlobalAllowPublicSuffixList: f.GlobalAllowList.publicSuffix,
+		Include:                     f.Include,
 	}
-	defer f.Close()
+}
 
-	yamlFile, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, fmt.Errorf("could not load acl configuration")
+func (yc *YAMLConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var f configFile
+	if err := unmarshal(&f); err != nil {
+		return err
 	}
+	*yc = f.config()
+	return nil
+}
 
-	yamlConfig := YAMLConfig{}
-	err = yaml.Unmarshal(yamlFile, &yamlConfig)
-	if err != nil {
-		return nil, err
+func (yc *YAMLConfig) UnmarshalJSON(data []byte) error {
+	var f configFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*yc = f.config()
+	return nil
+}
+
+// ruleFile is the form of YAMLRule in a YAML or JSON file.
+type ruleFile struct {
+	Name         string          `yaml:"name" json:"name"`
+	Project      string          `yaml:"project" json:"project"`
+	Action       string          `yaml:"action" json:"action"`
+	AllowedHosts yamlDomainGlobs `yaml:"allowed_domains" json:"allowed_domains"`
+}
+
+func (f *ruleFile) rule() YAMLRule {
+	return YAMLRule{
+		Name:                     f.Name,
+		Project:                  f.Project,
+		Action:                   f.Action,
+		AllowedHosts:             f.AllowedHosts.globs,
+		AllowedPublicSuffixHosts: f.AllowedHosts.publicSuffix,
 	}
+}
+
+func (yr *YAMLRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var f ruleFile
+	if err := unmarshal(&f); err != nil {
+		return err
+	}
+	*yr = f.rule()
+	return nil
+}
 
-	if yamlConfig.Version != "v1" {
-		return nil, fmt.Errorf("expected version \"v1\" got %#v", yamlConfig.Version)
+func (yr *YAMLRule) UnmarshalJSON(data []byte) error {
+	var f ruleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
 	}
+	*yr = f.rule()
+	return nil
+}
+
+// yamlDomainGlobs is a list of domain globs. An entry may be written as
+// {domain: GLOB, allow_public_suffix: true} to allow a glob matching every
+// domain under a public suffix.
+type yamlDomainGlobs struct {
+	globs        []string
+	publicSuffix []string
+}
+
+func (d *yamlDomainGlobs) set(entries []yamlDomainGlob) {
+	d.globs = make([]string, 0, len(entries))
+	for _, e := range entries {
+		d.globs = append(d.globs, e.Domain)
+		if e.AllowPublicSuffix {
+			d.publicSuffix = append(d.publicSuffix, e.Domain)
+		}
+	}
+}
 
-	return yamlConfig.Load()
+func (d *yamlDomainGlobs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []yamlDomainGlob
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	d.set(entries)
+	return nil
+}
+
+func (d *yamlDomainGlobs) UnmarshalJSON(data []byte) error {
+	var entries []yamlDomainGlob
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	if entries != nil {
+		d.set(entries)
+	}
+	return nil
+}
+
+type yamlDomainGlob struct {
+	Domain            string `yaml:"domain" json:"domain"`
+	AllowPublicSuffix bool   `yaml:"allow_public_suffix" json:"allow_public_suffix"`
+}
+
+func (g *yamlDomainGlob) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&g.Domain); err == nil {
+		return nil
+	}
+	type plain yamlDomainGlob
+	if err := unmarshal((*plain)(g)); err != nil {
+		return err
+	}
+	return g.check()
+}
+
+func (g *yamlDomainGlob) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &g.Domain); err == nil {
+		return nil
+	}
+	type plain yamlDomainGlob
+	if err := json.Unmarshal(data, (*plain)(g)); err != nil {
+		return err
+	}
+	return g.check()
+}
+
+func (g *yamlDomainGlob) check() error {
+	if g.Domain == "" {
+		return errors.New("domain entry is missing 'domain'")
+	}
+	return nil
+}
+
+func (yc *YAMLConfig) ValidateConfig() error {
+	_, err := yc.Load()
+	return err
+}
+
+func (yl *YAMLLoader) Load() (*ACL, error) {
+	r := newConfigReader(yl.verifier)
+	err := r.ReadFile(yl.path, yaml.Unmarshal, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.merged.Load()
 }
 
 func (cfg *YAMLConfig) Load() (*ACL, error) {
@@ -78,9 +219,10 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 		}
 
 		r := Rule{
-			Project:     v.Project,
-			Policy:      p,
-			DomainGlobs: v.AllowedHosts,
+			Project:           v.Project,
+			Policy:            p,
+			DomainGlobs:       v.AllowedHosts,
+			PublicSuffixGlobs: v.AllowedPublicSuffixHosts,
 		}
 
 		err = acl.Add(v.Name, r)
@@ -96,9 +238,10 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 		}
 
 		acl.DefaultRule = &Rule{
-			Project:     cfg.Default.Project,
-			Policy:      p,
-			DomainGlobs: cfg.Default.AllowedHosts,
+			Project:           cfg.Default.Project,
+			Policy:            p,
+			DomainGlobs:       cfg.Default.AllowedHosts,
+			PublicSuffixGlobs: cfg.Default.AllowedPublicSuffixHosts,
 		}
 	}
 
@@ -108,6 +251,7 @@ func (cfg *YAMLConfig) Load() (*ACL, error) {
 	if cfg.GlobalAllowList != nil {
 		acl.GlobalAllowList = cfg.GlobalAllowList
 	}
+	acl.GlobalAllowPublicSuffixGlobs = cfg.GlobalAllowPublicSuffixList
 	if cfg.GlobalDenyList != nil {
 		acl.GlobalDenyList = cfg.GlobalDenyList
 	}
@@ -0,0 +1,329 @@
+// Package acl implements version 2 of the egress ACL format. Compared to
+// v1, an entry may be a domain glob or a CIDR, be restricted to ports and
+// expire, rules carry owner and contact metadata, and each rule has its own
+// deny list. The decisions and policies are those of acl/v1.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+type ACL struct {
+	Rules             map[string]Rule
+	DefaultRule       *Rule
+	GlobalDenyList    []Entry
+	GlobalAllowList   []Entry
+	DisabledPolicies  []v1.EnforcementPolicy
+	PublicSuffixCheck v1.PublicSuffixCheck
+	*logrus.Logger
+
+	// now returns the time entries expire against; defaults to time.Now.
+	now func() time.Time
+}
+
+type Rule struct {
+	Project string
+	Owner   string
+	Contact string
+	Comment string
+	Policy  v1.EnforcementPolicy
+	Allow   []Entry
+	Deny    []Entry
+}
+
+// Entry matches destinations by domain glob or, for IP address hosts, by
+// CIDR; exactly one of Domain and CIDR is set. In deny lists, CIDR entries
+// also match the addresses host names resolve to; see DecideAddr.
+type Entry struct {
+	Domain string
+	CIDR   *net.IPNet
+	// Ports the entry is restricted to. Empty means every port.
+	Ports []int
+	// The entry no longer matches from Expires on, unless it is zero.
+	Expires       time.Time
+	Justification string
+	// AllowPublicSuffix allows Domain to match every domain under a public
+	// suffix.
+	AllowPublicSuffix bool
+}
+
+func (e Entry) String() string {
+	var s string
+	if e.CIDR != nil {
+		s = e.CIDR.String()
+	} else {
+		s = e.Domain
+	}
+	if len(e.Ports) > 0 {
+		ports := make([]string, len(e.Ports))
+		for i, p := range e.Ports {
+			ports[i] = fmt.Sprint(p)
+		}
+		s += " port " + strings.Join(ports, ",")
+	}
+	return s
+}
+
+// Matches reports whether the entry matches host and port at now. Entries
+// restricted to ports never match an unknown (zero) port.
+func (e Entry) Matches(host string, port int, now time.Time) bool {
+	return e.MatchesAddr(host, nil, port, now)
+}
+
+// MatchesAddr is Matches for a host which resolved to ip: a CIDR entry
+// matches ip rather than host, unless ip is nil.
+func (e Entry) MatchesAddr(host string, ip net.IP, port int, now time.Time) bool {
+	if !e.Expires.IsZero() && !now.Before(e.Expires) {
+		return false
+	}
+	if len(e.Ports) > 0 && !containsPort(e.Ports, port) {
+		return false
+	}
+	if e.CIDR != nil {
+		if ip == nil {
+			ip = net.ParseIP(strings.Trim(host, "[]"))
+		}
+		return ip != nil && e.CIDR.Contains(ip)
+	}
+	return v1.HostMatchesGlob(host, e.Domain)
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func matchingEntry(entries []Entry, host string, ip net.IP, port int, now time.Time) (Entry, bool) {
+	for _, e := range entries {
+		if e.MatchesAddr(host, ip, port, now) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func New(logger *logrus.Logger, loader Loader, disabledActions []string) (*ACL, error) {
+	return NewWithOptions(logger, loader, disabledActions, v1.Options{})
+}
+
+// NewWithOptions is New, with the optional settings of opts.
+func NewWithOptions(logger *logrus.Logger, loader Loader, disabledActions []string, opts v1.Options) (*ACL, error) {
+	acl, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range disabledActions {
+		p, err := v1.PolicyFromAction(a)
+		if err != nil {
+			return nil, err
+		}
+		acl.DisabledPolicies = append(acl.DisabledPolicies, p)
+	}
+
+	acl.Logger = logger
+	acl.PublicSuffixCheck = opts.PublicSuffixCheck
+
+	err = acl.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if acl.DefaultRule == nil {
+		acl.Warn("no default rule set. any services without a rule will be denied.")
+	}
+	return acl, nil
+}
+
+// Decide implements acl/v1's Decider. The port being unknown, entries
+// restricted to ports do not match.
+func (acl *ACL) Decide(service, host string) (v1.Decision, error) {
+	return acl.DecidePort(service, host, 0)
+}
+
+// DecidePort uses the rule configured for the given service to determine if
+//  1. The destination is in the rule's deny list
+//  2. The destination is in the rule's allow list
+//  3. The destination has been globally denied
+//  4. The destination has been globally allowed
+//  5. There is a default rule for the ACL
+func (acl *ACL) DecidePort(service, host string, port int) (v1.Decision, error) {
+	return acl.DecideAddr(service, host, nil, port)
+}
+
+// DecideAddr is DecidePort for a host which resolved to ip. The CIDR entries
+// of the deny lists match ip, so that host names cannot bypass them, while
+// those of the allow lists still only match IP address hosts.
+func (acl *ACL) DecideAddr(service, host string, ip net.IP, port int) (v1.Decision, error) {
+	var d v1.Decision
+
+	rule := acl.Rule(service)
+	if rule == nil {
+		d.Result = v1.Deny
+		d.Reason = "no rule matched"
+		return d, nil
+	}
+
+	d.Project = rule.Project
+	d.Default = rule == acl.DefaultRule
+	now := acl.timeNow()
+
+	if e, ok := matchingEntry(rule.Deny, host, ip, port, now); ok {
+		d.Result, d.Reason = v1.Deny, fmt.Sprintf("host matched denied entry %s in rule", e)
+		return d, nil
+	}
+
+	if _, ok := matchingEntry(rule.Allow, host, nil, port, now); ok {
+		d.Result, d.Reason = v1.Allow, "host matched allowed domain in rule"
+		return d, nil
+	}
+
+	if _, ok := matchingEntry(acl.GlobalDenyList, host, ip, port, now); ok {
+		d.Result, d.Reason = v1.Deny, "host matched rule in global deny list"
+		return d, nil
+	}
+
+	if _, ok := matchingEntry(acl.GlobalAllowList, host, nil, port, now); ok {
+		d.Result, d.Reason = v1.Allow, "host matched rule in global allow list"
+		return d, nil
+	}
+
+	var err error
+	switch rule.Policy {
+	case v1.Report:
+		d.Result, d.Reason = v1.AllowAndReport, "rule has allow and report policy"
+	case v1.Enforce:
+		d.Result, d.Reason = v1.Deny, "rule has enforce policy"
+	case v1.Open:
+		d.Result, d.Reason = v1.Allow, "rule has open enforcement policy"
+	default:
+		d.Result, d.Reason = v1.Deny, "unexpected policy value"
+		err = fmt.Errorf("unexpected policy value for (%s -> %s): %d", service, host, rule.Policy)
+	}
+
+	if d.Default {
+		d.Reason = "default rule policy used"
+	}
+
+	return d, err
+}
+
+func (acl *ACL) timeNow() time.Time {
+	if acl.now != nil {
+		return acl.now()
+	}
+	return time.Now()
+}
+
+// Validate checks the entries of every rule and of the global lists, that
+// no rule uses a disabled policy, and globs on public suffixes as
+// configured by PublicSuffixCheck. Expired entries are logged.
+func (acl *ACL) Validate() error {
+	var services []string
+	for svc := range acl.Rules {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	for _, svc := range services {
+		err := acl.validateRule(svc, acl.Rules[svc])
+		if err != nil {
+			return err
+		}
+	}
+	if acl.DefaultRule != nil {
+		err := acl.validateRule("default", *acl.DefaultRule)
+		if err != nil {
+			return err
+		}
+	}
+	err := acl.validateEntries("global allow list", acl.GlobalAllowList, true)
+	if err != nil {
+		return err
+	}
+	return acl.validateEntries("global deny list", acl.GlobalDenyList, false)
+}
+
+func (acl *ACL) validateRule(svc string, r Rule) error {
+	for _, dp := range acl.DisabledPolicies {
+		if dp == r.Policy {
+			return fmt.Errorf("rule for svc:%v utilizes a disabled policy:%v", svc, r.Policy)
+		}
+	}
+	err := acl.validateEntries(svc, r.Allow, true)
+	if err != nil {
+		return err
+	}
+	return acl.validateEntries(svc, r.Deny, false)
+}
+
+func (acl *ACL) validateEntries(svc string, entries []Entry, allowing bool) error {
+	list := acl.PublicSuffixCheck.List
+	if list == nil {
+		list = v1.DefaultPublicSuffixList()
+	}
+	now := acl.timeNow()
+
+	for _, e := range entries {
+		if (e.Domain == "") == (e.CIDR == nil) {
+			return fmt.Errorf("%v: entry must have exactly one of domain and cidr", svc)
+		}
+		for _, p := range e.Ports {
+			if p < 1 || p > 65535 {
+				return fmt.Errorf("%v: %v: invalid port %d", svc, e, p)
+			}
+		}
+		if e.Domain != "" {
+			err := (&v1.ACL{}).ValidateDomainGlobs(svc, []string{e.Domain})
+			if err != nil {
+				return err
+			}
+			if suffix, ok := list.GlobSuffix(e.Domain); ok && allowing && !e.AllowPublicSuffix {
+				err := fmt.Errorf("%v: %v: domain glob matches every domain under the public suffix %v", svc, e.Domain, suffix)
+				if acl.PublicSuffixCheck.Reject {
+					return err
+				}
+				acl.warn(err)
+			}
+		}
+		if !e.Expires.IsZero() && !now.Before(e.Expires) {
+			acl.warn(fmt.Errorf("%v: %v: entry expired on %s", svc, e, e.Expires.Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+func (acl *ACL) warn(err error) {
+	if acl.Logger != nil {
+		acl.Warn(err)
+	}
+}
+
+// Project returns the configured project for a service
+func (acl *ACL) Project(service string) (string, error) {
+	rule := acl.Rule(service)
+	if rule == nil {
+		return "", fmt.Errorf("no rule for service: %v", service)
+	}
+	return rule.Project, nil
+}
+
+// Rule returns the configured rule for a service, or the default rule if none
+// is configured.
+func (acl *ACL) Rule(service string) *Rule {
+	if service, ok := acl.Rules[service]; ok {
+		return &service
+	}
+	return acl.DefaultRule
+}
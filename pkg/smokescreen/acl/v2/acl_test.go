@@ -0,0 +1,167 @@
+//go:build !nounit
+// +build !nounit
+
+package acl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+var testNow = time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func loadSample(t *testing.T) *ACL {
+	acl, err := New(logrus.New(), NewLoader("testdata/sample_config.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl.now = func() time.Time { return testNow }
+	return acl
+}
+
+func TestDecidePort(t *testing.T) {
+	acl := loadSample(t)
+
+	testCases := []struct {
+		name, service, host string
+		port                int
+		expectDecision      v1.DecisionResult
+		expectReason        string
+	}{
+		{"allowed by domain", "enforce-dummy-srv", "example1.com", 80, v1.Allow, "host matched allowed domain in rule"},
+		{"allowed on port", "enforce-dummy-srv", "api.example2.com", 443, v1.Allow, "host matched allowed domain in rule"},
+		{"denied on other port", "enforce-dummy-srv", "api.example2.com", 80, v1.Deny, "rule has enforce policy"},
+		{"denied on unknown port", "enforce-dummy-srv", "api.example2.com", 0, v1.Deny, "rule has enforce policy"},
+		{"denied by rule", "enforce-dummy-srv", "admin.example2.com", 443, v1.Deny, "host matched denied entry admin.example2.com in rule"},
+		{"allowed by cidr", "enforce-dummy-srv", "10.1.2.3", 5432, v1.Allow, "host matched allowed domain in rule"},
+		{"cidr on other port", "enforce-dummy-srv", "10.1.9.9", 443, v1.Deny, "rule has enforce policy"},
+		{"cidr does not match domains", "enforce-dummy-srv", "10.1.2.3.example.com", 5432, v1.Deny, "rule has enforce policy"},
+		{"allowed before expiry", "enforce-dummy-srv", "temporary.example.com", 443, v1.Allow, "host matched allowed domain in rule"},
+		{"denied by rule when open", "open-dummy-srv", "169.254.169.254", 80, v1.Deny, "host matched denied entry 169.254.0.0/16 in rule"},
+		{"allowed when open", "open-dummy-srv", "example.com", 80, v1.Allow, "rule has open enforcement policy"},
+		{"global deny by cidr", "report-dummy-srv", "10.1.2.3", 5432, v1.Deny, "host matched rule in global deny list"},
+		{"global deny", "report-dummy-srv", "badexample1.com", 443, v1.Deny, "host matched rule in global deny list"},
+		{"global allow", "report-dummy-srv", "goodexample1.com", 443, v1.Allow, "host matched rule in global allow list"},
+		{"reported", "report-dummy-srv", "example.com", 443, v1.AllowAndReport, "rule has allow and report policy"},
+		{"default rule", "unknown-srv", "default.example.com", 443, v1.Allow, "host matched allowed domain in rule"},
+		{"default rule policy", "unknown-srv", "example.com", 443, v1.Deny, "default rule policy used"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+			d, err := acl.DecidePort(tc.service, tc.host, tc.port)
+			a.NoError(err)
+			a.Equal(tc.expectDecision, d.Result)
+			a.Equal(tc.expectReason, d.Reason)
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	a := assert.New(t)
+	acl := loadSample(t)
+
+	rule := acl.Rules["enforce-dummy-srv"]
+	a.Equal("usersec-team", rule.Owner)
+	a.Equal("#usersec", rule.Contact)
+	a.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), rule.Allow[3].Expires)
+	a.Equal("migration off the old API", rule.Allow[3].Justification)
+
+	acl.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+	d, err := acl.DecidePort("enforce-dummy-srv", "temporary.example.com", 443)
+	a.NoError(err)
+	a.Equal(v1.Deny, d.Result)
+	a.Equal("rule has enforce policy", d.Reason)
+}
+
+func TestInvalidEntries(t *testing.T) {
+	testCases := map[string]string{
+		"both domain and cidr": `{domain: example.com, cidr: 10.0.0.0/8}`,
+		"no domain or cidr":    `{ports: [443]}`,
+		"invalid port":         `{domain: example.com, ports: [0]}`,
+		"invalid cidr":         `10.0.0.0/33`,
+		"invalid expiry":       `{domain: example.com, expires: tomorrow}`,
+		"middle glob":          `api.*.example.com`,
+		"unknown action":       ``,
+	}
+
+	for name, entry := range testCases {
+		t.Run(name, func(t *testing.T) {
+			action := "enforce"
+			if entry == "" {
+				action, entry = "allow", "example.com"
+			}
+			dir := t.TempDir()
+			writeFile(t, dir, "acl.yaml", "version: v2\nservices:\n  - name: srv\n    action: "+action+"\n    allow:\n      - "+entry+"\n")
+
+			_, err := New(logrus.New(), NewLoader(dir+"/acl.yaml"), nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPublicSuffixEntries(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "acl.yaml", `version: v2
+services:
+  - name: srv
+    action: enforce
+    allow:
+      - "*.co.uk"
+`)
+
+	_, err := New(logrus.New(), NewLoader(dir+"/acl.yaml"), nil)
+	a.NoError(err)
+	_, err = NewWithOptions(logrus.New(), NewLoader(dir+"/acl.yaml"), nil, v1.Options{PublicSuffixCheck: v1.PublicSuffixCheck{Reject: true}})
+	a.EqualError(err, "srv: *.co.uk: domain glob matches every domain under the public suffix co.uk")
+
+	writeFile(t, dir, "acl.yaml", `version: v2
+services:
+  - name: srv
+    action: enforce
+    allow:
+      - domain: "*.co.uk"
+        allow_public_suffix: true
+`)
+	_, err = NewWithOptions(logrus.New(), NewLoader(dir+"/acl.yaml"), nil, v1.Options{PublicSuffixCheck: v1.PublicSuffixCheck{Reject: true}})
+	a.NoError(err)
+}
+
+func TestDisabledPolicies(t *testing.T) {
+	_, err := New(logrus.New(), NewLoader("testdata/sample_config.yaml"), []string{"open"})
+	assert.EqualError(t, err, "rule for svc:open-dummy-srv utilizes a disabled policy:Open")
+}
+
+func TestDecideAddr(t *testing.T) {
+	acl := loadSample(t)
+
+	testCases := []struct {
+		name, service, host, ip string
+		port                    int
+		expectDecision          v1.DecisionResult
+		expectReason            string
+	}{
+		{"denied by rule cidr", "open-dummy-srv", "metadata.example.com", "169.254.169.254", 80, v1.Deny, "host matched denied entry 169.254.0.0/16 in rule"},
+		{"allowed outside rule cidr", "open-dummy-srv", "example.com", "93.184.216.34", 80, v1.Allow, "rule has open enforcement policy"},
+		{"denied by global cidr", "report-dummy-srv", "db.example.com", "10.1.2.3", 5432, v1.Deny, "host matched rule in global deny list"},
+		{"allow cidr does not match domains", "enforce-dummy-srv", "db.example.com", "10.1.9.9", 5432, v1.Deny, "rule has enforce policy"},
+		{"rule allow before global cidr", "enforce-dummy-srv", "example1.com", "10.1.2.3", 80, v1.Allow, "host matched allowed domain in rule"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := assert.New(t)
+			d, err := acl.DecideAddr(tc.service, tc.host, net.ParseIP(tc.ip), tc.port)
+			a.NoError(err)
+			a.Equal(tc.expectDecision, d.Result)
+			a.Equal(tc.expectReason, d.Reason)
+		})
+	}
+}
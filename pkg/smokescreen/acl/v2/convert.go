@@ -0,0 +1,51 @@
+package acl
+
+import (
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// ConvertV1 converts a v1 configuration to v2. The converted configuration
+// makes the same decisions; its includes are kept as they are, since v1
+// files may be included by v2 files.
+func ConvertV1(cfg *v1.YAMLConfig) *YAMLConfig {
+	out := &YAMLConfig{
+		Version:         "v2",
+		Include:         cfg.Include,
+		GlobalAllowList: convertV1Domains(cfg.GlobalAllowList, cfg.GlobalAllowPublicSuffixList),
+		GlobalDenyList:  convertV1Domains(cfg.GlobalDenyList, nil),
+	}
+	if cfg.Services != nil {
+		out.Services = make([]YAMLRule, 0, len(cfg.Services))
+	}
+	for _, r := range cfg.Services {
+		out.Services = append(out.Services, convertV1Rule(r))
+	}
+	if cfg.Default != nil {
+		r := convertV1Rule(*cfg.Default)
+		out.Default = &r
+	}
+	return out
+}
+
+func convertV1Rule(r v1.YAMLRule) YAMLRule {
+	return YAMLRule{
+		Name:    r.Name,
+		Project: r.Project,
+		Action:  r.Action,
+		Allow:   convertV1Domains(r.AllowedHosts, r.AllowedPublicSuffixHosts),
+	}
+}
+
+func convertV1Domains(globs, publicSuffixGlobs []string) []YAMLEntry {
+	var entries []YAMLEntry
+	for _, g := range globs {
+		e := YAMLEntry{Domain: g}
+		for _, p := range publicSuffixGlobs {
+			if p == g {
+				e.AllowPublicSuffix = true
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,193 @@
+package acl
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/internal/aclfile"
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// Loader is an interface used to return a parsed ACL from an abstract source
+type Loader interface {
+	Load() (*ACL, error)
+}
+
+// LoadOptions are the optional settings of LoadWithOptions.
+type LoadOptions struct {
+	v1.Options
+	// Verifier, if set, checks every file read.
+	Verifier v1.FileVerifier
+}
+
+// Load loads the egress ACL at path, a YAML or JSON (.json) file or a
+// directory of them. ACLs without v2 files are loaded by acl/v1, exactly as
+// before; the others by this package, which converts the v1 files they
+// include.
+func Load(logger *logrus.Logger, path string, disabledActions []string) (v1.Decider, error) {
+	return LoadWithOptions(logger, path, disabledActions, LoadOptions{})
+}
+
+// LoadWithOptions is Load, with the optional settings of opts.
+func LoadWithOptions(logger *logrus.Logger, path string, disabledActions []string, opts LoadOptions) (v1.Decider, error) {
+	if !HasV2Files(path) {
+		acl, err := v1.NewWithOptions(logger, v1.NewVerifiedLoader(path, opts.Verifier), disabledActions, opts.Options)
+		if err != nil {
+			return nil, err
+		}
+		return acl, nil
+	}
+	acl, err := NewWithOptions(logger, NewVerifiedLoader(path, opts.Verifier), disabledActions, opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// HasV2Files reports whether the file at path, a file of the directory at
+// path, or a file they include declares version v2. Such ACLs are loaded by
+// this package rather than acl/v1.
+func HasV2Files(path string) bool {
+	found := false
+	r := aclfile.NewReader(func(path string, data []byte, unmarshal aclfile.Unmarshal, includerVersion string) (string, []string, error) {
+		var h versionHeader
+		err := unmarshal(data, &h)
+		if err != nil {
+			return "", nil, err
+		}
+		version := h.Version
+		if version == "" {
+			version = includerVersion
+		}
+		found = found || version == "v2"
+		return version, h.Include, nil
+	}, nil)
+
+	// Errors are reported when the ACL is loaded.
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		_ = r.ReadDir(path)
+	} else {
+		_ = r.ReadFile(path, aclfile.UnmarshalFor(path), false)
+	}
+	return found
+}
+
+type versionHeader struct {
+	Version string   `yaml:"version" json:"version"`
+	Include []string `yaml:"include" json:"include"`
+}
+
+// NewLoader returns the loader of the ACL at path: a YAML or JSON (.json)
+// file, or a directory of them merged in the order of their names. Files may
+// be v1 or v2, and include other files.
+func NewLoader(path string) Loader {
+	return NewVerifiedLoader(path, nil)
+}
+
+// NewVerifiedLoader is NewLoader, except that every file read must pass
+// verifier unless it is nil. Directories and included patterns are then
+// refused.
+func NewVerifiedLoader(path string, verifier v1.FileVerifier) Loader {
+	return &pathLoader{path: path, verifier: verifier}
+}
+
+type pathLoader struct {
+	path     string
+	verifier v1.FileVerifier
+}
+
+func (pl *pathLoader) Load() (*ACL, error) {
+	fi, err := os.Stat(pl.path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newConfigReader(pl.verifier)
+	if fi.IsDir() {
+		err = r.ReadDir(pl.path)
+	} else {
+		err = r.ReadFile(pl.path, aclfile.UnmarshalFor(pl.path), false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.merged.Load()
+}
+
+// configReader reads configuration files, and the files they include, into
+// one YAMLConfig, converting v1 files. A service or the default rule defined
+// by two files is an error, as is a file which verifier, if set, refuses.
+type configReader struct {
+	*aclfile.Reader
+	merged YAMLConfig
+}
+
+func newConfigReader(verifier v1.FileVerifier) *configReader {
+	r := &configReader{merged: YAMLConfig{Version: "v2"}}
+	r.Reader = aclfile.NewReader(r.decode, verifier)
+	return r
+}
+
+// decode merges a file, of version v1 or v2. Included files may omit the
+// version, inheriting that of the file including them.
+func (r *configReader) decode(path string, data []byte, unmarshal aclfile.Unmarshal, includerVersion string) (string, []string, error) {
+	var h versionHeader
+	err := unmarshal(data, &h)
+	if err != nil {
+		return "", nil, err
+	}
+	version := h.Version
+	if version == "" {
+		version = includerVersion
+	}
+
+	var cfg *YAMLConfig
+	switch version {
+	case "v1":
+		var v1cfg v1.YAMLConfig
+		err = unmarshal(data, &v1cfg)
+		cfg = ConvertV1(&v1cfg)
+	case "v2":
+		cfg = &YAMLConfig{}
+		err = unmarshal(data, cfg)
+	default:
+		return "", nil, fmt.Errorf("expected version \"v1\" or \"v2\" got %#v", h.Version)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = r.merge(path, cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	return version, cfg.Include, nil
+}
+
+func (r *configReader) merge(path string, cfg *YAMLConfig) error {
+	m := &r.merged
+
+	if cfg.Services != nil && m.Services == nil {
+		m.Services = []YAMLRule{}
+	}
+	for _, svc := range cfg.Services {
+		// Services defined twice in the same file are refused by
+		// YAMLConfig.Load.
+		if err := r.DefineService(path, svc.Name); err != nil {
+			return err
+		}
+		m.Services = append(m.Services, svc)
+	}
+
+	if cfg.Default != nil {
+		if err := r.DefineDefault(path); err != nil {
+			return err
+		}
+		m.Default = cfg.Default
+	}
+
+	m.GlobalDenyList = append(m.GlobalDenyList, cfg.GlobalDenyList...)
+	m.GlobalAllowList = append(m.GlobalAllowList, cfg.GlobalAllowList...)
+	return nil
+}
@@ -0,0 +1,181 @@
+//go:build !nounit
+// +build !nounit
+
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func writeFile(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var v1Files = []string{
+	"sample_config.yaml",
+	"sample_config.json",
+	"sample_config_with_global.yaml",
+	"public_suffix.yaml",
+	"include/main.yaml",
+	"dir",
+}
+
+func TestLoadV1(t *testing.T) {
+	for _, f := range v1Files {
+		t.Run(f, func(t *testing.T) {
+			a := assert.New(t)
+			path := filepath.Join("../v1/testdata", f)
+			logger := logrus.New()
+
+			expected, err := v1.New(logger, v1.NewLoader(path), nil)
+			a.NoError(err)
+			d, err := Load(logger, path, nil)
+			a.NoError(err)
+			a.Equal(expected, d)
+		})
+	}
+
+	d, err := Load(logrus.New(), "../v1/testdata/unknown_action.yaml", nil)
+	assert.Error(t, err)
+	assert.Nil(t, d)
+}
+
+func TestLoadV2(t *testing.T) {
+	d, err := Load(logrus.New(), "testdata/sample_config.yaml", nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &ACL{}, d)
+	assert.Implements(t, (*v1.PortDecider)(nil), d)
+}
+
+// Converted v1 ACLs decide like the v1 ACL they are converted from.
+func TestConvertV1(t *testing.T) {
+	services := []string{"enforce-dummy-srv", "report-dummy-srv", "open-dummy-srv", "dummy-glob", "bucket-srv", "uk-srv", "unknown-srv"}
+	hosts := []string{"example1.com", "www.example1.com", "example3.com", "api.example.com", "example.com", "default.example.com",
+		"badexample1.com", "goodexample1.com", "conflictingexample.com", "bucket.s3.amazonaws.com", "www.example.co.uk", "me.github.io"}
+
+	for _, f := range v1Files {
+		t.Run(f, func(t *testing.T) {
+			a := assert.New(t)
+			path := filepath.Join("../v1/testdata", f)
+
+			expected, err := v1.New(logrus.New(), v1.NewLoader(path), nil)
+			a.NoError(err)
+			converted, err := New(logrus.New(), NewLoader(path), nil)
+			a.NoError(err)
+
+			for _, svc := range services {
+				for _, host := range hosts {
+					want, err := expected.Decide(svc, host)
+					a.NoError(err)
+					got, err := converted.DecidePort(svc, host, 443)
+					a.NoError(err)
+					a.Equal(want, got, "%s -> %s", svc, host)
+				}
+			}
+		})
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	a := assert.New(t)
+	data, err := ioutil.ReadFile("testdata/sample_config.yaml")
+	a.NoError(err)
+
+	var cfg YAMLConfig
+	a.NoError(yaml.Unmarshal(data, &cfg))
+	a.Equal(YAMLEntry{Domain: "example1.com"}, cfg.Services[0].Allow[0])
+	a.Equal(YAMLEntry{CIDR: "10.1.2.0/24"}, cfg.GlobalDenyList[1])
+
+	out, err := yaml.Marshal(&cfg)
+	a.NoError(err)
+	var again YAMLConfig
+	a.NoError(yaml.Unmarshal(out, &again))
+	a.Equal(cfg, again)
+}
+
+func TestMixedVersions(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "main.yaml", `version: v2
+include:
+  - legacy.yaml
+  - services/*.yaml
+services:
+  - name: db-srv
+    action: enforce
+    allow:
+      - cidr: 10.0.0.0/8
+        ports: [5432]
+`)
+	writeFile(t, dir, "legacy.yaml", `version: v1
+services:
+  - name: legacy-srv
+    action: enforce
+    allowed_domains:
+      - legacy.example.com
+`)
+	a.NoError(os.Mkdir(filepath.Join(dir, "services"), 0700))
+	// Included files without a version have the version of their includer.
+	writeFile(t, dir, "services/web.yaml", `services:
+  - name: web-srv
+    action: enforce
+    allow:
+      - domain: www.example.com
+        ports: [443]
+`)
+
+	d, err := Load(logrus.New(), filepath.Join(dir, "main.yaml"), nil)
+	a.NoError(err)
+	acl := d.(*ACL)
+	a.Len(acl.Rules, 3)
+
+	for _, tc := range []struct {
+		service, host string
+		port          int
+		expect        v1.DecisionResult
+	}{
+		{"db-srv", "10.2.3.4", 5432, v1.Allow},
+		{"legacy-srv", "legacy.example.com", 8080, v1.Allow},
+		{"web-srv", "www.example.com", 443, v1.Allow},
+		{"web-srv", "www.example.com", 80, v1.Deny},
+	} {
+		dec, err := acl.DecidePort(tc.service, tc.host, tc.port)
+		a.NoError(err)
+		a.Equal(tc.expect, dec.Result, "%s -> %s:%d", tc.service, tc.host, tc.port)
+	}
+
+	// A v2 file in a directory switches the whole directory to v2.
+	dirPath := filepath.Join(dir, "dir")
+	a.NoError(os.Mkdir(dirPath, 0700))
+	writeFile(t, dirPath, "a.yaml", "version: v1\nservices:\n  - name: a-srv\n    action: open\n")
+	writeFile(t, dirPath, "b.json", `{"version": "v2", "services": [{"name": "b-srv", "action": "enforce", "allow": [{"domain": "b.example.com", "ports": [443]}]}]}`)
+	d, err = Load(logrus.New(), dirPath, nil)
+	a.NoError(err)
+	a.IsType(&ACL{}, d)
+	a.Len(d.(*ACL).Rules, 2)
+
+	writeFile(t, dirPath, "c.yaml", "version: v2\nservices:\n  - name: a-srv\n    action: open\n")
+	_, err = Load(logrus.New(), dirPath, nil)
+	a.EqualError(err, filepath.Join(dirPath, "c.yaml")+`: service "a-srv" is already defined in `+filepath.Join(dirPath, "a.yaml"))
+
+	// So does a v2 file included by a v1 file.
+	writeFile(t, dir, "v1_main.yaml", "version: v1\ninclude:\n  - dir/b.json\nservices:\n  - name: v1-srv\n    action: open\n")
+	d, err = Load(logrus.New(), filepath.Join(dir, "v1_main.yaml"), nil)
+	a.NoError(err)
+	a.IsType(&ACL{}, d)
+	a.Len(d.(*ACL).Rules, 2)
+
+	writeFile(t, dir, "bad.yaml", "version: v3\nservices: []\n")
+	_, err = Load(logrus.New(), filepath.Join(dir, "bad.yaml"), nil)
+	a.Error(err)
+}
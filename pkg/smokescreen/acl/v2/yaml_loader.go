@@ -0,0 +1,206 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	v1 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+type YAMLConfig struct {
+	Version  string     `yaml:"version" json:"version"`
+	Include  []string   `yaml:"include,omitempty" json:"include,omitempty"`
+	Services []YAMLRule `yaml:"services" json:"services"`
+	Default  *YAMLRule  `yaml:"default,omitempty" json:"default,omitempty"`
+	// Entries allowed or denied for every service.
+	GlobalAllowList []YAMLEntry `yaml:"global_allow_list,omitempty" json:"global_allow_list,omitempty"`
+	GlobalDenyList  []YAMLEntry `yaml:"global_deny_list,omitempty" json:"global_deny_list,omitempty"`
+}
+
+type YAMLRule struct {
+	Name    string      `yaml:"name,omitempty" json:"name,omitempty"`
+	Project string      `yaml:"project,omitempty" json:"project,omitempty"`
+	Owner   string      `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Contact string      `yaml:"contact,omitempty" json:"contact,omitempty"`
+	Comment string      `yaml:"comment,omitempty" json:"comment,omitempty"`
+	Action  string      `yaml:"action" json:"action"`
+	Allow   []YAMLEntry `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny    []YAMLEntry `yaml:"deny,omitempty" json:"deny,omitempty"`
+}
+
+// YAMLEntry is an allowed or denied destination. An entry with only a
+// domain glob or a CIDR may be written as a string.
+type YAMLEntry struct {
+	Domain string `yaml:"domain,omitempty" json:"domain,omitempty"`
+	CIDR   string `yaml:"cidr,omitempty" json:"cidr,omitempty"`
+	Ports  []int  `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// RFC 3339 time, or date at which the entry expires at midnight UTC.
+	Expires           string `yaml:"expires,omitempty" json:"expires,omitempty"`
+	Justification     string `yaml:"justification,omitempty" json:"justification,omitempty"`
+	AllowPublicSuffix bool   `yaml:"allow_public_suffix,omitempty" json:"allow_public_suffix,omitempty"`
+}
+
+func (e *YAMLEntry) setString(s string) {
+	if strings.Contains(s, "/") {
+		*e = YAMLEntry{CIDR: s}
+	} else {
+		*e = YAMLEntry{Domain: s}
+	}
+}
+
+// short returns the string form of the entry, if it has one.
+func (e YAMLEntry) short() (string, bool) {
+	if len(e.Ports) > 0 || e.Expires != "" || e.Justification != "" || e.AllowPublicSuffix {
+		return "", false
+	}
+	switch {
+	case e.CIDR == "" && !strings.Contains(e.Domain, "/"):
+		return e.Domain, e.Domain != ""
+	case e.Domain == "":
+		return e.CIDR, true
+	}
+	return "", false
+}
+
+func (e *YAMLEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		e.setString(s)
+		return nil
+	}
+	type plain YAMLEntry
+	return unmarshal((*plain)(e))
+}
+
+func (e YAMLEntry) MarshalYAML() (interface{}, error) {
+	if s, ok := e.short(); ok {
+		return s, nil
+	}
+	type plain YAMLEntry
+	return plain(e), nil
+}
+
+func (e *YAMLEntry) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		e.setString(s)
+		return nil
+	}
+	type plain YAMLEntry
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+func (e YAMLEntry) MarshalJSON() ([]byte, error) {
+	if s, ok := e.short(); ok {
+		return json.Marshal(s)
+	}
+	type plain YAMLEntry
+	return json.Marshal(plain(e))
+}
+
+func (cfg *YAMLConfig) Load() (*ACL, error) {
+	acl := ACL{
+		Rules: make(map[string]Rule),
+	}
+
+	if cfg.Services == nil {
+		return nil, errors.New("Top level list 'services' is missing")
+	}
+
+	for _, v := range cfg.Services {
+		r, err := v.rule()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", v.Name, err)
+		}
+		if _, ok := acl.Rules[v.Name]; ok {
+			return nil, fmt.Errorf("rule already exists for service %v", v.Name)
+		}
+		acl.Rules[v.Name] = r
+	}
+
+	if cfg.Default != nil {
+		r, err := cfg.Default.rule()
+		if err != nil {
+			return nil, fmt.Errorf("default: %v", err)
+		}
+		acl.DefaultRule = &r
+	}
+
+	var err error
+	acl.GlobalAllowList, err = entries(cfg.GlobalAllowList)
+	if err != nil {
+		return nil, fmt.Errorf("global allow list: %v", err)
+	}
+	acl.GlobalDenyList, err = entries(cfg.GlobalDenyList)
+	if err != nil {
+		return nil, fmt.Errorf("global deny list: %v", err)
+	}
+
+	return &acl, nil
+}
+
+func (yr *YAMLRule) rule() (Rule, error) {
+	p, err := v1.PolicyFromAction(yr.Action)
+	if err != nil {
+		return Rule{}, err
+	}
+	r := Rule{
+		Project: yr.Project,
+		Owner:   yr.Owner,
+		Contact: yr.Contact,
+		Comment: yr.Comment,
+		Policy:  p,
+	}
+	r.Allow, err = entries(yr.Allow)
+	if err != nil {
+		return Rule{}, err
+	}
+	r.Deny, err = entries(yr.Deny)
+	if err != nil {
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+func entries(yes []YAMLEntry) ([]Entry, error) {
+	es := make([]Entry, 0, len(yes))
+	for _, ye := range yes {
+		e := Entry{
+			Domain:            ye.Domain,
+			Ports:             ye.Ports,
+			Justification:     ye.Justification,
+			AllowPublicSuffix: ye.AllowPublicSuffix,
+		}
+		if ye.CIDR != "" {
+			_, cidr, err := net.ParseCIDR(ye.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			e.CIDR = cidr
+		}
+		if ye.Expires != "" {
+			expires, err := parseExpires(ye.Expires)
+			if err != nil {
+				return nil, err
+			}
+			e.Expires = expires
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q: expected an RFC 3339 time or a date", s)
+	}
+	return t, nil
+}
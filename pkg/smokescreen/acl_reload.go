@@ -0,0 +1,238 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+const LogFieldRevokedByACLChange = "revoked_by_acl_change"
+
+// How tracked connections which a new egress ACL denies are handled.
+const (
+	// Close the connections once AclRevocationGracePeriod has elapsed.
+	AclRevocationClose = "close"
+	// Only log and count the connections, and flag their close log line.
+	AclRevocationFlag = "flag"
+)
+
+const closeReasonACLChange = "acl_change"
+
+// SetAclRevocation configures how tracked connections which are denied by a
+// new egress ACL are handled: action is AclRevocationClose or
+// AclRevocationFlag, and grace is how long closed connections may live on.
+func (config *Config) SetAclRevocation(action string, grace time.Duration) error {
+	switch action {
+	case "":
+		action = AclRevocationClose
+	case AclRevocationClose, AclRevocationFlag:
+	default:
+		return fmt.Errorf("invalid ACL revocation action %q: must be %q or %q", action, AclRevocationClose, AclRevocationFlag)
+	}
+	if grace < 0 {
+		return fmt.Errorf("invalid ACL revocation grace period %v", grace)
+	}
+	config.AclRevocationAction = action
+	config.AclRevocationGracePeriod = grace
+	return nil
+}
+
+// ReplaceEgressACL replaces the proxy-wide egress ACL and re-evaluates the
+// tracked connections against it.
+func (config *Config) ReplaceEgressACL(egressACL acl.Decider) {
+	config.egressACLMu.Lock()
+	config.EgressACL = egressACL
+	config.egressACLMu.Unlock()
+
+	config.revokeConns()
+}
+
+// ReloadEgressAcls reloads the egress ACLs of the proxy and of its listeners
+// from their files, then re-evaluates the tracked connections. If any ACL
+// fails to load, none is replaced. With an EgressAclSource, the proxy's ACL
+// is fetched first.
+func (config *Config) ReloadEgressAcls() error {
+	if config.EgressAclSource != nil {
+		if _, err := config.fetchEgressAcl(); err != nil {
+			config.Log.Errorf("failed to fetch the egress ACL, reloading the cached one: %v", err)
+		}
+	}
+	return config.reloadAndRevoke()
+}
+
+func (config *Config) reloadAndRevoke() error {
+	err := config.reloadEgressAcls()
+	config.MetricsClient.IncrWithTags("acl.reload", []string{fmt.Sprintf("success:%t", err == nil)}, 1)
+	if err != nil {
+		return err
+	}
+	config.revokeConns()
+	return nil
+}
+
+func (config *Config) reloadEgressAcls() error {
+	var egressACL acl.Decider
+	if config.EgressAclFile != "" {
+		var err error
+		if egressACL, err = config.loadEgressAcl(config.EgressAclFile); err != nil {
+			return err
+		}
+	}
+
+	listenerACLs := make(map[*ListenerConfig]acl.Decider)
+	for _, lc := range config.Listeners {
+		if lc.EgressAclFile == "" {
+			continue
+		}
+		lcACL, err := config.loadEgressAcl(lc.EgressAclFile)
+		if err != nil {
+			return fmt.Errorf("listener %q: %v", lc.Name, err)
+		}
+		listenerACLs[lc] = lcACL
+	}
+
+	config.egressACLMu.Lock()
+	defer config.egressACLMu.Unlock()
+	if egressACL != nil {
+		config.EgressACL = egressACL
+	}
+	for lc, lcACL := range listenerACLs {
+		lc.EgressACL = lcACL
+	}
+	return nil
+}
+
+// aclLoadOptions returns how egress ACLs treat globs on public suffixes, and
+// how their files are verified.
+func (config *Config) aclLoadOptions() aclv2.LoadOptions {
+	return aclv2.LoadOptions{
+		Options: acl.Options{
+			PublicSuffixCheck: acl.PublicSuffixCheck{
+				List:   config.PublicSuffixList,
+				Reject: config.RejectPublicSuffixGlobs,
+			},
+		},
+		Verifier: config.AclVerifier,
+	}
+}
+
+func (config *Config) loadEgressAcl(aclFile string) (acl.Decider, error) {
+	config.Log.Printf("Loading egress ACL from %s", aclFile)
+	return aclv2.LoadWithOptions(config.Log, aclFile, config.DisabledAclPolicyActions, config.aclLoadOptions())
+}
+
+// decideACL decides whether role may connect to host and port, which ACLs
+// supporting ports (such as v2 ACLs) take into account.
+func decideACL(egressACL acl.Decider, role, host string, port int) (acl.Decision, error) {
+	if pd, ok := egressACL.(acl.PortDecider); ok {
+		return pd.DecidePort(role, host, port)
+	}
+	return egressACL.Decide(role, host)
+}
+
+// checkResolvedAddr denies the allowed decision d for host if the ACL denies
+// the address host resolved to, as v2 ACLs do for addresses in the CIDRs of
+// their deny lists. It reports whether it denied d.
+func checkResolvedAddr(egressACL acl.Decider, d *aclDecision, host string) bool {
+	ad, ok := egressACL.(acl.AddrDecider)
+	if !ok || !d.allow || d.resolvedAddr == nil || net.ParseIP(host) != nil {
+		return false
+	}
+	aclDecision, err := ad.DecideAddr(d.role, host, d.resolvedAddr.IP, d.resolvedAddr.Port)
+	if err != nil || aclDecision.Result != acl.Deny {
+		return false
+	}
+	d.allow = false
+	d.enforceWouldDeny = true
+	d.reason = aclDecision.Reason
+	return true
+}
+
+// revokeConns closes or flags the tracked connections which the current
+// egress ACLs deny.
+func (config *Config) revokeConns() {
+	if config.ConnTracker == nil {
+		return
+	}
+
+	config.ConnTracker.Range(func(k, v interface{}) bool {
+		ic := k.(*conntrack.InstrumentedConn)
+		revoked, reason := config.revokedByACL(ic)
+		if !revoked {
+			return true
+		}
+
+		config.MetricsClient.IncrWithTags("cn.acl_revoked", []string{
+			fmt.Sprintf("role:%s", ic.Role),
+			fmt.Sprintf("action:%s", config.AclRevocationAction),
+		}, 1)
+		logger := config.Log.WithFields(logrus.Fields{
+			LogFieldID:             ic.ID,
+			LogFieldRole:           ic.Role,
+			LogFieldRequestedHost:  ic.OutboundHost,
+			LogFieldDecisionReason: reason,
+		})
+
+		if config.AclRevocationAction == AclRevocationFlag {
+			ic.AddLogFields(logrus.Fields{LogFieldRevokedByACLChange: true})
+			logger.Warn("tracked connection is denied by the new egress ACL")
+			return true
+		}
+
+		logger.Warnf("closing tracked connection denied by the new egress ACL in %v", config.AclRevocationGracePeriod)
+		if config.AclRevocationGracePeriod == 0 {
+			ic.ForceClose(closeReasonACLChange, logrus.Fields{LogFieldRevokedByACLChange: true})
+			return true
+		}
+		time.AfterFunc(config.AclRevocationGracePeriod, func() {
+			// The ACL may have changed again during the grace period.
+			if revoked, _ := config.revokedByACL(ic); revoked {
+				ic.ForceClose(closeReasonACLChange, logrus.Fields{LogFieldRevokedByACLChange: true})
+			}
+		})
+		return true
+	})
+}
+
+// revokedByACL reports whether the egress ACL which applies to ic denies it
+// now, and why.
+func (config *Config) revokedByACL(ic *conntrack.InstrumentedConn) (bool, string) {
+	var lc *ListenerConfig
+	for _, l := range config.Listeners {
+		if l.Name == ic.Listener {
+			lc = l
+		}
+	}
+	egressACL := egressACLForListener(config, lc)
+	if egressACL == nil {
+		return false, ""
+	}
+
+	host, portStr, err := net.SplitHostPort(ic.OutboundHost)
+	if err != nil {
+		return false, ""
+	}
+	port, _ := strconv.Atoi(portStr)
+	decision, err := decideACL(egressACL, ic.Role, host, port)
+	if err != nil {
+		return false, ""
+	}
+
+	// Tunnels to host names are also checked against the address they
+	// connected to.
+	ad, ok := egressACL.(acl.AddrDecider)
+	addr, isTCP := ic.RemoteAddr().(*net.TCPAddr)
+	if decision.Result != acl.Deny && ok && isTCP && net.ParseIP(host) == nil {
+		decision, err = ad.DecideAddr(ic.Role, host, addr.IP, port)
+		if err != nil {
+			return false, ""
+		}
+	}
+	return decision.Result == acl.Deny, decision.Reason
+}
@@ -0,0 +1,272 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+const (
+	reloadAllowACL = `
+version: v1
+services:
+  - name: reload-srv
+    project: security
+    action: enforce
+    allowed_domains:
+      - 127.0.0.1
+`
+	reloadDenyACL = `
+version: v1
+services:
+  - name: reload-srv
+    project: security
+    action: enforce
+    allowed_domains:
+      - example.com
+`
+)
+
+func reloadTestConfig(t *testing.T, action string, grace time.Duration) (*Config, string) {
+	r := require.New(t)
+
+	aclFile := filepath.Join(t.TempDir(), "acl.yaml")
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadAllowACL), 0600))
+
+	cfg, err := testConfig("reload-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetupEgressAcl(aclFile))
+	r.NoError(cfg.SetAclRevocation(action, grace))
+	return cfg, aclFile
+}
+
+// openTunnel opens a CONNECT tunnel to an echo server and waits for it to be
+// established.
+func openTunnel(t *testing.T, proxyURL, target string) net.Conn {
+	conn, resp := connectTunnel(t, proxyURL, target)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Write([]byte("ping"))
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	return conn
+}
+
+// tunnelClosed reports whether the proxy closed the tunnel within wait.
+func tunnelClosed(conn net.Conn, wait time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	_, err := conn.Read(make([]byte, 1))
+	return err != nil && !isTimeout(err)
+}
+
+func TestAclRevocationClose(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	cfg, aclFile := reloadTestConfig(t, AclRevocationClose, 0)
+	logHook := proxyLogHook(cfg)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	// A reload which still allows the tunnel leaves it open.
+	r.NoError(cfg.ReloadEgressAcls())
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+
+	// A reload which fails keeps the current ACL.
+	r.NoError(ioutil.WriteFile(aclFile, []byte("services: ["), 0600))
+	r.Error(cfg.ReloadEgressAcls())
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadDenyACL), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+
+	entry := findCanonicalProxyClose(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Equal(true, entry.Data[LogFieldRevokedByACLChange])
+	r.Equal(closeReasonACLChange, entry.Data[conntrack.LogFieldCloseReason])
+
+	// New tunnels are denied by the new ACL.
+	resp, err := proxyClientGet(proxy.URL, "http://"+echo.Addr().String())
+	r.NoError(err)
+	r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+}
+
+func proxyClientGet(proxyURL, target string) (*http.Response, error) {
+	client, err := proxyClient(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestAclRevocationGracePeriod(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	cfg, _ := reloadTestConfig(t, AclRevocationClose, 300*time.Millisecond)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	egressACL, err := cfg.loadEgressAcl(writeACL(t, reloadDenyACL))
+	r.NoError(err)
+	cfg.ReplaceEgressACL(egressACL)
+
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+}
+
+func TestAclRevocationGracePeriodRestored(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	cfg, aclFile := reloadTestConfig(t, AclRevocationClose, 200*time.Millisecond)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadDenyACL), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadAllowACL), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+
+	// The tunnel is allowed again by the time the grace period ends.
+	r.False(tunnelClosed(tunnel, 500*time.Millisecond))
+}
+
+func TestAclRevocationFlag(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	cfg, aclFile := reloadTestConfig(t, AclRevocationFlag, 0)
+	logHook := proxyLogHook(cfg)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadDenyACL), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+
+	tunnel.Close()
+	r.Eventually(func() bool {
+		return findCanonicalProxyClose(logHook.AllEntries()) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	entry := findCanonicalProxyClose(logHook.AllEntries())
+	r.Equal(true, entry.Data[LogFieldRevokedByACLChange])
+	r.Nil(entry.Data[conntrack.LogFieldCloseReason])
+}
+
+func TestSetAclRevocation(t *testing.T) {
+	r := require.New(t)
+
+	cfg := NewConfig()
+	r.Equal(AclRevocationClose, cfg.AclRevocationAction)
+	r.Error(cfg.SetAclRevocation("drop", 0))
+	r.Error(cfg.SetAclRevocation(AclRevocationFlag, -time.Second))
+	r.NoError(cfg.SetAclRevocation("", time.Minute))
+	r.Equal(AclRevocationClose, cfg.AclRevocationAction)
+	r.Equal(time.Minute, cfg.AclRevocationGracePeriod)
+}
+
+func writeACL(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// v2 ACLs restricting ports are decided on the port of the request, and of
+// tracked connections when reloaded.
+func TestAclRevocationV2Ports(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	r.NoError(err)
+	portACL := func(port string) string {
+		return `
+version: v2
+services:
+  - name: reload-srv
+    project: security
+    action: enforce
+    allow:
+      - cidr: 127.0.0.0/8
+        ports: [` + port + `]
+`
+	}
+
+	cfg, aclFile := reloadTestConfig(t, AclRevocationClose, 0)
+	r.NoError(ioutil.WriteFile(aclFile, []byte(portACL(port)), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	r.NoError(ioutil.WriteFile(aclFile, []byte(portACL("1")), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+}
+
+func TestAclDenyCidrHostNames(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	r.NoError(err)
+	target := net.JoinHostPort("localhost", port)
+	cidrACL := func(denied string) string {
+		return `
+version: v2
+services:
+  - name: reload-srv
+    project: security
+    action: open
+global_deny_list:
+  - cidr: ` + denied + `
+`
+	}
+
+	cfg, aclFile := reloadTestConfig(t, AclRevocationClose, 0)
+	r.NoError(ioutil.WriteFile(aclFile, []byte(cidrACL("10.0.0.0/8")), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, target)
+
+	// The host name resolves to an address in the new deny CIDR.
+	r.NoError(ioutil.WriteFile(aclFile, []byte(cidrACL("127.0.0.0/8")), 0600))
+	r.NoError(cfg.ReloadEgressAcls())
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+
+	logHook := proxyLogHook(cfg)
+	_, resp := connectTunnel(t, proxy.URL, target)
+	r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	entry := findCanonicalProxyDecision(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Equal(false, entry.Data["allow"])
+	r.Equal("host matched rule in global deny list", entry.Data["decision_reason"])
+}
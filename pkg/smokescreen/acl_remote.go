@@ -0,0 +1,127 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/remote"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/signature"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
+)
+
+// Outcomes of egress ACL fetches, in the status tag of acl.remote.fetch.
+const (
+	aclFetchUpdated     = "updated"
+	aclFetchNotModified = "not_modified"
+	aclFetchError       = "error"
+)
+
+// Defaults of the acl_source configuration section.
+const (
+	defaultAclPollInterval = time.Minute
+	defaultAclFetchTimeout = 30 * time.Second
+)
+
+// SetupRemoteEgressAcl fetches the proxy's egress ACL from src, and once the
+// proxy is started, every pollInterval unless it is zero. The ACL is loaded
+// from src's cache file, which holds the last ACL fetched and loaded
+// successfully: when the URL is unavailable or serves an invalid ACL, the
+// cached one is used, and setting up fails only if there is none.
+func (config *Config) SetupRemoteEgressAcl(src *remote.Source, pollInterval time.Duration) error {
+	config.EgressAclSource = src
+	config.EgressAclPollInterval = pollInterval
+
+	if _, err := config.fetchEgressAcl(); err != nil {
+		if _, statErr := os.Stat(src.CacheFile); statErr != nil {
+			return err
+		}
+		config.Log.Warnf("failed to fetch the egress ACL, using the cached one from %s: %v", src.CacheFile, err)
+	}
+	return config.SetupEgressAcl(src.CacheFile)
+}
+
+// fetchEgressAcl fetches the egress ACL from EgressAclSource, accepting it
+// only if it loads, and reports whether the cached ACL changed.
+func (config *Config) fetchEgressAcl() (bool, error) {
+	changed, err := config.EgressAclSource.Fetch(func(path string) error {
+		_, err := aclv2.LoadWithOptions(config.Log, path, config.DisabledAclPolicyActions, config.aclLoadOptions())
+		return err
+	})
+
+	status, stale := aclFetchNotModified, 0.0
+	switch {
+	case err != nil:
+		status, stale = aclFetchError, 1
+	case changed:
+		status = aclFetchUpdated
+	}
+	config.MetricsClient.IncrWithTags("acl.remote.fetch", []string{"status:" + status}, 1)
+	config.MetricsClient.Gauge("acl.remote.stale", stale, 1)
+	return changed, err
+}
+
+// pollEgressAcl fetches the egress ACL every EgressAclPollInterval, and
+// reloads the ACLs when it changes, until quit is closed.
+func (config *Config) pollEgressAcl(quit <-chan interface{}) {
+	ticker := time.NewTicker(config.EgressAclPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := config.fetchEgressAcl()
+		if err != nil {
+			config.Log.Errorf("failed to fetch the egress ACL, keeping the current one: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		config.Log.Print("egress ACL changed, reloading egress ACLs")
+		if err := config.reloadAndRevoke(); err != nil {
+			config.Log.Errorf("failed to reload egress ACLs, keeping the current ones: %v", err)
+		}
+	}
+}
+
+func (config *Config) setupAclSource(ys *yamlConfigAclSource) error {
+	if ys.URL == "" || ys.CacheFile == "" {
+		return errors.New("both 'url' and 'cache_file' are required")
+	}
+	if ys.PollInterval < 0 || ys.Timeout < 0 {
+		return errors.New("'poll_interval' and 'timeout' must not be negative")
+	}
+
+	var tlsConfig *tls.Config
+	if ys.Tls != nil {
+		var err error
+		tlsConfig, err = remote.ClientTLSConfig(ys.Tls.CertFile, ys.Tls.KeyFile, ys.Tls.CAFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	pollInterval := ys.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultAclPollInterval
+	}
+	timeout := ys.Timeout
+	if timeout == 0 {
+		timeout = defaultAclFetchTimeout
+	}
+	src := remote.NewSource(ys.URL, ys.CacheFile, tlsConfig, timeout)
+	// Signed ACLs are served with their signature.
+	if config.AclVerifier != nil {
+		src.SignatureURL = ys.SignatureURL
+		if src.SignatureURL == "" {
+			src.SignatureURL = ys.URL + signature.Suffix
+		}
+	}
+	return config.SetupRemoteEgressAcl(src, pollInterval)
+}
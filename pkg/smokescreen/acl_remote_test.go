@@ -0,0 +1,141 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/remote"
+)
+
+// remoteACL serves an egress ACL with an ETag which changes with it.
+type remoteACL struct {
+	mu      sync.Mutex
+	acl     string
+	version int
+	down    bool
+}
+
+func (s *remoteACL) set(acl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acl = acl
+	s.version++
+}
+
+func (s *remoteACL) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *remoteACL) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	etag := `"` + string(rune('a'+s.version)) + `"`
+	rw.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Write([]byte(s.acl))
+}
+
+func remoteTestConfig(t *testing.T, server *httptest.Server, cacheFile string) (*Config, error) {
+	cfg, err := testConfig("reload-srv")
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	return cfg, cfg.SetupRemoteEgressAcl(remote.NewSource(server.URL, cacheFile, nil, time.Second), 0)
+}
+
+func TestRemoteEgressAcl(t *testing.T) {
+	r := require.New(t)
+
+	source := &remoteACL{acl: reloadAllowACL}
+	server := httptest.NewServer(source)
+	defer server.Close()
+	cacheFile := filepath.Join(t.TempDir(), "acl.yaml")
+
+	cfg, err := remoteTestConfig(t, server, cacheFile)
+	r.NoError(err)
+	r.Equal(cacheFile, cfg.EgressAclFile)
+
+	echo := echoServer(t)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	// Invalid ACLs are not cached, and the current ACL is kept.
+	source.set("version: v1\nservices: [")
+	r.NoError(cfg.ReloadEgressAcls())
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+	r.True(cfg.EgressAclSource.Status().Stale())
+
+	// Polling picks up new ACLs and reloads them.
+	quit := make(chan interface{})
+	defer close(quit)
+	cfg.EgressAclPollInterval = 10 * time.Millisecond
+	go cfg.pollEgressAcl(quit)
+
+	source.set(reloadDenyACL)
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+	r.False(cfg.EgressAclSource.Status().Stale())
+}
+
+func TestRemoteEgressAclUnavailable(t *testing.T) {
+	r := require.New(t)
+
+	source := &remoteACL{acl: reloadAllowACL, down: true}
+	server := httptest.NewServer(source)
+	defer server.Close()
+	cacheFile := filepath.Join(t.TempDir(), "acl.yaml")
+
+	// Without a last-known-good ACL, the proxy cannot start.
+	_, err := remoteTestConfig(t, server, cacheFile)
+	r.Error(err)
+
+	source.setDown(false)
+	_, err = remoteTestConfig(t, server, cacheFile)
+	r.NoError(err)
+
+	// With one, it starts on it.
+	source.setDown(true)
+	cfg, err := remoteTestConfig(t, server, cacheFile)
+	r.NoError(err)
+	r.NotNil(cfg.EgressACL)
+	r.True(cfg.EgressAclSource.Status().Stale())
+}
+
+func TestRemoteEgressAclConfig(t *testing.T) {
+	r := require.New(t)
+
+	server := httptest.NewServer(&remoteACL{acl: reloadAllowACL})
+	defer server.Close()
+	cacheFile := filepath.Join(t.TempDir(), "acl.yaml")
+
+	conf, err := LoadConfig(writeConfig(t, "acl_source:\n  url: "+server.URL+"\n  cache_file: "+cacheFile+"\n"))
+	r.NoError(err)
+	r.NotNil(conf.EgressACL)
+	r.Equal(time.Minute, conf.EgressAclPollInterval)
+
+	for _, config := range []string{
+		"acl_source:\n  url: " + server.URL + "\n",
+		"acl_file: testdata/acl.yaml\nacl_source:\n  url: " + server.URL + "\n  cache_file: " + cacheFile + "\n",
+		"acl_source:\n  url: " + server.URL + "\n  cache_file: " + cacheFile + "\n  tls:\n    cert_file: /nonexistent.pem\n",
+	} {
+		_, err = LoadConfig(writeConfig(t, config))
+		r.Error(err)
+		r.Contains(err.Error(), "acl_source: ")
+	}
+}
@@ -0,0 +1,172 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/remote"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/signature"
+)
+
+// signingKey returns a new Ed25519 key, and the file of its public key.
+func signingKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "release.pub")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(pub)), 0600))
+	return priv, keyFile
+}
+
+func writeSignedACL(t *testing.T, path, content string, key ed25519.PrivateKey) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	require.NoError(t, ioutil.WriteFile(path+signature.Suffix, signature.Sign(key, []byte(content)), 0600))
+}
+
+func TestSignedEgressAcl(t *testing.T) {
+	r := require.New(t)
+
+	key, keyFile := signingKey(t)
+	aclFile := filepath.Join(t.TempDir(), "acl.yaml")
+	writeSignedACL(t, aclFile, reloadAllowACL, key)
+
+	cfg, err := testConfig("reload-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetupAclSignatures([]string{keyFile}, nil))
+	logHook := proxyLogHook(cfg)
+	r.NoError(cfg.SetupEgressAcl(aclFile))
+	r.NoError(cfg.SetAclRevocation(AclRevocationClose, 0))
+
+	var verified bool
+	for _, entry := range logHook.AllEntries() {
+		if entry.Message == "verified egress ACL signature" {
+			verified = true
+			r.Equal(aclFile, entry.Data[signature.LogFieldFile])
+			r.Contains(entry.Data[signature.LogFieldSigner], "release.pub")
+		}
+	}
+	r.True(verified)
+
+	echo := echoServer(t)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+
+	// Tampered and unsigned ACLs are refused, and the current ACL is kept.
+	r.NoError(ioutil.WriteFile(aclFile, []byte(reloadDenyACL), 0600))
+	r.Error(cfg.ReloadEgressAcls())
+	r.NoError(ioutil.WriteFile(aclFile+signature.Suffix, nil, 0600))
+	r.Error(cfg.ReloadEgressAcls())
+	r.False(tunnelClosed(tunnel, 100*time.Millisecond))
+
+	writeSignedACL(t, aclFile, reloadDenyACL, key)
+	r.NoError(cfg.ReloadEgressAcls())
+	r.True(tunnelClosed(tunnel, 5*time.Second))
+
+	unsigned := writeACL(t, reloadAllowACL)
+	err = cfg.SetupEgressAcl(unsigned)
+	r.Error(err)
+	r.Contains(err.Error(), signature.ErrUnsigned.Error())
+}
+
+// Signatures do not cover which files a directory holds or a pattern
+// matches, so signed ACLs may only include files by name.
+func TestSignedEgressAclFileSets(t *testing.T) {
+	r := require.New(t)
+
+	key, keyFile := signingKey(t)
+	cfg, err := testConfig("reload-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetupAclSignatures([]string{keyFile}, nil))
+
+	dir := t.TempDir()
+	writeSignedACL(t, filepath.Join(dir, "a.yaml"), reloadAllowACL, key)
+	other := filepath.Join(dir, "b.yaml")
+	writeSignedACL(t, other, "version: v1\nservices:\n  - name: other-srv\n    action: open\n", key)
+	err = cfg.SetupEgressAcl(dir)
+	r.Error(err)
+	r.Contains(err.Error(), "signed ACLs cannot be directories")
+
+	// Deleting a signed file from the directory is refused as well.
+	r.NoError(os.Remove(other))
+	r.NoError(os.Remove(other + signature.Suffix))
+	err = cfg.SetupEgressAcl(dir)
+	r.Error(err)
+	r.Contains(err.Error(), "signed ACLs cannot be directories")
+
+	mainFile := filepath.Join(t.TempDir(), "main.yaml")
+	writeSignedACL(t, mainFile, "version: v1\ninclude:\n  - "+filepath.Join(dir, "*.yaml")+"\n", key)
+	err = cfg.SetupEgressAcl(mainFile)
+	r.Error(err)
+	r.Contains(err.Error(), "signed ACLs cannot include patterns")
+
+	// Files included by name are covered by the signature of their includer.
+	included := filepath.Join(dir, "a.yaml")
+	writeSignedACL(t, mainFile, "version: v1\ninclude:\n  - "+included+"\n", key)
+	r.NoError(cfg.SetupEgressAcl(mainFile))
+	r.NoError(os.Remove(included))
+	r.Error(cfg.ReloadEgressAcls())
+}
+
+func TestSignedRemoteEgressAcl(t *testing.T) {
+	r := require.New(t)
+
+	key, keyFile := signingKey(t)
+	source := &remoteACL{acl: reloadAllowACL}
+	sig := signature.Sign(key, []byte(reloadAllowACL))
+	mux := http.NewServeMux()
+	mux.Handle("/acl.yaml", source)
+	mux.HandleFunc("/acl.yaml.sig", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(sig)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cacheFile := filepath.Join(t.TempDir(), "acl.yaml")
+
+	cfg, err := testConfig("reload-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetupAclSignatures([]string{keyFile}, nil))
+	src := remote.NewSource(server.URL+"/acl.yaml", cacheFile, nil, time.Second)
+	src.SignatureURL = server.URL + "/acl.yaml.sig"
+	r.NoError(cfg.SetupRemoteEgressAcl(src, 0))
+	r.FileExists(cacheFile + signature.Suffix)
+
+	// A new ACL served with a stale signature is not cached.
+	source.set(reloadDenyACL)
+	r.NoError(cfg.ReloadEgressAcls())
+	r.True(src.Status().Stale())
+	cached, err := ioutil.ReadFile(cacheFile)
+	r.NoError(err)
+	r.Equal(reloadAllowACL, string(cached))
+}
+
+func TestAclSignatureConfig(t *testing.T) {
+	r := require.New(t)
+
+	key, keyFile := signingKey(t)
+	aclFile := filepath.Join(t.TempDir(), "acl.yaml")
+	writeSignedACL(t, aclFile, reloadAllowACL, key)
+
+	conf, err := LoadConfig(writeConfig(t, "acl_file: "+aclFile+"\nacl_signature:\n  public_key_files: ["+keyFile+"]\n"))
+	r.NoError(err)
+	r.NotNil(conf.AclVerifier)
+	r.NotNil(conf.EgressACL)
+
+	_, err = LoadConfig(writeConfig(t, "acl_file: testdata/acl.yaml\nacl_signature:\n  public_key_files: ["+keyFile+"]\n"))
+	r.Error(err)
+
+	_, err = LoadConfig(writeConfig(t, "acl_signature: {}\n"))
+	r.Error(err)
+}
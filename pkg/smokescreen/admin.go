@@ -0,0 +1,298 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// Close reason of connections closed through the admin API.
+const closeReasonAdmin = "admin"
+
+// LogFieldAdminClient identifies the admin API client which closed a
+// connection.
+const LogFieldAdminClient = "admin_client"
+
+// The admin API is served on the stats socket and, when AdminAddr is set, on
+// a TCP listener requiring client certificates. It lists, inspects and closes
+// tracked connections:
+//
+//	GET  /connections                 list connections matching the filters
+//	GET  /connections/{id}            inspect a connection
+//	POST /connections/{id}/close      close a connection
+//	POST /connections/close           close the connections matching the filters
+//	POST /acl/reload                  reload the egress ACLs from their files
+//
+// The filters are the query parameters role, host (a hostname or host:port),
+// min_age, max_age, min_idle and max_idle (durations such as 90s or 1h).
+type connFilter struct {
+	role             string
+	host             string
+	minAge, maxAge   time.Duration
+	minIdle, maxIdle time.Duration
+}
+
+func parseConnFilter(q url.Values) (connFilter, error) {
+	f := connFilter{
+		role: q.Get("role"),
+		host: q.Get("host"),
+	}
+
+	durations := map[string]*time.Duration{
+		"min_age":  &f.minAge,
+		"max_age":  &f.maxAge,
+		"min_idle": &f.minIdle,
+		"max_idle": &f.maxIdle,
+	}
+	for name, d := range durations {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d, err = time.ParseDuration(v); err != nil {
+			return f, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return f, nil
+}
+
+func (f connFilter) matches(ic *conntrack.InstrumentedConn, now time.Time) bool {
+	if f.role != "" && ic.Role != f.role {
+		return false
+	}
+	if f.host != "" && ic.OutboundHost != f.host {
+		host, _, err := net.SplitHostPort(ic.OutboundHost)
+		if err != nil || !strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(f.host, ".")) {
+			return false
+		}
+	}
+
+	age := now.Sub(ic.Start)
+	if age < f.minAge || (f.maxAge != 0 && age > f.maxAge) {
+		return false
+	}
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(ic.LastActivity)))
+	if idle < f.minIdle || (f.maxIdle != 0 && idle > f.maxIdle) {
+		return false
+	}
+	return true
+}
+
+// findConns returns the tracked connections matching f.
+func findConns(config *Config, f connFilter) []*conntrack.InstrumentedConn {
+	now := time.Now()
+	var conns []*conntrack.InstrumentedConn
+	config.ConnTracker.Range(func(k, v interface{}) bool {
+		ic := k.(*conntrack.InstrumentedConn)
+		if f.matches(ic, now) {
+			conns = append(conns, ic)
+		}
+		return true
+	})
+	return conns
+}
+
+func findConn(config *Config, id string) *conntrack.InstrumentedConn {
+	var found *conntrack.InstrumentedConn
+	config.ConnTracker.Range(func(k, v interface{}) bool {
+		ic := k.(*conntrack.InstrumentedConn)
+		if ic.ID == id {
+			found = ic
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func (s *StatsServer) connections(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/connections"), "/")
+	parts := strings.Split(path, "/")
+
+	method := http.MethodGet
+	var handle func()
+	switch {
+	case path == "":
+		handle = func() { s.listConns(rw, req) }
+	case path == "close":
+		method = http.MethodPost
+		handle = func() { s.closeConns(rw, req) }
+	case len(parts) == 1:
+		handle = func() { s.getConn(rw, parts[0]) }
+	case len(parts) == 2 && parts[1] == "close":
+		method = http.MethodPost
+		handle = func() { s.closeConn(rw, req, parts[0]) }
+	default:
+		adminError(rw, http.StatusNotFound, "not found")
+		return
+	}
+
+	if req.Method != method {
+		rw.Header().Set("Allow", method)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handle()
+}
+
+func (s *StatsServer) listConns(rw http.ResponseWriter, req *http.Request) {
+	f, err := parseConnFilter(req.URL.Query())
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats := []*conntrack.InstrumentedConnStats{}
+	for _, ic := range findConns(s.config, f) {
+		stats = append(stats, ic.Stats())
+	}
+	adminJSON(rw, http.StatusOK, stats)
+}
+
+func (s *StatsServer) getConn(rw http.ResponseWriter, id string) {
+	ic := findConn(s.config, id)
+	if ic == nil {
+		adminError(rw, http.StatusNotFound, fmt.Sprintf("no connection %s", id))
+		return
+	}
+	adminJSON(rw, http.StatusOK, ic.Stats())
+}
+
+func (s *StatsServer) closeConn(rw http.ResponseWriter, req *http.Request, id string) {
+	ic := findConn(s.config, id)
+	if ic == nil {
+		adminError(rw, http.StatusNotFound, fmt.Sprintf("no connection %s", id))
+		return
+	}
+	s.forceClose(req, ic)
+	adminJSON(rw, http.StatusOK, map[string]int{"closed": 1})
+}
+
+func (s *StatsServer) closeConns(rw http.ResponseWriter, req *http.Request) {
+	f, err := parseConnFilter(req.URL.Query())
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Refuse to close every connection because of a forgotten parameter.
+	if f.role == "" && f.host == "" {
+		adminError(rw, http.StatusBadRequest, "role or host is required")
+		return
+	}
+
+	conns := findConns(s.config, f)
+	for _, ic := range conns {
+		s.forceClose(req, ic)
+	}
+	adminJSON(rw, http.StatusOK, map[string]int{"closed": len(conns)})
+}
+
+func (s *StatsServer) forceClose(req *http.Request, ic *conntrack.InstrumentedConn) {
+	ic.ForceClose(closeReasonAdmin, logrus.Fields{
+		LogFieldAdminClient: adminClient(req),
+	})
+}
+
+// adminClient describes the client of an admin API request for logging.
+func adminClient(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if req.RemoteAddr == "" || req.RemoteAddr == "@" {
+		return "stats socket"
+	}
+	return req.RemoteAddr
+}
+
+func (s *StatsServer) reloadAcls(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.config.Log.WithField(LogFieldAdminClient, adminClient(req)).Print("reloading egress ACLs")
+	if err := s.config.ReloadEgressAcls(); err != nil {
+		adminError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	adminJSON(rw, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func adminJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func adminError(rw http.ResponseWriter, code int, msg string) {
+	adminJSON(rw, code, map[string]string{"error": msg})
+}
+
+// SetupAdminTls serves the admin API on AdminAddr over TLS, using the
+// certificate and key in certFile and keyFile. Clients must present a
+// certificate issued by a CA in clientCAFiles.
+func (config *Config) SetupAdminTls(certFile, keyFile string, clientCAFiles []string) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("both certificate and key files must be specified to set up admin TLS")
+	}
+	if len(clientCAFiles) == 0 {
+		return errors.New("the admin API requires client certificates, but no client CA is configured")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	for _, caFile := range clientCAFiles {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	config.AdminTlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// startAdminServer serves the stats socket's handlers, including the admin
+// API, on AdminAddr.
+func startAdminServer(config *Config) (*http.Server, error) {
+	if config.AdminTlsConfig == nil {
+		return nil, errors.New("the admin API is only served over TCP with client certificates; set up admin TLS")
+	}
+	ln, err := net.Listen("tcp", config.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: newServer(config)}
+	go func() {
+		config.Log.Printf("serving admin API on %s", ln.Addr())
+		if err := server.Serve(tls.NewListener(ln, config.AdminTlsConfig)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			config.Log.Errorf("admin API serve error: %v", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,263 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// echoServer accepts connections and echoes what they receive.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func adminRequest(t *testing.T, s *StatsServer, method, target string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	if v != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestAdminAPI(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	logHook := proxyLogHook(cfg)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	var tunnels []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, resp := connectTunnel(t, proxy.URL, echo.Addr().String())
+		r.Equal(http.StatusOK, resp.StatusCode)
+		conn.Write([]byte("ping"))
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		r.NoError(err)
+		tunnels = append(tunnels, conn)
+	}
+
+	admin := newServer(cfg)
+
+	var conns []conntrack.InstrumentedConnStats
+	r.Equal(http.StatusOK, adminRequest(t, admin, "GET", "/connections", &conns))
+	r.Len(conns, 2)
+	r.NotEmpty(conns[0].ID)
+	r.NotEqual(conns[0].ID, conns[1].ID)
+	r.Equal("test-local-srv", conns[0].Role)
+	r.Equal(connectProxy, conns[0].ProxyType)
+
+	filters := map[string]int{
+		"/connections?role=test-local-srv":             2,
+		"/connections?role=other-srv":                  0,
+		"/connections?host=127.0.0.1":                  2,
+		"/connections?host=" + echo.Addr().String():    2,
+		"/connections?host=example.com":                0,
+		"/connections?min_age=1h":                      0,
+		"/connections?max_age=1h&max_idle=1h":          2,
+		"/connections?role=test-local-srv&min_idle=1h": 0,
+	}
+	for target, n := range filters {
+		r.Equal(http.StatusOK, adminRequest(t, admin, "GET", target, &conns), target)
+		r.Len(conns, n, target)
+	}
+
+	var errResp map[string]string
+	r.Equal(http.StatusBadRequest, adminRequest(t, admin, "GET", "/connections?min_age=soon", &errResp))
+	r.Equal(http.StatusBadRequest, adminRequest(t, admin, "POST", "/connections/close", &errResp))
+	r.Equal(http.StatusMethodNotAllowed, adminRequest(t, admin, "GET", "/connections/close", &errResp))
+	r.Equal(http.StatusNotFound, adminRequest(t, admin, "GET", "/connections/unknown", &errResp))
+	r.Equal(http.StatusNotFound, adminRequest(t, admin, "POST", "/connections/unknown/close", &errResp))
+
+	r.Equal(http.StatusOK, adminRequest(t, admin, "GET", "/connections?host=127.0.0.1", &conns))
+	id := conns[0].ID
+	var conn conntrack.InstrumentedConnStats
+	r.Equal(http.StatusOK, adminRequest(t, admin, "GET", "/connections/"+id, &conn))
+	r.Equal(id, conn.ID)
+
+	var closed map[string]int
+	r.Equal(http.StatusOK, adminRequest(t, admin, "POST", "/connections/"+id+"/close", &closed))
+	r.Equal(1, closed["closed"])
+
+	entry := findCanonicalProxyClose(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Equal(id, entry.Data[LogFieldID])
+	r.Equal(closeReasonAdmin, entry.Data[conntrack.LogFieldCloseReason])
+	r.NotEmpty(entry.Data[LogFieldAdminClient])
+
+	r.Equal(http.StatusOK, adminRequest(t, admin, "POST", "/connections/close?role=test-local-srv", &closed))
+	r.Equal(1, closed["closed"])
+	r.Equal(http.StatusOK, adminRequest(t, admin, "GET", "/connections", &conns))
+	r.Empty(conns)
+
+	var reloaded map[string]bool
+	r.Equal(http.StatusOK, adminRequest(t, admin, "POST", "/acl/reload", &reloaded))
+	r.True(reloaded["reloaded"])
+	r.Equal(http.StatusMethodNotAllowed, adminRequest(t, admin, "GET", "/acl/reload", &errResp))
+
+	// The clients' side of the tunnels are closed too.
+	for _, tunnel := range tunnels {
+		tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := tunnel.Read(make([]byte, 1))
+		r.Error(err)
+		r.False(isTimeout(err))
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// writeTestPKI writes a CA, a server certificate for 127.0.0.1 and a client
+// certificate with the given CN, all issued by the CA, to dir. The CA's CRL
+// revoking the client certificate is written to ca.crl.
+func writeTestPKI(t *testing.T, dir, clientCN string) (caFile, serverCert, serverKey string, client tls.Certificate) {
+	r := require.New(t)
+
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		r.NoError(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+		return path
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		r.NoError(err)
+		return key
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	r.NoError(err)
+	ca, err := x509.ParseCertificate(caDER)
+	r.NoError(err)
+	caFile = writePEM("ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key := newKey()
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		r.NoError(err)
+		return der, key
+	}
+
+	der, key := issue(2, "smokescreen", x509.ExtKeyUsageServerAuth)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	r.NoError(err)
+	serverCert = writePEM("server.pem", "CERTIFICATE", der)
+	serverKey = writePEM("server.key", "EC PRIVATE KEY", keyDER)
+
+	der, key = issue(3, clientCN, x509.ExtKeyUsageClientAuth)
+	client = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(3), RevocationTime: time.Now()},
+		},
+	}, ca, caKey)
+	r.NoError(err)
+	writePEM("ca.crl", "X509 CRL", crlDER)
+	return caFile, serverCert, serverKey, client
+}
+
+func TestAdminAPIOverTLS(t *testing.T) {
+	r := require.New(t)
+
+	caFile, serverCert, serverKey, clientCert := writeTestPKI(t, t.TempDir(), "operator")
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.Error(cfg.SetupAdminTls(serverCert, serverKey, nil))
+	r.NoError(cfg.SetupAdminTls(serverCert, serverKey, []string{caFile}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	cfg.AdminAddr = ln.Addr().String()
+	ln.Close()
+
+	server, err := startAdminServer(cfg)
+	r.NoError(err)
+	defer server.Close()
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	r.NoError(err)
+	roots := x509.NewCertPool()
+	r.True(roots.AppendCertsFromPEM(caPEM))
+
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+		return client.Get("https://" + cfg.AdminAddr + "/connections")
+	}
+
+	_, err = get()
+	r.Error(err)
+
+	resp, err := get(clientCert)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+}
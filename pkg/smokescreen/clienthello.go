@@ -0,0 +1,96 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tlsRecordTypeHandshake is the first byte of a TLS record carrying a
+// ClientHello.
+const tlsRecordTypeHandshake = 0x16
+
+var errNotClientHello = errors.New("connection did not start with a TLS ClientHello")
+
+// peekClientHello reads a TLS ClientHello from r. The returned reader replays
+// every byte consumed from r, followed by the rest of r, so the connection
+// can be passed on unchanged.
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	var peeked bytes.Buffer
+	hello, err := readClientHello(io.TeeReader(r, &peeked))
+	return hello, io.MultiReader(&peeked, r), err
+}
+
+// readClientHello parses a ClientHello by starting a server-side handshake
+// which is aborted as soon as crypto/tls has decoded the hello.
+func readClientHello(r io.Reader) (*tls.ClientHelloInfo, error) {
+	var hello *tls.ClientHelloInfo
+
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errNotClientHello
+		},
+	}).Handshake()
+
+	if hello == nil {
+		if err == nil {
+			err = errNotClientHello
+		}
+		return nil, err
+	}
+	return hello, nil
+}
+
+// peekHostname determines the hostname a client is trying to reach from the
+// first bytes it sends: the SNI of a TLS ClientHello, or the Host header of an
+// HTTP request. An empty hostname is returned when the protocol is not
+// recognized or carries no name.
+func peekHostname(br *bufio.Reader) (string, io.Reader, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", br, err
+	}
+
+	if first[0] == tlsRecordTypeHandshake {
+		hello, replay, err := peekClientHello(br)
+		if err != nil {
+			return "", replay, err
+		}
+		return hello.ServerName, replay, nil
+	}
+
+	var peeked bytes.Buffer
+	replay := io.MultiReader(&peeked, br)
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(br, &peeked)))
+	if err != nil {
+		// Not HTTP; the caller falls back to the destination address.
+		return "", replay, nil
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, replay, nil
+}
+
+// readOnlyConn is a net.Conn which only supports reading, used to feed a
+// connection's first bytes to crypto/tls without replying.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
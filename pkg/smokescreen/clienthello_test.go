@@ -0,0 +1,87 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordClientHello returns the first bytes a TLS client sends when
+// connecting to serverName.
+func recordClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+
+	// The ClientHello fits in a single record; read its header and body.
+	var hdr [5]byte
+	_, err := io.ReadFull(server, hdr[:])
+	require.NoError(t, err)
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	_, err = io.ReadFull(server, body)
+	require.NoError(t, err)
+	return append(hdr[:], body...)
+}
+
+func TestPeekHostname(t *testing.T) {
+	t.Run("TLS ClientHello", func(t *testing.T) {
+		r := require.New(t)
+
+		hello := recordClientHello(t, "api.example.com")
+		input := append(append([]byte{}, hello...), "trailing"...)
+
+		host, replay, err := peekHostname(bufio.NewReader(bytes.NewReader(input)))
+		r.NoError(err)
+		r.Equal("api.example.com", host)
+
+		replayed, err := io.ReadAll(replay)
+		r.NoError(err)
+		r.Equal(input, replayed)
+	})
+
+	t.Run("HTTP Host header", func(t *testing.T) {
+		r := require.New(t)
+
+		input := []byte("GET / HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n")
+		host, replay, err := peekHostname(bufio.NewReader(bytes.NewReader(input)))
+		r.NoError(err)
+		r.Equal("www.example.com", host)
+
+		replayed, err := io.ReadAll(replay)
+		r.NoError(err)
+		r.Equal(input, replayed)
+	})
+
+	t.Run("unknown protocol", func(t *testing.T) {
+		r := require.New(t)
+
+		input := []byte("\x00\x01\x02 not a known protocol")
+		host, replay, err := peekHostname(bufio.NewReader(bytes.NewReader(input)))
+		r.NoError(err)
+		r.Empty(host)
+
+		replayed, err := io.ReadAll(replay)
+		r.NoError(err)
+		r.Equal(input, replayed)
+	})
+
+	t.Run("truncated ClientHello", func(t *testing.T) {
+		r := require.New(t)
+
+		hello := recordClientHello(t, "api.example.com")
+		_, _, err := peekHostname(bufio.NewReader(bytes.NewReader(hello[:20])))
+		r.Error(err)
+	})
+}
@@ -15,12 +15,18 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/remote"
+	"github.com/stripe/smokescreen/pkg/smokescreen/acl/signature"
 	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
 	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing"
 )
 
 type RuleRange struct {
@@ -39,6 +45,7 @@ type Config struct {
 	ExitTimeout                  time.Duration
 	MetricsClient                *MetricsClient
 	EgressACL                    acl.Decider
+	egressACLMu                  sync.RWMutex // Guards EgressACL and the EgressACL of each of Listeners
 	SupportProxyProtocol         bool
 	TlsConfig                    *tls.Config
 	CrlByAuthorityKeyId          map[string]*pkix.CertificateList
@@ -61,6 +68,25 @@ type Config struct {
 	// A connection is idle if it has been inactive (no bytes in/out) for this many seconds.
 	IdleTimeout time.Duration
 
+	// Tunnels are closed once they are MaxConnLifetime old, or as old as the
+	// entry of their role in RoleMaxConnLifetime. Zero means no limit. Each
+	// tunnel's lifetime is shortened by a random fraction of up to
+	// MaxConnLifetimeJitter.
+	MaxConnLifetime       time.Duration
+	RoleMaxConnLifetime   map[string]time.Duration
+	MaxConnLifetimeJitter float64
+
+	// New tunnels and HTTP proxy requests are shed with a 503 once
+	// MaxConcurrentConns are in flight, or when they arrive faster than
+	// MaxRequestRate per second, with bursts of up to RequestBurst. The rate
+	// counts CONNECT and HTTP proxy requests, not accepted client
+	// connections, which may carry many requests. Zero means no limit; see
+	// SetConnLimits.
+	MaxConcurrentConns int
+	MaxRequestRate     float64
+	RequestBurst       int
+	connLimiter        *connLimiter
+
 	// These are *only* used for traditional HTTP proxy requests
 	TransportMaxIdleConns        int
 	TransportMaxIdleConnsPerHost int
@@ -74,6 +100,100 @@ type Config struct {
 	// Customer handler to allow clients to modify reject responses
 	RejectResponseHandler func(*http.Response)
 
+	// When SupportProxyProtocol is set, only accept PROXY protocol headers
+	// from clients in ProxyProtocolTrustedRanges (or from any client when it
+	// is empty, which LoadConfig refuses when the headers determine roles).
+	// In strict mode, those clients must send a header and all other clients
+	// are refused.
+	ProxyProtocolStrict        bool
+	ProxyProtocolTrustedRanges []RuleRange
+
+	// Prometheus sink set up by SetupPrometheus. Its metrics are served at
+	// PrometheusPath on PrometheusAddr when it is set, and on the stats
+	// socket when PrometheusOnStatsSocket is set.
+	Prometheus              *stats.Prometheus
+	PrometheusAddr          string
+	PrometheusPath          string
+	PrometheusOnStatsSocket bool
+
+	// Tracer set up by SetupTracing, which records spans of proxy requests.
+	Tracer *tracing.Tracer
+
+	// Also serve the stats socket, including the admin API, on AdminAddr
+	// using AdminTlsConfig, which must require client certificates.
+	AdminAddr      string
+	AdminTlsConfig *tls.Config
+
+	// File the egress ACL was loaded from by SetupEgressAcl, and reloaded
+	// from by ReloadEgressAcls.
+	EgressAclFile string
+
+	// Source the egress ACL is fetched from by SetupRemoteEgressAcl, and
+	// refetched from every EgressAclPollInterval. EgressAclFile is then its
+	// cache file.
+	EgressAclSource       *remote.Source
+	EgressAclPollInterval time.Duration
+
+	// Egress ACL domain globs matching every domain under a public suffix of
+	// PublicSuffixList, such as *.com, fail to load when
+	// RejectPublicSuffixGlobs is set, and are logged otherwise. A nil
+	// PublicSuffixList stands for the list embedded in smokescreen.
+	PublicSuffixList        *acl.PublicSuffixList
+	RejectPublicSuffixGlobs bool
+
+	// Every egress ACL file, including the files of a directory and included
+	// files, must pass AclVerifier, when set, to be loaded or reloaded. See
+	// SetupAclSignatures.
+	AclVerifier acl.FileVerifier
+
+	// How tracked connections which are denied by a reloaded or replaced
+	// egress ACL are handled; see SetAclRevocation.
+	AclRevocationAction      string
+	AclRevocationGracePeriod time.Duration
+
+	// Additional proxy listeners, each with its own settings.
+	Listeners []*ListenerConfig
+
+	// Offer HTTP/2 to clients of the TLS proxy listener. CONNECT requests may
+	// then be multiplexed as streams of a single client connection.
+	HTTP2 bool
+
+	// Check that the SNI of the TLS ClientHello sent through a CONNECT tunnel
+	// names the CONNECT host, or a host the client's role is allowed to reach.
+	// Tunnels failing the check are closed before any client data is forwarded.
+	VerifySNI bool
+
+	// SOCKS5 listener. It is only started when SocksListener or SocksPort is set,
+	// and uses the same TLS and PROXY protocol settings as the HTTP listener.
+	SocksIp       string
+	SocksPort     uint16
+	SocksListener net.Listener
+
+	// Check the credentials of SOCKS5 clients with ProxyAuth, which makes
+	// their username their role. Otherwise ProxyAuth ignores SOCKS5 clients,
+	// whose role RoleFromRequest determines. Requires ProxyAuth: unverified
+	// usernames would let any client claim any role.
+	SocksUsernameAsRole bool
+
+	// Authenticate clients using the Proxy-Authorization header (or SOCKS5
+	// credentials). Authenticated clients take the role ProxyAuth determines;
+	// clients presenting no credentials fall back to RoleFromRequest, and
+	// clients presenting invalid credentials are rejected with a 407.
+	ProxyAuth *ProxyAuthenticator
+
+	// Transparent proxy listener for connections redirected to smokescreen by
+	// iptables. It is only started when TransparentListener or TransparentPort
+	// is set. TransparentMode is one of TransparentModeRedirect (the default)
+	// or TransparentModeTProxy.
+	TransparentIp       string
+	TransparentPort     uint16
+	TransparentListener net.Listener
+	TransparentMode     string
+
+	// OutboundSourceRules select the local address used for outbound connections.
+	// The first matching rule wins; when none match the kernel chooses.
+	OutboundSourceRules []*OutboundSourceRule
+
 	// UnsafeAllowPrivateRanges inverts the default behavior, telling smokescreen to allow private IP
 	// ranges by default (exempting loopback and unicast ranges)
 	// This setting can be used to configure Smokescreen with a blocklist, rather than an allowlist
@@ -231,10 +351,17 @@ func NewConfig() *Config {
 		ShuttingDown:            atomic.Value{},
 		MetricsClient:           NewNoOpMetricsClient(),
 		Network:                 "ip",
+		AclRevocationAction:     AclRevocationClose,
 	}
 }
 
 func (config *Config) SetupCrls(crlFiles []string) error {
+	return config.loadCrls(crlFiles, config.clientCasBySubjectKeyId, config.CrlByAuthorityKeyId)
+}
+
+// loadCrls adds the CRLs in crlFiles issued by one of cas to crls. Both maps
+// are keyed by the key identifier of the CAs.
+func (config *Config) loadCrls(crlFiles []string, cas map[string]*x509.Certificate, crls map[string]*pkix.CertificateList) error {
 	for _, crlFile := range crlFiles {
 		crlBytes, err := ioutil.ReadFile(crlFile)
 		if err != nil {
@@ -243,7 +370,7 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 
 		certList, err := x509.ParseCRL(crlBytes)
 		if err != nil {
-			log.Printf("Failed to parse CRL in '%s': %#v\n", crlFile, err)
+			config.Log.Errorf("Failed to parse CRL in '%s': %#v", crlFile, err)
 		}
 
 		// find the X509v3 Authority Key Identifier in the extensions (2.5.29.35)
@@ -255,7 +382,7 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 				var crlAuthorityKey authKeyId
 				_, err := asn1.Unmarshal(v.Value, &crlAuthorityKey)
 				if err != nil {
-					fmt.Printf("error: Failed to read AuthorityKey: %#v\n", err)
+					config.Log.Errorf("Failed to read AuthorityKey: %#v", err)
 					continue
 				}
 				crlIssuerId = string(crlAuthorityKey.Id)
@@ -263,44 +390,70 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 			}
 		}
 		if crlIssuerId == "" {
-			log.Print(fmt.Errorf("error: CRL from '%s' has no Authority Key Identifier: ignoring it\n", crlFile))
+			config.Log.Errorf("CRL from '%s' has no Authority Key Identifier: ignoring it", crlFile)
 			continue
 		}
 
 		// Make sure we have a CA for this CRL or warn
-		caCert, ok := config.clientCasBySubjectKeyId[crlIssuerId]
+		caCert, ok := cas[crlIssuerId]
 
 		if !ok {
-			log.Printf("warn: CRL loaded for issuer '%s' but no such CA loaded: ignoring it\n", hex.EncodeToString([]byte(crlIssuerId)))
-			fmt.Printf("%#v loaded certs\n", len(config.clientCasBySubjectKeyId))
+			config.Log.Warnf("CRL loaded for issuer '%s' but no such CA loaded: ignoring it", hex.EncodeToString([]byte(crlIssuerId)))
+			config.Log.Infof("%d loaded certs", len(cas))
 			continue
 		}
 
 		// At this point, we have the CA certificate and the CRL. All that's left before evicting the CRL we currently trust is to verify the new CRL's signature
 		err = caCert.CheckCRLSignature(certList)
 		if err != nil {
-			fmt.Printf("error: Could not trust CRL. Error during signature check: %#v\n", err)
+			config.Log.Errorf("Could not trust CRL. Error during signature check: %#v", err)
 			continue
 		}
 
 		// At this point, we have a new CRL which we trust. Let's evict the old one.
-		config.CrlByAuthorityKeyId[crlIssuerId] = certList
-		fmt.Printf("info: Loaded CRL for Authority ID '%s'\n", hex.EncodeToString([]byte(crlIssuerId)))
+		crls[crlIssuerId] = certList
+		config.Log.Infof("Loaded CRL for Authority ID '%s'", hex.EncodeToString([]byte(crlIssuerId)))
 	}
 
 	// Verify that all CAs loaded have a CRL
-	for k := range config.clientCasBySubjectKeyId {
-		_, ok := config.CrlByAuthorityKeyId[k]
+	for k := range cas {
+		_, ok := crls[k]
 		if !ok {
-			fmt.Printf("warn: no CRL loaded for Authority ID '%s'\n", hex.EncodeToString([]byte(k)))
+			config.Log.Warnf("no CRL loaded for Authority ID '%s'", hex.EncodeToString([]byte(k)))
 		}
 	}
 	return nil
 }
 
+// verifyNotRevoked returns a tls.Config VerifyPeerCertificate function which
+// refuses client certificates revoked by one of crls, keyed by the key
+// identifier of their issuer. Certificates whose issuer's CRL is past its
+// next update are refused too, as they may have been revoked since.
+func verifyNotRevoked(crls map[string]*pkix.CertificateList) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				crl, ok := crls[string(cert.AuthorityKeyId)]
+				if !ok {
+					continue
+				}
+				if crl.HasExpired(time.Now()) {
+					return fmt.Errorf("certificate %q: CRL of its issuer expired at %s", cert.Subject, crl.TBSCertList.NextUpdate)
+				}
+				for _, revoked := range crl.TBSCertList.RevokedCertificates {
+					if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return fmt.Errorf("certificate %q (serial %s) is revoked", cert.Subject, cert.SerialNumber)
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
 func (config *Config) SetupStatsdWithNamespace(addr, namespace string) error {
 	if addr == "" {
-		fmt.Println("warn: no statsd addr provided, using noop client")
+		config.Log.Warn("no statsd addr provided, using noop client")
 		config.MetricsClient = NewNoOpMetricsClient()
 		return nil
 	}
@@ -318,28 +471,44 @@ func (config *Config) SetupStatsd(addr string) error {
 }
 
 func (config *Config) SetupEgressAcl(aclFile string) error {
+	config.EgressAclFile = aclFile
 	if aclFile == "" {
-		config.EgressACL = nil
+		config.ReplaceEgressACL(nil)
 		return nil
 	}
 
-	log.Printf("Loading egress ACL from %s", aclFile)
+	config.Log.Infof("Loading egress ACL from %s", aclFile)
 
-	egressACL, err := acl.New(config.Log, acl.NewYAMLLoader(aclFile), config.DisabledAclPolicyActions)
+	egressACL, err := aclv2.LoadWithOptions(config.Log, aclFile, config.DisabledAclPolicyActions, config.aclLoadOptions())
 	if err != nil {
-		log.Print(err)
+		config.Log.Error(err)
 		return err
 	}
-	config.EgressACL = egressACL
+	config.ReplaceEgressACL(egressACL)
 
 	return nil
 }
 
-func addCertsFromFile(config *Config, pool *x509.CertPool, fileName string) error {
+// SetupAclSignatures requires egress ACL files to be signed by one of the
+// Ed25519 public keys in keyFiles, or by a certificate issued by a CA in
+// caFiles; see package acl/signature. It must be called before the ACLs are
+// loaded. The signer of every file loaded is logged. Directories and
+// included patterns are refused, as signatures do not cover which files they
+// match.
+func (config *Config) SetupAclSignatures(keyFiles, caFiles []string) error {
+	verifier, err := signature.NewVerifier(keyFiles, caFiles, config.Log)
+	if err != nil {
+		return err
+	}
+	config.AclVerifier = verifier
+	return nil
+}
+
+func (config *Config) addCertsFromFile(cas map[string]*x509.Certificate, pool *x509.CertPool, fileName string) error {
 	data, err := ioutil.ReadFile(fileName)
 
 	//TODO this is a bit awkward
-	config.populateClientCaMap(data)
+	config.populateClientCaMap(cas, data)
 
 	if err != nil {
 		return err
@@ -353,13 +522,43 @@ func addCertsFromFile(config *Config, pool *x509.CertPool, fileName string) erro
 
 // certFile and keyFile may be the same file containing concatenated PEM blocks
 func (config *Config) SetupTls(certFile, keyFile string, clientCAFiles []string) error {
+	tlsConfig, err := config.newTlsConfig(certFile, keyFile, clientCAFiles, config.clientCasBySubjectKeyId)
+	if err != nil {
+		return err
+	}
+	// CRLs are added by SetupCrls, which may be called later.
+	tlsConfig.VerifyPeerCertificate = verifyNotRevoked(config.CrlByAuthorityKeyId)
+	config.TlsConfig = tlsConfig
+	return nil
+}
+
+// NewTlsConfig builds a server TLS configuration in the same way as SetupTls
+// and SetupCrls, for use by additional listeners. The client CAs and CRLs
+// only apply to connections using the returned configuration.
+func (config *Config) NewTlsConfig(certFile, keyFile string, clientCAFiles, crlFiles []string) (*tls.Config, error) {
+	cas := make(map[string]*x509.Certificate)
+	tlsConfig, err := config.newTlsConfig(certFile, keyFile, clientCAFiles, cas)
+	if err != nil {
+		return nil, err
+	}
+	crls := make(map[string]*pkix.CertificateList)
+	if err := config.loadCrls(crlFiles, cas, crls); err != nil {
+		return nil, err
+	}
+	tlsConfig.VerifyPeerCertificate = verifyNotRevoked(crls)
+	return tlsConfig, nil
+}
+
+// newTlsConfig builds a server TLS configuration trusting the client CAs in
+// clientCAFiles, which are also added to cas.
+func (config *Config) newTlsConfig(certFile, keyFile string, clientCAFiles []string, cas map[string]*x509.Certificate) (*tls.Config, error) {
 	if certFile == "" || keyFile == "" {
-		return errors.New("both certificate and key files must be specified to set up TLS")
+		return nil, errors.New("both certificate and key files must be specified to set up TLS")
 	}
 
 	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	clientAuth := tls.NoClientCert
@@ -368,23 +567,21 @@ func (config *Config) SetupTls(certFile, keyFile string, clientCAFiles []string)
 	if len(clientCAFiles) != 0 {
 		clientAuth = tls.VerifyClientCertIfGiven
 		for _, caFile := range clientCAFiles {
-			err = addCertsFromFile(config, clientCAs, caFile)
+			err = config.addCertsFromFile(cas, clientCAs, caFile)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
-	config.TlsConfig = &tls.Config{
+	return &tls.Config{
 		Certificates: []tls.Certificate{serverCert},
 		ClientAuth:   clientAuth,
 		ClientCAs:    clientCAs,
-	}
-
-	return nil
+	}, nil
 }
 
-func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
+func (config *Config) populateClientCaMap(cas map[string]*x509.Certificate, pemCerts []byte) (ok bool) {
 
 	for len(pemCerts) > 0 {
 		var block *pem.Block
@@ -400,8 +597,8 @@ func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
 		if err != nil {
 			continue
 		}
-		fmt.Printf("info: Loaded CA with Authority ID '%s'\n", hex.EncodeToString(cert.SubjectKeyId))
-		config.clientCasBySubjectKeyId[string(cert.SubjectKeyId)] = cert
+		config.Log.Infof("Loaded CA with Authority ID '%s'", hex.EncodeToString(cert.SubjectKeyId))
+		cas[string(cert.SubjectKeyId)] = cert
 		ok = true
 	}
 	return
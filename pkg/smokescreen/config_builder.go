@@ -0,0 +1,496 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// Kinds of ConfigSource, from lowest to highest precedence.
+const (
+	ConfigSourceDefault = "default"
+	ConfigSourceFile    = "file"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFlag    = "flag"
+)
+
+// ConfigSource is where the value of a configuration key comes from.
+type ConfigSource struct {
+	Kind string `json:"kind"`
+	// Path of the file, or name of the environment variable or command line
+	// option.
+	Name string `json:"name,omitempty"`
+}
+
+func (s ConfigSource) String() string {
+	switch s.Kind {
+	case ConfigSourceFile:
+		return s.Name
+	case ConfigSourceEnv:
+		return "$" + s.Name
+	case ConfigSourceFlag:
+		return "--" + s.Name
+	}
+	return s.Kind
+}
+
+// ConfigError is an invalid configuration key. Line is the line of Key in
+// the configuration file it was read from, if any.
+type ConfigError struct {
+	Key    string
+	Source ConfigSource
+	Line   int
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.Source.Kind != "" {
+		b.WriteString(e.Source.String())
+		if e.Line > 0 {
+			fmt.Fprintf(&b, ":%d", e.Line)
+		}
+		b.WriteString(": ")
+	}
+	if e.Key != "" {
+		b.WriteString(e.Key)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all the invalid keys found at once, such as the unknown
+// keys of a configuration file.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ConfigBuilder builds a Config out of configuration files and individual
+// keys, such as those set on the command line. Keys take the value they were
+// last given: maps are merged key by key, while lists and other values are
+// replaced as a whole. Errors name the offending key, and where its value
+// comes from.
+type ConfigBuilder struct {
+	// Logger of the built Config, which is also used while it is set up.
+	Log *logrus.Logger
+
+	values  map[interface{}]interface{}
+	sources map[string]ConfigSource
+	lines   map[string]map[string]int // Lines of the keys of each file
+}
+
+// NewConfigBuilder returns a builder holding the defaults of NewConfig.
+func NewConfigBuilder() *ConfigBuilder {
+	b := &ConfigBuilder{
+		values:  make(map[interface{}]interface{}),
+		sources: make(map[string]ConfigSource),
+		lines:   make(map[string]map[string]int),
+	}
+
+	defaults := NewConfig()
+	source := ConfigSource{Kind: ConfigSourceDefault}
+	b.Set("port", defaults.Port, source)
+	b.Set("network", defaults.Network, source)
+	b.Set("exit_timeout", defaults.ExitTimeout.String(), source)
+	b.Set("stats_socket_file_mode", strconv.FormatUint(uint64(defaults.StatsSocketFileMode), 8), source)
+	b.Set("statsd_namespace", DefaultStatsdNamespace, source)
+	b.Set("acl_revocation.action", defaults.AclRevocationAction, source)
+	return b
+}
+
+// AddFile merges the configuration file at path into the configuration. The
+// file must be valid on its own: unknown keys and values of the wrong type
+// are reported with their line.
+func (b *ConfigBuilder) AddFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	source := ConfigSource{Kind: ConfigSourceFile, Name: path}
+	lines := yamlKeyLines(data)
+
+	var yc yamlConfig
+	if err := yaml.UnmarshalStrict(data, &yc); err != nil {
+		return yamlErrors(source, keysByLine(lines), err)
+	}
+	var values map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return yamlErrors(source, keysByLine(lines), err)
+	}
+
+	b.lines[path] = lines
+	b.merge(b.values, values, "", source)
+	return nil
+}
+
+// Set sets the value of key, a path such as "tls.cert_file", replacing any
+// value it had.
+func (b *ConfigBuilder) Set(key string, value interface{}, source ConfigSource) {
+	parts := strings.Split(key, ".")
+	m := b.values
+	for i := range parts[:len(parts)-1] {
+		path := strings.Join(parts[:i+1], ".")
+		next, ok := m[parts[i]].(map[interface{}]interface{})
+		if !ok {
+			b.clearSources(path)
+			next = make(map[interface{}]interface{})
+			m[parts[i]] = next
+		}
+		if s, ok := b.sources[path]; !ok || s.Kind == ConfigSourceDefault {
+			b.sources[path] = source
+		}
+		m = next
+	}
+	b.clearSources(key)
+	m[parts[len(parts)-1]] = value
+	b.sources[key] = source
+}
+
+// Source returns where the value of key comes from.
+func (b *ConfigBuilder) Source(key string) (ConfigSource, bool) {
+	source, ok := b.sources[key]
+	return source, ok
+}
+
+// WriteYAML writes the configuration as a configuration file, with the
+// source of each value as a comment.
+func (b *ConfigBuilder) WriteYAML(w io.Writer) error {
+	node, err := b.yamlNode(b.values, "")
+	if err != nil {
+		return err
+	}
+	enc := yaml3.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (b *ConfigBuilder) yamlNode(m map[interface{}]interface{}, path string) (*yaml3.Node, error) {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	node := &yaml3.Node{Kind: yaml3.MappingNode}
+	for _, k := range keys {
+		key := joinKey(path, fmt.Sprint(k))
+		keyNode := &yaml3.Node{}
+		if err := keyNode.Encode(k); err != nil {
+			return nil, err
+		}
+
+		if sub, ok := m[k].(map[interface{}]interface{}); ok && len(sub) > 0 {
+			valueNode, err := b.yamlNode(sub, key)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, keyNode, valueNode)
+			continue
+		}
+
+		valueNode := &yaml3.Node{}
+		if err := valueNode.Encode(m[k]); err != nil {
+			return nil, err
+		}
+		if source, _ := b.locate(key); source.Kind != "" {
+			if valueNode.Kind == yaml3.ScalarNode {
+				valueNode.LineComment = source.String()
+			} else {
+				keyNode.LineComment = source.String()
+			}
+		}
+		node.Content = append(node.Content, keyNode, valueNode)
+	}
+	return node, nil
+}
+
+// Values returns the configuration, with the keys of sections as strings so
+// that it can be encoded as JSON.
+func (b *ConfigBuilder) Values() map[string]interface{} {
+	return stringKeys(b.values).(map[string]interface{})
+}
+
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = stringKeys(e)
+		}
+		return l
+	}
+	return v
+}
+
+// Sources returns where the value of each key comes from. Sections such as
+// tls are broken down into their keys.
+func (b *ConfigBuilder) Sources() map[string]ConfigSource {
+	sources := make(map[string]ConfigSource)
+	var walk func(m map[interface{}]interface{}, path string)
+	walk = func(m map[interface{}]interface{}, path string) {
+		for k, v := range m {
+			key := joinKey(path, fmt.Sprint(k))
+			if sub, ok := v.(map[interface{}]interface{}); ok && len(sub) > 0 {
+				walk(sub, key)
+			} else if source, _ := b.locate(key); source.Kind != "" {
+				sources[key] = source
+			}
+		}
+	}
+	walk(b.values, "")
+	return sources
+}
+
+// decode validates the configuration against the schema of the
+// configuration file.
+func (b *ConfigBuilder) decode() (*yamlConfig, error) {
+	data, err := yaml.Marshal(b.values)
+	if err != nil {
+		return nil, err
+	}
+
+	var yc yamlConfig
+	if err := yaml.UnmarshalStrict(data, &yc); err != nil {
+		// Lines of the merged configuration mean nothing to users; point
+		// at where the offending keys were set instead.
+		err = yamlErrors(ConfigSource{}, keysByLine(yamlKeyLines(data)), err)
+		var errs ConfigErrors
+		if !errors.As(err, &errs) {
+			errs = ConfigErrors{err.(*ConfigError)}
+		}
+		for _, e := range errs {
+			e.Source, e.Line = b.locate(e.Key)
+		}
+		if len(errs) == 1 {
+			return nil, errs[0]
+		}
+		return nil, errs
+	}
+	return &yc, nil
+}
+
+// Build sets up a new Config from the configuration.
+func (b *ConfigBuilder) Build() (*Config, error) {
+	yc, err := b.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	config := NewConfig()
+	if b.Log != nil {
+		config.Log = b.Log
+	}
+	if err := yc.apply(config); err != nil {
+		var ke *configKeyError
+		if !errors.As(err, &ke) {
+			return nil, err
+		}
+		source, line := b.locate(ke.key)
+		return nil, &ConfigError{Key: ke.key, Source: source, Line: line, Err: ke.err}
+	}
+	return config, nil
+}
+
+func (b *ConfigBuilder) merge(dst, src map[interface{}]interface{}, path string, source ConfigSource) {
+	for k, v := range src {
+		key := joinKey(path, fmt.Sprint(k))
+		if sm, ok := v.(map[interface{}]interface{}); ok {
+			dm, ok := dst[k].(map[interface{}]interface{})
+			if !ok {
+				b.clearSources(key)
+				dm = make(map[interface{}]interface{})
+				dst[k] = dm
+			}
+			b.sources[key] = source
+			b.merge(dm, sm, key, source)
+			continue
+		}
+		b.clearSources(key)
+		dst[k] = v
+		b.sources[key] = source
+	}
+}
+
+// clearSources forgets the sources of key and of the keys below it.
+func (b *ConfigBuilder) clearSources(key string) {
+	for k := range b.sources {
+		if k == key || strings.HasPrefix(k, key+".") || strings.HasPrefix(k, key+"[") {
+			delete(b.sources, k)
+		}
+	}
+}
+
+// locate returns where the value of key comes from: the source of the key
+// itself, of the nearest section above it, or else of a key below it.
+func (b *ConfigBuilder) locate(key string) (ConfigSource, int) {
+	found := key
+	source, ok := b.sources[key]
+	for k := key; !ok; {
+		i := strings.LastIndexAny(k, ".[")
+		if i < 0 {
+			break
+		}
+		k = k[:i]
+		source, ok = b.sources[k]
+		found = k
+	}
+	if !ok {
+		var below []string
+		for k := range b.sources {
+			if strings.HasPrefix(k, key+".") || strings.HasPrefix(k, key+"[") {
+				below = append(below, k)
+			}
+		}
+		if len(below) == 0 {
+			return ConfigSource{}, 0
+		}
+		sort.Strings(below)
+		found = below[0]
+		source = b.sources[found]
+	}
+
+	if source.Kind != ConfigSourceFile {
+		return source, 0
+	}
+	lines := b.lines[source.Name]
+	if line, ok := lines[key]; ok {
+		return source, line
+	}
+	return source, lines[found]
+}
+
+var (
+	yamlErrorLine      = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownKeyType = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// yamlErrors turns the errors of yaml.UnmarshalStrict, which only carry line
+// numbers, into ConfigErrors naming the offending keys.
+func yamlErrors(source ConfigSource, keys map[int][]string, err error) error {
+	msgs := []string{err.Error()}
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	}
+
+	var errs ConfigErrors
+	for _, msg := range msgs {
+		e := &ConfigError{Source: source}
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		} else {
+			msg = strings.TrimPrefix(msg, "yaml: ")
+		}
+
+		candidates := keys[e.Line]
+		if len(candidates) > 0 {
+			e.Key = candidates[len(candidates)-1]
+		}
+		if m := yamlUnknownKeyType.FindStringSubmatch(msg); m != nil {
+			msg = "unknown key"
+			for _, k := range candidates {
+				if k == m[1] || strings.HasSuffix(k, "."+m[1]) {
+					e.Key = k
+				}
+			}
+		}
+		e.Err = errors.New(msg)
+		errs = append(errs, e)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errs
+}
+
+// yamlKeyLines returns the line of each key of a YAML document, by path such
+// as "listeners[1].tls.cert_file".
+func yamlKeyLines(data []byte) map[string]int {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	lines := make(map[string]int)
+	var walk func(n *yaml3.Node, path string)
+	walk = func(n *yaml3.Node, path string) {
+		switch n.Kind {
+		case yaml3.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml3.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := joinKey(path, n.Content[i].Value)
+				lines[key] = n.Content[i].Line
+				walk(n.Content[i+1], key)
+			}
+		case yaml3.SequenceNode:
+			for i, c := range n.Content {
+				key := fmt.Sprintf("%s[%d]", path, i)
+				lines[key] = c.Line
+				walk(c, key)
+			}
+		}
+	}
+	walk(&doc, "")
+	return lines
+}
+
+// keysByLine inverts the result of yamlKeyLines. The keys of each line are
+// sorted from the outermost to the innermost.
+func keysByLine(lines map[string]int) map[int][]string {
+	keys := make(map[int][]string)
+	for key, line := range lines {
+		keys[line] = append(keys[line], key)
+	}
+	for _, ks := range keys {
+		sort.Slice(ks, func(i, j int) bool {
+			if len(ks[i]) != len(ks[j]) {
+				return len(ks[i]) < len(ks[j])
+			}
+			return ks[i] < ks[j]
+		})
+	}
+	return keys
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
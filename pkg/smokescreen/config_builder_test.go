@@ -0,0 +1,269 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config string
+		key    string
+		line   int
+		errMsg string
+	}{
+		{
+			name:   "unknown key",
+			config: "port: 4750\ntls:\n  cert_file: a.pem\n  cert_fiel: b.pem\n",
+			key:    "tls.cert_fiel",
+			line:   4,
+			errMsg: "unknown key",
+		},
+		{
+			name:   "invalid type",
+			config: "ip: 127.0.0.1\nport: many\n",
+			key:    "port",
+			line:   2,
+			errMsg: "cannot unmarshal",
+		},
+		{
+			name:   "invalid value",
+			config: "deny_ranges:\n  - 10.0.0.0/8\n  - nope\n",
+			key:    "deny_ranges",
+			line:   1,
+			errMsg: "invalid CIDR address",
+		},
+		{
+			name:   "invalid value in list",
+			config: "listeners:\n  - port: 4751\n  - port: 4752\n    tls: {key_file: a.pem}\n",
+			key:    "listeners[1].tls",
+			line:   4,
+			errMsg: "'cert_file' is required",
+		},
+		{
+			name:   "invalid role strategy",
+			config: "role_from_request:\n  - header:X-Role\n  - nope\n",
+			key:    "role_from_request",
+			line:   1,
+			errMsg: "nope",
+		},
+		{
+			name:   "proxy protocol roles from any client",
+			config: "support_proxy_protocol: true\nrole_from_request:\n  - proxy_tlv:0xEA\n",
+			key:    "support_proxy_protocol",
+			line:   1,
+			errMsg: "'proxy_protocol_trusted_ranges' is required",
+		},
+		{
+			name:   "listener proxy protocol roles from any client",
+			config: "role_from_request:\n  - type: cidr\n    cidrs: [{cidr: 10.0.0.0/8, role: internal}]\nlisteners:\n  - port: 4751\n    support_proxy_protocol: true\n",
+			key:    "listeners[0].support_proxy_protocol",
+			line:   6,
+			errMsg: "'proxy_protocol_trusted_ranges' is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			path := writeConfig(t, tc.config)
+			_, err := LoadConfig(path)
+			r.Error(err)
+
+			var ce *ConfigError
+			r.True(errors.As(err, &ce), "%T: %v", err, err)
+			r.Equal(tc.key, ce.Key)
+			r.Equal(tc.line, ce.Line)
+			r.Equal(ConfigSource{Kind: ConfigSourceFile, Name: path}, ce.Source)
+			r.Contains(ce.Err.Error(), tc.errMsg)
+			r.Contains(err.Error(), path+":")
+		})
+	}
+}
+
+func TestLoadConfigAllKeys(t *testing.T) {
+	r := require.New(t)
+
+	path := writeConfig(t, `
+deny_addresses: [10.1.1.1]
+allow_addresses: ["127.0.0.1:8080"]
+disable_acl_policy_actions: [open]
+statsd_address: 127.0.0.1:8200
+statsd_namespace: egress.
+metric_tags:
+  acl.allow: [zone:a, team:b]
+role_from_request:
+  - header:X-Role
+  - type: cn
+transport_max_idle_conns: 10
+`)
+	conf, err := LoadConfig(path)
+	r.NoError(err)
+	r.Len(conf.DenyRanges, 1)
+	r.Len(conf.AllowRanges, 1)
+	r.Equal(8080, conf.AllowRanges[0].Port)
+	r.Equal([]string{"open"}, conf.DisabledAclPolicyActions)
+	r.Equal([]string{"zone:a", "team:b"}, conf.MetricsClient.GetMetricTags("acl.allow"))
+	r.NotNil(conf.RoleFromRequest)
+	r.Equal(10, conf.TransportMaxIdleConns)
+
+	// Policy actions are disabled before the ACL is loaded.
+	path = writeConfig(t, "disable_acl_policy_actions: [open]\nacl_file: testdata/acl.yaml\n")
+	_, err = LoadConfig(path)
+	r.Error(err)
+	r.Contains(err.Error(), "acl_file: ")
+
+	// So are the public suffix checks.
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl.yaml")
+	r.NoError(ioutil.WriteFile(aclFile, []byte("version: v1\nservices:\n  - {name: uk, action: enforce, allowed_domains: [\"*.co.uk\"]}\n"), 0600))
+	pslFile := filepath.Join(dir, "public_suffix_list.dat")
+	r.NoError(ioutil.WriteFile(pslFile, []byte("com\n"), 0600))
+
+	path = writeConfig(t, "reject_public_suffix_globs: true\nacl_file: "+aclFile+"\n")
+	_, err = LoadConfig(path)
+	r.Error(err)
+	r.Contains(err.Error(), "acl_file: uk: *.co.uk: domain glob matches every domain under the public suffix co.uk")
+
+	path = writeConfig(t, "reject_public_suffix_globs: true\npublic_suffix_list_file: "+pslFile+"\nacl_file: "+aclFile+"\n")
+	conf, err = LoadConfig(path)
+	r.NoError(err)
+	r.True(conf.RejectPublicSuffixGlobs)
+	r.NotNil(conf.PublicSuffixList)
+
+	path = writeConfig(t, "public_suffix_list_file: "+aclFile+"\n")
+	_, err = LoadConfig(path)
+	r.Error(err)
+	r.Contains(err.Error(), "public_suffix_list_file: ")
+
+	// The ACL may be a directory of files.
+	path = writeConfig(t, "acl_file: acl/v1/testdata/dir\n")
+	conf, err = LoadConfig(path)
+	r.NoError(err)
+	r.NotNil(conf.EgressACL)
+}
+
+func TestConfigBuilderPrecedence(t *testing.T) {
+	r := require.New(t)
+
+	path := writeConfig(t, `
+port: 4751
+connect_timeout: 5s
+deny_ranges: [10.0.0.0/8, 172.16.0.0/12]
+tls:
+  cert_file: a.pem
+  key_file: b.pem
+`)
+	flag := func(name string) ConfigSource {
+		return ConfigSource{Kind: ConfigSourceFlag, Name: name}
+	}
+
+	builder := NewConfigBuilder()
+	r.NoError(builder.AddFile(path))
+	builder.Set("connect_timeout", "10s", flag("timeout"))
+	builder.Set("deny_ranges", []string{"192.168.0.0/16"}, flag("deny-range"))
+	builder.Set("tls", nil, flag("no-tls"))
+
+	conf, err := builder.Build()
+	r.NoError(err)
+	r.Equal(uint16(4751), conf.Port)
+	r.Equal(10*time.Second, conf.ConnectTimeout)
+	r.Len(conf.DenyRanges, 1)
+	r.Nil(conf.TlsConfig)
+
+	source, ok := builder.Source("port")
+	r.True(ok)
+	r.Equal(ConfigSource{Kind: ConfigSourceFile, Name: path}, source)
+	source, ok = builder.Source("connect_timeout")
+	r.True(ok)
+	r.Equal(flag("timeout"), source)
+	_, ok = builder.Source("tls.cert_file")
+	r.False(ok)
+
+	// Errors name the source of the offending value.
+	builder.Set("port", "many", flag("listen-port"))
+	_, err = builder.Build()
+	r.EqualError(err, "--listen-port: port: cannot unmarshal !!str `many` into uint16")
+
+	builder.Set("port", 4752, flag("listen-port"))
+	builder.Set("tls.key_file", "b.pem", flag("tls-key-file"))
+	_, err = builder.Build()
+	r.EqualError(err, "--tls-key-file: tls: 'cert_file' is required")
+}
+
+func TestConfigBuilderEnv(t *testing.T) {
+	r := require.New(t)
+
+	path := writeConfig(t, "port: 4751\nconnect_timeout: 5s\nidle_timeout: 1m\n")
+
+	builder := NewConfigBuilder()
+	r.NoError(builder.AddFile(path))
+	r.NoError(builder.AddEnv([]string{
+		"HOME=/root",
+		"SMOKESCREEN_CONFIG_FILE=" + path,
+		"SMOKESCREEN_CONNECT_TIMEOUT=7s",
+		"SMOKESCREEN_IDLE_TIMEOUT=2m",
+		"SMOKESCREEN_DENY_RANGES=10.0.0.0/8, 172.16.0.0/12",
+		"SMOKESCREEN_TLS_CERT_FILE=",
+		"SMOKESCREEN_ROLE_FROM_REQUEST=cn,header:X-Role",
+		"SMOKESCREEN_METRIC_TAGS={acl.deny: [zone:a]}",
+	}))
+	builder.Set("connect_timeout", "10s", ConfigSource{Kind: ConfigSourceFlag, Name: "timeout"})
+
+	var out bytes.Buffer
+	r.NoError(builder.WriteYAML(&out))
+	r.Contains(out.String(), "port: 4751 # "+path+"\n")
+	r.Contains(out.String(), "connect_timeout: 10s # --timeout\n")
+	r.Contains(out.String(), "idle_timeout: 2m # $SMOKESCREEN_IDLE_TIMEOUT\n")
+	r.Contains(out.String(), "network: ip # default\n")
+	r.Contains(out.String(), "deny_ranges: # $SMOKESCREEN_DENY_RANGES\n")
+
+	// An empty cert file leaves the TLS section unusable.
+	_, err := builder.Build()
+	r.EqualError(err, "$SMOKESCREEN_TLS_CERT_FILE: tls: 'cert_file' is required")
+
+	builder.Set("tls", nil, ConfigSource{Kind: ConfigSourceFlag, Name: "no-tls"})
+	conf, err := builder.Build()
+	r.NoError(err)
+	r.Equal(uint16(4751), conf.Port)
+	r.Equal(10*time.Second, conf.ConnectTimeout)
+	r.Equal(2*time.Minute, conf.IdleTimeout)
+	r.Len(conf.DenyRanges, 2)
+	r.NotNil(conf.RoleFromRequest)
+	r.Equal([]string{"zone:a"}, conf.MetricsClient.GetMetricTags("acl.deny"))
+
+	err = NewConfigBuilder().AddEnv([]string{"SMOKESCREEN_LISTEN_PORT=4750", "SMOKESCREEN_PORT=[1"})
+	var errs ConfigErrors
+	r.True(errors.As(err, &errs))
+	r.Len(errs, 2)
+	r.Equal("$SMOKESCREEN_LISTEN_PORT: unknown environment variable", errs[0].Error())
+	r.Equal("port", errs[1].Key)
+}
+
+func TestConfigEnvVars(t *testing.T) {
+	r := require.New(t)
+
+	vars := ConfigEnvVars()
+	r.Contains(vars, "SMOKESCREEN_PORT")
+	r.Contains(vars, "SMOKESCREEN_TLS_CLIENT_CA_FILES")
+	r.Contains(vars, "SMOKESCREEN_ACL_REVOCATION_GRACE_PERIOD")
+	r.Contains(vars, "SMOKESCREEN_LISTENERS")
+	r.NotContains(vars, ConfigFileEnvVar)
+}
@@ -0,0 +1,406 @@
+package smokescreen
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Severities of ConfigFinding.
+const (
+	FindingError   = "error"
+	FindingWarning = "warning"
+)
+
+// Checks reporting a ConfigFinding.
+const (
+	CheckConfig   = "config"
+	CheckTLS      = "tls"
+	CheckRanges   = "ranges"
+	CheckResolver = "resolver"
+)
+
+// ConfigFinding is a problem found by ConfigBuilder.Check. Errors prevent
+// smokescreen from starting or break part of its configuration, while
+// warnings point at settings which likely do not do what was intended.
+type ConfigFinding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Key      string `json:"key,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (f ConfigFinding) String() string {
+	var b strings.Builder
+	b.WriteString(f.Severity)
+	b.WriteString(": ")
+	if f.Source != "" {
+		b.WriteString(f.Source)
+		if f.Line > 0 {
+			fmt.Fprintf(&b, ":%d", f.Line)
+		}
+		b.WriteString(": ")
+	}
+	if f.Key != "" {
+		b.WriteString(f.Key)
+		b.WriteString(": ")
+	}
+	b.WriteString(f.Message)
+	return b.String()
+}
+
+// CheckOptions tunes ConfigBuilder.Check.
+type CheckOptions struct {
+	// Look up ResolverCheckHost with the configured resolver, or the system
+	// resolver, within ResolverTimeout.
+	CheckResolvers    bool
+	ResolverCheckHost string
+	ResolverTimeout   time.Duration
+
+	// Certificates expiring within ExpiryWarning are reported as warnings.
+	ExpiryWarning time.Duration
+
+	// Time at which certificates must be valid. Defaults to now.
+	Now time.Time
+}
+
+const (
+	DefaultResolverCheckHost = "example.com"
+	DefaultResolverTimeout   = 5 * time.Second
+	DefaultExpiryWarning     = 30 * 24 * time.Hour
+)
+
+type configChecker struct {
+	b        *ConfigBuilder
+	opts     CheckOptions
+	findings []ConfigFinding
+}
+
+func (cc *configChecker) add(severity, check, key string, format string, args ...interface{}) {
+	f := ConfigFinding{
+		Severity: severity,
+		Check:    check,
+		Key:      key,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if key != "" {
+		source, line := cc.b.locate(key)
+		if source.Kind != "" {
+			f.Source = source.String()
+			f.Line = line
+		}
+	}
+	cc.findings = append(cc.findings, f)
+}
+
+func (cc *configChecker) addError(err error) {
+	cc.findings = append(cc.findings, ErrorFindings(err)...)
+}
+
+// ErrorFindings returns an error of building a configuration, such as a
+// ConfigError, as findings.
+func ErrorFindings(err error) []ConfigFinding {
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		var ce *ConfigError
+		if !errors.As(err, &ce) {
+			return []ConfigFinding{{Severity: FindingError, Check: CheckConfig, Message: err.Error()}}
+		}
+		errs = ConfigErrors{ce}
+	}
+
+	findings := make([]ConfigFinding, len(errs))
+	for i, e := range errs {
+		findings[i] = ConfigFinding{
+			Severity: FindingError,
+			Check:    CheckConfig,
+			Key:      e.Key,
+			Line:     e.Line,
+			Message:  e.Err.Error(),
+		}
+		if e.Source.Kind != "" {
+			findings[i].Source = e.Source.String()
+		}
+	}
+	return findings
+}
+
+// hasError reports whether an error was found for key or a key below it.
+func (cc *configChecker) hasError(key string) bool {
+	for _, f := range cc.findings {
+		if f.Severity == FindingError && (f.Key == key || strings.HasPrefix(f.Key, key+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates the configuration beyond what Build does: it checks the
+// certificates, keys, CAs and CRLs of every TLS section, the overlaps between
+// allowed and denied ranges and, optionally, that the resolver answers. It
+// then builds the configuration, which also loads the egress ACLs, and
+// reports any error doing so.
+func (b *ConfigBuilder) Check(opts CheckOptions) []ConfigFinding {
+	if opts.ResolverCheckHost == "" {
+		opts.ResolverCheckHost = DefaultResolverCheckHost
+	}
+	if opts.ResolverTimeout == 0 {
+		opts.ResolverTimeout = DefaultResolverTimeout
+	}
+	if opts.ExpiryWarning == 0 {
+		opts.ExpiryWarning = DefaultExpiryWarning
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	cc := &configChecker{b: b, opts: opts}
+
+	yc, err := b.decode()
+	if err != nil {
+		cc.addError(err)
+		return cc.findings
+	}
+
+	if yc.Tls != nil {
+		cc.checkTls("tls", yc.Tls)
+	}
+	if yc.Admin != nil && yc.Admin.Tls != nil {
+		cc.checkTls("admin.tls", yc.Admin.Tls)
+	}
+	for i, yl := range yc.Listeners {
+		if yl.Tls != nil {
+			cc.checkTls(fmt.Sprintf("listeners[%d].tls", i), yl.Tls)
+		}
+	}
+
+	cc.checkRanges(yc)
+
+	if opts.CheckResolvers {
+		cc.checkResolver(yc.Resolvers)
+	}
+
+	if _, err := b.Build(); err != nil {
+		var ce *ConfigError
+		if !errors.As(err, &ce) || !cc.hasError(ce.Key) {
+			cc.addError(err)
+		}
+	}
+	return cc.findings
+}
+
+// checkCertValidity reports certificates which are not valid yet, have
+// expired or are about to.
+func (cc *configChecker) checkCertValidity(key, file string, cert *x509.Certificate) {
+	now := cc.opts.Now
+	name := cert.Subject.String()
+	switch {
+	case now.Before(cert.NotBefore):
+		cc.add(FindingError, CheckTLS, key, "certificate %q in %s is not valid before %s", name, file, cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		cc.add(FindingError, CheckTLS, key, "certificate %q in %s expired on %s", name, file, cert.NotAfter.Format(time.RFC3339))
+	case now.Add(cc.opts.ExpiryWarning).After(cert.NotAfter):
+		cc.add(FindingWarning, CheckTLS, key, "certificate %q in %s expires on %s", name, file, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func (cc *configChecker) checkTls(key string, t *yamlConfigTls) {
+	if t.CertFile == "" {
+		// Reported by Build.
+		return
+	}
+
+	certs, err := readCertificates(t.CertFile)
+	if err != nil {
+		cc.add(FindingError, CheckTLS, key+".cert_file", "%v", err)
+	} else {
+		for _, cert := range certs {
+			cc.checkCertValidity(key+".cert_file", t.CertFile, cert)
+		}
+
+		keyFile := t.KeyFile
+		if keyFile == "" {
+			keyFile = t.CertFile
+		}
+		if _, err := tls.LoadX509KeyPair(t.CertFile, keyFile); err != nil {
+			cc.add(FindingError, CheckTLS, key+".key_file", "%v", err)
+		}
+	}
+
+	var cas []*x509.Certificate
+	for _, caFile := range t.ClientCAFiles {
+		certs, err := readCertificates(caFile)
+		if err != nil {
+			cc.add(FindingError, CheckTLS, key+".client_ca_files", "%v", err)
+			continue
+		}
+		for _, ca := range certs {
+			cc.checkCertValidity(key+".client_ca_files", caFile, ca)
+			if !ca.IsCA {
+				cc.add(FindingWarning, CheckTLS, key+".client_ca_files", "certificate %q in %s is not a CA", ca.Subject.String(), caFile)
+			}
+		}
+		cas = append(cas, certs...)
+	}
+
+	for _, crlFile := range t.CRLFiles {
+		data, err := ioutil.ReadFile(crlFile)
+		if err != nil {
+			cc.add(FindingError, CheckTLS, key+".crl_files", "%v", err)
+			continue
+		}
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			cc.add(FindingError, CheckTLS, key+".crl_files", "invalid CRL in %s: %v", crlFile, err)
+			continue
+		}
+
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if ca.CheckCRLSignature(crl) == nil {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
+			cc.add(FindingError, CheckTLS, key+".crl_files", "CRL in %s is not signed by any of the client CAs, so it is ignored", crlFile)
+			continue
+		}
+		if next := crl.TBSCertList.NextUpdate; !next.IsZero() && cc.opts.Now.After(next) {
+			cc.add(FindingWarning, CheckTLS, key+".crl_files", "CRL in %s should have been updated on %s", crlFile, next.Format(time.RFC3339))
+		}
+	}
+}
+
+// readCertificates returns the certificates of a PEM file, which may also
+// hold other blocks such as a private key.
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return certs, nil
+}
+
+type checkedRange struct {
+	key string
+	RuleRange
+}
+
+func (r checkedRange) String() string {
+	if r.Port != 0 {
+		return net.JoinHostPort(r.Net.IP.String(), fmt.Sprint(r.Port))
+	}
+	if ones, bits := r.Net.Mask.Size(); ones == bits {
+		return r.Net.IP.String()
+	}
+	return r.Net.String()
+}
+
+// covers reports whether every address and port of o is in r.
+func (r checkedRange) covers(o checkedRange) bool {
+	rOnes, _ := r.Net.Mask.Size()
+	oOnes, _ := o.Net.Mask.Size()
+	return r.Net.Contains(o.Net.IP) && rOnes <= oOnes && (r.Port == 0 || r.Port == o.Port)
+}
+
+func (r checkedRange) overlaps(o checkedRange) bool {
+	return (r.Net.Contains(o.Net.IP) || o.Net.Contains(r.Net.IP)) &&
+		(r.Port == 0 || o.Port == 0 || r.Port == o.Port)
+}
+
+// checkRanges reports entries of the allow and deny lists which have no
+// effect, and allowed ranges which override part of a denied range.
+func (cc *configChecker) checkRanges(yc *yamlConfig) {
+	collect := func(key string, values []string, parse func([]string) ([]RuleRange, error)) []checkedRange {
+		ranges, err := parse(values)
+		if err != nil {
+			// Reported by Build.
+			return nil
+		}
+		checked := make([]checkedRange, len(ranges))
+		for i, r := range ranges {
+			checked[i] = checkedRange{key, r}
+		}
+		return checked
+	}
+	allow := append(
+		collect("allow_ranges", yc.AllowRanges, parseRanges),
+		collect("allow_addresses", yc.AllowAddresses, parseAddresses)...)
+	deny := append(
+		collect("deny_ranges", yc.DenyRanges, parseRanges),
+		collect("deny_addresses", yc.DenyAddresses, parseAddresses)...)
+
+	redundant := func(list []checkedRange) {
+		for i, r := range list {
+			for j, o := range list {
+				if i == j || !o.covers(r) || (r.covers(o) && j > i) {
+					continue
+				}
+				cc.add(FindingWarning, CheckRanges, r.key, "%s is already covered by %s", r, o)
+				break
+			}
+		}
+	}
+	redundant(allow)
+	redundant(deny)
+
+	// Allowed ranges take precedence over denied ones.
+	for _, d := range deny {
+		for _, a := range allow {
+			if a.covers(d) {
+				cc.add(FindingWarning, CheckRanges, d.key, "%s has no effect: it is within allowed %s", d, a)
+				break
+			}
+			if a.overlaps(d) {
+				cc.add(FindingWarning, CheckRanges, a.key, "%s allows part of denied %s", a, d)
+			}
+		}
+	}
+}
+
+func (cc *configChecker) checkResolver(addresses []string) {
+	c := &Config{}
+	if err := c.SetResolverAddresses(addresses); err != nil {
+		// Reported by Build.
+		return
+	}
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cc.opts.ResolverTimeout)
+	defer cancel()
+	if _, err := resolver.LookupHost(ctx, cc.opts.ResolverCheckHost); err != nil {
+		cc.add(FindingError, CheckResolver, "resolver_addresses", "could not resolve %s: %v", cc.opts.ResolverCheckHost, err)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCRL writes a CA and an empty CRL it issued to dir.
+func writeTestCRL(t *testing.T, dir string) (caFile, crlFile string) {
+	r := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CRL CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	r.NoError(err)
+	ca, err := x509.ParseCertificate(der)
+	r.NoError(err)
+	crlDER, err := ca.CreateCRL(rand.Reader, key, nil, time.Now(), time.Now().Add(time.Hour))
+	r.NoError(err)
+
+	caFile = filepath.Join(dir, "crl-ca.pem")
+	r.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	crlFile = filepath.Join(dir, "crl.pem")
+	r.NoError(ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600))
+	return caFile, crlFile
+}
+
+func checkConfig(t *testing.T, config string, opts CheckOptions) ([]ConfigFinding, string) {
+	path := writeConfig(t, config)
+	builder := NewConfigBuilder()
+	require.NoError(t, builder.AddFile(path))
+	return builder.Check(opts), path
+}
+
+func TestCheckConfigTLS(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	caFile, serverCert, serverKey, _ := writeTestPKI(t, dir, "client")
+	crlCA, crlFile := writeTestCRL(t, dir)
+	_, _, otherKey, _ := writeTestPKI(t, t.TempDir(), "client")
+
+	tlsConfig := func(keyFile, caFile string) string {
+		return fmt.Sprintf("tls:\n  cert_file: %s\n  key_file: %s\n  client_ca_files: [%s]\n  crl_files: [%s]\n",
+			serverCert, keyFile, caFile, crlFile)
+	}
+	opts := CheckOptions{ExpiryWarning: time.Minute}
+
+	findings, _ := checkConfig(t, tlsConfig(serverKey, crlCA), opts)
+	r.Empty(findings)
+
+	// The certificates of writeTestPKI expire in an hour.
+	findings, _ = checkConfig(t, tlsConfig(serverKey, crlCA), CheckOptions{})
+	r.Len(findings, 2)
+	for i, key := range []string{"tls.cert_file", "tls.client_ca_files"} {
+		r.Equal(FindingWarning, findings[i].Severity)
+		r.Equal(key, findings[i].Key)
+		r.Contains(findings[i].Message, "expires on")
+	}
+
+	opts.Now = time.Now().Add(2 * time.Hour)
+	findings, _ = checkConfig(t, tlsConfig(serverKey, crlCA), opts)
+	r.Len(findings, 3)
+	r.Contains(findings[0].Message, "expired on")
+	r.Equal("tls.client_ca_files", findings[1].Key)
+	r.Contains(findings[1].Message, "expired on")
+	r.Equal(FindingWarning, findings[2].Severity)
+	r.Equal("tls.crl_files", findings[2].Key)
+	r.Contains(findings[2].Message, "should have been updated on")
+	opts.Now = time.Time{}
+
+	findings, path := checkConfig(t, tlsConfig(otherKey, caFile), opts)
+	r.Len(findings, 2)
+	r.Equal(ConfigFinding{
+		Severity: FindingError,
+		Check:    CheckTLS,
+		Key:      "tls.key_file",
+		Source:   path,
+		Line:     3,
+		Message:  "tls: private key does not match public key",
+	}, findings[0])
+	r.Equal("tls.crl_files", findings[1].Key)
+	r.Contains(findings[1].Message, "is not signed by any of the client CAs")
+	r.Equal(fmt.Sprintf("error: %s:3: tls.key_file: tls: private key does not match public key", path), findings[0].String())
+}
+
+func TestCheckConfigRanges(t *testing.T) {
+	r := require.New(t)
+
+	findings, _ := checkConfig(t, `
+deny_ranges: [10.0.0.0/8, 10.1.0.0/16, 192.168.0.0/16]
+deny_addresses: ["192.168.1.1:443"]
+allow_ranges: [10.1.2.0/24, 192.168.0.0/16]
+`, CheckOptions{})
+
+	var messages []string
+	for _, f := range findings {
+		r.Equal(FindingWarning, f.Severity)
+		r.Equal(CheckRanges, f.Check)
+		messages = append(messages, f.Key+": "+f.Message)
+	}
+	r.ElementsMatch([]string{
+		"deny_ranges: 10.1.0.0/16 is already covered by 10.0.0.0/8",
+		"deny_addresses: 192.168.1.1:443 is already covered by 192.168.0.0/16",
+		"allow_ranges: 10.1.2.0/24 allows part of denied 10.0.0.0/8",
+		"allow_ranges: 10.1.2.0/24 allows part of denied 10.1.0.0/16",
+		"deny_ranges: 192.168.0.0/16 has no effect: it is within allowed 192.168.0.0/16",
+		"deny_addresses: 192.168.1.1:443 has no effect: it is within allowed 192.168.0.0/16",
+	}, messages)
+}
+
+func TestCheckConfigErrors(t *testing.T) {
+	r := require.New(t)
+
+	findings, path := checkConfig(t, "port: 4750\nresolver_addresses: [\"127.0.0.1:1\"]\nacl_file: /nonexistent/acl.yaml\n", CheckOptions{
+		CheckResolvers:  true,
+		ResolverTimeout: 500 * time.Millisecond,
+	})
+	r.Len(findings, 2)
+	r.Equal(CheckResolver, findings[0].Check)
+	r.Equal("resolver_addresses", findings[0].Key)
+	r.Equal(2, findings[0].Line)
+	r.Equal(CheckConfig, findings[1].Check)
+	r.Equal("acl_file", findings[1].Key)
+	r.Equal(path, findings[1].Source)
+
+	builder := NewConfigBuilder()
+	builder.Set("tls.cert_fiel", "a.pem", ConfigSource{Kind: ConfigSourceEnv, Name: "SMOKESCREEN_TLS_CERT_FIEL"})
+	findings = builder.Check(CheckOptions{})
+	r.Len(findings, 1)
+	r.Equal("error: $SMOKESCREEN_TLS_CERT_FIEL: tls.cert_fiel: unknown key", findings[0].String())
+}
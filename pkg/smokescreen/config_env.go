@@ -0,0 +1,131 @@
+package smokescreen
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigEnvPrefix starts the names of the environment variables setting
+// configuration keys. The name of the variable setting a key is the key in
+// upper case with dots replaced by underscores, such as
+// SMOKESCREEN_TLS_CERT_FILE for tls.cert_file.
+const ConfigEnvPrefix = "SMOKESCREEN_"
+
+// ConfigFileEnvVar names the configuration file. It is the only variable
+// which does not set a key.
+const ConfigFileEnvVar = ConfigEnvPrefix + "CONFIG_FILE"
+
+// configEnvKey is a configuration key settable by an environment variable.
+type configEnvKey struct {
+	key string
+	typ reflect.Type
+}
+
+// configEnvKeys maps environment variable names to the keys of yamlConfig
+// they set. Sections such as tls are broken down into their keys; lists and
+// maps are set as a whole.
+var configEnvKeys = func() map[string]configEnvKey {
+	keys := make(map[string]configEnvKey)
+	var walk func(t reflect.Type, path string)
+	walk = func(t reflect.Type, path string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			key := joinKey(path, name)
+
+			typ := field.Type
+			if typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			if typ.Kind() == reflect.Struct {
+				walk(typ, key)
+				continue
+			}
+			env := ConfigEnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+			if _, ok := keys[env]; ok {
+				panic(fmt.Sprintf("%s sets more than one configuration key", env))
+			}
+			keys[env] = configEnvKey{key: key, typ: typ}
+		}
+	}
+	walk(reflect.TypeOf(yamlConfig{}), "")
+	return keys
+}()
+
+// ConfigEnvVars returns the names of the environment variables which set
+// configuration keys, sorted.
+func ConfigEnvVars() []string {
+	var names []string
+	for name := range configEnvKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddEnv sets the configuration keys named by the SMOKESCREEN_* variables of
+// environ, which is in the form returned by os.Environ. Strings are taken
+// as is, lists may be given comma separated, and other values are parsed as
+// YAML, such as "[{port: 4751}]" or "{acl.deny: [zone:a]}".
+func (b *ConfigBuilder) AddEnv(environ []string) error {
+	var errs ConfigErrors
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		name := parts[0]
+		if !strings.HasPrefix(name, ConfigEnvPrefix) || name == ConfigFileEnvVar || len(parts) != 2 {
+			continue
+		}
+		source := ConfigSource{Kind: ConfigSourceEnv, Name: name}
+
+		ek, ok := configEnvKeys[name]
+		if !ok {
+			errs = append(errs, &ConfigError{Source: source, Err: fmt.Errorf("unknown environment variable")})
+			continue
+		}
+		value, err := parseEnvValue(parts[1], ek.typ)
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: ek.key, Source: source, Err: err})
+			continue
+		}
+		b.Set(ek.key, value, source)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func parseEnvValue(s string, typ reflect.Type) (interface{}, error) {
+	switch {
+	case typ.Kind() == reflect.String:
+		return s, nil
+	case typ.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(s), "["):
+		values := []string{}
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values, nil
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(s), &value); err != nil {
+		return nil, fmt.Errorf("invalid value: %v", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	return value, nil
+}
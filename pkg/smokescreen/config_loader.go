@@ -3,12 +3,16 @@ package smokescreen
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+	aclv2 "github.com/stripe/smokescreen/pkg/smokescreen/acl/v2"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing"
 )
 
 type yamlConfigTls struct {
@@ -16,8 +20,195 @@ type yamlConfigTls struct {
 	KeyFile       string   `yaml:"key_file"`
 	ClientCAFiles []string `yaml:"client_ca_files"`
 	CRLFiles      []string `yaml:"crl_files"`
+	HTTP2         bool     `yaml:"http2"`
 }
 
+type yamlConfigSocks5 struct {
+	Ip             string
+	Port           uint16
+	UsernameAsRole bool `yaml:"username_as_role"`
+}
+
+type yamlConfigPrometheus struct {
+	ListenAddress string `yaml:"listen_address"`
+	Path          string
+	StatsSocket   bool `yaml:"stats_socket"`
+	Namespace     string
+	DropLabels    []string             `yaml:"drop_labels"`
+	LabelLimits   map[string]int       `yaml:"label_limits"`
+	Buckets       map[string][]float64 `yaml:"buckets"`
+}
+
+type yamlConfigAclRevocation struct {
+	Action      string
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+type yamlConfigAclSource struct {
+	URL          string        `yaml:"url"`
+	SignatureURL string        `yaml:"signature_url"`
+	CacheFile    string        `yaml:"cache_file"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Tls          *yamlConfigAclSourceTls
+}
+
+// yamlConfigAclSourceTls is the client certificate, and the CAs trusted for
+// the server, of the ACL source.
+type yamlConfigAclSourceTls struct {
+	CertFile string   `yaml:"cert_file"`
+	KeyFile  string   `yaml:"key_file"`
+	CAFiles  []string `yaml:"ca_files"`
+}
+
+type yamlConfigAclSignature struct {
+	PublicKeyFiles []string `yaml:"public_key_files"`
+	CAFiles        []string `yaml:"ca_files"`
+}
+
+type yamlConfigAdmin struct {
+	ListenAddress string `yaml:"listen_address"`
+	Tls           *yamlConfigTls
+}
+
+type yamlConfigTracing struct {
+	OtlpEndpoint  string            `yaml:"otlp_endpoint"`
+	ServiceName   string            `yaml:"service_name"`
+	Headers       map[string]string `yaml:"headers"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+}
+
+type yamlConfigProxyAuth struct {
+	Realm        string
+	HtpasswdFile string `yaml:"htpasswd_file"`
+	JWKSFile     string `yaml:"jwks_file"`
+	Issuer       string
+	Audience     string
+	RoleClaim    string `yaml:"role_claim"`
+}
+
+type yamlConfigListener struct {
+	Name                 string
+	Ip                   string
+	Port                 uint16
+	EinhornFd            int    `yaml:"einhorn_fd"`
+	UnixPath             string `yaml:"unix_path"`
+	UnixFileMode         string `yaml:"unix_file_mode"`
+	UnixOwner            string `yaml:"unix_owner"`
+	SupportProxyProtocol bool   `yaml:"support_proxy_protocol"`
+	Tls                  *yamlConfigTls
+	EgressAclFile        string             `yaml:"acl_file"`
+	RoleFromRequest      []yamlRoleStrategy `yaml:"role_from_request"`
+
+	ProxyProtocolStrict        bool     `yaml:"proxy_protocol_strict"`
+	ProxyProtocolTrustedRanges []string `yaml:"proxy_protocol_trusted_ranges"`
+}
+
+type yamlRoleCIDR struct {
+	CIDR string
+	Role string
+}
+
+// yamlRoleStrategy is a role strategy, either as a mapping or in the command
+// line form accepted by ParseRoleStrategy, such as "header:X-Role".
+type yamlRoleStrategy struct {
+	Type        string
+	Prefix      string
+	TrustDomain string `yaml:"trust_domain"`
+	Header      string
+	Uids        map[uint32]string
+	CIDRs       []yamlRoleCIDR `yaml:"cidrs"`
+	TLVType     uint8          `yaml:"tlv_type"`
+
+	short string
+}
+
+func (y *yamlRoleStrategy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&y.short); err == nil {
+		return nil
+	}
+	type plain yamlRoleStrategy
+	return unmarshal((*plain)(y))
+}
+
+func roleFromRequestFromYaml(ys []yamlRoleStrategy) (func(*http.Request) (string, error), error) {
+	var strategies []RoleStrategy
+	for _, y := range ys {
+		if y.short != "" {
+			rs, err := ParseRoleStrategy(y.short)
+			if err != nil {
+				return nil, err
+			}
+			strategies = append(strategies, rs)
+			continue
+		}
+		rs := RoleStrategy{
+			Type:        y.Type,
+			Prefix:      y.Prefix,
+			TrustDomain: y.TrustDomain,
+			Header:      y.Header,
+			Uids:        y.Uids,
+			TLVType:     y.TLVType,
+		}
+		for _, c := range y.CIDRs {
+			_, ipnet, err := net.ParseCIDR(c.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			rs.CIDRs = append(rs.CIDRs, RoleCIDR{Net: *ipnet, Role: c.Role})
+		}
+		strategies = append(strategies, rs)
+	}
+	return NewRoleFromRequest(strategies)
+}
+
+// rolesFromProxyHeader reports whether any of the role strategies ys takes
+// roles from what a PROXY protocol header may claim: the client's address
+// or its TLVs.
+func rolesFromProxyHeader(ys []yamlRoleStrategy) bool {
+	for _, y := range ys {
+		typ := y.Type
+		if y.short != "" {
+			rs, err := ParseRoleStrategy(y.short)
+			if err != nil {
+				continue
+			}
+			typ = rs.Type
+		}
+		if typ == RoleStrategyCIDR || typ == RoleStrategyProxyTLV {
+			return true
+		}
+	}
+	return false
+}
+
+// errUntrustedProxyRoles refuses PROXY protocol headers from any client when
+// they determine roles, which would let every client claim any role.
+var errUntrustedProxyRoles = errors.New("'proxy_protocol_trusted_ranges' is required when 'role_from_request' takes roles from PROXY protocol headers ('cidr' or 'proxy_tlv')")
+
+type yamlConfigUnix struct {
+	Path     string
+	FileMode string `yaml:"file_mode"`
+	Owner    string
+}
+
+type yamlConfigTransparent struct {
+	Ip   string
+	Port uint16
+	Mode string
+}
+
+type yamlOutboundSourceRule struct {
+	Role        string   `yaml:"role"`
+	Project     string   `yaml:"project"`
+	Destination string   `yaml:"destination"`
+	Addresses   []string `yaml:"addresses"`
+}
+
+// yamlConfig is the schema of the configuration file. It covers every
+// setting of Config, except for those only available to Go callers such as
+// Log and the function fields.
+//
 // Port and ExitTimeout use a pointer so we can distinguish unset vs explicit
 // zero, to avoid overriding a non-zero default when the value is not set.
 type yamlConfig struct {
@@ -25,6 +216,8 @@ type yamlConfig struct {
 	Port                 *uint16
 	DenyRanges           []string `yaml:"deny_ranges"`
 	AllowRanges          []string `yaml:"allow_ranges"`
+	DenyAddresses        []string `yaml:"deny_addresses"`
+	AllowAddresses       []string `yaml:"allow_addresses"`
 	Resolvers            []string `yaml:"resolver_addresses"`
 	StatsdAddress        string   `yaml:"statsd_address"`
 	EgressAclFile        string   `yaml:"acl_file"`
@@ -33,10 +226,27 @@ type yamlConfig struct {
 	AllowMissingRole     bool     `yaml:"allow_missing_role"`
 	Network              string   `yaml:"network"`
 
+	// Persistent tags of metrics, by metric name. StatsdNamespace is a
+	// pointer so that it can be set to the empty string.
+	StatsdNamespace *string             `yaml:"statsd_namespace"`
+	MetricTags      map[string][]string `yaml:"metric_tags"`
+
+	DisabledAclPolicyActions []string `yaml:"disable_acl_policy_actions"`
+	PublicSuffixListFile     string   `yaml:"public_suffix_list_file"`
+	RejectPublicSuffixGlobs  bool     `yaml:"reject_public_suffix_globs"`
+
 	ConnectTimeout time.Duration  `yaml:"connect_timeout"`
 	IdleTimeout    time.Duration  `yaml:"idle_timeout"`
 	ExitTimeout    *time.Duration `yaml:"exit_timeout"`
 
+	MaxConnLifetime       time.Duration            `yaml:"max_conn_lifetime"`
+	RoleMaxConnLifetime   map[string]time.Duration `yaml:"role_max_conn_lifetime"`
+	MaxConnLifetimeJitter float64                  `yaml:"max_conn_lifetime_jitter"`
+
+	MaxConcurrentConns int     `yaml:"max_concurrent_conns"`
+	MaxRequestRate     float64 `yaml:"max_request_rate"`
+	RequestBurst       int     `yaml:"request_burst"`
+
 	StatsSocketDir      string `yaml:"stats_socket_dir"`
 	StatsSocketFileMode string `yaml:"stats_socket_file_mode"`
 
@@ -45,8 +255,29 @@ type yamlConfig struct {
 
 	TimeConnect bool `yaml:"time_connect"`
 
-	Tls *yamlConfigTls
-	// Currently not configurable via YAML: RoleFromRequest, Log, DisabledAclPolicyActions
+	ProxyProtocolStrict        bool     `yaml:"proxy_protocol_strict"`
+	ProxyProtocolTrustedRanges []string `yaml:"proxy_protocol_trusted_ranges"`
+
+	VerifySNI bool `yaml:"verify_sni"`
+
+	Tls         *yamlConfigTls
+	Socks5      *yamlConfigSocks5
+	Transparent *yamlConfigTransparent
+	Prometheus  *yamlConfigPrometheus
+	Tracing     *yamlConfigTracing
+	Admin       *yamlConfigAdmin
+
+	AclRevocation *yamlConfigAclRevocation `yaml:"acl_revocation"`
+	AclSource     *yamlConfigAclSource     `yaml:"acl_source"`
+	AclSignature  *yamlConfigAclSignature  `yaml:"acl_signature"`
+
+	OutboundSourceAddresses []yamlOutboundSourceRule `yaml:"outbound_source_addresses"`
+
+	RoleFromRequest []yamlRoleStrategy   `yaml:"role_from_request"`
+	ProxyAuth       *yamlConfigProxyAuth `yaml:"proxy_auth"`
+
+	Listeners  []yamlConfigListener
+	ListenUnix *yamlConfigUnix `yaml:"listen_unix"`
 
 	UnsafeAllowPrivateRanges bool	`yaml:"unsafe_allow_private_ranges"`
 }
@@ -59,57 +290,172 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	return yc.apply(c)
+}
+
+// configKeyError is an invalid value of a configuration key, such as
+// "tls.cert_file" or "listeners[1].acl_file".
+type configKeyError struct {
+	key string
+	err error
+}
+
+func (e *configKeyError) Error() string {
+	return e.key + ": " + e.err.Error()
+}
+
+func (e *configKeyError) Unwrap() error {
+	return e.err
+}
 
+func keyError(key string, err error) error {
+	return &configKeyError{key: key, err: err}
+}
+
+// apply sets up c from the configuration file yc. Errors name the offending
+// key with a configKeyError.
+func (yc *yamlConfig) apply(c *Config) error {
 	c.Ip = yc.Ip
 
 	if yc.Port != nil {
 		c.Port = *yc.Port
 	}
 
-	err = c.SetDenyRanges(yc.DenyRanges)
+	err := c.SetDenyRanges(yc.DenyRanges)
 	if err != nil {
-		return err
+		return keyError("deny_ranges", err)
 	}
 
 	err = c.SetAllowRanges(yc.AllowRanges)
 	if err != nil {
-		return err
+		return keyError("allow_ranges", err)
+	}
+
+	err = c.SetDenyAddresses(yc.DenyAddresses)
+	if err != nil {
+		return keyError("deny_addresses", err)
+	}
+
+	err = c.SetAllowAddresses(yc.AllowAddresses)
+	if err != nil {
+		return keyError("allow_addresses", err)
 	}
 
 	err = c.SetResolverAddresses(yc.Resolvers)
 	if err != nil {
-		return err
+		return keyError("resolver_addresses", err)
 	}
 
 	c.IdleTimeout = yc.IdleTimeout
+	c.MaxConnLifetime = yc.MaxConnLifetime
+	c.RoleMaxConnLifetime = yc.RoleMaxConnLifetime
+	c.MaxConnLifetimeJitter = yc.MaxConnLifetimeJitter
+	if c.MaxConnLifetimeJitter < 0 || c.MaxConnLifetimeJitter > 1 {
+		return keyError("max_conn_lifetime_jitter", fmt.Errorf("must be between 0 and 1, not %v", c.MaxConnLifetimeJitter))
+	}
+	err = c.SetConnLimits(yc.MaxConcurrentConns, yc.MaxRequestRate, yc.RequestBurst)
+	if err != nil {
+		return keyError("max_concurrent_conns", err)
+	}
+	c.VerifySNI = yc.VerifySNI
 	c.ConnectTimeout = yc.ConnectTimeout
+	c.TransportMaxIdleConns = yc.TransportMaxIdleConns
+	c.TransportMaxIdleConnsPerHost = yc.TransportMaxIdleConnsPerHost
 	if yc.ExitTimeout != nil {
 		c.ExitTimeout = *yc.ExitTimeout
 	}
 
-	err = c.SetupStatsd(yc.StatsdAddress)
+	namespace := DefaultStatsdNamespace
+	if yc.StatsdNamespace != nil {
+		namespace = *yc.StatsdNamespace
+	}
+	err = c.SetupStatsdWithNamespace(yc.StatsdAddress, namespace)
 	if err != nil {
-		return err
+		return keyError("statsd_address", err)
+	}
+	for metric, tags := range yc.MetricTags {
+		err = c.MetricsClient.AddMetricTags(metric, tags)
+		if err != nil {
+			return keyError("metric_tags."+metric, err)
+		}
+	}
+
+	if yc.Prometheus != nil {
+		c.PrometheusAddr = yc.Prometheus.ListenAddress
+		c.PrometheusPath = yc.Prometheus.Path
+		c.PrometheusOnStatsSocket = yc.Prometheus.StatsSocket
+		err = c.SetupPrometheus(stats.PrometheusConfig{
+			Namespace:   yc.Prometheus.Namespace,
+			DropLabels:  yc.Prometheus.DropLabels,
+			LabelLimits: yc.Prometheus.LabelLimits,
+			Buckets:     yc.Prometheus.Buckets,
+		})
+		if err != nil {
+			return keyError("prometheus", err)
+		}
+	}
+
+	if yc.Tracing != nil {
+		err = c.SetupTracing(tracing.Config{
+			Endpoint:      yc.Tracing.OtlpEndpoint,
+			ServiceName:   yc.Tracing.ServiceName,
+			Headers:       yc.Tracing.Headers,
+			FlushInterval: yc.Tracing.FlushInterval,
+		})
+		if err != nil {
+			return keyError("tracing", err)
+		}
+	}
+
+	// The disabled actions, the public suffix checks and the signatures
+	// apply to every ACL, so they must be known first.
+	c.DisabledAclPolicyActions = yc.DisabledAclPolicyActions
+	c.RejectPublicSuffixGlobs = yc.RejectPublicSuffixGlobs
+	if yc.PublicSuffixListFile != "" {
+		c.PublicSuffixList, err = acl.LoadPublicSuffixList(yc.PublicSuffixListFile)
+		if err != nil {
+			return keyError("public_suffix_list_file", err)
+		}
+	}
+	if yc.AclSignature != nil {
+		err = c.SetupAclSignatures(yc.AclSignature.PublicKeyFiles, yc.AclSignature.CAFiles)
+		if err != nil {
+			return keyError("acl_signature", err)
+		}
 	}
 
 	if yc.EgressAclFile != "" {
 		err = c.SetupEgressAcl(yc.EgressAclFile)
 		if err != nil {
-			return err
+			return keyError("acl_file", err)
+		}
+	}
+
+	if yc.AclSource != nil {
+		if yc.EgressAclFile != "" {
+			return keyError("acl_source", errors.New("'acl_file' and 'acl_source' are mutually exclusive"))
+		}
+		err = c.setupAclSource(yc.AclSource)
+		if err != nil {
+			return keyError("acl_source", err)
 		}
 	}
 
 	c.SupportProxyProtocol = yc.SupportProxyProtocol
+	c.ProxyProtocolStrict = yc.ProxyProtocolStrict
+	err = c.SetProxyProtocolTrustedRanges(yc.ProxyProtocolTrustedRanges)
+	if err != nil {
+		return keyError("proxy_protocol_trusted_ranges", err)
+	}
 
 	if yc.StatsSocketDir != "" {
 		c.StatsSocketDir = yc.StatsSocketDir
 	}
 
 	if yc.StatsSocketFileMode != "" {
-		filemode, err := strconv.ParseInt(yc.StatsSocketFileMode, 8, 9)
-
+		filemode, err := strconv.ParseUint(yc.StatsSocketFileMode, 8, 9)
 		if err != nil {
-			c.Log.Fatal(err)
+			return keyError("stats_socket_file_mode", err)
 		}
 
 		c.StatsSocketFileMode = os.FileMode(filemode)
@@ -117,7 +463,7 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	if yc.Tls != nil {
 		if yc.Tls.CertFile == "" {
-			return errors.New("'tls' section requires 'cert_file'")
+			return keyError("tls", errors.New("'cert_file' is required"))
 		}
 
 		key_file := yc.Tls.KeyFile
@@ -128,24 +474,205 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 		err = c.SetupTls(yc.Tls.CertFile, key_file, yc.Tls.ClientCAFiles)
 		if err != nil {
-			return err
+			return keyError("tls", err)
 		}
 
 		err = c.SetupCrls(yc.Tls.CRLFiles)
 		if err != nil {
-			return err
+			return keyError("tls.crl_files", err)
+		}
+
+		c.HTTP2 = yc.Tls.HTTP2
+	}
+
+	if yc.AclRevocation != nil {
+		err = c.SetAclRevocation(yc.AclRevocation.Action, yc.AclRevocation.GracePeriod)
+		if err != nil {
+			return keyError("acl_revocation", err)
 		}
 	}
 
+	if yc.Admin != nil {
+		if yc.Admin.Tls == nil {
+			return keyError("admin", errors.New("'tls' is required"))
+		}
+		key_file := yc.Admin.Tls.KeyFile
+		if key_file == "" {
+			key_file = yc.Admin.Tls.CertFile
+		}
+		err = c.SetupAdminTls(yc.Admin.Tls.CertFile, key_file, yc.Admin.Tls.ClientCAFiles)
+		if err != nil {
+			return keyError("admin.tls", err)
+		}
+		c.AdminAddr = yc.Admin.ListenAddress
+	}
+
 	if yc.Network != "" {
 		switch yc.Network {
 		case "ip", "ip4", "ip6":
 		default:
-			return fmt.Errorf("invalid network type: %v", yc.Network)
+			return keyError("network", fmt.Errorf("invalid network type: %v", yc.Network))
 		}
 		c.Network = yc.Network
 	}
 
+	if yc.Socks5 != nil {
+		if yc.Socks5.Port == 0 {
+			return keyError("socks5", errors.New("'port' is required"))
+		}
+		c.SocksIp = yc.Socks5.Ip
+		c.SocksPort = yc.Socks5.Port
+		if yc.Socks5.UsernameAsRole && yc.ProxyAuth == nil {
+			return keyError("socks5", errors.New("'username_as_role' requires 'proxy_auth' to verify passwords"))
+		}
+		c.SocksUsernameAsRole = yc.Socks5.UsernameAsRole
+	}
+
+	if yc.Transparent != nil {
+		if yc.Transparent.Port == 0 {
+			return keyError("transparent", errors.New("'port' is required"))
+		}
+		c.TransparentIp = yc.Transparent.Ip
+		c.TransparentPort = yc.Transparent.Port
+		if err := c.SetTransparentMode(yc.Transparent.Mode); err != nil {
+			return keyError("transparent.mode", err)
+		}
+	}
+
+	if len(yc.OutboundSourceAddresses) > 0 {
+		var rules []OutboundSourceRule
+		for i, r := range yc.OutboundSourceAddresses {
+			rule := OutboundSourceRule{
+				Role:        r.Role,
+				Project:     r.Project,
+				Destination: r.Destination,
+			}
+			for _, addr := range r.Addresses {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					return keyError(fmt.Sprintf("outbound_source_addresses[%d].addresses", i), fmt.Errorf("invalid outbound source address '%s'", addr))
+				}
+				rule.Addresses = append(rule.Addresses, ip)
+			}
+			rules = append(rules, rule)
+		}
+		err = c.SetOutboundSourceRules(rules)
+		if err != nil {
+			return keyError("outbound_source_addresses", err)
+		}
+	}
+
+	if len(yc.RoleFromRequest) > 0 {
+		c.RoleFromRequest, err = roleFromRequestFromYaml(yc.RoleFromRequest)
+		if err != nil {
+			return keyError("role_from_request", err)
+		}
+	}
+	if yc.SupportProxyProtocol && len(yc.ProxyProtocolTrustedRanges) == 0 && rolesFromProxyHeader(yc.RoleFromRequest) {
+		return keyError("support_proxy_protocol", errUntrustedProxyRoles)
+	}
+
+	if yc.ProxyAuth != nil {
+		c.ProxyAuth, err = NewProxyAuthenticator(ProxyAuthConfig{
+			Realm:        yc.ProxyAuth.Realm,
+			HtpasswdFile: yc.ProxyAuth.HtpasswdFile,
+			JWKSFile:     yc.ProxyAuth.JWKSFile,
+			Issuer:       yc.ProxyAuth.Issuer,
+			Audience:     yc.ProxyAuth.Audience,
+			RoleClaim:    yc.ProxyAuth.RoleClaim,
+		})
+		if err != nil {
+			return keyError("proxy_auth", err)
+		}
+	}
+
+	for i, yl := range yc.Listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		lc := &ListenerConfig{
+			Name:                 yl.Name,
+			Ip:                   yl.Ip,
+			Port:                 yl.Port,
+			EinhornFd:            yl.EinhornFd,
+			UnixPath:             yl.UnixPath,
+			UnixOwner:            yl.UnixOwner,
+			SupportProxyProtocol: yl.SupportProxyProtocol,
+			ProxyProtocolStrict:  yl.ProxyProtocolStrict,
+		}
+		lc.ProxyProtocolTrustedRanges, err = parseRanges(yl.ProxyProtocolTrustedRanges)
+		if err != nil {
+			return keyError(key+".proxy_protocol_trusted_ranges", err)
+		}
+		if lc.Name == "" {
+			lc.Name = fmt.Sprintf("listener-%d", i)
+		}
+
+		if yl.UnixFileMode != "" {
+			filemode, err := strconv.ParseUint(yl.UnixFileMode, 8, 9)
+			if err != nil {
+				return keyError(key+".unix_file_mode", err)
+			}
+			lc.UnixFileMode = os.FileMode(filemode)
+		}
+
+		if yl.Tls != nil {
+			if yl.Tls.CertFile == "" {
+				return keyError(key+".tls", errors.New("'cert_file' is required"))
+			}
+			keyFile := yl.Tls.KeyFile
+			if keyFile == "" {
+				keyFile = yl.Tls.CertFile
+			}
+			lc.TlsConfig, err = c.NewTlsConfig(yl.Tls.CertFile, keyFile, yl.Tls.ClientCAFiles, yl.Tls.CRLFiles)
+			if err != nil {
+				return keyError(key+".tls", err)
+			}
+			lc.HTTP2 = yl.Tls.HTTP2
+		}
+
+		if len(yl.RoleFromRequest) > 0 {
+			lc.RoleFromRequest, err = roleFromRequestFromYaml(yl.RoleFromRequest)
+			if err != nil {
+				return keyError(key+".role_from_request", err)
+			}
+		}
+		roles := yl.RoleFromRequest
+		if len(roles) == 0 {
+			roles = yc.RoleFromRequest
+		}
+		if yl.SupportProxyProtocol && len(yl.ProxyProtocolTrustedRanges) == 0 && rolesFromProxyHeader(roles) {
+			return keyError(key+".support_proxy_protocol", errUntrustedProxyRoles)
+		}
+
+		if yl.EgressAclFile != "" {
+			lc.EgressACL, err = aclv2.LoadWithOptions(c.Log, yl.EgressAclFile, c.DisabledAclPolicyActions, c.aclLoadOptions())
+			if err != nil {
+				return keyError(key+".acl_file", err)
+			}
+			lc.EgressAclFile = yl.EgressAclFile
+		}
+
+		if err := c.AddListener(lc); err != nil {
+			return keyError(key, err)
+		}
+	}
+
+	if yc.ListenUnix != nil {
+		if yc.ListenUnix.Path == "" {
+			return keyError("listen_unix", errors.New("'path' is required"))
+		}
+		var mode os.FileMode
+		if yc.ListenUnix.FileMode != "" {
+			filemode, err := strconv.ParseUint(yc.ListenUnix.FileMode, 8, 9)
+			if err != nil {
+				return keyError("listen_unix.file_mode", err)
+			}
+			mode = os.FileMode(filemode)
+		}
+		if err := c.SetUnixListener(yc.ListenUnix.Path, mode, yc.ListenUnix.Owner); err != nil {
+			return keyError("listen_unix", err)
+		}
+	}
+
 	c.AllowMissingRole = yc.AllowMissingRole
 	c.AdditionalErrorMessageOnDeny = yc.DenyMessageExtra
 	c.TimeConnect = yc.TimeConnect
@@ -154,16 +681,11 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// LoadConfig sets up a new Config from the configuration file at filePath.
 func LoadConfig(filePath string) (*Config, error) {
-	bytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
+	builder := NewConfigBuilder()
+	if err := builder.AddFile(filePath); err != nil {
 		return nil, err
 	}
-
-	config := &Config{}
-	if err := yaml.UnmarshalStrict(bytes, config); err != nil {
-		return nil, err
-	}
-
-	return config, nil
+	return builder.Build()
 }
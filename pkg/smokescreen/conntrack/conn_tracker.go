@@ -1,26 +1,36 @@
 package conntrack
 
 import (
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
 )
 
 type Tracker struct {
 	*sync.Map
 	ShuttingDown atomic.Value
 	Wg           *sync.WaitGroup
-	statsc       statsd.ClientInterface
+	statsc       stats.Sink
 
 	// A connection is idle if it has been inactive (no bytes in/out) for this
 	// many seconds.
 	IdleTimeout time.Duration
+
+	// Connections are closed once they are MaxLifetime old, or as old as the
+	// entry of their role in RoleMaxLifetime if there is one. Zero means no
+	// limit. The lifetime of each connection is shortened by a random
+	// fraction of up to MaxLifetimeJitter, so that connections opened
+	// together are not all closed at once.
+	MaxLifetime       time.Duration
+	RoleMaxLifetime   map[string]time.Duration
+	MaxLifetimeJitter float64
 }
 
-func NewTracker(idle time.Duration, statsc statsd.ClientInterface, logger *logrus.Logger, sd atomic.Value) *Tracker {
+func NewTracker(idle time.Duration, statsc stats.Sink, logger *logrus.Logger, sd atomic.Value) *Tracker {
 	return &Tracker{
 		Map:          &sync.Map{},
 		ShuttingDown: sd,
@@ -30,6 +40,23 @@ func NewTracker(idle time.Duration, statsc statsd.ClientInterface, logger *logru
 	}
 }
 
+// lifetime returns how long a new connection of role may live, or 0 if it
+// has no limit.
+func (tr *Tracker) lifetime(role string) time.Duration {
+	max, ok := tr.RoleMaxLifetime[role]
+	if !ok {
+		max = tr.MaxLifetime
+	}
+	if max <= 0 || tr.MaxLifetimeJitter <= 0 {
+		return max
+	}
+	jitter := tr.MaxLifetimeJitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	return max - time.Duration(rand.Float64()*jitter*float64(max))
+}
+
 // MaybeIdleIn returns the longest amount of time it will take for all tracked
 // connections to become idle based on the configured IdleTimeout.
 //
@@ -8,6 +8,7 @@ import (
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,6 +46,54 @@ func TestConnTrackerMaybeIdleIn(t *testing.T) {
 	assert.Equal(time.Second, idleIn)
 }
 
+// TestConnTrackerMaxLifetime tests that connections are closed once they reach
+// the maximum lifetime of their role
+func TestConnTrackerMaxLifetime(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(0)
+	tr.MaxLifetime = 50 * time.Millisecond
+	tr.RoleMaxLifetime = map[string]time.Duration{"unlimited": 0}
+
+	logger, hook := logrustest.NewNullLogger()
+	client, server := net.Pipe()
+	defer server.Close()
+	limited := tr.NewInstrumentedConn(client, logrus.NewEntry(logger), "limited", "localhost:443", "connect")
+	unlimited := tr.NewInstrumentedConn(&net.UnixConn{}, logrus.NewEntry(testLogger), "unlimited", "localhost:443", "connect")
+
+	assert.Eventually(func() bool {
+		limited.Lock()
+		defer limited.Unlock()
+		return limited.closed
+	}, time.Second, 5*time.Millisecond)
+
+	entry := hook.LastEntry()
+	assert.Equal(CanonicalProxyConnClose, entry.Message)
+	assert.Equal(true, entry.Data[LogFieldMaxLifetime])
+	assert.Equal("max_lifetime", entry.Data[LogFieldCloseReason])
+
+	unlimited.Lock()
+	assert.False(unlimited.closed)
+	unlimited.Unlock()
+}
+
+func TestConnTrackerLifetimeJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(0)
+	tr.MaxLifetime = time.Hour
+	tr.RoleMaxLifetime = map[string]time.Duration{"short": time.Minute}
+	assert.Equal(time.Hour, tr.lifetime("any"))
+
+	tr.MaxLifetimeJitter = 0.1
+	for i := 0; i < 100; i++ {
+		lifetime := tr.lifetime("any")
+		assert.True(lifetime > 54*time.Minute && lifetime <= time.Hour, lifetime)
+		lifetime = tr.lifetime("short")
+		assert.True(lifetime > 54*time.Second && lifetime <= time.Minute, lifetime)
+	}
+}
+
 func NewTestTracker(idle time.Duration) *Tracker {
 	sd := atomic.Value{}
 	sd.Store(false)
@@ -12,6 +12,8 @@ import (
 )
 
 const (
+	LogFieldID              = "id"
+	LogFieldListener        = "listener"
 	LogFieldBytesIn         = "bytes_in"
 	LogFieldBytesOut        = "bytes_out"
 	LogFieldEndTime         = "end_time"
@@ -19,11 +21,15 @@ const (
 	LogFieldError           = "error"
 	LogFieldLastActivity    = "last_activity"
 	LogFieldOutboundAddr    = "outbound_remote_addr"
+	LogFieldCloseReason     = "close_reason"
+	LogFieldMaxLifetime     = "max_lifetime_reached"
 	CanonicalProxyConnClose = "CANONICAL-PROXY-CN-CLOSE"
 )
 
 type InstrumentedConn struct {
 	net.Conn
+	ID           string // The id field of the connection's log lines
+	Listener     string // The listener field of the connection's log lines
 	Role         string
 	OutboundHost string
 	proxyType    string
@@ -43,6 +49,10 @@ type InstrumentedConn struct {
 
 	closed     bool
 	CloseError error
+
+	lifetimeTimer *time.Timer
+
+	onClose []func(*InstrumentedConn)
 }
 
 func (t *Tracker) NewInstrumentedConnWithTimeout(conn net.Conn, timeout time.Duration, logger *logrus.Entry, role, outboundHost, proxyType string) *InstrumentedConn {
@@ -57,10 +67,16 @@ func (t *Tracker) NewInstrumentedConn(conn net.Conn, logger *logrus.Entry, role,
 	bytesIn := uint64(0)
 	bytesOut := uint64(0)
 
+	id, _ := logger.Data[LogFieldID].(string)
+	listener, _ := logger.Data[LogFieldListener].(string)
+
 	ic := &InstrumentedConn{
 		Conn:         conn,
+		ID:           id,
+		Listener:     listener,
 		Role:         role,
 		OutboundHost: outboundHost,
+		proxyType:    proxyType,
 		tracker:      t,
 		logger:       logger,
 		Start:        now,
@@ -72,6 +88,12 @@ func (t *Tracker) NewInstrumentedConn(conn net.Conn, logger *logrus.Entry, role,
 	ic.tracker.Store(ic, nil)
 	ic.tracker.Wg.Add(1)
 
+	if lifetime := t.lifetime(role); lifetime > 0 {
+		ic.Lock()
+		ic.lifetimeTimer = time.AfterFunc(lifetime, ic.maxLifetimeReached)
+		ic.Unlock()
+	}
+
 	return ic
 }
 
@@ -81,14 +103,22 @@ func (ic *InstrumentedConn) Error(err error) {
 
 func (ic *InstrumentedConn) Close() error {
 	ic.Lock()
-	defer ic.Unlock()
-
 	if ic.closed {
+		defer ic.Unlock()
 		return ic.CloseError
 	}
+	return ic.closeAndUnlock()
+}
 
+// closeAndUnlock closes the connection, which the caller has locked and found
+// open. It unlocks the connection before calling the OnClose callbacks, so
+// they may use it.
+func (ic *InstrumentedConn) closeAndUnlock() error {
 	ic.closed = true
 	ic.tracker.Delete(ic)
+	if ic.lifetimeTimer != nil {
+		ic.lifetimeTimer.Stop()
+	}
 
 	end := time.Now()
 	duration := end.Sub(ic.Start).Seconds()
@@ -132,7 +162,65 @@ func (ic *InstrumentedConn) Close() error {
 
 	ic.tracker.Wg.Done()
 	ic.CloseError = ic.Conn.Close()
-	return ic.CloseError
+	err := ic.CloseError
+	onClose := ic.onClose
+	ic.onClose = nil
+	ic.Unlock()
+
+	for _, fn := range onClose {
+		fn(ic)
+	}
+	return err
+}
+
+// OnClose registers fn to be called once the connection is closed. If it is
+// already closed, fn is called immediately.
+func (ic *InstrumentedConn) OnClose(fn func(*InstrumentedConn)) {
+	ic.Lock()
+	if ic.closed {
+		ic.Unlock()
+		fn(ic)
+		return
+	}
+	ic.onClose = append(ic.onClose, fn)
+	ic.Unlock()
+}
+
+// AddLogFields adds fields to the connection's close log line.
+func (ic *InstrumentedConn) AddLogFields(fields logrus.Fields) {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.logger = ic.logger.WithFields(fields)
+}
+
+// ForceClose closes the connection before either side did, for the given
+// reason. The reason and fields are added to the connection's close log line.
+func (ic *InstrumentedConn) ForceClose(reason string, fields logrus.Fields) error {
+	_, err := ic.forceClose(reason, fields)
+	return err
+}
+
+// forceClose is ForceClose, also reporting whether it closed the connection
+// rather than finding it closed already.
+func (ic *InstrumentedConn) forceClose(reason string, fields logrus.Fields) (bool, error) {
+	ic.Lock()
+	if ic.closed {
+		defer ic.Unlock()
+		return false, ic.CloseError
+	}
+	ic.logger = ic.logger.WithField(LogFieldCloseReason, reason).WithFields(fields)
+
+	ic.tracker.statsc.Incr("cn.forced_close", []string{
+		fmt.Sprintf("role:%s", ic.Role),
+		fmt.Sprintf("reason:%s", reason),
+	}, 1)
+	return true, ic.closeAndUnlock()
+}
+
+func (ic *InstrumentedConn) maxLifetimeReached() {
+	if closed, _ := ic.forceClose("max_lifetime", logrus.Fields{LogFieldMaxLifetime: true}); closed {
+		ic.tracker.statsc.Incr("cn.max_lifetime", []string{fmt.Sprintf("role:%s", ic.Role)}, 1)
+	}
 }
 
 func (ic *InstrumentedConn) Read(b []byte) (int, error) {
@@ -187,6 +275,7 @@ func (ic *InstrumentedConn) Stats() *InstrumentedConnStats {
 	defer ic.Unlock()
 
 	return &InstrumentedConnStats{
+		ID:                       ic.ID,
 		Role:                     ic.Role,
 		Rhost:                    ic.OutboundHost,
 		Raddr:                    ic.Conn.RemoteAddr().String(),
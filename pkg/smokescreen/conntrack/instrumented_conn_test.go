@@ -158,3 +158,72 @@ func TestInstrumentedConnWithTimeout(t *testing.T) {
 		ic.Close()
 	}
 }
+
+// TestInstrumentedConnOnClose tests that OnClose callbacks run once, and may
+// use the connection.
+func TestInstrumentedConnOnClose(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTestTracker(0)
+	ic := tr.NewInstrumentedConn(&net.UnixConn{}, logrus.NewEntry(testLogger), "testOnClose", "localhost", "connect")
+
+	calls := make(chan string, 3)
+	ic.OnClose(func(ic *InstrumentedConn) {
+		ic.AddLogFields(logrus.Fields{"callback": true})
+		calls <- "registered"
+	})
+	ic.Close()
+	ic.Close()
+	ic.OnClose(func(ic *InstrumentedConn) {
+		ic.ForceClose("test", nil)
+		calls <- "closed"
+	})
+	close(calls)
+
+	var got []string
+	for call := range calls {
+		got = append(got, call)
+	}
+	assert.Equal([]string{"registered", "closed"}, got)
+}
+
+type countingSink map[string]int
+
+func (s countingSink) Incr(name string, tags []string, rate float64) error {
+	s[name]++
+	return nil
+}
+
+func (s countingSink) Gauge(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func (s countingSink) Histogram(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func (s countingSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return nil
+}
+
+// TestInstrumentedConnMaxLifetimeMetric tests that connections are only
+// counted as reaching their maximum lifetime if that closed them.
+func TestInstrumentedConnMaxLifetimeMetric(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := countingSink{}
+	tr := NewTestTracker(0)
+	tr.statsc = sink
+
+	closed := tr.NewInstrumentedConn(&net.UnixConn{}, logrus.NewEntry(testLogger), "testClosed", "localhost", "connect")
+	closed.Close()
+	closed.maxLifetimeReached()
+	assert.Zero(sink["cn.max_lifetime"])
+	assert.Zero(sink["cn.forced_close"])
+
+	open := tr.NewInstrumentedConn(&net.UnixConn{}, logrus.NewEntry(testLogger), "testOpen", "localhost", "connect")
+	open.maxLifetimeReached()
+	open.maxLifetimeReached()
+	assert.Equal(1, sink["cn.max_lifetime"])
+	assert.Equal(1, sink["cn.forced_close"])
+}
@@ -3,6 +3,7 @@ package conntrack
 import "time"
 
 type InstrumentedConnStats struct {
+	ID                       string    `json:"id"`
 	Role                     string    `json:"role"`
 	Rhost                    string    `json:"rhost"`
 	Raddr                    string    `json:"raddr"`
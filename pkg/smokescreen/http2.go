@@ -0,0 +1,173 @@
+package smokescreen
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/goproxy"
+)
+
+// http2Handler serves proxy requests arriving over HTTP/2. goproxy relies on
+// hijacking the client connection for CONNECT, which HTTP/2 does not support
+// since many streams share one connection, so CONNECT streams are tunneled
+// here instead. HTTP/1.x requests are passed through unchanged.
+type http2Handler struct {
+	config *Config
+	proxy  http.Handler
+}
+
+func (h *http2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		h.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		h.serveConnect(w, r)
+		return
+	}
+
+	// HTTP/2 requests carry the target in :authority rather than an
+	// absolute-form request target. Plain HTTP is the only scheme a client
+	// would ask the proxy to fetch; HTTPS is tunneled with CONNECT.
+	if r.URL.Host == "" {
+		r.URL.Scheme = "http"
+		r.URL.Host = r.Host
+	}
+	h.proxy.ServeHTTP(w, r)
+}
+
+// serveConnect runs a CONNECT stream through the same pipeline as HTTP/1.1
+// CONNECT requests. The stream is tunneled until either side closes it.
+func (h *http2Handler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	config := h.config
+
+	sctx := newContext(config, connectProxy, r)
+	pctx := &goproxy.ProxyCtx{Req: r, UserData: sctx}
+	defer r.Header.Del(traceHeader)
+
+	destination, err := handleConnect(config, pctx)
+	if err != nil {
+		pctx.Resp = rejectResponse(pctx, err)
+		logProxy(config, pctx)
+		writeResponse(w, pctx.Resp)
+		return
+	}
+
+	sctx.decisionPending = config.VerifySNI
+	if !sctx.decisionPending {
+		logProxy(config, pctx)
+	}
+
+	ctx := context.WithValue(r.Context(), goproxy.ProxyContextKey, pctx)
+	target, err := dialContext(ctx, "tcp", destination)
+	if err != nil {
+		writeResponse(w, rejectResponse(pctx, err))
+		if sctx.decisionPending {
+			sctx.decisionPending = false
+			logProxy(config, pctx)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	stream := newStreamConn(w, r)
+	if config.VerifySNI {
+		go verifySNICopyHandler(config)(pctx, stream, target)
+	} else {
+		spliceConns(config, pctx, stream, target)
+	}
+
+	// The stream ends when the handler returns.
+	<-stream.done
+}
+
+// headerNewlineToSpace mirrors http.Header.Write, since HTTP/2 drops header
+// values containing newlines rather than rewriting them.
+var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, headerNewlineToSpace.Replace(v))
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// streamConn adapts an HTTP/2 CONNECT stream to a net.Conn so it can be
+// spliced with the connection to the target.
+type streamConn struct {
+	w    http.ResponseWriter
+	body io.ReadCloser
+
+	local, remote net.Addr
+
+	// mu serializes writes with Close, as the ResponseWriter must not be used
+	// once the handler has returned.
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := &streamConn{
+		w:    w,
+		body: r.Body,
+		done: make(chan struct{}),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	c.w.(http.Flusher).Flush()
+	return n, nil
+}
+
+func (c *streamConn) Close() error {
+	c.body.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,124 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func http2ProxyServer(cfg *Config) *httptest.Server {
+	s := httptest.NewUnstartedServer(&http2Handler{config: cfg, proxy: BuildProxy(cfg)})
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+// http2Connect opens a CONNECT stream to target and returns the writer for
+// data sent to the target along with the proxy's response.
+func http2Connect(t *testing.T, client *http.Client, proxyURL, target string) (io.WriteCloser, *http.Response) {
+	u, err := url.Parse(proxyURL)
+	require.NoError(t, err)
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    u,
+		Host:   target,
+		Header: http.Header{},
+		Body:   pr,
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, resp.ProtoMajor)
+	return pw, resp
+}
+
+func TestHTTP2Connect(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+	target := remote.Listener.Addr().String()
+
+	t.Run("streams share a connection", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-local-srv")
+		r.NoError(err)
+		r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+		logHook := proxyLogHook(cfg)
+
+		proxy := http2ProxyServer(cfg)
+		defer proxy.Close()
+		client := proxy.Client()
+
+		var streams []io.WriteCloser
+		for i := 0; i < 2; i++ {
+			pw, resp := http2Connect(t, client, proxy.URL, target)
+			r.Equal(http.StatusOK, resp.StatusCode)
+
+			req, err := http.NewRequest("GET", remote.URL, nil)
+			r.NoError(err)
+			go func() {
+				req.Write(pw)
+			}()
+			tunneled, err := http.ReadResponse(bufio.NewReader(resp.Body), req)
+			r.NoError(err)
+			body, err := io.ReadAll(tunneled.Body)
+			r.NoError(err)
+			r.Equal("OK", string(body))
+
+			streams = append(streams, pw)
+		}
+
+		count := 0
+		cfg.ConnTracker.Range(func(k, v interface{}) bool {
+			count++
+			return true
+		})
+		r.Equal(2, count, "each stream should be tracked")
+
+		for _, pw := range streams {
+			pw.Close()
+		}
+		cfg.ConnTracker.Wg.Wait()
+
+		var decisions int
+		for _, entry := range logHook.AllEntries() {
+			if entry.Message == CanonicalProxyDecision {
+				decisions++
+				r.Equal(connectProxy, entry.Data[LogFieldProxyType])
+				r.Equal(true, entry.Data[LogFieldAllow])
+			}
+		}
+		r.Equal(2, decisions)
+	})
+
+	t.Run("denied by ACL", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-trusted-srv")
+		r.NoError(err)
+		logHook := proxyLogHook(cfg)
+
+		proxy := http2ProxyServer(cfg)
+		defer proxy.Close()
+
+		pw, resp := http2Connect(t, proxy.Client(), proxy.URL, "example.com:443")
+		defer pw.Close()
+		r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+		r.NotEmpty(resp.Header.Get(errorHeader))
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(false, entry.Data[LogFieldAllow])
+	})
+}
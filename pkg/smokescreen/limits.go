@@ -0,0 +1,208 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+)
+
+// LogFieldLoadShed is the limit a shed request ran into.
+const LogFieldLoadShed = "load_shed"
+
+// Limits new tunnels and HTTP proxy requests are shed for.
+const (
+	shedReasonConcurrency = "max_concurrent_conns"
+	shedReasonRate        = "max_request_rate"
+)
+
+// overloadError is returned for requests which are shed because the proxy is
+// at one of its limits. It is answered with a 503 rather than a 407, so that
+// clients can tell it apart from an ACL denial and retry elsewhere.
+type overloadError struct {
+	reason string
+}
+
+func (e overloadError) Error() string {
+	switch e.reason {
+	case shedReasonConcurrency:
+		return "too many concurrent connections"
+	case shedReasonRate:
+		return "new requests are arriving too fast"
+	default:
+		return e.reason
+	}
+}
+
+// connLimiter caps the number of tunnels and HTTP proxy requests in flight,
+// and the rate at which new ones arrive with a token bucket.
+type connLimiter struct {
+	max    int64
+	active int64 // accessed atomically
+
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// SetConnLimits sheds new tunnels and HTTP proxy requests once maxConns of
+// them are in flight, or when they arrive faster than rate per second, with
+// bursts of up to burst. The rate applies to CONNECT and HTTP proxy requests
+// rather than to client connections, which may carry several of them. Zero
+// means no limit; burst defaults to one second's worth of rate.
+func (config *Config) SetConnLimits(maxConns int, rate float64, burst int) error {
+	if maxConns < 0 {
+		return fmt.Errorf("invalid maximum number of concurrent connections %d", maxConns)
+	}
+	if rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return fmt.Errorf("invalid maximum request rate %v", rate)
+	}
+	if burst < 0 {
+		return fmt.Errorf("invalid request burst %d", burst)
+	}
+	if burst > 0 && rate == 0 {
+		return errors.New("a request burst requires a maximum request rate")
+	}
+	if rate > 0 && burst == 0 {
+		burst = int(math.Ceil(rate))
+	}
+
+	config.MaxConcurrentConns = maxConns
+	config.MaxRequestRate = rate
+	config.RequestBurst = burst
+
+	if maxConns == 0 && rate == 0 {
+		config.connLimiter = nil
+		return nil
+	}
+	config.connLimiter = &connLimiter{
+		max:    int64(maxConns),
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+	return nil
+}
+
+// allowRate takes a token from the bucket, if there is one.
+func (l *connLimiter) allowRate(now time.Time) bool {
+	if l.rate == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acquireConnSlot admits the request of sctx under the connection limits, or
+// returns an overloadError. The slot is held until sctx.releaseConnSlot is
+// called.
+func acquireConnSlot(sctx *smokescreenContext) error {
+	config := sctx.cfg
+	l := config.connLimiter
+	if l == nil {
+		return nil
+	}
+
+	active := atomic.AddInt64(&l.active, 1)
+	reason := ""
+	if l.max > 0 && active > l.max {
+		reason = shedReasonConcurrency
+	} else if !l.allowRate(time.Now()) {
+		reason = shedReasonRate
+	}
+	if reason != "" {
+		atomic.AddInt64(&l.active, -1)
+		config.MetricsClient.IncrWithTags("limit.shed", []string{
+			fmt.Sprintf("reason:%s", reason),
+			fmt.Sprintf("proxy_type:%s", sctx.proxyType),
+		}, 1)
+		return overloadError{reason}
+	}
+	reportConnLimits(config, l, active)
+
+	var released int32
+	sctx.connSlot = func() {
+		if atomic.CompareAndSwapInt32(&released, 0, 1) {
+			reportConnLimits(config, l, atomic.AddInt64(&l.active, -1))
+		}
+	}
+	return nil
+}
+
+// reportConnLimits reports how many connections are in flight and, when
+// they are capped, which fraction of the cap they use.
+func reportConnLimits(config *Config, l *connLimiter, active int64) {
+	config.MetricsClient.Gauge("limit.conns.active", float64(active), 1)
+	if l.max > 0 {
+		config.MetricsClient.Gauge("limit.conns.utilization", float64(active)/float64(l.max), 1)
+	}
+}
+
+// releaseConnSlot releases the connection slot held by sctx, if any. It may
+// be called more than once.
+func (sctx *smokescreenContext) releaseConnSlot() {
+	if sctx.connSlot != nil {
+		sctx.connSlot()
+	}
+}
+
+// releaseConnSlotOnClose hands the connection slot held by sctx over to the
+// tunnel ic, which releases it once closed.
+func releaseConnSlotOnClose(sctx *smokescreenContext, ic *conntrack.InstrumentedConn) {
+	if release := sctx.connSlot; release != nil {
+		ic.OnClose(func(*conntrack.InstrumentedConn) { release() })
+	}
+}
+
+// slotReleasingBody releases a connection slot once the response body it
+// wraps is closed.
+type slotReleasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *slotReleasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// releaseConnSlotOnBodyClose hands the connection slot held by sctx over to
+// the body of resp, which releases it once closed.
+func releaseConnSlotOnBodyClose(sctx *smokescreenContext, resp *http.Response) {
+	if sctx.connSlot == nil {
+		return
+	}
+	if resp.Body == nil {
+		sctx.releaseConnSlot()
+		return
+	}
+	resp.Body = &slotReleasingBody{resp.Body, sctx.releaseConnSlot}
+}
+
+// isDenyOrOverload reports whether err rejects a request by design, as
+// opposed to an unexpected failure.
+func isDenyOrOverload(err error) bool {
+	switch err.(type) {
+	case denyError, overloadError:
+		return true
+	}
+	return false
+}
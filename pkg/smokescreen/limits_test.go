@@ -0,0 +1,182 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
+)
+
+func limitsTestConfig(t *testing.T, maxConns int, rate float64, burst int) *Config {
+	r := require.New(t)
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetupPrometheus(stats.PrometheusConfig{}))
+	r.NoError(cfg.SetConnLimits(maxConns, rate, burst))
+	return cfg
+}
+
+func noActiveConns(cfg *Config) func() bool {
+	return func() bool { return atomic.LoadInt64(&cfg.connLimiter.active) == 0 }
+}
+
+// shedEntries returns the canonical decision lines of requests shed for
+// reason.
+func shedEntries(logs []*logrus.Entry, reason string) []*logrus.Entry {
+	var entries []*logrus.Entry
+	for _, entry := range logs {
+		if entry.Message == CanonicalProxyDecision && entry.Data[LogFieldLoadShed] == reason {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestConnLimitConcurrency(t *testing.T) {
+	r := require.New(t)
+
+	echo := echoServer(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg := limitsTestConfig(t, 2, 0, 0)
+	logHook := proxyLogHook(cfg)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	// Denied tunnels give up their slot.
+	_, resp := connectTunnel(t, proxy.URL, "10.0.0.1:443")
+	r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+
+	tunnel := openTunnel(t, proxy.URL, echo.Addr().String())
+	openTunnel(t, proxy.URL, echo.Addr().String())
+
+	_, resp = connectTunnel(t, proxy.URL, echo.Addr().String())
+	r.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	r.Equal("1", resp.Header.Get("Retry-After"))
+	r.Contains(resp.Header.Get(errorHeader), "Proxy is overloaded")
+
+	resp, err := proxyClientGet(proxy.URL, backend.URL)
+	r.NoError(err)
+	r.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	r.Len(shedEntries(logHook.AllEntries(), shedReasonConcurrency), 2)
+
+	rec := httptest.NewRecorder()
+	cfg.Prometheus.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	r.Contains(rec.Body.String(), "limit_conns_active 2\n")
+	r.Contains(rec.Body.String(), "limit_conns_utilization 1\n")
+	r.Contains(rec.Body.String(), `limit_shed_total{proxy_type="connect",reason="max_concurrent_conns"} 1`)
+	r.Contains(rec.Body.String(), `limit_shed_total{proxy_type="http",reason="max_concurrent_conns"} 1`)
+
+	// Closing a tunnel frees its slot.
+	tunnel.Close()
+	r.Eventually(func() bool {
+		return atomic.LoadInt64(&cfg.connLimiter.active) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	openTunnel(t, proxy.URL, echo.Addr().String())
+}
+
+func TestConnLimitHTTP(t *testing.T) {
+	r := require.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg := limitsTestConfig(t, 1, 0, 0)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	// HTTP requests hold their slot until their response has been sent.
+	for i := 0; i < 3; i++ {
+		r.Eventually(noActiveConns(cfg), 5*time.Second, 10*time.Millisecond)
+		resp, err := proxyClientGet(proxy.URL, backend.URL)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	// Denied requests and failed round trips give up their slot.
+	r.Eventually(noActiveConns(cfg), 5*time.Second, 10*time.Millisecond)
+	resp, err := proxyClientGet(proxy.URL, "http://10.0.0.1/")
+	r.NoError(err)
+	r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	r.Eventually(noActiveConns(cfg), 5*time.Second, 10*time.Millisecond)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	resp, err = proxyClientGet(proxy.URL, down.URL)
+	r.NoError(err)
+	r.NotEqual(http.StatusOK, resp.StatusCode)
+	r.Eventually(noActiveConns(cfg), 5*time.Second, 10*time.Millisecond)
+
+	// A response still being streamed holds its slot.
+	done := make(chan struct{})
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// More than goproxy buffers, so that the response reaches the client.
+		w.Write(make([]byte, 64<<10))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer streaming.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+	resp, err = client.Get(streaming.URL)
+	r.NoError(err)
+	r.Equal(int64(1), atomic.LoadInt64(&cfg.connLimiter.active))
+	close(done)
+	resp.Body.Close()
+	r.Eventually(noActiveConns(cfg), 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConnLimitRate(t *testing.T) {
+	r := require.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg := limitsTestConfig(t, 0, 0.001, 2)
+	logHook := proxyLogHook(cfg)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := proxyClientGet(proxy.URL, backend.URL)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+	}
+	resp, err := proxyClientGet(proxy.URL, backend.URL)
+	r.NoError(err)
+	r.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	entries := shedEntries(logHook.AllEntries(), shedReasonRate)
+	r.Len(entries, 1)
+	r.Nil(entries[0].Data[LogFieldDecisionReason])
+}
+
+func TestSetConnLimits(t *testing.T) {
+	r := require.New(t)
+
+	cfg := NewConfig()
+	r.Nil(cfg.connLimiter)
+	r.Error(cfg.SetConnLimits(-1, 0, 0))
+	r.Error(cfg.SetConnLimits(0, -1, 0))
+	r.Error(cfg.SetConnLimits(0, 10, -1))
+	r.Error(cfg.SetConnLimits(0, 0, 10))
+
+	r.NoError(cfg.SetConnLimits(100, 2.5, 0))
+	r.Equal(3, cfg.RequestBurst)
+	r.NotNil(cfg.connLimiter)
+
+	r.NoError(cfg.SetConnLimits(0, 0, 0))
+	r.Nil(cfg.connLimiter)
+}
@@ -0,0 +1,177 @@
+package smokescreen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/smokescreen/internal/einhorn"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+const LogFieldListener = "listener"
+
+// ListenerConfig describes a proxy listener served in addition to the one
+// configured by Config.Ip, Config.Port and Config.Listener. Additional
+// listeners share the proxy's connection tracker, metrics and every setting
+// not overridden here.
+type ListenerConfig struct {
+	// Name identifies the listener in logs.
+	Name string
+
+	Ip       string
+	Port     uint16
+	Listener net.Listener
+
+	// When running under einhorn, use the socket with this index instead of
+	// opening one. Index 0 is always used by the main listener.
+	EinhornFd int
+
+	// Listen on a Unix domain socket at UnixPath instead of TCP. The mode and
+	// owner ("user" or "user:group") of the socket file are set when they are
+	// not empty. Unix socket listeners do not support TLS or the PROXY
+	// protocol; clients are identified by their peer credentials instead.
+	UnixPath     string
+	UnixFileMode os.FileMode
+	UnixOwner    string
+
+	// TLS settings for this listener. Connections are plaintext when nil.
+	TlsConfig *tls.Config
+	HTTP2     bool
+
+	SupportProxyProtocol       bool
+	ProxyProtocolStrict        bool
+	ProxyProtocolTrustedRanges []RuleRange
+
+	// RoleFromRequest and EgressACL, when set, replace the proxy-wide
+	// settings for requests received on this listener.
+	RoleFromRequest func(subject *http.Request) (string, error)
+	EgressACL       acl.Decider
+
+	// File EgressACL is reloaded from by Config.ReloadEgressAcls.
+	EgressAclFile string
+}
+
+type listenerConfigKey struct{}
+
+// listenerConfigFromRequest returns the settings of the additional listener
+// which received req, or nil for the main listener.
+func listenerConfigFromRequest(req *http.Request) *ListenerConfig {
+	if req == nil {
+		return nil
+	}
+	lc, _ := req.Context().Value(listenerConfigKey{}).(*ListenerConfig)
+	return lc
+}
+
+// egressACLForRequest returns the ACL which applies to req.
+func egressACLForRequest(config *Config, req *http.Request) acl.Decider {
+	return egressACLForListener(config, listenerConfigFromRequest(req))
+}
+
+// egressACLForListener returns the ACL which applies to requests received on
+// lc, or on the main listener if lc is nil.
+func egressACLForListener(config *Config, lc *ListenerConfig) acl.Decider {
+	config.egressACLMu.RLock()
+	defer config.egressACLMu.RUnlock()
+	if lc != nil && lc.EgressACL != nil {
+		return lc.EgressACL
+	}
+	return config.EgressACL
+}
+
+// AddListener validates and adds an additional proxy listener.
+func (config *Config) AddListener(lc *ListenerConfig) error {
+	if lc.Listener == nil && lc.Port == 0 && lc.EinhornFd == 0 && lc.UnixPath == "" {
+		return fmt.Errorf("listener %q requires a port", lc.Name)
+	}
+	if lc.UnixPath != "" && (lc.TlsConfig != nil || lc.SupportProxyProtocol) {
+		return fmt.Errorf("listener %q: unix socket listeners do not support TLS or the PROXY protocol", lc.Name)
+	}
+	if lc.HTTP2 && lc.TlsConfig == nil {
+		return fmt.Errorf("listener %q: HTTP/2 requires TLS to be configured", lc.Name)
+	}
+	for _, other := range config.Listeners {
+		if other.Name == lc.Name {
+			return fmt.Errorf("duplicate listener name %q", lc.Name)
+		}
+	}
+	config.Listeners = append(config.Listeners, lc)
+	return nil
+}
+
+func (lc *ListenerConfig) listen(log *logrus.Logger) (net.Listener, error) {
+	listener := lc.Listener
+	if listener == nil {
+		var err error
+		if einhorn.IsWorker() && lc.EinhornFd > 0 {
+			listener, err = einhorn.GetListener(lc.EinhornFd)
+		} else if lc.UnixPath != "" {
+			listener, err = listenUnix(lc.UnixPath, lc.UnixFileMode, lc.UnixOwner)
+		} else {
+			listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", lc.Ip, lc.Port))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if lc.SupportProxyProtocol {
+		listener = newProxyProtocolListener(listener, lc.ProxyProtocolStrict, lc.ProxyProtocolTrustedRanges, log)
+	}
+
+	if lc.TlsConfig != nil {
+		tlsConfig := lc.TlsConfig
+		if lc.HTTP2 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		listener = newTLSListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+// startListeners serves handler on every additional listener. The returned
+// servers are shut down along with the main server.
+func startListeners(config *Config, handler http.Handler) ([]*http.Server, error) {
+	var servers []*http.Server
+	for _, lc := range config.Listeners {
+		lc := lc
+		listener, err := lc.listen(config.Log)
+		if err != nil {
+			return nil, fmt.Errorf("can't find listener %q: %v", lc.Name, err)
+		}
+
+		server := &http.Server{
+			Handler:     handler,
+			IdleTimeout: config.IdleTimeout,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				ctx = context.WithValue(ctx, listenerConfigKey{}, lc)
+				ctx = withProxyHeader(ctx, c)
+				if uc, ok := c.(*net.UnixConn); ok {
+					creds, err := peerCredentials(uc)
+					if err != nil {
+						config.Log.WithField(LogFieldListener, lc.Name).Warnf("could not read peer credentials: %v", err)
+					} else {
+						ctx = context.WithValue(ctx, peerCredentialsKey{}, creds)
+					}
+				}
+				return ctx
+			},
+		}
+		servers = append(servers, server)
+
+		go func() {
+			config.Log.WithField(LogFieldListener, lc.Name).Printf("listening on %s", listener.Addr())
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				config.Log.WithField(LogFieldListener, lc.Name).Errorf("http serve error: %v", err)
+			}
+		}()
+	}
+	return servers, nil
+}
@@ -0,0 +1,173 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+func TestAdditionalListeners(t *testing.T) {
+	r := require.New(t)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	cfg, err := testConfig("test-trusted-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	logHook := proxyLogHook(cfg)
+
+	localACL := &acl.ACL{Rules: map[string]acl.Rule{}}
+	r.NoError(localACL.Add("local-agent", acl.Rule{
+		Project:     "agents",
+		Policy:      acl.Enforce,
+		DomainGlobs: []string{"127.0.0.1"},
+	}))
+
+	// One listener only overrides the role, the other also has its own ACL.
+	roleListener, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	aclListener, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	r.NoError(cfg.AddListener(&ListenerConfig{
+		Name:     "role-only",
+		Listener: roleListener,
+		RoleFromRequest: func(*http.Request) (string, error) {
+			return "test-local-srv", nil
+		},
+	}))
+	r.NoError(cfg.AddListener(&ListenerConfig{
+		Name:     "local",
+		Listener: aclListener,
+		RoleFromRequest: func(*http.Request) (string, error) {
+			return "local-agent", nil
+		},
+		EgressACL: localACL,
+	}))
+	r.Error(cfg.AddListener(&ListenerConfig{Name: "local", Port: 1}))
+	r.Error(cfg.AddListener(&ListenerConfig{Name: "no-port"}))
+
+	handler := &http2Handler{config: cfg, proxy: BuildProxy(cfg)}
+	servers, err := startListeners(cfg, handler)
+	r.NoError(err)
+	defer func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
+
+	main := httptest.NewServer(handler)
+	defer main.Close()
+
+	tests := []struct {
+		name     string
+		proxy    string
+		role     string
+		listener interface{}
+		allow    bool
+	}{
+		{"main listener", main.URL, "test-trusted-srv", nil, false},
+		{"listener role", "http://" + roleListener.Addr().String(), "test-local-srv", "role-only", true},
+		{"listener ACL", "http://" + aclListener.Addr().String(), "local-agent", "local", true},
+	}
+
+	for _, tt := range tests {
+		logHook.Reset()
+
+		client, err := proxyClient(tt.proxy)
+		r.NoError(err)
+		resp, err := client.Get(remote.URL)
+		r.NoError(err)
+		resp.Body.Close()
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry, tt.name)
+		r.Equal(tt.role, entry.Data[LogFieldRole], tt.name)
+		r.Equal(tt.allow, entry.Data[LogFieldAllow], tt.name)
+		r.Equal(tt.listener, entry.Data[LogFieldListener], tt.name)
+	}
+}
+
+// tlsHandshake reports the error of the server side of a TLS handshake of a
+// client presenting cert.
+func tlsHandshake(t *testing.T, serverConfig *tls.Config, cert tls.Certificate) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	return tls.Server(conn, serverConfig).Handshake()
+}
+
+// CRLs of an additional listener only apply to it.
+func TestListenerCrls(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	caFile, serverCert, serverKey, client := writeTestPKI(t, dir, "test-srv")
+	crlFile := filepath.Join(dir, "ca.crl")
+
+	cfg, err := testConfig("test-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetupTls(serverCert, serverKey, []string{caFile}))
+
+	listenerTLS, err := cfg.NewTlsConfig(serverCert, serverKey, []string{caFile}, []string{crlFile})
+	r.NoError(err)
+	err = tlsHandshake(t, listenerTLS, client)
+	r.Error(err)
+	r.Contains(err.Error(), "revoked")
+
+	r.NoError(tlsHandshake(t, cfg.TlsConfig, client))
+	r.Empty(cfg.CrlByAuthorityKeyId)
+
+	// The main listener checks its own CRLs.
+	r.NoError(cfg.SetupCrls([]string{crlFile}))
+	r.Error(tlsHandshake(t, cfg.TlsConfig, client))
+}
+
+// Certificates whose issuer's CRL has expired are refused.
+func TestExpiredListenerCrl(t *testing.T) {
+	r := require.New(t)
+
+	_, _, _, client := writeTestPKI(t, t.TempDir(), "test-srv")
+	cert, err := x509.ParseCertificate(client.Certificate[0])
+	r.NoError(err)
+
+	crl := &pkix.CertificateList{}
+	crl.TBSCertList.NextUpdate = time.Now().Add(time.Hour)
+	verify := verifyNotRevoked(map[string]*pkix.CertificateList{string(cert.AuthorityKeyId): crl})
+	r.NoError(verify(nil, [][]*x509.Certificate{{cert}}))
+
+	crl.TBSCertList.NextUpdate = time.Now().Add(-time.Hour)
+	err = verify(nil, [][]*x509.Certificate{{cert}})
+	r.Error(err)
+	r.Contains(err.Error(), "CRL of its issuer expired")
+}
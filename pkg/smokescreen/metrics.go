@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
 )
 
 // metrics contains all of the metric names contained within the smokescreen package.
@@ -14,13 +15,19 @@ import (
 // if the metric should support persistent tagging.
 var metrics = []string{
 	"acl.allow",
+	"acl.auth_failed",
 	"acl.decide_error",
 	"acl.deny",
+	"acl.remote.fetch",
+	"acl.remote.stale",
 	"acl.report",
 	"acl.role_not_determined",
 	"acl.unknown_error",
 	"cn.atpt.connect.time",
 	"cn.atpt.total",
+	"limit.conns.active",
+	"limit.conns.utilization",
+	"limit.shed",
 	"resolver.allow.default",
 	"resolver.allow.user_configured",
 	"resolver.attempts_total",
@@ -31,12 +38,14 @@ var metrics = []string{
 }
 
 // MetricsClient is a thin wrapper around statsd.ClientInterface. It is used to allow
-// adding arbitrary tags to Smokescreen metrics.
+// adding arbitrary tags to Smokescreen metrics, and to report them to
+// additional sinks such as Prometheus.
 //
 // MetricsClient is not thread safe and should not be used concurrently.
 type MetricsClient struct {
 	metricsTags  map[string][]string
 	StatsdClient statsd.ClientInterface
+	sinks        stats.Multi
 	started      atomic.Value
 }
 
@@ -100,24 +109,86 @@ func (mc *MetricsClient) GetMetricTags(metric string) []string {
 	return nil
 }
 
+// AddSink reports all metrics to s in addition to statsd. Adding a sink
+// twice has no effect.
+//
+// Like AddMetricTags, this should only be done prior to running smokescreen.
+func (mc *MetricsClient) AddSink(s stats.Sink) error {
+	if mc.started.Load() != nil {
+		return fmt.Errorf("cannot add metrics sinks after starting smokescreen")
+	}
+	for _, existing := range mc.sinks {
+		if existing == s {
+			return nil
+		}
+	}
+	mc.sinks = append(mc.sinks, s)
+	return nil
+}
+
+// Sink returns a stats.Sink reporting to statsd and every sink added with
+// AddSink. It is used by components reporting metrics without persistent
+// tags, such as the connection tracker.
+func (mc *MetricsClient) Sink() stats.Sink {
+	return metricsClientSink{mc}
+}
+
+// metricsClientSink reports to StatsdClient, then to the sinks. Like
+// stats.Multi, it returns the first error once every sink has been called.
+type metricsClientSink struct {
+	mc *MetricsClient
+}
+
+func firstError(err, other error) error {
+	if err != nil {
+		return err
+	}
+	return other
+}
+
+func (s metricsClientSink) Incr(name string, tags []string, rate float64) error {
+	err := s.mc.StatsdClient.Incr(name, tags, rate)
+	return firstError(err, s.mc.sinks.Incr(name, tags, rate))
+}
+
+func (s metricsClientSink) Gauge(name string, value float64, tags []string, rate float64) error {
+	err := s.mc.StatsdClient.Gauge(name, value, tags, rate)
+	return firstError(err, s.mc.sinks.Gauge(name, value, tags, rate))
+}
+
+func (s metricsClientSink) Histogram(name string, value float64, tags []string, rate float64) error {
+	err := s.mc.StatsdClient.Histogram(name, value, tags, rate)
+	return firstError(err, s.mc.sinks.Histogram(name, value, tags, rate))
+}
+
+func (s metricsClientSink) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	err := s.mc.StatsdClient.Timing(name, value, tags, rate)
+	return firstError(err, s.mc.sinks.Timing(name, value, tags, rate))
+}
+
 func (mc *MetricsClient) Incr(metric string, rate float64) error {
 	mTags := mc.GetMetricTags(metric)
-	return mc.StatsdClient.Incr(metric, mTags, rate)
+	return mc.Sink().Incr(metric, mTags, rate)
 }
 
 func (mc *MetricsClient) IncrWithTags(metric string, tags []string, rate float64) error {
 	mTags := mc.GetMetricTags(metric)
 	tags = append(tags, mTags...)
-	return mc.StatsdClient.Incr(metric, tags, rate)
+	return mc.Sink().Incr(metric, tags, rate)
+}
+
+func (mc *MetricsClient) Gauge(metric string, value float64, rate float64) error {
+	mTags := mc.GetMetricTags(metric)
+	return mc.Sink().Gauge(metric, value, mTags, rate)
 }
 
 func (mc *MetricsClient) Timing(metric string, d time.Duration, rate float64) error {
 	mTags := mc.GetMetricTags(metric)
-	return mc.StatsdClient.Timing(metric, d, mTags, rate)
+	return mc.Sink().Timing(metric, d, mTags, rate)
 }
 
 func (mc *MetricsClient) TimingWithTags(metric string, d time.Duration, rate float64, tags []string) error {
 	mTags := mc.GetMetricTags(metric)
 	tags = append(tags, mTags...)
-	return mc.StatsdClient.Timing(metric, d, tags, rate)
+	return mc.Sink().Timing(metric, d, tags, rate)
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
 )
 
 func TestMetricsTags(t *testing.T) {
@@ -56,3 +57,31 @@ func TestMetricsClient(t *testing.T) {
 		r.Error(err)
 	})
 }
+
+type countingSink struct {
+	stats.Multi
+	incrs int
+}
+
+func (s *countingSink) Incr(name string, tags []string, rate float64) error {
+	s.incrs++
+	return nil
+}
+
+func TestMetricsSinks(t *testing.T) {
+	r := require.New(t)
+
+	mc := NewNoOpMetricsClient()
+	sink := &countingSink{}
+	r.NoError(mc.AddSink(sink))
+	r.NoError(mc.AddSink(sink))
+
+	r.NoError(mc.Incr("acl.allow", 1))
+	r.Equal(1, sink.incrs)
+
+	// Reporting a metric does not allocate a list of the sinks.
+	allocs := testing.AllocsPerRun(100, func() {
+		mc.Sink().Incr("cn.close", nil, 1)
+	})
+	r.Zero(allocs)
+}
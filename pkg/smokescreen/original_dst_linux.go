@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package smokescreen
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// redirectedDestination returns the address a connection redirected with an
+// iptables REDIRECT or DNAT rule was originally sent to.
+func redirectedDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	isIPv6 := local != nil && local.IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv6 {
+			var sa syscall.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			sockErr = getsockopt(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sa), &size)
+			if sockErr == nil {
+				port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+				addr = &net.TCPAddr{
+					IP:   net.IP(append([]byte(nil), sa.Addr[:]...)),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+			return
+		}
+
+		var sa syscall.RawSockaddrInet4
+		size := uint32(unsafe.Sizeof(sa))
+		sockErr = getsockopt(int(fd), syscall.IPPROTO_IP, soOriginalDst, unsafe.Pointer(&sa), &size)
+		if sockErr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("could not get original destination: %v", sockErr)
+	}
+	return addr, nil
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// listenTransparent opens a listener with IP_TRANSPARENT set, as required to
+// accept connections diverted by an iptables TPROXY rule.
+func listenTransparent(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package smokescreen
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func redirectedDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparent(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,160 @@
+package smokescreen
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// OutboundSourceRule binds outbound connections to one of a pool of local
+// addresses. A rule matches a connection when every non-empty selector (Role,
+// Project and Destination) matches; a rule with no selectors matches
+// everything and can be used as a catch-all default.
+//
+// When a rule has more than one address, addresses of the same family as the
+// destination are used in round-robin order.
+type OutboundSourceRule struct {
+	Role    string
+	Project string
+
+	// Destination is a domain glob following the same syntax as the egress
+	// ACL's allowed_domains.
+	Destination string
+
+	Addresses []net.IP
+
+	next uint32
+}
+
+type outboundLocalAddrKey struct{}
+
+// interfaceAddrs is overridden in tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// Matches returns true if the rule applies to a connection made on behalf of
+// role and project to host.
+func (r *OutboundSourceRule) Matches(role, project, host string) bool {
+	if r.Role != "" && r.Role != role {
+		return false
+	}
+	if r.Project != "" && r.Project != project {
+		return false
+	}
+	if r.Destination != "" && !acl.HostMatchesGlob(host, r.Destination) {
+		return false
+	}
+	return true
+}
+
+// pick returns the next address from the rule's pool which is usable to reach
+// remote, or nil if there is none.
+func (r *OutboundSourceRule) pick(remote net.IP) net.IP {
+	var candidates []net.IP
+	for _, ip := range r.Addresses {
+		if (ip.To4() == nil) == (remote.To4() == nil) {
+			candidates = append(candidates, ip)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	n := atomic.AddUint32(&r.next, 1) - 1
+	return candidates[n%uint32(len(candidates))]
+}
+
+// SetOutboundSourceRules validates and installs rules used to choose the local
+// address of outbound connections. Every address must be assigned to an
+// interface on this host.
+func (config *Config) SetOutboundSourceRules(rules []OutboundSourceRule) error {
+	local, err := interfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("could not list local interface addresses: %v", err)
+	}
+
+	var outRules []*OutboundSourceRule
+	for i := range rules {
+		rule := rules[i]
+		if len(rule.Addresses) == 0 {
+			return fmt.Errorf("outbound source rule %d has no addresses", i)
+		}
+		if rule.Destination != "" {
+			err := (&acl.ACL{}).ValidateDomainGlobs("outbound source rule", []string{rule.Destination})
+			if err != nil {
+				return err
+			}
+		}
+		for _, ip := range rule.Addresses {
+			if !ipIsLocal(ip, local) {
+				return fmt.Errorf("outbound source address %s is not assigned to any interface on this host", ip)
+			}
+		}
+		outRules = append(outRules, &rule)
+	}
+
+	config.OutboundSourceRules = outRules
+	return nil
+}
+
+func ipIsLocal(ip net.IP, addrs []net.Addr) bool {
+	for _, addr := range addrs {
+		var local net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			local = a.IP
+		case *net.IPAddr:
+			local = a.IP
+		}
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundLocalAddr returns the local address that should be used for a
+// connection to remote, or nil if the kernel should choose.
+func outboundLocalAddr(config *Config, d *aclDecision, remote *net.TCPAddr) (*net.TCPAddr, error) {
+	if len(config.OutboundSourceRules) == 0 {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(d.outboundHost)
+	if err != nil {
+		host = d.outboundHost
+	}
+
+	for _, rule := range config.OutboundSourceRules {
+		if !rule.Matches(d.role, d.project, host) {
+			continue
+		}
+		ip := rule.pick(remote.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("no outbound source address configured for the address family of %s", remote.IP)
+		}
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	return nil, nil
+}
+
+// OutboundLocalAddrFromContext returns the local address selected by the
+// configured OutboundSourceRules. Custom ProxyDialTimeout implementations
+// should bind to this address when it is present.
+func OutboundLocalAddrFromContext(ctx context.Context) (*net.TCPAddr, bool) {
+	addr, ok := ctx.Value(outboundLocalAddrKey{}).(*net.TCPAddr)
+	return addr, ok
+}
+
+func dialWithLocalAddr(network, address string, localAddr *net.TCPAddr, config *Config) (net.Conn, error) {
+	if localAddr == nil {
+		return net.DialTimeout(network, address, config.ConnectTimeout)
+	}
+	dialer := net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		LocalAddr: localAddr,
+	}
+	return dialer.Dial(network, address)
+}
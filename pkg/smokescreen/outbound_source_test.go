@@ -0,0 +1,140 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOutboundSourceRules(t *testing.T) {
+	r := require.New(t)
+
+	t.Run("address present on host", func(t *testing.T) {
+		conf := NewConfig()
+		err := conf.SetOutboundSourceRules([]OutboundSourceRule{
+			{Role: "test", Addresses: []net.IP{net.ParseIP("127.0.0.1")}},
+		})
+		r.NoError(err)
+		r.Len(conf.OutboundSourceRules, 1)
+	})
+
+	t.Run("address missing from host", func(t *testing.T) {
+		conf := NewConfig()
+		err := conf.SetOutboundSourceRules([]OutboundSourceRule{
+			{Role: "test", Addresses: []net.IP{net.ParseIP("192.0.2.200")}},
+		})
+		r.Error(err)
+		r.Contains(err.Error(), "192.0.2.200")
+	})
+
+	t.Run("no addresses", func(t *testing.T) {
+		conf := NewConfig()
+		err := conf.SetOutboundSourceRules([]OutboundSourceRule{{Role: "test"}})
+		r.Error(err)
+	})
+
+	t.Run("invalid destination glob", func(t *testing.T) {
+		conf := NewConfig()
+		err := conf.SetOutboundSourceRules([]OutboundSourceRule{
+			{Destination: "*", Addresses: []net.IP{net.ParseIP("127.0.0.1")}},
+		})
+		r.Error(err)
+	})
+}
+
+func TestOutboundLocalAddr(t *testing.T) {
+	r := require.New(t)
+
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, s := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "2001:db8::1", "198.51.100.1"} {
+			addrs = append(addrs, &net.IPAddr{IP: net.ParseIP(s)})
+		}
+		return addrs, nil
+	}
+
+	conf := NewConfig()
+	r.NoError(conf.SetOutboundSourceRules([]OutboundSourceRule{
+		{Role: "payments", Addresses: []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")}},
+		{Project: "security", Destination: "*.bank.example", Addresses: []net.IP{net.ParseIP("203.0.113.3"), net.ParseIP("2001:db8::1")}},
+		{Destination: "partner.example", Addresses: []net.IP{net.ParseIP("198.51.100.1")}},
+	}))
+
+	v4 := &net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 443}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:4860::8888"), Port: 443}
+
+	pick := func(role, project, host string, remote *net.TCPAddr) string {
+		addr, err := outboundLocalAddr(conf, &aclDecision{role: role, project: project, outboundHost: host}, remote)
+		r.NoError(err)
+		if addr == nil {
+			return ""
+		}
+		return addr.IP.String()
+	}
+
+	// Pools are used in round-robin order
+	r.Equal("203.0.113.1", pick("payments", "", "example.com:443", v4))
+	r.Equal("203.0.113.2", pick("payments", "", "example.com:443", v4))
+	r.Equal("203.0.113.1", pick("payments", "", "example.com:443", v4))
+
+	// All selectors of a rule must match, and the address family follows the destination
+	r.Equal("203.0.113.3", pick("other", "security", "api.bank.example:443", v4))
+	r.Equal("2001:db8::1", pick("other", "security", "api.bank.example:443", v6))
+	r.Equal("", pick("other", "usersec", "api.bank.example:443", v4))
+
+	r.Equal("198.51.100.1", pick("other", "", "partner.example:443", v4))
+
+	// No address of the destination's family
+	_, err := outboundLocalAddr(conf, &aclDecision{role: "other", outboundHost: "partner.example:443"}, v6)
+	r.Error(err)
+}
+
+func TestProxyOutboundSourceAddress(t *testing.T) {
+	r := require.New(t)
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetOutboundSourceRules([]OutboundSourceRule{
+		{Role: "test-local-srv", Addresses: []net.IP{net.ParseIP("127.0.0.1")}},
+	}))
+
+	var customLocalAddr *net.TCPAddr
+	cfg.ProxyDialTimeout = func(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+		customLocalAddr, _ = OutboundLocalAddrFromContext(ctx)
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	logHook := proxyLogHook(cfg)
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+
+	resp, err := client.Get(remote.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	r.NotNil(customLocalAddr)
+	r.Equal("127.0.0.1", customLocalAddr.IP.String())
+
+	entry := findCanonicalProxyDecision(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Contains(entry.Data, LogFieldOutLocalAddr)
+}
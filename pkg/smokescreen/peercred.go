@@ -0,0 +1,123 @@
+package smokescreen
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// PeerCredentials identify the process on the other end of a Unix domain
+// socket connection, as reported by the kernel.
+type PeerCredentials struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+type peerCredentialsKey struct{}
+
+var errPeerCredentialsUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// PeerCredentialsFromRequest returns the credentials of the client which sent
+// req over a Unix domain socket listener. RoleFromRequest implementations can
+// use them to identify local processes without certificates.
+func PeerCredentialsFromRequest(req *http.Request) (*PeerCredentials, bool) {
+	creds, ok := req.Context().Value(peerCredentialsKey{}).(*PeerCredentials)
+	return creds, ok
+}
+
+// unixListenerName is the name of the listener configured by SetUnixListener.
+const unixListenerName = "unix"
+
+// SetUnixListener configures a proxy listener on a Unix domain socket at path,
+// replacing one set previously. It uses the proxy-wide role extraction and
+// ACL.
+func (config *Config) SetUnixListener(path string, mode os.FileMode, owner string) error {
+	for i, lc := range config.Listeners {
+		if lc.Name == unixListenerName {
+			config.Listeners = append(config.Listeners[:i], config.Listeners[i+1:]...)
+			break
+		}
+	}
+	return config.AddListener(&ListenerConfig{
+		Name:         unixListenerName,
+		UnixPath:     path,
+		UnixFileMode: mode,
+		UnixOwner:    owner,
+	})
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing a stale socket
+// left behind by a previous process.
+func listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// lookupOwner resolves "user" or "user:group", given as names or numeric IDs.
+// A gid of -1 leaves the group unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+
+	uid, err := strconv.Atoi(userName)
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("unexpected uid %q for user %s", u.Uid, userName)
+		}
+	}
+
+	gid := -1
+	if groupName != "" {
+		gid, err = strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("unexpected gid %q for group %s", g.Gid, groupName)
+			}
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package smokescreen
+
+import "net"
+
+func peerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, errPeerCredentialsUnsupported
+}
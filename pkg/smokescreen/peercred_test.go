@@ -0,0 +1,89 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	r := require.New(t)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	cfg, err := testConfig("")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	cfg.RoleFromRequest = func(req *http.Request) (string, error) {
+		creds, ok := PeerCredentialsFromRequest(req)
+		if !ok || creds.Uid != uint32(os.Getuid()) || creds.Pid != int32(os.Getpid()) {
+			return "", errors.New("unexpected peer credentials")
+		}
+		return "test-local-srv", nil
+	}
+	logHook := proxyLogHook(cfg)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	r.NoError(cfg.SetUnixListener(path, 0660, ""))
+	r.Len(cfg.Listeners, 1)
+
+	servers, err := startListeners(cfg, BuildProxy(cfg))
+	r.NoError(err)
+	defer servers[0].Close()
+
+	fi, err := os.Stat(path)
+	r.NoError(err)
+	r.Equal(os.FileMode(0660), fi.Mode().Perm())
+
+	proxyURL, err := url.Parse("http://smokescreen")
+	r.NoError(err)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get(remote.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	entry := findCanonicalProxyDecision(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Equal("test-local-srv", entry.Data[LogFieldRole])
+	r.Equal(unixListenerName, entry.Data[LogFieldListener])
+}
+
+func TestUnixListenerValidation(t *testing.T) {
+	r := require.New(t)
+
+	cfg := NewConfig()
+	r.Error(cfg.AddListener(&ListenerConfig{Name: "unix-proxyproto", UnixPath: "/tmp/x.sock", SupportProxyProtocol: true}))
+
+	// Setting the Unix listener again replaces it
+	r.NoError(cfg.SetUnixListener("/tmp/a.sock", 0, ""))
+	r.NoError(cfg.SetUnixListener("/tmp/b.sock", 0, ""))
+	r.Len(cfg.Listeners, 1)
+	r.Equal("/tmp/b.sock", cfg.Listeners[0].UnixPath)
+}
@@ -0,0 +1,84 @@
+package smokescreen
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
+)
+
+const (
+	DefaultPrometheusNamespace = "smokescreen"
+	DefaultPrometheusPath      = "/metrics"
+)
+
+// Histogram buckets of the connection metrics, which are far from the
+// default buckets' range.
+var defaultPrometheusBuckets = map[string][]float64{
+	"cn.duration":  {0.1, 1, 5, 15, 60, 300, 900, 3600, 14400},
+	"cn.bytes_in":  {1 << 10, 1 << 14, 1 << 17, 1 << 20, 1 << 24, 1 << 27, 1 << 30},
+	"cn.bytes_out": {1 << 10, 1 << 14, 1 << 17, 1 << 20, 1 << 24, 1 << 27, 1 << 30},
+}
+
+// Limits on the number of distinct values of the labels which depend on
+// clients and destinations.
+var defaultPrometheusLabelLimits = map[string]int{
+	"role":    1000,
+	"project": 1000,
+	"domain":  1000,
+}
+
+// SetupPrometheus reports metrics to a Prometheus sink configured by pc, in
+// addition to statsd. It must be called after SetupStatsd. The metrics are
+// served on PrometheusAddr and, if PrometheusOnStatsSocket is set, on the
+// stats socket.
+func (config *Config) SetupPrometheus(pc stats.PrometheusConfig) error {
+	if pc.Namespace == "" {
+		pc.Namespace = DefaultPrometheusNamespace
+	}
+
+	buckets := make(map[string][]float64)
+	for name, b := range defaultPrometheusBuckets {
+		buckets[name] = b
+	}
+	for name, b := range pc.Buckets {
+		buckets[name] = b
+	}
+	pc.Buckets = buckets
+
+	limits := make(map[string]int)
+	for name, l := range defaultPrometheusLabelLimits {
+		limits[name] = l
+	}
+	for name, l := range pc.LabelLimits {
+		limits[name] = l
+	}
+	pc.LabelLimits = limits
+
+	config.Prometheus = stats.NewPrometheus(pc)
+	if config.PrometheusPath == "" {
+		config.PrometheusPath = DefaultPrometheusPath
+	}
+	return config.MetricsClient.AddSink(config.Prometheus)
+}
+
+// startPrometheusServer serves the Prometheus metrics on PrometheusAddr.
+func startPrometheusServer(config *Config) (*http.Server, error) {
+	ln, err := net.Listen("tcp", config.PrometheusAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(config.PrometheusPath, config.Prometheus)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		config.Log.Printf("serving Prometheus metrics on %s", ln.Addr())
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			config.Log.Errorf("prometheus serve error: %v", err)
+		}
+	}()
+	return server, nil
+}
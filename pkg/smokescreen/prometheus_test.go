@@ -0,0 +1,77 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/stats"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	r := require.New(t)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetupPrometheus(stats.PrometheusConfig{DropLabels: []string{"domain"}}))
+	cfg.PrometheusOnStatsSocket = true
+	cfg.TimeConnect = true
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+
+	resp, err := client.Get(remote.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	// The metrics are served on the stats socket.
+	rec := httptest.NewRecorder()
+	newServer(cfg).ServeHTTP(rec, httptest.NewRequest("GET", DefaultPrometheusPath, nil))
+	r.Equal(http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	r.Contains(body, `smokescreen_acl_allow_total{def_rule="false",project="security",role="test-local-srv"} 1`)
+	r.Contains(body, `smokescreen_cn_atpt_total{success="true"} 1`)
+	r.Contains(body, `smokescreen_cn_atpt_connect_time_seconds_count 1`)
+	r.Contains(body, `smokescreen_resolver_attempts_total 1`)
+}
+
+func TestPrometheusFromConfigFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte(`
+prometheus:
+  listen_address: 127.0.0.1:9810
+  label_limits:
+    role: 2
+`), 0600))
+
+	conf, err := LoadConfig(path)
+	r.NoError(err)
+	r.NotNil(conf.Prometheus)
+	r.Equal("127.0.0.1:9810", conf.PrometheusAddr)
+	r.Equal(DefaultPrometheusPath, conf.PrometheusPath)
+
+	for _, role := range []string{"a", "b", "c"} {
+		conf.MetricsClient.IncrWithTags("acl.deny", []string{"role:" + role}, 1)
+	}
+	rec := httptest.NewRecorder()
+	conf.Prometheus.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	r.Contains(rec.Body.String(), `smokescreen_acl_deny_total{role="__other__"} 1`)
+}
@@ -0,0 +1,536 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultProxyAuthRealm     = "smokescreen"
+	defaultProxyAuthRoleClaim = "sub"
+
+	// Allowed clock skew when checking the validity period of tokens.
+	jwtLeeway = time.Minute
+)
+
+// ProxyAuthConfig configures authentication of clients using the
+// Proxy-Authorization header.
+type ProxyAuthConfig struct {
+	// Realm sent in Proxy-Authenticate challenges.
+	Realm string
+
+	// Basic credentials are checked against an htpasswd file. The role is
+	// the username.
+	HtpasswdFile string
+
+	// Bearer tokens are JWTs verified against the keys in a JWKS file, which
+	// must expire. The role is the value of RoleClaim ("sub" by default). When Issuer or
+	// Audience are set, the token's iss and aud claims must match them.
+	JWKSFile  string
+	Issuer    string
+	Audience  string
+	RoleClaim string
+}
+
+// ProxyAuthenticator determines the role of clients from the credentials they
+// present in the Proxy-Authorization header.
+type ProxyAuthenticator struct {
+	realm     string
+	users     map[string]string
+	keys      []jwk
+	issuer    string
+	audience  string
+	roleClaim string
+
+	now func() time.Time
+}
+
+// proxyAuthError is returned for credentials which are present but invalid.
+// Unlike a MissingRoleError, it is never treated as an anonymous request.
+type proxyAuthError struct {
+	error
+}
+
+func NewProxyAuthenticator(c ProxyAuthConfig) (*ProxyAuthenticator, error) {
+	if c.HtpasswdFile == "" && c.JWKSFile == "" {
+		return nil, errors.New("proxy authentication requires an htpasswd file or a JWKS file")
+	}
+
+	a := &ProxyAuthenticator{
+		realm:     c.Realm,
+		issuer:    c.Issuer,
+		audience:  c.Audience,
+		roleClaim: c.RoleClaim,
+		now:       time.Now,
+	}
+	if a.realm == "" {
+		a.realm = defaultProxyAuthRealm
+	}
+	if a.roleClaim == "" {
+		a.roleClaim = defaultProxyAuthRoleClaim
+	}
+
+	if c.HtpasswdFile != "" {
+		users, err := loadHtpasswd(c.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	if c.JWKSFile != "" {
+		keys, err := loadJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	return a, nil
+}
+
+// Authenticate returns the role of the client which sent req. A
+// MissingRoleError is returned when req carries no credentials.
+func (a *ProxyAuthenticator) Authenticate(req *http.Request) (string, error) {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", MissingRoleError("request has no Proxy-Authorization header")
+	}
+
+	scheme, credentials := header, ""
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		scheme, credentials = header[:i], strings.TrimSpace(header[i+1:])
+	}
+
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.users != nil:
+		return a.authenticateBasic(credentials)
+	case strings.EqualFold(scheme, "Bearer") && a.keys != nil:
+		return a.authenticateBearer(credentials)
+	default:
+		return "", proxyAuthError{fmt.Errorf("unsupported Proxy-Authorization scheme %q", scheme)}
+	}
+}
+
+// Challenges returns the Proxy-Authenticate values for the schemes accepted.
+func (a *ProxyAuthenticator) Challenges() []string {
+	var challenges []string
+	if a.users != nil {
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if a.keys != nil {
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	return challenges
+}
+
+func (a *ProxyAuthenticator) authenticateBasic(credentials string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", proxyAuthError{errors.New("malformed Basic credentials")}
+	}
+	username, password := string(decoded), ""
+	if i := bytes.IndexByte(decoded, ':'); i >= 0 {
+		username, password = string(decoded[:i]), string(decoded[i+1:])
+	}
+
+	hash, ok := a.users[username]
+	if !ok || !htpasswdMatches(hash, password) {
+		return "", proxyAuthError{fmt.Errorf("invalid credentials for user %q", username)}
+	}
+	return username, nil
+}
+
+func (a *ProxyAuthenticator) authenticateBearer(token string) (string, error) {
+	claims, err := verifyJWT(token, a.keys)
+	if err != nil {
+		return "", proxyAuthError{err}
+	}
+
+	// Tokens must expire: a leaked token without exp would be valid forever.
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", proxyAuthError{errors.New("token has no numeric exp claim")}
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", proxyAuthError{errors.New("token has expired")}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		nbf, ok := nbf.(float64)
+		if !ok {
+			return "", proxyAuthError{errors.New("token has a non-numeric nbf claim")}
+		}
+		if now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return "", proxyAuthError{errors.New("token is not valid yet")}
+		}
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return "", proxyAuthError{fmt.Errorf("unexpected token issuer %v", claims["iss"])}
+	}
+	if a.audience != "" && !audienceMatches(claims["aud"], a.audience) {
+		return "", proxyAuthError{fmt.Errorf("token audience does not include %s", a.audience)}
+	}
+
+	role, ok := claims[a.roleClaim].(string)
+	if !ok || role == "" {
+		return "", proxyAuthError{fmt.Errorf("token has no %s claim", a.roleClaim)}
+	}
+	return role, nil
+}
+
+func audienceMatches(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadHtpasswd reads an htpasswd file with bcrypt ($2y$, $2a$ or $2b$),
+// Apache MD5 ($apr1$) or SHA1 ({SHA}) password hashes.
+func loadHtpasswd(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: malformed htpasswd entry", path, lineNo)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash for user %q; use bcrypt, Apache MD5 or SHA1", path, lineNo, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
+func htpasswdMatches(hash, password string) bool {
+	var computed string
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 implements the Apache variant of the MD5-based crypt(3) scheme.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + string(out)
+}
+
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// loadJWKS reads the RSA, EC and Ed25519 public keys of a JSON Web Key Set.
+func loadJWKS(path string) ([]jwk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var keys []jwk
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k.Kty, k.Crv, k.N, k.E, k.X, k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %v", path, i, err)
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signing keys found", path)
+	}
+	return keys, nil
+}
+
+func parseJWK(kty, crv, n, e, x, y string) (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch kty {
+	case "RSA":
+		nb, err := decode(n)
+		if err != nil {
+			return nil, err
+		}
+		eb, err := decode(e)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(new(big.Int).SetBytes(eb).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+		xb, err := decode(x)
+		if err != nil {
+			return nil, err
+		}
+		yb, err := decode(y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	case "OKP":
+		if crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+		xb, err := decode(x)
+		if err != nil {
+			return nil, err
+		}
+		if len(xb) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(xb), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", kty)
+	}
+}
+
+// verifyJWT checks the signature of a compact JWS and returns its claims.
+// Only asymmetric algorithms are accepted.
+func verifyJWT(token string, keys []jwk) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifyJWS(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("token signature is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, sig)
+	default:
+		return false
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch alg[0] {
+	case 'R':
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case 'P':
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+	default:
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+}
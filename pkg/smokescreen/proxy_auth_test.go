@@ -0,0 +1,283 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Generated with: openssl passwd -apr1 -salt saltsalt secret
+const testApr1Hash = "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"
+
+func TestHtpasswdHashes(t *testing.T) {
+	r := require.New(t)
+
+	r.Equal(testApr1Hash, apr1("secret", "saltsalt"))
+	r.True(htpasswdMatches(testApr1Hash, "secret"))
+	r.False(htpasswdMatches(testApr1Hash, "Secret"))
+
+	// Generated with: htpasswd -nbs user secret
+	r.True(htpasswdMatches("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"))
+	r.False(htpasswdMatches("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "public"))
+
+	// Generated with bcrypt at cost 5; htpasswd -B writes the same hash with
+	// the $2y$ prefix.
+	const bcryptHash = "$2a$05$Iwc4aslrMWzozfWRAsWeD.iMTF65PcFZLJcOqXtzXAx3.LFtFB912"
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		hash := prefix + strings.TrimPrefix(bcryptHash, "$2a$")
+		r.True(htpasswdMatches(hash, "secret"), prefix)
+		r.False(htpasswdMatches(hash, "Secret"), prefix)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	r.NoError(ioutil.WriteFile(path, []byte("bcrypt:$2y$"+strings.TrimPrefix(bcryptHash, "$2a$")+"\n"), 0600))
+	users, err := loadHtpasswd(path)
+	r.NoError(err)
+	r.Contains(users, "bcrypt")
+
+	// Generated with: openssl passwd -6 -salt saltsalt secret
+	r.NoError(ioutil.WriteFile(path, []byte("sha512:$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1\n"), 0600))
+	_, err = loadHtpasswd(path)
+	r.Error(err)
+}
+
+func jwtTestBase64(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signTestJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	signed := jwtTestBase64(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + jwtTestBase64(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"n":   enc(rsaKey.N.Bytes()),
+				"e":   enc(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"crv": "P-256",
+				"x":   enc(ecKey.X.Bytes()),
+				"y":   enc(ecKey.Y.Bytes()),
+			},
+		},
+	}
+	data, err := json.Marshal(jwks)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	r := require.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	r.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+
+	auth, err := NewProxyAuthenticator(ProxyAuthConfig{
+		JWKSFile:  writeTestJWKS(t, rsaKey, ecKey),
+		Issuer:    "https://auth.example.com",
+		Audience:  "smokescreen",
+		RoleClaim: "service",
+	})
+	r.NoError(err)
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":     "https://auth.example.com",
+			"aud":     []string{"other", "smokescreen"},
+			"exp":     now.Add(time.Hour).Unix(),
+			"service": "test-local-srv",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		role  string
+	}{
+		{"rsa", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(nil)), "test-local-srv"},
+		{"ecdsa", signTestJWT(t, ecKey, "ES256", "ec-1", claims(map[string]interface{}{"aud": "smokescreen"})), "test-local-srv"},
+		{"unknown key", signTestJWT(t, otherKey, "ES256", "ec-1", claims(nil)), ""},
+		{"wrong algorithm for key", signTestJWT(t, ecKey, "RS256", "ec-1", claims(nil)), ""},
+		{"expired", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), ""},
+		{"no expiry", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"exp": nil})), ""},
+		{"non-numeric expiry", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"exp": "never"})), ""},
+		{"non-numeric not before", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"nbf": "now"})), ""},
+		{"not yet valid", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), ""},
+		{"wrong issuer", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"iss": "https://evil.example.com"})), ""},
+		{"wrong audience", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"aud": "other"})), ""},
+		{"missing role claim", signTestJWT(t, rsaKey, "RS256", "rsa-1", claims(map[string]interface{}{"service": nil})), ""},
+		{"unsigned", jwtTestBase64(map[string]string{"alg": "none"}) + "." + jwtTestBase64(claims(nil)) + ".", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{}}
+			req.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+
+			role, err := auth.Authenticate(req)
+			if tt.role == "" {
+				require.Error(t, err)
+				require.False(t, IsMissingRoleError(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.role, role)
+		})
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	r := require.New(t)
+
+	var forwarded http.Header
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	r.NoError(ioutil.WriteFile(path, []byte("# test users\ntest-local-srv:"+testApr1Hash+"\n"), 0600))
+
+	cfg, err := testConfig("")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	cfg.RoleFromRequest = func(*http.Request) (string, error) {
+		return "", MissingRoleError("no role")
+	}
+	cfg.ProxyAuth, err = NewProxyAuthenticator(ProxyAuthConfig{HtpasswdFile: path, Realm: "egress"})
+	r.NoError(err)
+	logHook := proxyLogHook(cfg)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+
+	tests := []struct {
+		name     string
+		userinfo *url.Userinfo
+		status   int
+		reason   string
+	}{
+		{"valid credentials", url.UserPassword("test-local-srv", "secret"), http.StatusOK, ""},
+		{"no credentials", nil, http.StatusProxyAuthRequired, "Client role cannot be determined"},
+		{"wrong password", url.UserPassword("test-local-srv", "guess"), http.StatusProxyAuthRequired, "Proxy authentication failed"},
+		{"unknown user", url.UserPassword("nobody", "secret"), http.StatusProxyAuthRequired, "Proxy authentication failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := require.New(t)
+			logHook.Reset()
+			forwarded = nil
+
+			proxyURL, err := url.Parse(proxy.URL)
+			a.NoError(err)
+			proxyURL.User = tt.userinfo
+			client, err := proxyClient(proxyURL.String())
+			a.NoError(err)
+
+			resp, err := client.Get(remote.URL)
+			a.NoError(err)
+			resp.Body.Close()
+			a.Equal(tt.status, resp.StatusCode)
+
+			entry := findCanonicalProxyDecision(logHook.AllEntries())
+			a.NotNil(entry)
+
+			if tt.status == http.StatusOK {
+				a.Equal("test-local-srv", entry.Data["role"])
+				a.NotNil(forwarded)
+				a.Empty(forwarded.Get("Proxy-Authorization"))
+				return
+			}
+			a.Equal(tt.reason, entry.Data["decision_reason"])
+			a.Equal([]string{`Basic realm="egress"`}, resp.Header.Values("Proxy-Authenticate"))
+		})
+	}
+}
+
+func TestProxyAuthFromConfigFile(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	r.NoError(ioutil.WriteFile(htpasswd, []byte("svc:"+testApr1Hash+"\n"), 0600))
+
+	path := filepath.Join(dir, "config.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte(`
+proxy_auth:
+  realm: egress
+  htpasswd_file: `+htpasswd+`
+`), 0600))
+
+	conf, err := LoadConfig(path)
+	r.NoError(err)
+	r.NotNil(conf.ProxyAuth)
+	r.Equal([]string{`Basic realm="egress"`}, conf.ProxyAuth.Challenges())
+
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth("svc", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	role, err := conf.ProxyAuth.Authenticate(req)
+	r.NoError(err)
+	r.Equal("svc", role)
+}
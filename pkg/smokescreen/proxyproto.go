@@ -0,0 +1,553 @@
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+const LogFieldProxyTLVs = "proxy_protocol_tlvs"
+
+// Types of PROXY protocol v2 TLVs.
+const (
+	ProxyTLVTypeALPN      = 0x01
+	ProxyTLVTypeAuthority = 0x02
+	ProxyTLVTypeCRC32C    = 0x03
+	ProxyTLVTypeNoop      = 0x04
+	ProxyTLVTypeUniqueID  = 0x05
+	ProxyTLVTypeSSL       = 0x20
+	ProxyTLVTypeNetNS     = 0x30
+	ProxyTLVTypeGCP       = 0xE0
+	ProxyTLVTypeAWS       = 0xEA
+	ProxyTLVTypeAzure     = 0xEE
+
+	// Sub-TLVs of ProxyTLVTypeSSL.
+	ProxyTLVTypeSSLVersion = 0x21
+	ProxyTLVTypeSSLCN      = 0x22
+	ProxyTLVTypeSSLCipher  = 0x23
+	ProxyTLVTypeSSLSigAlg  = 0x24
+	ProxyTLVTypeSSLKeyAlg  = 0x25
+)
+
+// Names of TLVs in the decision log. Other types are logged by number.
+var proxyTLVNames = map[byte]string{
+	ProxyTLVTypeALPN:       "alpn",
+	ProxyTLVTypeAuthority:  "authority",
+	ProxyTLVTypeUniqueID:   "unique_id",
+	ProxyTLVTypeNetNS:      "netns",
+	ProxyTLVTypeGCP:        "gcp_psc_connection_id",
+	ProxyTLVTypeAWS:        "aws_vpce_id",
+	ProxyTLVTypeAzure:      "azure_private_endpoint_link_id",
+	ProxyTLVTypeSSLVersion: "ssl_version",
+	ProxyTLVTypeSSLCN:      "ssl_cn",
+	ProxyTLVTypeSSLCipher:  "ssl_cipher",
+	ProxyTLVTypeSSLSigAlg:  "ssl_sig_alg",
+	ProxyTLVTypeSSLKeyAlg:  "ssl_key_alg",
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader = errors.New("connection did not start with a PROXY protocol header")
+)
+
+const (
+	// v1 headers are at most 107 bytes, including the CRLF.
+	proxyV1MaxLength = 107
+
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// ProxyHeader holds what a load balancer reported about a connection using
+// the PROXY protocol.
+type ProxyHeader struct {
+	Version int
+
+	// Source and Destination are nil when the sender did not report them,
+	// e.g. for v2 health checks using the LOCAL command.
+	Source      net.Addr
+	Destination net.Addr
+
+	// TLVs of a v2 header, in the order received. The sub-TLVs of a
+	// ProxyTLVTypeSSL TLV are listed after it.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value field of a v2 PROXY protocol header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first TLV of type typ.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// logFields formats the TLVs for the decision log.
+func (h *ProxyHeader) logFields() map[string]string {
+	fields := make(map[string]string)
+	for _, tlv := range h.TLVs {
+		name, ok := proxyTLVNames[tlv.Type]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", tlv.Type)
+		}
+		switch tlv.Type {
+		case ProxyTLVTypeCRC32C, ProxyTLVTypeNoop, ProxyTLVTypeSSL:
+			continue
+		}
+		fields[name] = proxyTLVString(tlv.Type, tlv.Value)
+	}
+	return fields
+}
+
+// proxyTLVString returns a TLV value as text: printable values as they are,
+// others hex encoded. The AWS TLV's leading subtype is dropped.
+func proxyTLVString(typ byte, value []byte) string {
+	if typ == ProxyTLVTypeAWS && len(value) > 0 {
+		value = value[1:]
+	}
+	if utf8.Valid(value) && bytes.IndexFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) < 0 {
+		return string(value)
+	}
+	return hex.EncodeToString(value)
+}
+
+type proxyHeaderKey struct{}
+
+// ProxyHeaderFromRequest returns the PROXY protocol header received on the
+// connection req arrived on, if any.
+func ProxyHeaderFromRequest(req *http.Request) (*ProxyHeader, bool) {
+	if req == nil {
+		return nil, false
+	}
+	c, ok := req.Context().Value(proxyHeaderKey{}).(*proxyProtocolConn)
+	if !ok {
+		return nil, false
+	}
+	h := c.proxyHeader()
+	return h, h != nil
+}
+
+// withProxyHeader makes the PROXY protocol header of c available to requests
+// served on it. It does not block: the header is read on first use.
+func withProxyHeader(ctx context.Context, c net.Conn) context.Context {
+	if pc := proxyProtocolConnOf(c); pc != nil {
+		return context.WithValue(ctx, proxyHeaderKey{}, pc)
+	}
+	return ctx
+}
+
+// SetProxyProtocolTrustedRanges sets the CIDRs from which PROXY protocol
+// headers are accepted.
+func (config *Config) SetProxyProtocolTrustedRanges(rangeStrings []string) error {
+	ranges, err := parseRanges(rangeStrings)
+	if err != nil {
+		return err
+	}
+	config.ProxyProtocolTrustedRanges = ranges
+	return nil
+}
+
+// proxyProtocolListener accepts connections which may start with a PROXY
+// protocol v1 or v2 header. Only connections from trustedRanges, or from
+// anywhere when it is empty, may send a header; in strict mode they must, and
+// connections from other sources are refused.
+type proxyProtocolListener struct {
+	net.Listener
+	strict        bool
+	trustedRanges []RuleRange
+	log           *logrus.Logger
+}
+
+func newProxyProtocolListener(l net.Listener, strict bool, trustedRanges []RuleRange, log *logrus.Logger) net.Listener {
+	return &proxyProtocolListener{Listener: l, strict: strict, trustedRanges: trustedRanges, log: log}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.trusted(conn.RemoteAddr()) {
+			if l.strict {
+				l.log.WithField(LogFieldInRemoteAddr, conn.RemoteAddr().String()).Warn("refusing connection from source not trusted to send PROXY protocol headers")
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		}
+
+		return &proxyProtocolConn{
+			Conn:   conn,
+			br:     bufio.NewReader(conn),
+			strict: l.strict,
+			log:    l.log,
+		}, nil
+	}
+}
+
+func (l *proxyProtocolListener) trusted(addr net.Addr) bool {
+	if len(l.trustedRanges) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, r := range l.trustedRanges {
+		if r.Net.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn reads the PROXY protocol header of a connection on first
+// use, so that a slow client cannot stall the listener's accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+	br     *bufio.Reader
+	strict bool
+	log    *logrus.Logger
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+
+	// Set when the connection is wrapped in TLS by a tlsListener.
+	tlsConn *tls.Conn
+
+	// The read deadline set by the connection's user, restored once the
+	// header has been read.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// proxyProtocolConnOf returns the PROXY protocol connection underlying c.
+func proxyProtocolConnOf(c net.Conn) *proxyProtocolConn {
+	switch c := c.(type) {
+	case *proxyProtocolConn:
+		return c
+	case *tls.Conn:
+		if pc, ok := proxiedTLSConns.Load(c); ok {
+			return pc.(*proxyProtocolConn)
+		}
+	}
+	return nil
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		timeout := time.Now().Add(proxyHeaderTimeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			c.Conn.SetReadDeadline(timeout)
+		}
+
+		c.header, c.err = readProxyHeader(c.br)
+		if c.err == errNoProxyHeader && !c.strict {
+			c.err = nil
+		}
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+
+		if c.err != nil {
+			// Close right away so that nothing, not even an error response,
+			// is sent to the client.
+			c.log.WithField(LogFieldInRemoteAddr, c.Conn.RemoteAddr().String()).Warnf("invalid PROXY protocol header: %v", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) proxyHeader() *ProxyHeader {
+	c.readHeader()
+	return c.header
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) Close() error {
+	if c.tlsConn != nil {
+		proxiedTLSConns.Delete(c.tlsConn)
+	}
+	return c.Conn.Close()
+}
+
+// proxiedTLSConns maps TLS connections to the PROXY protocol connections they
+// wrap, as tls.Conn does not expose its underlying connection.
+var proxiedTLSConns sync.Map
+
+// tlsListener is tls.NewListener, keeping track of the PROXY protocol
+// connections wrapped in TLS.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func newTLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return &tlsListener{Listener: l, config: config}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, l.config)
+	if pc, ok := conn.(*proxyProtocolConn); ok {
+		pc.tlsConn = tlsConn
+		proxiedTLSConns.Store(tlsConn, pc)
+	}
+	return tlsConn, nil
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from br. It returns
+// errNoProxyHeader, having consumed nothing, if there is none.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	first, err := br.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// The client is waiting for the server to speak first.
+		return nil, errNoProxyHeader
+	} else if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if b, err := br.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(b, proxyV1Prefix) {
+			return readProxyHeaderV1(br)
+		}
+	case proxyV2Signature[0]:
+		if b, err := br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return readProxyHeaderV2(br)
+		}
+	}
+	return nil, errNoProxyHeader
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	if (fields[1] == "TCP4") != (src.To4() != nil && dst.To4() != nil) {
+		return nil, fmt.Errorf("v1 header addresses do not match protocol %s", fields[1])
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return h, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+
+	var addrLen int
+	switch family {
+	case 0x11, 0x12: // TCP and UDP over IPv4
+		addrLen = 12
+	case 0x21, 0x22: // TCP and UDP over IPv6
+		addrLen = 36
+	case 0x31, 0x32: // Unix stream and datagram sockets
+		addrLen = 216
+	case 0x00:
+	default:
+		return nil, fmt.Errorf("unsupported v2 address family 0x%02x", family)
+	}
+	if len(payload) < addrLen {
+		return nil, errors.New("v2 header is too short for its address family")
+	}
+
+	tlvs, err := parseProxyTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+
+	if crc, ok := h.TLV(ProxyTLVTypeCRC32C); ok {
+		if err := checkProxyCRC32C(fixed, payload, addrLen, crc); err != nil {
+			return nil, err
+		}
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the connection was opened by the proxy itself.
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command 0x%x", command)
+	}
+
+	switch addrLen {
+	case 12:
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 36:
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	case 216:
+		h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+	}
+	return h, nil
+}
+
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("truncated v2 TLV")
+		}
+		typ, length := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return nil, fmt.Errorf("truncated v2 TLV 0x%02x", typ)
+		}
+		value := b[3 : 3+length]
+		tlvs = append(tlvs, ProxyTLV{Type: typ, Value: value})
+
+		if typ == ProxyTLVTypeSSL {
+			// client (1 byte) and verify (4 bytes) precede the sub-TLVs.
+			if len(value) < 5 {
+				return nil, errors.New("truncated v2 SSL TLV")
+			}
+			sub, err := parseProxyTLVs(value[5:])
+			if err != nil {
+				return nil, err
+			}
+			tlvs = append(tlvs, sub...)
+		}
+		b = b[3+length:]
+	}
+	return tlvs, nil
+}
+
+// checkProxyCRC32C verifies the checksum of a v2 header, which is computed
+// with the checksum's own value set to zero.
+func checkProxyCRC32C(fixed, payload []byte, addrLen int, crc []byte) error {
+	if len(crc) != 4 {
+		return errors.New("invalid v2 CRC32C TLV")
+	}
+	want := binary.BigEndian.Uint32(crc)
+
+	zeroed := append([]byte(nil), payload...)
+	for b := zeroed[addrLen:]; len(b) >= 3; {
+		length := int(binary.BigEndian.Uint16(b[1:3]))
+		if b[0] == ProxyTLVTypeCRC32C {
+			copy(b[3:3+length], make([]byte, length))
+			break
+		}
+		b = b[3+length:]
+	}
+
+	sum := crc32.Checksum(fixed, crc32.MakeTable(crc32.Castagnoli))
+	sum = crc32.Update(sum, crc32.MakeTable(crc32.Castagnoli), zeroed)
+	if sum != want {
+		return errors.New("v2 header checksum mismatch")
+	}
+	return nil
+}
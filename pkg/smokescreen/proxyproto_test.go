@@ -0,0 +1,228 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header encodes a v2 PROXY command for TCP over IPv4.
+func proxyV2Header(src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	var payload bytes.Buffer
+	payload.Write(src.IP.To4())
+	payload.Write(dst.IP.To4())
+	binary.Write(&payload, binary.BigEndian, uint16(src.Port))
+	binary.Write(&payload, binary.BigEndian, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		payload.WriteByte(tlv.Type)
+		binary.Write(&payload, binary.BigEndian, uint16(len(tlv.Value)))
+		payload.Write(tlv.Value)
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.Write([]byte{0x21, 0x11})
+	binary.Write(&b, binary.BigEndian, uint16(payload.Len()))
+	b.Write(payload.Bytes())
+	return b.Bytes()
+}
+
+// withProxyCRC32C appends a valid checksum TLV to a v2 header.
+func withProxyCRC32C(header []byte) []byte {
+	header = append(header, ProxyTLVTypeCRC32C, 0, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], binary.BigEndian.Uint16(header[14:16])+7)
+	sum := crc32.Checksum(header, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(header[len(header)-4:], sum)
+	return header
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.5").To4(), Port: 4750}
+
+	sslTLV := ProxyTLV{Type: ProxyTLVTypeSSL, Value: append([]byte{0x07, 0, 0, 0, 0},
+		ProxyTLVTypeSSLVersion, 0, 7, 'T', 'L', 'S', 'v', '1', '.', '3')}
+	awsTLV := ProxyTLV{Type: ProxyTLVTypeAWS, Value: append([]byte{0x01}, "vpce-0123456789abcdef0"...)}
+	v2 := proxyV2Header(src, dst, awsTLV, sslTLV)
+
+	badCRC := withProxyCRC32C(proxyV2Header(src, dst, awsTLV))
+	badCRC[len(badCRC)-1] ^= 0xff
+
+	local := proxyV2Header(src, dst)
+	local[12] = 0x20
+
+	truncated := proxyV2Header(src, dst, ProxyTLV{Type: 0xE1, Value: []byte("x")})
+	binary.BigEndian.PutUint16(truncated[29:31], 5)
+
+	tests := []struct {
+		name   string
+		input  []byte
+		source string
+		tlvs   map[string]string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.10 10.0.0.5 51000 4750\r\nGET /"), "192.0.2.10:51000", nil, false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 4750\r\nGET /"), "[2001:db8::1]:51000", nil, false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET /"), "", nil, false},
+		{"v1 mismatched family", []byte("PROXY TCP4 2001:db8::1 10.0.0.5 51000 4750\r\nGET /"), "", nil, true},
+		{"v1 unterminated", []byte("PROXY TCP4 192.0.2.10 10.0.0.5 51000 4750\nGET /"), "", nil, true},
+		{"v2", append(v2, "GET /"...), "192.0.2.10:51000", map[string]string{
+			"aws_vpce_id": "vpce-0123456789abcdef0",
+			"ssl_version": "TLSv1.3",
+		}, false},
+		{"v2 checksum", append(withProxyCRC32C(proxyV2Header(src, dst)), "GET /"...), "192.0.2.10:51000", map[string]string{}, false},
+		{"v2 bad checksum", append(badCRC, "GET /"...), "", nil, true},
+		{"v2 local", append(local, "GET /"...), "", map[string]string{}, false},
+		{"v2 truncated TLV", append(truncated, "GET /"...), "", nil, true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			br := bufio.NewReader(bytes.NewReader(tt.input))
+
+			h, err := readProxyHeader(br)
+			if tt.err {
+				r.Error(err)
+				return
+			}
+			r.NoError(err)
+
+			if tt.source == "" {
+				r.Nil(h.Source)
+			} else {
+				r.Equal(tt.source, h.Source.String())
+			}
+			if tt.tlvs != nil {
+				r.Equal(tt.tlvs, h.logFields())
+			}
+
+			rest, _ := br.Peek(5)
+			r.Equal("GET /", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	roleFromTLV, err := NewRoleFromRequest([]RoleStrategy{{Type: RoleStrategyProxyTLV, TLVType: ProxyTLVTypeAWS}})
+	require.NoError(t, err)
+
+	cfg, err := testConfig("")
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	cfg.RoleFromRequest = roleFromTLV
+	logHook := proxyLogHook(cfg)
+
+	serve := func(t *testing.T, strict bool, trusted []string) string {
+		ranges, err := parseRanges(trusted)
+		require.NoError(t, err)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := &http.Server{
+			Handler:     BuildProxy(cfg),
+			ConnContext: withProxyHeader,
+		}
+		go server.Serve(newProxyProtocolListener(ln, strict, ranges, cfg.Log))
+		t.Cleanup(func() { server.Close() })
+		return ln.Addr().String()
+	}
+
+	request := func(addr string, header []byte) (*http.Response, error) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write(header)
+		fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", remote.URL, strings.TrimPrefix(remote.URL, "http://"))
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 4750}
+	awsTLV := ProxyTLV{Type: ProxyTLVTypeAWS, Value: append([]byte{0x01}, "test-local-srv"...)}
+
+	t.Run("role from TLV", func(t *testing.T) {
+		r := require.New(t)
+		logHook.Reset()
+		addr := serve(t, true, []string{"127.0.0.0/8"})
+
+		resp, err := request(addr, proxyV2Header(src, dst, awsTLV))
+		r.NoError(err)
+		resp.Body.Close()
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal("test-local-srv", entry.Data[LogFieldRole])
+		r.Equal("192.0.2.10:51000", entry.Data[LogFieldInRemoteAddr])
+		r.Equal(map[string]string{"aws_vpce_id": "test-local-srv"}, entry.Data[LogFieldProxyTLVs])
+	})
+
+	t.Run("strict requires header", func(t *testing.T) {
+		addr := serve(t, true, []string{"127.0.0.0/8"})
+		_, err := request(addr, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("strict refuses untrusted sources", func(t *testing.T) {
+		addr := serve(t, true, []string{"10.0.0.0/8"})
+		_, err := request(addr, proxyV2Header(src, dst, awsTLV))
+		require.Error(t, err)
+	})
+
+	t.Run("untrusted sources cannot choose the role", func(t *testing.T) {
+		r := require.New(t)
+		logHook.Reset()
+		addr := serve(t, false, []string{"10.0.0.0/8"})
+
+		resp, err := request(addr, proxyV2Header(src, dst, awsTLV))
+		r.NoError(err)
+		resp.Body.Close()
+		r.Equal(http.StatusBadRequest, resp.StatusCode)
+		r.Nil(findCanonicalProxyDecision(logHook.AllEntries()))
+
+		resp, err = request(addr, nil)
+		r.NoError(err)
+		resp.Body.Close()
+		r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Empty(entry.Data[LogFieldRole])
+		r.Nil(entry.Data[LogFieldProxyTLVs])
+	})
+}
+
+func TestProxyTLVRoleStrategy(t *testing.T) {
+	r := require.New(t)
+
+	rs, err := ParseRoleStrategy("proxy_tlv:0xEA")
+	r.NoError(err)
+	r.Equal(RoleStrategy{Type: RoleStrategyProxyTLV, TLVType: ProxyTLVTypeAWS}, rs)
+
+	_, err = ParseRoleStrategy("proxy_tlv:vpce")
+	r.Error(err)
+	_, err = ParseRoleStrategy("proxy_tlv")
+	r.Error(err)
+}
@@ -0,0 +1,313 @@
+package smokescreen
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Built-in role strategies, selectable with RoleStrategy.Type.
+const (
+	// Common name of the client certificate.
+	RoleStrategyCN = "cn"
+	// First organizational unit of the client certificate.
+	RoleStrategyOU = "ou"
+	// First DNS SAN of the client certificate.
+	RoleStrategyDNSSAN = "dns_san"
+	// First URI SAN of the client certificate, without Prefix.
+	RoleStrategyURISAN = "uri_san"
+	// Path of the SPIFFE ID in the client certificate's URI SANs which
+	// belongs to TrustDomain.
+	RoleStrategySPIFFE = "spiffe"
+	// Value of the Header request header (X-Smokescreen-Role by default).
+	RoleStrategyHeader = "header"
+	// Uid of a client connected over a Unix domain socket, mapped through
+	// Uids or else to its user name.
+	RoleStrategyUnixUID = "unix_uid"
+	// Role of the most specific CIDR in CIDRs containing the client address.
+	RoleStrategyCIDR = "cidr"
+	// Value of the TLV of type TLVType in the connection's PROXY protocol
+	// header, e.g. the VPC endpoint ID sent by AWS load balancers.
+	RoleStrategyProxyTLV = "proxy_tlv"
+)
+
+// RoleStrategy configures one way of determining a client's role.
+type RoleStrategy struct {
+	Type string
+
+	Prefix      string
+	TrustDomain string
+	Header      string
+	Uids        map[uint32]string
+	CIDRs       []RoleCIDR
+	TLVType     uint8
+}
+
+// RoleCIDR assigns Role to clients connecting from Net.
+type RoleCIDR struct {
+	Net  net.IPNet
+	Role string
+}
+
+type roleFunc func(req *http.Request) (string, error)
+
+// NewRoleFromRequest builds a RoleFromRequest function from strategies. The
+// strategies are tried in order, and the first one able to determine a role
+// wins; a strategy which does not apply to a request (for example because
+// the client sent no certificate) falls through to the next. If none apply,
+// a MissingRoleError is returned so that AllowMissingRole is honored.
+func NewRoleFromRequest(strategies []RoleStrategy) (func(*http.Request) (string, error), error) {
+	if len(strategies) == 0 {
+		return nil, fmt.Errorf("at least one role strategy is required")
+	}
+
+	var chain []roleFunc
+	var names []string
+	for _, s := range strategies {
+		f, err := s.roleFunc()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, f)
+		names = append(names, s.Type)
+	}
+
+	return func(req *http.Request) (string, error) {
+		for _, f := range chain {
+			role, err := f(req)
+			if err == nil {
+				return role, nil
+			}
+			if !IsMissingRoleError(err) {
+				return "", err
+			}
+		}
+		return "", MissingRoleError(fmt.Sprintf("no role found using %s", strings.Join(names, ", ")))
+	}, nil
+}
+
+func (s RoleStrategy) roleFunc() (roleFunc, error) {
+	switch s.Type {
+	case RoleStrategyCN:
+		return roleFromCN, nil
+	case RoleStrategyOU:
+		return roleFromOU, nil
+	case RoleStrategyDNSSAN:
+		return roleFromDNSSAN, nil
+	case RoleStrategyURISAN:
+		return roleFromURISAN(s.Prefix), nil
+	case RoleStrategySPIFFE:
+		if s.TrustDomain == "" {
+			return nil, fmt.Errorf("role strategy %q requires a trust domain", s.Type)
+		}
+		return roleFromSPIFFE(s.TrustDomain), nil
+	case RoleStrategyHeader:
+		header := s.Header
+		if header == "" {
+			header = roleHeader
+		}
+		return roleFromHeader(header), nil
+	case RoleStrategyUnixUID:
+		return roleFromUnixUID(s.Uids), nil
+	case RoleStrategyCIDR:
+		if len(s.CIDRs) == 0 {
+			return nil, fmt.Errorf("role strategy %q requires at least one CIDR", s.Type)
+		}
+		return roleFromCIDR(s.CIDRs), nil
+	case RoleStrategyProxyTLV:
+		if s.TLVType == 0 {
+			return nil, fmt.Errorf("role strategy %q requires a TLV type", s.Type)
+		}
+		return roleFromProxyTLV(s.TLVType), nil
+	default:
+		return nil, fmt.Errorf("unknown role strategy %q", s.Type)
+	}
+}
+
+// ParseRoleStrategy parses the command line form of a role strategy:
+// TYPE, or TYPE:ARG where ARG is the trust domain of "spiffe", the prefix of
+// "uri_san", the header name of "header" or the TLV type of "proxy_tlv". The "cidr" strategy can only be
+// set up in the config file.
+func ParseRoleStrategy(s string) (RoleStrategy, error) {
+	typ, arg := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		typ, arg = s[:i], s[i+1:]
+	}
+
+	rs := RoleStrategy{Type: typ}
+	switch typ {
+	case RoleStrategySPIFFE:
+		rs.TrustDomain = arg
+	case RoleStrategyURISAN:
+		rs.Prefix = arg
+	case RoleStrategyHeader:
+		rs.Header = arg
+	case RoleStrategyProxyTLV:
+		typ, err := strconv.ParseUint(arg, 0, 8)
+		if err != nil {
+			return rs, fmt.Errorf("invalid TLV type %q", arg)
+		}
+		rs.TLVType = uint8(typ)
+	case RoleStrategyCIDR:
+		return rs, fmt.Errorf("role strategy %q must be configured in the config file", typ)
+	default:
+		if arg != "" {
+			return rs, fmt.Errorf("role strategy %q takes no argument", typ)
+		}
+	}
+	if _, err := rs.roleFunc(); err != nil {
+		return rs, err
+	}
+	return rs, nil
+}
+
+func roleFromCN(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", MissingRoleError("client did not provide certificate")
+	}
+	cn := req.TLS.PeerCertificates[0].Subject.CommonName
+	if cn == "" {
+		return "", MissingRoleError("client certificate has no common name")
+	}
+	return cn, nil
+}
+
+func roleFromOU(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", MissingRoleError("client did not provide certificate")
+	}
+	ous := req.TLS.PeerCertificates[0].Subject.OrganizationalUnit
+	if len(ous) == 0 {
+		return "", MissingRoleError("client certificate has no organizational unit")
+	}
+	return ous[0], nil
+}
+
+func roleFromDNSSAN(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", MissingRoleError("client did not provide certificate")
+	}
+	names := req.TLS.PeerCertificates[0].DNSNames
+	if len(names) == 0 {
+		return "", MissingRoleError("client certificate has no DNS SAN")
+	}
+	return names[0], nil
+}
+
+func roleFromURISAN(prefix string) roleFunc {
+	return func(req *http.Request) (string, error) {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return "", MissingRoleError("client did not provide certificate")
+		}
+		for _, u := range req.TLS.PeerCertificates[0].URIs {
+			s := u.String()
+			if strings.HasPrefix(s, prefix) && len(s) > len(prefix) {
+				return strings.TrimPrefix(s, prefix), nil
+			}
+		}
+		return "", MissingRoleError("client certificate has no matching URI SAN")
+	}
+}
+
+func roleFromSPIFFE(trustDomain string) roleFunc {
+	return func(req *http.Request) (string, error) {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return "", MissingRoleError("client did not provide certificate")
+		}
+		for _, u := range req.TLS.PeerCertificates[0].URIs {
+			if role, ok := spiffePath(u, trustDomain); ok {
+				return role, nil
+			}
+		}
+		return "", MissingRoleError(fmt.Sprintf("client certificate has no SPIFFE ID in trust domain %s", trustDomain))
+	}
+}
+
+// spiffePath returns the path of a SPIFFE ID without its leading slash, e.g.
+// "ns/prod/sa/api" for spiffe://example.org/ns/prod/sa/api.
+func spiffePath(u *url.URL, trustDomain string) (string, bool) {
+	if u.Scheme != "spiffe" || !strings.EqualFold(u.Host, trustDomain) || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	if path == "" {
+		return "", false
+	}
+	return path, true
+}
+
+func roleFromHeader(header string) roleFunc {
+	return func(req *http.Request) (string, error) {
+		role := req.Header.Get(header)
+		if role == "" {
+			return "", MissingRoleError(fmt.Sprintf("request has no %s header", header))
+		}
+		return role, nil
+	}
+}
+
+func roleFromUnixUID(uids map[uint32]string) roleFunc {
+	return func(req *http.Request) (string, error) {
+		creds, ok := PeerCredentialsFromRequest(req)
+		if !ok {
+			return "", MissingRoleError("client is not connected over a Unix domain socket")
+		}
+		if uids != nil {
+			role, ok := uids[creds.Uid]
+			if !ok {
+				return "", MissingRoleError(fmt.Sprintf("no role for uid %d", creds.Uid))
+			}
+			return role, nil
+		}
+		u, err := user.LookupId(strconv.FormatUint(uint64(creds.Uid), 10))
+		if err != nil {
+			return "", MissingRoleError(fmt.Sprintf("no user for uid %d", creds.Uid))
+		}
+		return u.Username, nil
+	}
+}
+
+func roleFromCIDR(cidrs []RoleCIDR) roleFunc {
+	return func(req *http.Request) (string, error) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", MissingRoleError("client address cannot be determined")
+		}
+
+		role, bestLen := "", -1
+		for _, c := range cidrs {
+			if !c.Net.Contains(ip) {
+				continue
+			}
+			if ones, _ := c.Net.Mask.Size(); ones > bestLen {
+				role, bestLen = c.Role, ones
+			}
+		}
+		if bestLen < 0 {
+			return "", MissingRoleError(fmt.Sprintf("no role for address %s", ip))
+		}
+		return role, nil
+	}
+}
+
+func roleFromProxyTLV(typ uint8) roleFunc {
+	return func(req *http.Request) (string, error) {
+		h, ok := ProxyHeaderFromRequest(req)
+		if !ok {
+			return "", MissingRoleError("client did not send a PROXY protocol header")
+		}
+		value, ok := h.TLV(typ)
+		if !ok || (typ == ProxyTLVTypeAWS && len(value) < 2) {
+			return "", MissingRoleError(fmt.Sprintf("PROXY protocol header has no TLV of type 0x%02x", typ))
+		}
+		return proxyTLVString(typ, value), nil
+	}
+}
@@ -0,0 +1,184 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func roleTestRequest(cert *x509.Certificate, remoteAddr string) *http.Request {
+	req := &http.Request{Header: http.Header{}, RemoteAddr: remoteAddr}
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return req.WithContext(context.Background())
+}
+
+func TestRoleStrategies(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/prod/sa/api")
+	otherID, _ := url.Parse("spiffe://other.org/ns/prod/sa/db")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "api-cn",
+			OrganizationalUnit: []string{"api-ou"},
+		},
+		DNSNames: []string{"api.internal"},
+		URIs:     []*url.URL{otherID, spiffeID},
+	}
+
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, subNet, _ := net.ParseCIDR("10.1.0.0/16")
+	cidrs := []RoleCIDR{{Net: *tenNet, Role: "internal"}, {Net: *subNet, Role: "batch"}}
+
+	tests := []struct {
+		name     string
+		strategy RoleStrategy
+		req      *http.Request
+		role     string
+	}{
+		{"cn", RoleStrategy{Type: RoleStrategyCN}, roleTestRequest(cert, ""), "api-cn"},
+		{"ou", RoleStrategy{Type: RoleStrategyOU}, roleTestRequest(cert, ""), "api-ou"},
+		{"dns san", RoleStrategy{Type: RoleStrategyDNSSAN}, roleTestRequest(cert, ""), "api.internal"},
+		{"uri san", RoleStrategy{Type: RoleStrategyURISAN, Prefix: "spiffe://example.org/"}, roleTestRequest(cert, ""), "ns/prod/sa/api"},
+		{"spiffe", RoleStrategy{Type: RoleStrategySPIFFE, TrustDomain: "example.org"}, roleTestRequest(cert, ""), "ns/prod/sa/api"},
+		{"spiffe other trust domain", RoleStrategy{Type: RoleStrategySPIFFE, TrustDomain: "example.com"}, roleTestRequest(cert, ""), ""},
+		{"cidr most specific", RoleStrategy{Type: RoleStrategyCIDR, CIDRs: cidrs}, roleTestRequest(nil, "10.1.2.3:5555"), "batch"},
+		{"cidr", RoleStrategy{Type: RoleStrategyCIDR, CIDRs: cidrs}, roleTestRequest(nil, "10.2.2.3:5555"), "internal"},
+		{"cidr no match", RoleStrategy{Type: RoleStrategyCIDR, CIDRs: cidrs}, roleTestRequest(nil, "192.0.2.1:5555"), ""},
+		{"cn without certificate", RoleStrategy{Type: RoleStrategyCN}, roleTestRequest(nil, ""), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+
+			rfr, err := NewRoleFromRequest([]RoleStrategy{tt.strategy})
+			r.NoError(err)
+			role, err := rfr(tt.req)
+			if tt.role == "" {
+				r.True(IsMissingRoleError(err), "expected missing role, got %v", err)
+				return
+			}
+			r.NoError(err)
+			r.Equal(tt.role, role)
+		})
+	}
+
+	t.Run("header", func(t *testing.T) {
+		r := require.New(t)
+
+		rfr, err := NewRoleFromRequest([]RoleStrategy{{Type: RoleStrategyHeader}})
+		r.NoError(err)
+		req := roleTestRequest(nil, "")
+		req.Header.Set(roleHeader, "from-header")
+		role, err := rfr(req)
+		r.NoError(err)
+		r.Equal("from-header", role)
+	})
+
+	t.Run("unix uid", func(t *testing.T) {
+		r := require.New(t)
+
+		rfr, err := NewRoleFromRequest([]RoleStrategy{{Type: RoleStrategyUnixUID, Uids: map[uint32]string{1000: "sidecar"}}})
+		r.NoError(err)
+		req := roleTestRequest(nil, "@")
+		req = req.WithContext(context.WithValue(req.Context(), peerCredentialsKey{}, &PeerCredentials{Uid: 1000}))
+		role, err := rfr(req)
+		r.NoError(err)
+		r.Equal("sidecar", role)
+
+		_, err = rfr(roleTestRequest(nil, "127.0.0.1:1234"))
+		r.True(IsMissingRoleError(err))
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		r := require.New(t)
+
+		rfr, err := NewRoleFromRequest([]RoleStrategy{
+			{Type: RoleStrategySPIFFE, TrustDomain: "example.org"},
+			{Type: RoleStrategyCIDR, CIDRs: cidrs},
+		})
+		r.NoError(err)
+
+		role, err := rfr(roleTestRequest(cert, "10.1.2.3:5555"))
+		r.NoError(err)
+		r.Equal("ns/prod/sa/api", role)
+
+		role, err = rfr(roleTestRequest(nil, "10.1.2.3:5555"))
+		r.NoError(err)
+		r.Equal("batch", role)
+
+		_, err = rfr(roleTestRequest(nil, "192.0.2.1:5555"))
+		r.True(IsMissingRoleError(err))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := NewRoleFromRequest(nil)
+		r.Error(err)
+		_, err = NewRoleFromRequest([]RoleStrategy{{Type: "bogus"}})
+		r.Error(err)
+		_, err = NewRoleFromRequest([]RoleStrategy{{Type: RoleStrategySPIFFE}})
+		r.Error(err)
+		_, err = NewRoleFromRequest([]RoleStrategy{{Type: RoleStrategyCIDR}})
+		r.Error(err)
+	})
+}
+
+func TestParseRoleStrategy(t *testing.T) {
+	r := require.New(t)
+
+	rs, err := ParseRoleStrategy("spiffe:example.org")
+	r.NoError(err)
+	r.Equal(RoleStrategy{Type: RoleStrategySPIFFE, TrustDomain: "example.org"}, rs)
+
+	rs, err = ParseRoleStrategy("header:X-Role")
+	r.NoError(err)
+	r.Equal(RoleStrategy{Type: RoleStrategyHeader, Header: "X-Role"}, rs)
+
+	rs, err = ParseRoleStrategy("cn")
+	r.NoError(err)
+	r.Equal(RoleStrategy{Type: RoleStrategyCN}, rs)
+
+	_, err = ParseRoleStrategy("cn:extra")
+	r.Error(err)
+	_, err = ParseRoleStrategy("cidr")
+	r.Error(err)
+	_, err = ParseRoleStrategy("spiffe")
+	r.Error(err)
+}
+
+func TestRoleStrategiesFromConfigFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte(`
+role_from_request:
+  - type: cn
+  - type: cidr
+    cidrs:
+      - cidr: 10.0.0.0/8
+        role: internal
+`), 0600))
+
+	conf, err := LoadConfig(path)
+	r.NoError(err)
+	r.NotNil(conf.RoleFromRequest)
+
+	role, err := conf.RoleFromRequest(roleTestRequest(nil, "10.3.2.1:443"))
+	r.NoError(err)
+	r.Equal("internal", role)
+}
@@ -2,7 +2,6 @@ package smokescreen
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -15,13 +14,13 @@ import (
 	"syscall"
 	"time"
 
-	proxyproto "github.com/armon/go-proxyproto"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/goproxy"
 	"github.com/stripe/smokescreen/internal/einhorn"
 	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
 	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing"
 	"golang.org/x/net/idna"
 )
 
@@ -36,6 +35,9 @@ const (
 
 	httpProxy    = "http"
 	connectProxy = "connect"
+	socks5Proxy  = "socks5"
+
+	transparentProxy = "transparent"
 )
 
 const (
@@ -47,6 +49,7 @@ const (
 	LogFieldRequestedHost    = "requested_host"
 	LogFieldStartTime        = "start_time"
 	LogFieldTraceID          = "trace_id"
+	LogFieldOtelTraceID      = "otel_trace_id"
 	LogFieldInRemoteX509CN   = "inbound_remote_x509_cn"
 	LogFieldInRemoteX509OU   = "inbound_remote_x509_ou"
 	LogFieldRole             = "role"
@@ -56,6 +59,7 @@ const (
 	LogFieldEnforceWouldDeny = "enforce_would_deny"
 	LogFieldAllow            = "allow"
 	LogFieldError            = "error"
+	LogFieldSNI              = "sni"
 	CanonicalProxyDecision   = "CANONICAL-PROXY-DECISION"
 	LogFieldConnEstablishMS  = "conn_establish_time_ms"
 	LogFieldDNSLookupTime    = "dns_lookup_time_ms"
@@ -68,6 +72,9 @@ type aclDecision struct {
 	resolvedAddr                        *net.TCPAddr
 	allow                               bool
 	enforceWouldDeny                    bool
+
+	// The client must present valid proxy credentials.
+	authRequired bool
 }
 
 type smokescreenContext struct {
@@ -80,6 +87,18 @@ type smokescreenContext struct {
 
 	// Time spent resolving the requested hostname
 	lookupTime time.Duration
+
+	// SNI presented through a CONNECT tunnel when VerifySNI is enabled. The
+	// canonical decision is not logged until it is known.
+	sni             string
+	decisionPending bool
+
+	// Root span of the request's trace, nil unless tracing is enabled.
+	span *tracing.Span
+
+	// Releases the connection slot held under the connection limits, nil if
+	// none is held.
+	connSlot func()
 }
 
 // ExitStatus is used to log Smokescreen's connection status at shutdown time
@@ -236,7 +255,7 @@ func proxyContext(ctx context.Context) (*goproxy.ProxyCtx, bool) {
 	return pctx, ok
 }
 
-func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+func dialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
 	pctx, ok := proxyContext(ctx)
 	if !ok {
 		return nil, fmt.Errorf("dialContext missing required *goproxy.ProxyCtx")
@@ -248,11 +267,27 @@ func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	}
 	d := sctx.decision
 
+	// A tunnel which fails to connect gives up its connection slot.
+	if sctx.proxyType != httpProxy {
+		defer func() {
+			if err != nil {
+				sctx.releaseConnSlot()
+			}
+		}()
+	}
+
 	// If an address hasn't been resolved, does not match the original outboundHost,
 	// or is not tcp we must re-resolve it before establishing the connection.
 	if d.resolvedAddr == nil || d.outboundHost != addr || network != "tcp" {
 		var err error
+		span := sctx.span.Child("smokescreen.dns", tracing.SpanKindInternal)
+		span.SetAttribute(spanAttrPeerName, addr)
 		d.resolvedAddr, d.reason, err = safeResolve(sctx.cfg, network, addr)
+		if d.resolvedAddr != nil {
+			span.SetAttribute(spanAttrPeerAddr, d.resolvedAddr.String())
+		}
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			if _, ok := err.(denyError); ok {
 				sctx.cfg.Log.WithFields(
@@ -263,15 +298,31 @@ func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 			}
 			return nil, err
 		}
+		host, _, _ := net.SplitHostPort(addr)
+		if checkResolvedAddr(egressACLForRequest(sctx.cfg, pctx.Req), d, host) {
+			return nil, denyError{errors.New(d.reason)}
+		}
 	}
 
 	var conn net.Conn
-	var err error
+
+	localAddr, err := outboundLocalAddr(sctx.cfg, d, d.resolvedAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	span := sctx.span.Child("smokescreen.dial", tracing.SpanKindClient)
+	span.SetAttribute(spanAttrPeerName, d.outboundHost)
+	span.SetAttribute(spanAttrPeerAddr, d.resolvedAddr.String())
+	defer span.End()
 
 	start := time.Now()
 	if sctx.cfg.ProxyDialTimeout == nil {
-		conn, err = net.DialTimeout(network, d.resolvedAddr.String(), sctx.cfg.ConnectTimeout)
+		conn, err = dialWithLocalAddr(network, d.resolvedAddr.String(), localAddr, sctx.cfg)
 	} else {
+		if localAddr != nil {
+			ctx = context.WithValue(ctx, outboundLocalAddrKey{}, localAddr)
+		}
 		conn, err = sctx.cfg.ProxyDialTimeout(ctx, network, d.resolvedAddr.String(), sctx.cfg.ConnectTimeout)
 	}
 	connTime := time.Since(start)
@@ -287,15 +338,15 @@ func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 
 	if err != nil {
 		sctx.cfg.MetricsClient.IncrWithTags("cn.atpt.total", []string{"success:false"}, 1)
+		span.SetError(err)
 		return nil, err
 	}
 	sctx.cfg.MetricsClient.IncrWithTags("cn.atpt.total", []string{"success:true"}, 1)
 
 	if conn != nil {
-		fields := logrus.Fields{}
-
 		if addr := conn.LocalAddr(); addr != nil {
 			fields[LogFieldOutLocalAddr] = addr.String()
+			span.SetAttribute(spanAttrSockAddr, addr.String())
 		}
 
 		if addr := conn.RemoteAddr(); addr != nil {
@@ -305,11 +356,13 @@ func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	}
 	sctx.logger = sctx.logger.WithFields(fields)
 
-	// Only wrap CONNECT conns with an InstrumentedConn. Connections used for traditional HTTP proxy
+	// Only wrap tunneled conns with an InstrumentedConn. Connections used for traditional HTTP proxy
 	// requests are pooled and reused by net.Transport.
-	if sctx.proxyType == connectProxy {
+	if sctx.proxyType != httpProxy {
 		ic := sctx.cfg.ConnTracker.NewInstrumentedConnWithTimeout(conn, sctx.cfg.IdleTimeout, sctx.logger, d.role, d.outboundHost, sctx.proxyType)
 		pctx.ConnErrorHandler = ic.Error
+		traceTunnel(sctx, ic)
+		releaseConnSlotOnClose(sctx, ic)
 		conn = ic
 	} else {
 		conn = NewTimeoutConn(conn, sctx.cfg.IdleTimeout)
@@ -331,6 +384,12 @@ func HTTPErrorHandler(w io.WriteCloser, pctx *goproxy.ProxyCtx, err error) {
 	if err := w.Close(); err != nil {
 		sctx.logger.Errorf("Failed to close proxy client connection: %s", err)
 	}
+
+	// The tunnel was never established, so its SNI will not be checked.
+	if sctx.decisionPending {
+		sctx.decisionPending = false
+		logProxy(sctx.cfg, pctx)
+	}
 }
 
 func rejectResponse(pctx *goproxy.ProxyCtx, err error) *http.Response {
@@ -354,6 +413,10 @@ func rejectResponse(pctx *goproxy.ProxyCtx, err error) *http.Response {
 		status = "Request rejected by proxy"
 		code = http.StatusProxyAuthRequired
 		msg = fmt.Sprintf(denyMsgTmpl, pctx.Req.Host, e.Error())
+	} else if e, ok := err.(overloadError); ok {
+		status = "Service unavailable"
+		code = http.StatusServiceUnavailable
+		msg = "Proxy is overloaded: " + e.Error()
 	} else {
 		status = "Internal server error"
 		code = http.StatusInternalServerError
@@ -361,8 +424,9 @@ func rejectResponse(pctx *goproxy.ProxyCtx, err error) *http.Response {
 		sctx.logger.WithField("error", err.Error()).Warn("rejectResponse called with unexpected error")
 	}
 
-	// Do not double log deny errors, they are logged in a previous call to logProxy.
-	if _, ok := err.(denyError); !ok {
+	// Do not double log deny and overload errors, they are logged in a
+	// previous call to logProxy.
+	if !isDenyOrOverload(err) {
 		sctx.logger.Error(msg)
 	}
 
@@ -375,6 +439,14 @@ func rejectResponse(pctx *goproxy.ProxyCtx, err error) *http.Response {
 	resp.ProtoMajor = pctx.Req.ProtoMajor
 	resp.ProtoMinor = pctx.Req.ProtoMinor
 	resp.Header.Set(errorHeader, msg)
+	if code == http.StatusServiceUnavailable {
+		resp.Header.Set("Retry-After", "1")
+	}
+	if code == http.StatusProxyAuthRequired && sctx.decision != nil && sctx.decision.authRequired {
+		for _, challenge := range sctx.cfg.ProxyAuth.Challenges() {
+			resp.Header.Add("Proxy-Authenticate", challenge)
+		}
+	}
 	if sctx.cfg.RejectResponseHandler != nil {
 		sctx.cfg.RejectResponseHandler(resp)
 	}
@@ -406,6 +478,21 @@ func newContext(cfg *Config, proxyType string, req *http.Request) *smokescreenCo
 		LogFieldStartTime:     start.UTC(),
 		LogFieldTraceID:       req.Header.Get(traceHeader),
 	})
+	if lc := listenerConfigFromRequest(req); lc != nil {
+		logger = logger.WithField(LogFieldListener, lc.Name)
+	}
+	if h, ok := ProxyHeaderFromRequest(req); ok && len(h.TLVs) > 0 {
+		logger = logger.WithField(LogFieldProxyTLVs, h.logFields())
+	}
+
+	var span *tracing.Span
+	if cfg.Tracer != nil {
+		parent, _ := tracing.ParseTraceparent(req.Header.Get(tracing.TraceparentHeader))
+		span = cfg.Tracer.Start("smokescreen.proxy", parent)
+		span.SetAttribute(spanAttrProxyType, proxyType)
+		span.SetAttribute(spanAttrPeerName, req.Host)
+		logger = logger.WithField(LogFieldOtelTraceID, span.Context().TraceID.String())
+	}
 
 	return &smokescreenContext{
 		cfg:           cfg,
@@ -413,6 +500,7 @@ func newContext(cfg *Config, proxyType string, req *http.Request) *smokescreenCo
 		proxyType:     proxyType,
 		start:         start,
 		requestedHost: req.Host,
+		span:          span,
 	}
 }
 
@@ -545,7 +633,17 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 	// attaches goproxy.ProxyCtx prior to calling dialContext.
 	rtFn := goproxy.RoundTripperFunc(func(req *http.Request, pctx *goproxy.ProxyCtx) (*http.Response, error) {
 		ctx := context.WithValue(req.Context(), goproxy.ProxyContextKey, pctx)
-		return proxy.Tr.RoundTrip(req.WithContext(ctx))
+		resp, err := proxy.Tr.RoundTrip(req.WithContext(ctx))
+
+		// The request holds its connection slot until goproxy has copied
+		// the response body to the client and closed it.
+		sctx := pctx.UserData.(*smokescreenContext)
+		if err != nil {
+			sctx.releaseConnSlot()
+			return nil, err
+		}
+		releaseConnSlotOnBodyClose(sctx, resp)
+		return resp, nil
 	})
 
 	// Associate a timeout with the CONNECT proxy client connection
@@ -556,7 +654,7 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 	}
 
 	// Handle traditional HTTP proxy
-	proxy.OnRequest().DoFunc(func(req *http.Request, pctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	proxy.OnRequest().DoFunc(func(req *http.Request, pctx *goproxy.ProxyCtx) (_ *http.Request, resp *http.Response) {
 
 		// We are intentionally *not* setting pctx.HTTPErrorHandler because with traditional HTTP
 		// proxy requests we are able to specify the request during the call to OnResponse().
@@ -569,11 +667,24 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 		defer func() {
 			req.Header.Del(roleHeader)
 			req.Header.Del(traceHeader)
+			req.Header.Del("Proxy-Authorization")
 		}()
 
 		// Set this on every request as every request mints a new goproxy.ProxyCtx
 		pctx.RoundTripper = rtFn
 
+		// Shed the request before doing any work for it when the proxy is
+		// overloaded. Otherwise it holds its slot until its response has been
+		// sent, or until it is rejected here.
+		if pctx.Error = acquireConnSlot(sctx); pctx.Error != nil {
+			return req, rejectResponse(pctx, pctx.Error)
+		}
+		defer func() {
+			if resp != nil {
+				sctx.releaseConnSlot()
+			}
+		}()
+
 		// Build an address parsable by net.ResolveTCPAddr
 		remoteHost, remotePort, err := NormalizeHostWithOptionalPort(req.Host, req.URL.Scheme, false)
 		if err != nil {
@@ -583,7 +694,7 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 
 		sctx.logger.WithField("url", req.RequestURI).Debug("received HTTP proxy request")
 
-		sctx.decision, sctx.lookupTime, pctx.Error = checkIfRequestShouldBeProxied(config, req, remoteHost, remotePort)
+		sctx.decision, sctx.lookupTime, pctx.Error = checkIfRequestShouldBeProxied(config, sctx.span, req, remoteHost, remotePort)
 
 		// Returning any kind of response in this handler is goproxy's way of short circuiting
 		// the request. The original request will never be sent, and goproxy will invoke our
@@ -599,14 +710,24 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 		return req, nil
 	})
 
+	if config.VerifySNI {
+		proxy.ConnectCopyHandler = verifySNICopyHandler(config)
+	}
+
 	// Handle CONNECT proxy to TLS & other TCP protocols destination
 	proxy.OnRequest().HandleConnectFunc(func(_ string, pctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		pctx.UserData = newContext(config, connectProxy, pctx.Req)
+		sctx := newContext(config, connectProxy, pctx.Req)
+		pctx.UserData = sctx
 		pctx.HTTPErrorHandler = HTTPErrorHandler
 
 		// Defer logging the proxy event here because logProxy relies
-		// on state set in handleConnect
-		defer logProxy(config, pctx)
+		// on state set in handleConnect. When the SNI is verified, logging
+		// waits until the client's ClientHello has been checked.
+		defer func() {
+			if !sctx.decisionPending {
+				logProxy(config, pctx)
+			}
+		}()
 		defer pctx.Req.Header.Del(traceHeader)
 
 		destination, err := handleConnect(config, pctx)
@@ -614,6 +735,7 @@ func BuildProxy(config *Config) *goproxy.ProxyHttpServer {
 			pctx.Resp = rejectResponse(pctx, err)
 			return goproxy.RejectConnect, ""
 		}
+		sctx.decisionPending = config.VerifySNI
 		return goproxy.OkConnect, destination
 	})
 
@@ -685,6 +807,10 @@ func logProxy(config *Config, pctx *goproxy.ProxyCtx) {
 		fields[LogFieldContentLength] = pctx.Resp.ContentLength
 	}
 
+	if sctx.sni != "" {
+		fields[LogFieldSNI] = sctx.sni
+	}
+
 	if sctx.decision != nil {
 		fields[LogFieldDecisionReason] = decision.reason
 		fields[LogFieldEnforceWouldDeny] = decision.enforceWouldDeny
@@ -695,10 +821,13 @@ func logProxy(config *Config, pctx *goproxy.ProxyCtx) {
 	if err != nil {
 		fields[LogFieldError] = err.Error()
 	}
+	if e, ok := err.(overloadError); ok {
+		fields[LogFieldLoadShed] = e.reason
+	}
 
 	entry := sctx.logger.WithFields(fields)
 	var logMethod func(...interface{})
-	if _, ok := err.(denyError); !ok && err != nil {
+	if !isDenyOrOverload(err) && err != nil {
 		logMethod = entry.Error
 	} else if decision != nil && decision.allow {
 		logMethod = entry.Info
@@ -706,18 +835,37 @@ func logProxy(config *Config, pctx *goproxy.ProxyCtx) {
 		logMethod = entry.Warn
 	}
 	logMethod(CanonicalProxyDecision)
+
+	setDecisionAttributes(sctx.span, decision)
+	if pctx.Resp != nil {
+		sctx.span.SetAttribute("http.status_code", pctx.Resp.StatusCode)
+	}
+	sctx.span.SetError(err)
+	sctx.span.End()
 }
 
-func handleConnect(config *Config, pctx *goproxy.ProxyCtx) (string, error) {
+func handleConnect(config *Config, pctx *goproxy.ProxyCtx) (destination string, err error) {
 	sctx := pctx.UserData.(*smokescreenContext)
 
+	// Shed the tunnel before doing any work for it when the proxy is
+	// overloaded. Otherwise it holds its slot until it is closed, or until it
+	// is rejected or fails to connect.
+	if pctx.Error = acquireConnSlot(sctx); pctx.Error != nil {
+		return "", pctx.Error
+	}
+	defer func() {
+		if err != nil {
+			sctx.releaseConnSlot()
+		}
+	}()
+
 	// Check if requesting role is allowed to talk to remote
 	remoteHost, remotePort, err := NormalizeHostPort(pctx.Req.Host, false)
 	if err != nil {
 		pctx.Error = denyError{err}
 		return "", pctx.Error
 	}
-	sctx.decision, sctx.lookupTime, pctx.Error = checkIfRequestShouldBeProxied(config, pctx.Req, remoteHost, remotePort)
+	sctx.decision, sctx.lookupTime, pctx.Error = checkIfRequestShouldBeProxied(config, sctx.span, pctx.Req, remoteHost, remotePort)
 	if pctx.Error != nil {
 		return "", denyError{pctx.Error}
 	}
@@ -755,10 +903,20 @@ func StartWithConfig(config *Config, quit <-chan interface{}) {
 	}
 
 	if config.SupportProxyProtocol {
-		listener = &proxyproto.Listener{Listener: listener}
+		listener = newProxyProtocolListener(listener, config.ProxyProtocolStrict, config.ProxyProtocolTrustedRanges, config.Log)
+	}
+
+	if config.HTTP2 && config.TlsConfig == nil {
+		config.Log.Fatal("HTTP/2 requires TLS to be configured")
+	}
+
+	if config.SocksUsernameAsRole && config.ProxyAuth == nil {
+		config.Log.Fatal("using SOCKS5 usernames as roles requires proxy authentication to be configured")
 	}
 
-	var handler http.Handler = proxy
+	// HTTP/1.x requests pass straight through to goproxy; HTTP/2 is only
+	// negotiated on listeners which enable it.
+	var handler http.Handler = &http2Handler{config: config, proxy: proxy}
 
 	if config.Healthcheck != nil {
 		handler = &HealthcheckMiddleware{
@@ -769,14 +927,98 @@ func StartWithConfig(config *Config, quit <-chan interface{}) {
 
 	// TLS support
 	if config.TlsConfig != nil {
-		listener = tls.NewListener(listener, config.TlsConfig)
+		tlsConfig := config.TlsConfig
+		if config.HTTP2 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		listener = newTLSListener(listener, tlsConfig)
 	}
 
 	// Setup connection tracking
-	config.ConnTracker = conntrack.NewTracker(config.IdleTimeout, config.MetricsClient.StatsdClient, config.Log, config.ShuttingDown)
+	if config.Prometheus != nil {
+		config.MetricsClient.AddSink(config.Prometheus)
+	}
+	config.ConnTracker = conntrack.NewTracker(config.IdleTimeout, config.MetricsClient.Sink(), config.Log, config.ShuttingDown)
+	config.ConnTracker.MaxLifetime = config.MaxConnLifetime
+	config.ConnTracker.RoleMaxLifetime = config.RoleMaxConnLifetime
+	config.ConnTracker.MaxLifetimeJitter = config.MaxConnLifetimeJitter
 
 	server := http.Server{
-		Handler: handler,
+		Handler:     handler,
+		ConnContext: withProxyHeader,
+	}
+
+	extraServers, err := startListeners(config, handler)
+	if err != nil {
+		config.Log.Fatal(err)
+	}
+	server.RegisterOnShutdown(func() {
+		for _, s := range extraServers {
+			ctx, cancel := context.WithTimeout(context.Background(), config.ExitTimeout)
+			if err := s.Shutdown(ctx); err != nil {
+				config.Log.Errorf("error shutting down http server: %v", err)
+			}
+			cancel()
+		}
+	})
+
+	if config.Prometheus != nil && config.PrometheusAddr != "" {
+		promServer, err := startPrometheusServer(config)
+		if err != nil {
+			config.Log.Fatal("can't start prometheus listener", err)
+		}
+		server.RegisterOnShutdown(func() { promServer.Close() })
+	}
+
+	if config.AdminAddr != "" {
+		adminServer, err := startAdminServer(config)
+		if err != nil {
+			config.Log.Fatal("can't start admin listener", err)
+		}
+		server.RegisterOnShutdown(func() { adminServer.Close() })
+	}
+
+	if config.SocksListener != nil || config.SocksPort != 0 {
+		socksListener := config.SocksListener
+		if socksListener == nil {
+			socksListener, err = findSocksListener(config.SocksIp, config.SocksPort)
+			if err != nil {
+				config.Log.Fatal("can't find socks5 listener", err)
+			}
+		}
+		if config.SupportProxyProtocol {
+			socksListener = newProxyProtocolListener(socksListener, config.ProxyProtocolStrict, config.ProxyProtocolTrustedRanges, config.Log)
+		}
+		if config.TlsConfig != nil {
+			socksListener = newTLSListener(socksListener, config.TlsConfig)
+		}
+
+		socksServer := NewSocksServer(config)
+		server.RegisterOnShutdown(func() { socksServer.Close() })
+		go func() {
+			if err := socksServer.Serve(socksListener); err != nil {
+				config.Log.Errorf("socks5 serve error: %v", err)
+			}
+		}()
+	}
+
+	if config.TransparentListener != nil || config.TransparentPort != 0 {
+		transparentListener := config.TransparentListener
+		if transparentListener == nil {
+			transparentListener, err = findTransparentListener(config)
+			if err != nil {
+				config.Log.Fatal("can't find transparent listener", err)
+			}
+		}
+
+		transparentServer := NewTransparentServer(config)
+		server.RegisterOnShutdown(func() { transparentServer.Close() })
+		go func() {
+			if err := transparentServer.Serve(transparentListener); err != nil {
+				config.Log.Errorf("transparent serve error: %v", err)
+			}
+		}()
 	}
 
 	// This sets an IdleTimeout on _all_ client connections. CONNECT requests
@@ -811,6 +1053,21 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 		config.StatsServer = StartStatsServer(config)
 	}
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGUSR1)
+	go func() {
+		for range reload {
+			config.Log.Print("reloading egress ACLs")
+			if err := config.ReloadEgressAcls(); err != nil {
+				config.Log.Errorf("failed to reload egress ACLs, keeping the current ones: %v", err)
+			}
+		}
+	}()
+
+	if config.EgressAclSource != nil && config.EgressAclPollInterval > 0 {
+		go config.pollEgressAcl(quit)
+	}
+
 	graceful := true
 	kill := make(chan os.Signal, 1)
 	signal.Notify(kill, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGHUP)
@@ -910,6 +1167,9 @@ func runServer(config *Config, server *http.Server, listener net.Listener, quit
 	if config.StatsServer != nil {
 		config.StatsServer.Shutdown()
 	}
+	if config.Tracer != nil {
+		shutdownTracing(config)
+	}
 }
 
 // Extract the client's ACL role from the HTTP request, using the configured
@@ -921,7 +1181,19 @@ func getRole(config *Config, req *http.Request) (string, error) {
 	var role string
 	var err error
 
-	if config.RoleFromRequest != nil {
+	// ProxyAuth only checks the credentials of SOCKS5 clients, making their
+	// username their role, with SocksUsernameAsRole.
+	_, socks := socksUsername(req)
+	proxyAuth := config.ProxyAuth != nil && (!socks || config.SocksUsernameAsRole)
+	if proxyAuth {
+		role, err = config.ProxyAuth.Authenticate(req)
+	}
+
+	if proxyAuth && !IsMissingRoleError(err) {
+		// Credentials were presented; they alone determine the role.
+	} else if lc := listenerConfigFromRequest(req); lc != nil && lc.RoleFromRequest != nil {
+		role, err = lc.RoleFromRequest(req)
+	} else if config.RoleFromRequest != nil {
 		role, err = config.RoleFromRequest(req)
 	} else {
 		err = MissingRoleError("RoleFromRequest is not configured")
@@ -942,15 +1214,25 @@ func getRole(config *Config, req *http.Request) (string, error) {
 	}
 }
 
-func checkIfRequestShouldBeProxied(config *Config, req *http.Request, host string, port int) (*aclDecision, time.Duration, error) {
+func checkIfRequestShouldBeProxied(config *Config, span *tracing.Span, req *http.Request, host string, port int) (*aclDecision, time.Duration, error) {
+	aclSpan := span.Child("smokescreen.acl", tracing.SpanKindInternal)
 	decision := checkACLsForRequest(config, req, host, port)
+	setDecisionAttributes(aclSpan, decision)
+	aclSpan.End()
 
 	var lookupTime time.Duration
 	if decision.allow {
 		start := time.Now()
 		hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+		dnsSpan := span.Child("smokescreen.dns", tracing.SpanKindInternal)
+		dnsSpan.SetAttribute(spanAttrPeerName, hostPort)
 		resolved, reason, err := safeResolve(config, "tcp", hostPort)
 		lookupTime = time.Since(start)
+		if resolved != nil {
+			dnsSpan.SetAttribute(spanAttrPeerAddr, resolved.String())
+		}
+		dnsSpan.SetError(err)
+		dnsSpan.End()
 		if err != nil {
 			if _, ok := err.(denyError); !ok {
 				return decision, lookupTime, err
@@ -960,6 +1242,7 @@ func checkIfRequestShouldBeProxied(config *Config, req *http.Request, host strin
 			decision.enforceWouldDeny = true
 		} else {
 			decision.resolvedAddr = resolved
+			checkResolvedAddr(egressACLForRequest(config, req), decision, host)
 		}
 	}
 
@@ -971,7 +1254,8 @@ func checkACLsForRequest(config *Config, req *http.Request, host string, port in
 		outboundHost: net.JoinHostPort(host, strconv.Itoa(port)),
 	}
 
-	if config.EgressACL == nil {
+	egressACL := egressACLForRequest(config, req)
+	if egressACL == nil {
 		decision.allow = true
 		decision.reason = "Egress ACL is not configured"
 		return decision
@@ -981,6 +1265,13 @@ func checkACLsForRequest(config *Config, req *http.Request, host string, port in
 	if roleErr != nil {
 		config.MetricsClient.Incr("acl.role_not_determined", 1)
 		decision.reason = "Client role cannot be determined"
+		if config.ProxyAuth != nil {
+			decision.authRequired = true
+			if _, ok := roleErr.(proxyAuthError); ok {
+				config.MetricsClient.Incr("acl.auth_failed", 1)
+				decision.reason = "Proxy authentication failed"
+			}
+		}
 		return decision
 	}
 
@@ -993,7 +1284,7 @@ func checkACLsForRequest(config *Config, req *http.Request, host string, port in
 		return decision
 	}
 
-	aclDecision, err := config.EgressACL.Decide(role, host)
+	aclDecision, err := decideACL(egressACL, role, host, port)
 	decision.project = aclDecision.Project
 	decision.reason = aclDecision.Reason
 	if err != nil {
@@ -0,0 +1,121 @@
+package smokescreen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/stripe/goproxy"
+)
+
+const sniMismatchReason = "TLS SNI does not match CONNECT target"
+
+// readServerName reads the first bytes sent through a tunnel and returns the
+// SNI of the TLS ClientHello they carry, if any. Every byte consumed from r is
+// returned in peeked so it can be forwarded to the target.
+func readServerName(r io.Reader) (sni string, isTLS bool, peeked []byte, err error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return "", false, nil, err
+	}
+	if first[0] != tlsRecordTypeHandshake {
+		return "", false, first[:], nil
+	}
+
+	buf := bytes.NewBuffer(first[:])
+	hello, err := readClientHello(io.MultiReader(bytes.NewReader(first[:]), io.TeeReader(r, buf)))
+	if err != nil {
+		return "", true, buf.Bytes(), err
+	}
+	return hello.ServerName, true, buf.Bytes(), nil
+}
+
+// verifySNICopyHandler is installed as goproxy's ConnectCopyHandler when
+// VerifySNI is enabled. It checks the ClientHello a client sends through an
+// accepted CONNECT tunnel before forwarding any of it, so a client cannot
+// CONNECT to an allowed host and then present a different SNI (domain
+// fronting). The canonical decision is logged here, once the SNI is known.
+func verifySNICopyHandler(config *Config) func(*goproxy.ProxyCtx, net.Conn, net.Conn) {
+	return func(pctx *goproxy.ProxyCtx, client, target net.Conn) {
+		sctx := pctx.UserData.(*smokescreenContext)
+
+		// Data from the target is not held back: it is not subject to the
+		// check, and server-first protocols would otherwise stall.
+		go func() {
+			io.Copy(client, target)
+			client.Close()
+		}()
+
+		sni, isTLS, peeked, err := readServerName(client)
+		sctx.sni = sni
+		sctx.decisionPending = false
+
+		if len(peeked) == 0 {
+			// The client went away or idled out before sending anything.
+			logProxy(config, pctx)
+			target.Close()
+			return
+		}
+
+		if err == nil && isTLS {
+			err = checkSNI(config, pctx, sni)
+		} else if err != nil {
+			err = denyError{fmt.Errorf("%s: could not parse TLS ClientHello: %v", sniMismatchReason, err)}
+		}
+
+		if err != nil {
+			sctx.decision.allow = false
+			sctx.decision.enforceWouldDeny = true
+			sctx.decision.reason = err.Error()
+			pctx.Error = err
+			config.MetricsClient.IncrWithTags("acl.sni_mismatch", []string{fmt.Sprintf("role:%s", sctx.decision.role)}, 1)
+			logProxy(config, pctx)
+			target.Close()
+			client.Close()
+			return
+		}
+
+		logProxy(config, pctx)
+
+		_, err = io.Copy(target, io.MultiReader(bytes.NewReader(peeked), client))
+		if err != nil && pctx.ConnErrorHandler != nil && !errors.Is(err, net.ErrClosed) {
+			pctx.ConnErrorHandler(err)
+		}
+		target.Close()
+	}
+}
+
+// checkSNI allows a ClientHello whose SNI names the CONNECT host, or which the
+// client's role is independently allowed to reach. A ClientHello without SNI
+// is only allowed through tunnels to IP addresses, which clients have no name
+// to send for.
+func checkSNI(config *Config, pctx *goproxy.ProxyCtx, sni string) error {
+	sctx := pctx.UserData.(*smokescreenContext)
+
+	host, portStr, err := net.SplitHostPort(sctx.decision.outboundHost)
+	if err != nil {
+		return denyError{err}
+	}
+	if sni == "" {
+		if net.ParseIP(host) != nil {
+			return nil
+		}
+		return denyError{fmt.Errorf("%s: ClientHello has no SNI", sniMismatchReason)}
+	}
+	sniHost, port, err := NormalizeHostPort(net.JoinHostPort(sni, portStr), false)
+	if err != nil {
+		return denyError{fmt.Errorf("%s: %v", sniMismatchReason, err)}
+	}
+	if strings.EqualFold(strings.TrimSuffix(sniHost, "."), strings.TrimSuffix(host, ".")) {
+		return nil
+	}
+
+	decision := checkACLsForRequest(config, pctx.Req, sniHost, port)
+	if !decision.allow {
+		return denyError{fmt.Errorf("%s: %s", sniMismatchReason, decision.reason)}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	acl "github.com/stripe/smokescreen/pkg/smokescreen/acl/v1"
+)
+
+// connectTunnel sends a CONNECT request for target through the proxy, and
+// returns the connection, closed when the test ends, and the proxy's
+// response.
+func connectTunnel(t *testing.T, proxyURL, target string) (net.Conn, *http.Response) {
+	r := require.New(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	r.NoError(err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	r.NoError(err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	r.NoError(err)
+	return conn, resp
+}
+
+func sniTestConfig(t *testing.T) *Config {
+	cfg, err := testConfig("sni-test-srv")
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+
+	egressACL := &acl.ACL{Rules: map[string]acl.Rule{}}
+	require.NoError(t, egressACL.Add("sni-test-srv", acl.Rule{
+		Project:     "security",
+		Policy:      acl.Enforce,
+		DomainGlobs: []string{"127.0.0.1", "localhost"},
+	}))
+	cfg.EgressACL = egressACL
+	cfg.VerifySNI = true
+	return cfg
+}
+
+func TestVerifySNI(t *testing.T) {
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+	_, port, err := net.SplitHostPort(remote.Listener.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		target     string
+		serverName string
+		allow      bool
+	}{
+		{"SNI matches CONNECT host", "localhost:" + port, "localhost", true},
+		{"SNI allowed by ACL", "127.0.0.1:" + port, "localhost", true},
+		{"no SNI to IP address", "127.0.0.1:" + port, "", true},
+		{"no SNI to host name", "localhost:" + port, "", false},
+		{"SNI denied by ACL", "127.0.0.1:" + port, "fronted.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+
+			cfg := sniTestConfig(t)
+			logHook := proxyLogHook(cfg)
+			proxy := proxyServer(cfg)
+			defer proxy.Close()
+
+			conn, resp := connectTunnel(t, proxy.URL, tt.target)
+			r.Equal(http.StatusOK, resp.StatusCode)
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			err := tlsConn.Handshake()
+			if tt.allow {
+				r.NoError(err)
+			} else {
+				r.Error(err)
+			}
+			tlsConn.Close()
+			cfg.ConnTracker.Wg.Wait()
+
+			entry := findCanonicalProxyDecision(logHook.AllEntries())
+			r.NotNil(entry)
+			r.Equal(tt.allow, entry.Data[LogFieldAllow])
+			if tt.serverName != "" {
+				r.Equal(tt.serverName, entry.Data[LogFieldSNI])
+			} else {
+				r.NotContains(entry.Data, LogFieldSNI)
+			}
+			if !tt.allow {
+				r.Contains(entry.Data[LogFieldDecisionReason], sniMismatchReason)
+			}
+		})
+	}
+
+	t.Run("non-TLS tunnel", func(t *testing.T) {
+		r := require.New(t)
+
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer plain.Close()
+
+		cfg := sniTestConfig(t)
+		logHook := proxyLogHook(cfg)
+		proxy := proxyServer(cfg)
+		defer proxy.Close()
+
+		conn, resp := connectTunnel(t, proxy.URL, plain.Listener.Addr().String())
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		req, err := http.NewRequest("GET", plain.URL, nil)
+		r.NoError(err)
+		r.NoError(req.Write(conn))
+		resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(true, entry.Data[LogFieldAllow])
+	})
+}
@@ -0,0 +1,296 @@
+package smokescreen
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/stripe/goproxy"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccepted = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+
+	// Clients must complete the SOCKS handshake within this time.
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+// SocksServer accepts SOCKS5 CONNECT requests and runs them through the same
+// role extraction, ACL, resolution and connection tracking as HTTP CONNECT
+// requests.
+type SocksServer struct {
+	connServer
+}
+
+type socksUsernameKey struct{}
+
+type socks5Request struct {
+	username, password string
+	host               string
+	port               int
+}
+
+func NewSocksServer(config *Config) *SocksServer {
+	s := &SocksServer{}
+	s.config = config
+	s.name = "socks5"
+	s.handle = s.handleConn
+	return s
+}
+
+func (s *SocksServer) handleConn(conn net.Conn) {
+	config := s.config
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			config.Log.WithField(LogFieldInRemoteAddr, conn.RemoteAddr().String()).Warnf("socks5 TLS handshake failed: %v", err)
+			conn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	br := bufio.NewReader(conn)
+	sreq, rep, err := readSocks5Request(br, conn)
+	if err != nil {
+		if rep != 0 {
+			writeSocks5Reply(conn, rep, nil)
+		}
+		config.Log.WithField(LogFieldInRemoteAddr, conn.RemoteAddr().String()).Warnf("invalid socks5 request: %v", err)
+		conn.Close()
+		return
+	}
+
+	req := sreq.httpRequest(conn.RemoteAddr(), tlsState)
+	req = req.WithContext(withProxyHeader(req.Context(), conn))
+	sctx := newContext(config, socks5Proxy, req)
+	pctx := &goproxy.ProxyCtx{Req: req, UserData: sctx}
+
+	destination, err := handleConnect(config, pctx)
+	logProxy(config, pctx)
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyForError(err), nil)
+		conn.Close()
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), goproxy.ProxyContextKey, pctx)
+	target, err := dialContext(ctx, "tcp", destination)
+	if err != nil {
+		sctx.logger.WithField(LogFieldError, err.Error()).Error("Failed to connect to remote host")
+		writeSocks5Reply(conn, socks5ReplyForError(err), nil)
+		conn.Close()
+		return
+	}
+
+	if err := writeSocks5Reply(conn, socks5RepSucceeded, target.LocalAddr()); err != nil {
+		target.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	spliceConns(config, pctx, &bufferedConn{Conn: conn, r: br}, target)
+}
+
+// httpRequest builds the request used for role extraction and ACL checks. It
+// mirrors the HTTP CONNECT request a client would have sent for the same
+// destination, with SOCKS credentials presented as Proxy-Authorization.
+func (sreq *socks5Request) httpRequest(remote net.Addr, state *tls.ConnectionState) *http.Request {
+	hostPort := net.JoinHostPort(sreq.host, strconv.Itoa(sreq.port))
+	req := tunnelRequest(hostPort, "SOCKS/5", remote, state)
+	if sreq.username != "" {
+		req.SetBasicAuth(sreq.username, sreq.password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+		req = req.WithContext(context.WithValue(context.Background(), socksUsernameKey{}, sreq.username))
+	}
+	return req
+}
+
+// socksUsername returns the username a SOCKS5 client authenticated with.
+func socksUsername(req *http.Request) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+	username, ok := req.Context().Value(socksUsernameKey{}).(string)
+	return username, ok
+}
+
+// readSocks5Request performs method negotiation and optional
+// username/password authentication, then reads the client's request. On
+// failure the returned reply code, if non-zero, should be sent to the client.
+func readSocks5Request(r *bufio.Reader, w io.Writer) (*socks5Request, byte, error) {
+	sreq := &socks5Request{}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, 0, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, 0, err
+	}
+
+	method := byte(socks5AuthNoAccepted)
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = m
+			break
+		}
+		if m == socks5AuthNone {
+			method = m
+		}
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return nil, 0, err
+	}
+
+	switch method {
+	case socks5AuthNoAccepted:
+		return nil, 0, errors.New("no acceptable authentication methods")
+	case socks5AuthPassword:
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, 0, err
+		}
+		if hdr[0] != socks5AuthVersion {
+			return nil, 0, fmt.Errorf("unsupported authentication version %d", hdr[0])
+		}
+		username := make([]byte, hdr[1])
+		if _, err := io.ReadFull(r, username); err != nil {
+			return nil, 0, err
+		}
+		plen, err := r.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+		password := make([]byte, plen)
+		if _, err := io.ReadFull(r, password); err != nil {
+			return nil, 0, err
+		}
+		sreq.username, sreq.password = string(username), string(password)
+
+		// Credentials are not verified here; they are made available to role
+		// extraction in the same way as HTTP Proxy-Authorization.
+		if _, err := w.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var reqHdr [4]byte
+	if _, err := io.ReadFull(r, reqHdr[:]); err != nil {
+		return nil, 0, err
+	}
+	if reqHdr[0] != socks5Version {
+		return nil, 0, fmt.Errorf("unsupported SOCKS version %d", reqHdr[0])
+	}
+	if reqHdr[1] != socks5CmdConnect {
+		return nil, socks5RepCmdNotSupported, fmt.Errorf("unsupported SOCKS command %d", reqHdr[1])
+	}
+
+	switch reqHdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if reqHdr[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, 0, err
+		}
+		sreq.host = ip.String()
+	case socks5AtypDomain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+		domain := make([]byte, l)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, 0, err
+		}
+		sreq.host = string(domain)
+	default:
+		return nil, socks5RepAddrTypeUnsupported, fmt.Errorf("unsupported address type %d", reqHdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, 0, err
+	}
+	sreq.port = int(binary.BigEndian.Uint16(port[:]))
+
+	return sreq, 0, nil
+}
+
+func writeSocks5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	reply := []byte{socks5Version, rep, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socks5AtypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socks5AtypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+
+	_, err := w.Write(reply)
+	return err
+}
+
+func socks5ReplyForError(err error) byte {
+	if _, ok := err.(denyError); ok {
+		return socks5RepNotAllowed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socks5RepConnectionRefused
+	}
+	if _, ok := err.(net.Error); ok {
+		return socks5RepHostUnreachable
+	}
+	return socks5RepGeneralFailure
+}
+
+func findSocksListener(ip string, port uint16) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", ip, port))
+}
@@ -0,0 +1,243 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Connect performs a SOCKS5 handshake against proxyAddr and returns the
+// connection along with the server's reply code.
+func socks5Connect(t *testing.T, proxyAddr, username, host string, port int, cmd byte) (net.Conn, byte) {
+	return socks5ConnectWithPassword(t, proxyAddr, username, "", host, port, cmd)
+}
+
+// socks5ConnectWithPassword is socks5Connect, authenticating with password.
+func socks5ConnectWithPassword(t *testing.T, proxyAddr, username, password, host string, port int, cmd byte) (net.Conn, byte) {
+	r := require.New(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	r.NoError(err)
+
+	if username != "" {
+		_, err = conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	} else {
+		_, err = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	}
+	r.NoError(err)
+
+	var resp [2]byte
+	_, err = io.ReadFull(conn, resp[:])
+	r.NoError(err)
+	r.Equal(byte(socks5Version), resp[0])
+
+	if username != "" {
+		r.Equal(byte(socks5AuthPassword), resp[1])
+		msg := []byte{socks5AuthVersion, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		_, err = conn.Write(msg)
+		r.NoError(err)
+		_, err = io.ReadFull(conn, resp[:])
+		r.NoError(err)
+		r.Equal(byte(0), resp[1])
+	}
+
+	msg := []byte{socks5Version, cmd, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		msg = append(msg, socks5AtypIPv4)
+		msg = append(msg, ip.To4()...)
+	} else {
+		msg = append(msg, socks5AtypDomain, byte(len(host)))
+		msg = append(msg, host...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	_, err = conn.Write(msg)
+	r.NoError(err)
+
+	var reply [10]byte
+	_, err = io.ReadFull(conn, reply[:])
+	r.NoError(err)
+	return conn, reply[1]
+}
+
+func socksTestServer(t *testing.T, cfg *Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewSocksServer(cfg)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// socksPasswordConfig returns a config using the verified usernames of
+// SOCKS5 clients as their role. The password of test-local-srv is "secret".
+func socksPasswordConfig(t *testing.T) *Config {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	r.NoError(ioutil.WriteFile(path, []byte("test-local-srv:"+testApr1Hash+"\n"), 0600))
+
+	cfg, err := testConfig("")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	cfg.ProxyAuth, err = NewProxyAuthenticator(ProxyAuthConfig{HtpasswdFile: path})
+	r.NoError(err)
+	cfg.SocksUsernameAsRole = true
+	return cfg
+}
+
+func TestSocks5UsernameAsRoleConfig(t *testing.T) {
+	r := require.New(t)
+
+	_, err := LoadConfig(writeConfig(t, "socks5:\n  port: 1080\n  username_as_role: true\n"))
+	r.Error(err)
+	r.Contains(err.Error(), "socks5: ")
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	remoteURL, err := url.Parse(remote.URL)
+	require.NoError(t, err)
+	remotePort, err := strconv.Atoi(remoteURL.Port())
+	require.NoError(t, err)
+
+	t.Run("allowed with username as role", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg := socksPasswordConfig(t)
+		logHook := proxyLogHook(cfg)
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5ConnectWithPassword(t, addr, "test-local-srv", "secret", "127.0.0.1", remotePort, socks5CmdConnect)
+		r.Equal(byte(socks5RepSucceeded), rep)
+
+		req, err := http.NewRequest("GET", remote.URL, nil)
+		r.NoError(err)
+		r.NoError(req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		count := 0
+		cfg.ConnTracker.Range(func(k, v interface{}) bool {
+			count++
+			return true
+		})
+		r.Equal(1, count, "connTracker should contain one tracked connection")
+
+		conn.Close()
+		cfg.ConnTracker.Wg.Wait()
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(socks5Proxy, entry.Data[LogFieldProxyType])
+		r.Equal("test-local-srv", entry.Data[LogFieldRole])
+		r.Equal(true, entry.Data[LogFieldAllow])
+		r.NotNil(findCanonicalProxyClose(logHook.AllEntries()))
+	})
+
+	t.Run("username not used as role with a wrong password", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg := socksPasswordConfig(t)
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5ConnectWithPassword(t, addr, "test-local-srv", "guess", "127.0.0.1", remotePort, socks5CmdConnect)
+		defer conn.Close()
+		r.NotEqual(byte(socks5RepSucceeded), rep)
+	})
+
+	t.Run("credentials left to RoleFromRequest", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg := socksPasswordConfig(t)
+		cfg.SocksUsernameAsRole = false
+		cfg.RoleFromRequest = func(req *http.Request) (string, error) {
+			return "test-local-srv", nil
+		}
+		logHook := proxyLogHook(cfg)
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5ConnectWithPassword(t, addr, "test-trusted-srv", "guess", "127.0.0.1", remotePort, socks5CmdConnect)
+		defer conn.Close()
+		r.Equal(byte(socks5RepSucceeded), rep)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal("test-local-srv", entry.Data[LogFieldRole])
+	})
+
+	t.Run("role from RoleFromRequest", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-local-srv")
+		r.NoError(err)
+		r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5Connect(t, addr, "", "127.0.0.1", remotePort, socks5CmdConnect)
+		defer conn.Close()
+		r.Equal(byte(socks5RepSucceeded), rep)
+	})
+
+	t.Run("denied by ACL", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-trusted-srv")
+		r.NoError(err)
+		logHook := proxyLogHook(cfg)
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5Connect(t, addr, "", "example.com", 443, socks5CmdConnect)
+		defer conn.Close()
+		r.Equal(byte(socks5RepNotAllowed), rep)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(false, entry.Data[LogFieldAllow])
+		r.Equal(socks5Proxy, entry.Data[LogFieldProxyType])
+	})
+
+	t.Run("denied by address rules", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-local-srv")
+		r.NoError(err)
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5Connect(t, addr, "", "127.0.0.1", remotePort, socks5CmdConnect)
+		defer conn.Close()
+		r.Equal(byte(socks5RepNotAllowed), rep)
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-local-srv")
+		r.NoError(err)
+
+		addr := socksTestServer(t, cfg)
+		conn, rep := socks5Connect(t, addr, "", "127.0.0.1", remotePort, 0x02)
+		defer conn.Close()
+		r.Equal(byte(socks5RepCmdNotSupported), rep, fmt.Sprintf("unexpected reply %d", rep))
+	})
+}
@@ -0,0 +1,334 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// OverflowLabelValue replaces the values of a label once it has reached
+	// its limit of distinct values.
+	OverflowLabelValue = "__other__"
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets for metrics
+// without buckets of their own, suited to durations in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusConfig configures a Prometheus sink.
+type PrometheusConfig struct {
+	// Prefix of every metric name.
+	Namespace string
+
+	// Upper bounds of the histogram buckets of metrics, by metric name.
+	Buckets map[string][]float64
+
+	// Tags which are not turned into labels.
+	DropLabels []string
+
+	// Maximum number of distinct values of a label. Further values are
+	// reported as OverflowLabelValue.
+	LabelLimits map[string]int
+}
+
+// Prometheus is a Sink which aggregates metrics in memory and serves them in
+// the Prometheus text exposition format. Counters are named after the metric
+// with a _total suffix, gauges after the metric itself, timings become
+// histograms with a _seconds suffix, and tags become labels.
+type Prometheus struct {
+	namespace string
+	buckets   map[string][]float64
+	drop      map[string]bool
+	limits    map[string]int
+
+	mu          sync.Mutex
+	families    map[string]*promFamily
+	labelValues map[string]map[string]bool
+}
+
+type promFamily struct {
+	typ     string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type promSeries struct {
+	labels []promLabel
+
+	value float64 // counters and gauges
+
+	counts []uint64 // histograms, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type promLabel struct {
+	name, value string
+}
+
+func NewPrometheus(c PrometheusConfig) *Prometheus {
+	p := &Prometheus{
+		namespace:   c.Namespace,
+		buckets:     make(map[string][]float64),
+		drop:        make(map[string]bool),
+		limits:      c.LabelLimits,
+		families:    make(map[string]*promFamily),
+		labelValues: make(map[string]map[string]bool),
+	}
+	for name, b := range c.Buckets {
+		b = append([]float64(nil), b...)
+		sort.Float64s(b)
+		p.buckets[name] = b
+	}
+	for _, l := range c.DropLabels {
+		p.drop[l] = true
+	}
+	return p
+}
+
+func (p *Prometheus) Incr(name string, tags []string, rate float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.series(p.metricName(name, "_total"), "counter", nil, tags)
+	if err != nil {
+		return err
+	}
+	s.value++
+	return nil
+}
+
+func (p *Prometheus) Gauge(name string, value float64, tags []string, rate float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.series(p.metricName(name, ""), "gauge", nil, tags)
+	if err != nil {
+		return err
+	}
+	s.value = value
+	return nil
+}
+
+func (p *Prometheus) Histogram(name string, value float64, tags []string, rate float64) error {
+	return p.observe(p.metricName(name, ""), p.bucketsFor(name), value, tags)
+}
+
+func (p *Prometheus) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return p.observe(p.metricName(name, "_seconds"), p.bucketsFor(name), value.Seconds(), tags)
+}
+
+func (p *Prometheus) observe(name string, buckets []float64, value float64, tags []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.series(name, "histogram", buckets, tags)
+	if err != nil {
+		return err
+	}
+	i := sort.SearchFloat64s(buckets, value)
+	if i < len(buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+	return nil
+}
+
+func (p *Prometheus) bucketsFor(name string) []float64 {
+	if b, ok := p.buckets[name]; ok {
+		return b
+	}
+	return DefaultBuckets
+}
+
+// series returns the series of a metric with the labels derived from tags.
+// p.mu must be held.
+func (p *Prometheus) series(name, typ string, buckets []float64, tags []string) (*promSeries, error) {
+	f, ok := p.families[name]
+	if !ok {
+		f = &promFamily{typ: typ, buckets: buckets, series: make(map[string]*promSeries)}
+		p.families[name] = f
+	} else if f.typ != typ {
+		return nil, fmt.Errorf("metric %s is a %s, not a %s", name, f.typ, typ)
+	}
+
+	labels := p.labels(tags)
+	key := formatLabels(labels, "")
+	s, ok := f.series[key]
+	if !ok {
+		s = &promSeries{labels: labels}
+		if typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s, nil
+}
+
+// labels converts tags to sorted labels, applying the label controls. p.mu
+// must be held.
+func (p *Prometheus) labels(tags []string) []promLabel {
+	var labels []promLabel
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		name, value := tag, "true"
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			name, value = tag[:i], tag[i+1:]
+		}
+		name = sanitizeName(name)
+		if p.drop[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if limit := p.limits[name]; limit > 0 {
+			values := p.labelValues[name]
+			if values == nil {
+				values = make(map[string]bool)
+				p.labelValues[name] = values
+			}
+			if !values[value] {
+				if len(values) >= limit {
+					value = OverflowLabelValue
+				} else {
+					values[value] = true
+				}
+			}
+		}
+		labels = append(labels, promLabel{name, value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func (p *Prometheus) metricName(name, suffix string) string {
+	n := sanitizeName(name)
+	if p.namespace != "" {
+		n = sanitizeName(p.namespace) + "_" + n
+	}
+	if !strings.HasSuffix(n, suffix) {
+		n += suffix
+	}
+	return n
+}
+
+// sanitizeName maps name to the characters allowed in metric and label names.
+func sanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels, plus an le label when le is not empty.
+func formatLabels(labels []promLabel, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, l.name, labelValueEscaper.Replace(l.value))
+	}
+	if le != "" {
+		if len(labels) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `le="%s"`, le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(cw, "# TYPE %s %s\n", name, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ == "counter" || f.typ == "gauge" {
+				fmt.Fprintf(cw, "%s%s %s\n", name, key, formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, upper := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatLabels(s.labels, formatFloat(upper)), cumulative)
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatLabels(s.labels, "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", name, key, formatFloat(s.sum))
+			fmt.Fprintf(cw, "%s_count%s %d\n", name, key, s.count)
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics to Prometheus scrapers.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	p.WriteTo(w)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,119 @@
+//go:build !nounit
+// +build !nounit
+
+package stats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusExposition(t *testing.T) {
+	r := require.New(t)
+
+	p := NewPrometheus(PrometheusConfig{
+		Namespace: "smokescreen",
+		Buckets:   map[string][]float64{"cn.atpt.connect.time": {1, 0.1}},
+	})
+
+	r.NoError(p.Incr("acl.allow", []string{"role:api", "def_rule:false"}, 1))
+	r.NoError(p.Incr("acl.allow", []string{"role:api", "def_rule:false"}, 1))
+	r.NoError(p.Incr("resolver.attempts_total", nil, 1))
+	r.NoError(p.Timing("cn.atpt.connect.time", 50*time.Millisecond, []string{"domain:example.com"}, 1))
+	r.NoError(p.Timing("cn.atpt.connect.time", 2*time.Second, []string{"domain:example.com"}, 1))
+	r.NoError(p.Histogram("cn.bytes_in", 10, []string{`role:a"b`}, 1))
+	r.Error(p.Histogram("acl.allow_total", 1, nil, 1))
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	r.Equal(prometheusContentType, rec.Header().Get("Content-Type"))
+
+	r.Equal(`# TYPE smokescreen_acl_allow_total counter
+smokescreen_acl_allow_total{def_rule="false",role="api"} 2
+# TYPE smokescreen_cn_atpt_connect_time_seconds histogram
+smokescreen_cn_atpt_connect_time_seconds_bucket{domain="example.com",le="0.1"} 1
+smokescreen_cn_atpt_connect_time_seconds_bucket{domain="example.com",le="1"} 1
+smokescreen_cn_atpt_connect_time_seconds_bucket{domain="example.com",le="+Inf"} 2
+smokescreen_cn_atpt_connect_time_seconds_sum{domain="example.com"} 2.05
+smokescreen_cn_atpt_connect_time_seconds_count{domain="example.com"} 2
+# TYPE smokescreen_cn_bytes_in histogram
+`+strings.Join([]string{
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.005"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.01"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.025"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.05"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.1"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.25"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="0.5"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="1"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="2.5"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="5"} 0`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="10"} 1`,
+		`smokescreen_cn_bytes_in_bucket{role="a\"b",le="+Inf"} 1`,
+		`smokescreen_cn_bytes_in_sum{role="a\"b"} 10`,
+		`smokescreen_cn_bytes_in_count{role="a\"b"} 1`,
+	}, "\n")+`
+# TYPE smokescreen_resolver_attempts_total counter
+smokescreen_resolver_attempts_total 1
+`, rec.Body.String())
+}
+
+func TestPrometheusLabelControls(t *testing.T) {
+	r := require.New(t)
+
+	p := NewPrometheus(PrometheusConfig{
+		DropLabels:  []string{"domain"},
+		LabelLimits: map[string]int{"role": 2},
+	})
+
+	for _, role := range []string{"a", "b", "c", "a", "d"} {
+		r.NoError(p.Incr("acl.deny", []string{"role:" + role, "domain:" + role + ".example.com"}, 1))
+	}
+
+	var b strings.Builder
+	_, err := p.WriteTo(&b)
+	r.NoError(err)
+	r.Equal(`# TYPE acl_deny_total counter
+acl_deny_total{role="__other__"} 2
+acl_deny_total{role="a"} 2
+acl_deny_total{role="b"} 1
+`, b.String())
+}
+
+func TestMulti(t *testing.T) {
+	r := require.New(t)
+
+	a, b := NewPrometheus(PrometheusConfig{}), NewPrometheus(PrometheusConfig{})
+	var sink Sink = Multi{a, b}
+	r.NoError(sink.Incr("cn.close", []string{"role:api"}, 1))
+
+	for _, p := range []*Prometheus{a, b} {
+		var out strings.Builder
+		p.WriteTo(&out)
+		r.Contains(out.String(), `cn_close_total{role="api"} 1`)
+	}
+}
+
+func TestPrometheusGauge(t *testing.T) {
+	r := require.New(t)
+
+	p := NewPrometheus(PrometheusConfig{Namespace: "smokescreen"})
+	var sink Sink = Multi{p}
+	r.NoError(sink.Gauge("limit.conns.active", 3, nil, 1))
+	r.NoError(sink.Gauge("limit.conns.active", 2, nil, 1))
+	r.NoError(sink.Gauge("limit.conns.utilization", 0.5, []string{"listener:main"}, 1))
+	r.Error(p.Histogram("limit.conns.active", 1, nil, 1))
+
+	var b strings.Builder
+	_, err := p.WriteTo(&b)
+	r.NoError(err)
+	r.Contains(b.String(), `# TYPE smokescreen_limit_conns_active gauge
+smokescreen_limit_conns_active 2
+# TYPE smokescreen_limit_conns_utilization gauge
+smokescreen_limit_conns_utilization{listener="main"} 0.5
+`)
+}
@@ -0,0 +1,59 @@
+// Package stats abstracts over the backends smokescreen reports metrics to.
+package stats
+
+import (
+	"time"
+)
+
+// Sink receives metrics. Tags are DogStatsD style "key:value" strings.
+// statsd.ClientInterface implements Sink.
+type Sink interface {
+	Incr(name string, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Histogram(name string, value float64, tags []string, rate float64) error
+	Timing(name string, value time.Duration, tags []string, rate float64) error
+}
+
+// Multi reports metrics to several sinks. The first error is returned, after
+// every sink has been called.
+type Multi []Sink
+
+func (m Multi) Incr(name string, tags []string, rate float64) error {
+	var err error
+	for _, s := range m {
+		if e := s.Incr(name, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m Multi) Gauge(name string, value float64, tags []string, rate float64) error {
+	var err error
+	for _, s := range m {
+		if e := s.Gauge(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m Multi) Histogram(name string, value float64, tags []string, rate float64) error {
+	var err error
+	for _, s := range m {
+		if e := s.Histogram(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m Multi) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	var err error
+	for _, s := range m {
+		if e := s.Timing(name, value, tags, rate); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -23,6 +23,12 @@ func newServer(config *Config) (s *StatsServer) {
 	}
 
 	s.mux.HandleFunc("/", s.stats)
+	s.mux.HandleFunc("/connections", s.connections)
+	s.mux.HandleFunc("/connections/", s.connections)
+	s.mux.HandleFunc("/acl/reload", s.reloadAcls)
+	if config.PrometheusOnStatsSocket && config.Prometheus != nil {
+		s.mux.Handle(config.PrometheusPath, config.Prometheus)
+	}
 	return
 }
 
@@ -0,0 +1,86 @@
+package smokescreen
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/smokescreen/pkg/smokescreen/conntrack"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing"
+)
+
+// Attributes of the spans of proxy requests.
+const (
+	spanAttrProxyType      = "smokescreen.proxy_type"
+	spanAttrRole           = "smokescreen.role"
+	spanAttrProject        = "smokescreen.project"
+	spanAttrDecision       = "smokescreen.decision"
+	spanAttrDecisionReason = "smokescreen.decision_reason"
+	spanAttrEnforceWould   = "smokescreen.enforce_would_deny"
+	spanAttrBytesIn        = "smokescreen.bytes_in"
+	spanAttrBytesOut       = "smokescreen.bytes_out"
+	spanAttrPeerName       = "net.peer.name"
+	spanAttrPeerAddr       = "net.peer.addr"
+	spanAttrSockAddr       = "net.sock.host.addr"
+)
+
+// How long to wait for spans to be exported at shutdown.
+const tracingShutdownTimeout = 5 * time.Second
+
+// SetupTracing records spans of proxy requests and exports them to the OTLP
+// collector configured in tc. Traces are continued from the traceparent
+// header of proxy requests.
+func (config *Config) SetupTracing(tc tracing.Config) error {
+	if tc.OnError == nil {
+		tc.OnError = func(err error) {
+			config.Log.Warnf("tracing: %v", err)
+		}
+	}
+	tracer, err := tracing.NewTracer(tc)
+	if err != nil {
+		return err
+	}
+	config.Tracer = tracer
+	return nil
+}
+
+// setDecisionAttributes records the outcome of d on span.
+func setDecisionAttributes(span *tracing.Span, d *aclDecision) {
+	if d == nil {
+		return
+	}
+	span.SetAttribute(spanAttrRole, d.role)
+	span.SetAttribute(spanAttrProject, d.project)
+	if d.allow {
+		span.SetAttribute(spanAttrDecision, "allow")
+	} else {
+		span.SetAttribute(spanAttrDecision, "deny")
+	}
+	span.SetAttribute(spanAttrDecisionReason, d.reason)
+	span.SetAttribute(spanAttrEnforceWould, d.enforceWouldDeny)
+}
+
+// traceTunnel records the lifetime of a tunnel as a span which ends when ic is
+// closed.
+func traceTunnel(sctx *smokescreenContext, ic *conntrack.InstrumentedConn) {
+	if sctx.span == nil {
+		return
+	}
+	span := sctx.span.Child("smokescreen.tunnel", tracing.SpanKindInternal)
+	setDecisionAttributes(span, sctx.decision)
+	span.SetAttribute(spanAttrPeerName, sctx.decision.outboundHost)
+	ic.OnClose(func(ic *conntrack.InstrumentedConn) {
+		span.SetAttribute(spanAttrBytesIn, atomic.LoadUint64(ic.BytesIn))
+		span.SetAttribute(spanAttrBytesOut, atomic.LoadUint64(ic.BytesOut))
+		span.SetError(ic.ConnError)
+		span.End()
+	})
+}
+
+func shutdownTracing(config *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := config.Tracer.Shutdown(ctx); err != nil {
+		config.Log.Errorf("error exporting remaining spans: %v", err)
+	}
+}
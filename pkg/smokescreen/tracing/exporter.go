@@ -0,0 +1,390 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultServiceName   = "smokescreen"
+	DefaultBatchSize     = 512
+	DefaultFlushInterval = 5 * time.Second
+	DefaultExportTimeout = 10 * time.Second
+
+	queueSize = 4096
+)
+
+// Config configures a Tracer.
+type Config struct {
+	// URL of the OTLP/HTTP traces endpoint, for instance
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+
+	// service.name resource attribute of the exported spans.
+	ServiceName string
+
+	// Headers sent with every export request, for instance for
+	// authentication.
+	Headers map[string]string
+
+	// Client used for export requests; http.DefaultClient if nil. Configure
+	// its transport to export over mutual TLS.
+	Client *http.Client
+
+	// Maximum number of spans per export request.
+	BatchSize int
+
+	// Interval at which partial batches are exported.
+	FlushInterval time.Duration
+
+	// Timeout of an export request.
+	ExportTimeout time.Duration
+
+	// Called when an export fails; errors are dropped if nil.
+	OnError func(error)
+}
+
+// Tracer starts spans and exports the ended ones in batches. A nil *Tracer is
+// valid and starts nil spans.
+type Tracer struct {
+	config Config
+
+	queue    chan *Span
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func NewTracer(c Config) (*Tracer, error) {
+	if c.Endpoint == "" {
+		return nil, errors.New("tracing: no endpoint")
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = DefaultServiceName
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = DefaultFlushInterval
+	}
+	if c.ExportTimeout <= 0 {
+		c.ExportTimeout = DefaultExportTimeout
+	}
+
+	t := &Tracer{
+		config: c,
+		queue:  make(chan *Span, queueSize),
+		flush:  make(chan chan struct{}),
+		done:   make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+// enqueue queues an ended span, dropping it if the queue is full so that
+// tracing never slows down proxying.
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+// Flush exports the spans ended so far.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the remaining spans and stops the Tracer. Spans ended
+// afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.done) })
+
+	stopped := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = nil
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+				if len(batch) >= t.config.BatchSize {
+					export()
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.config.BatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flush:
+			drain()
+			export()
+			close(done)
+		case <-t.done:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	body, err := json.Marshal(t.encode(spans))
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil && t.config.OnError != nil {
+		t.config.OnError(fmt.Errorf("exporting %d spans: %w", len(spans), err))
+	}
+}
+
+func (t *Tracer) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.ExportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of ExportTraceServiceRequest. IDs are hex
+// encoded and 64 bit integers are strings, as the OTLP spec requires.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (t *Tracer) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		os := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.attributes),
+		}
+		if s.parent != (SpanID{}) {
+			os.ParentSpanID = s.parent.String()
+		}
+		if s.errMessage != "" {
+			os.Status = otlpStatus{Code: otlpStatusError, Message: s.errMessage}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, os)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes(map[string]interface{}{
+			"service.name": t.config.ServiceName,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/stripe/smokescreen"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func encodeAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: encodeValue(attributes[k])})
+	}
+	return kvs
+}
+
+func encodeValue(v interface{}) otlpValue {
+	integer := func(i int64) otlpValue {
+		s := strconv.FormatInt(i, 10)
+		return otlpValue{IntValue: &s}
+	}
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		return integer(int64(v))
+	case int32:
+		return integer(int64(v))
+	case int64:
+		return integer(v)
+	case uint16:
+		return integer(int64(v))
+	case uint32:
+		return integer(int64(v))
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case time.Duration:
+		return integer(int64(v))
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
@@ -0,0 +1,205 @@
+// Package tracing records spans and exports them to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding. Only the parts of the
+// OpenTelemetry model smokescreen needs are implemented.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header.
+const TraceparentHeader = "traceparent"
+
+// Span kinds, as defined by OTLP.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc has non-zero trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Values of future
+// versions are parsed as far as version 00 defines them.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	for _, p := range parts[:4] {
+		if strings.ToLower(p) != p {
+			return sc, false
+		}
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is an operation being traced. All methods are safe to call on a nil
+// Span, which is what a nil Tracer starts, so that callers need not check
+// whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+
+	name   string
+	kind   int
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	errMessage string
+	ended      bool
+}
+
+// Start starts a server span, continuing the trace of parent if it is valid.
+// Traces which the parent did not sample are not exported.
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   SpanKindServer,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	rand.Read(s.sc.SpanID[:])
+	return s
+}
+
+// Child starts a span of the given kind within s.
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{
+		tracer: s.tracer,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		parent: s.sc.SpanID,
+	}
+	c.sc.TraceID = s.sc.TraceID
+	c.sc.Sampled = s.sc.Sampled
+	rand.Read(c.sc.SpanID[:])
+	return c
+}
+
+// Context returns the span's SpanContext.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records an attribute. Values may be strings, bools, integers
+// or floats; other types are recorded as strings. Spans which have ended are
+// not modified.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil err has no effect.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.errMessage = err.Error()
+	}
+}
+
+// End ends the span and queues it for export. Only the first call has an
+// effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
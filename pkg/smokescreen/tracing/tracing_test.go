@@ -0,0 +1,120 @@
+//go:build !nounit
+// +build !nounit
+
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing/tracingtest"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			require.Equal(t, tt.ok, ok)
+			if ok {
+				require.Equal(t, tt.sampled, sc.Sampled)
+				require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+				require.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+			}
+		})
+	}
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+}
+
+func TestTracerExport(t *testing.T) {
+	r := require.New(t)
+
+	c := tracingtest.NewCollector()
+	defer c.Close()
+
+	tracer, err := NewTracer(Config{
+		Endpoint:      c.Endpoint(),
+		ServiceName:   "smokescreen-test",
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		FlushInterval: time.Hour,
+	})
+	r.NoError(err)
+
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := tracer.Start("proxy", parent)
+	child := root.Child("dial", SpanKindClient)
+	child.SetAttribute("net.peer.port", 443)
+	child.SetAttribute("bytes", uint64(1<<40))
+	child.SetError(context.DeadlineExceeded)
+	child.End()
+	root.SetAttribute("decision", "allow")
+	root.SetAttribute("allow", true)
+	root.End()
+	root.End()
+
+	unsampledParent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tracer.Start("unsampled", unsampledParent).End()
+
+	r.NoError(tracer.Flush(context.Background()))
+	spans := c.Spans()
+	r.Len(spans, 2)
+	r.Equal("smokescreen-test", c.ServiceName())
+	r.Equal("Bearer token", c.Headers()[0].Get("Authorization"))
+
+	dial, proxy := spans[0], spans[1]
+	r.Equal("proxy", proxy.Name)
+	r.Equal(SpanKindServer, proxy.Kind)
+	r.Equal("4bf92f3577b34da6a3ce929d0e0e4736", proxy.TraceID)
+	r.Equal("00f067aa0ba902b7", proxy.ParentSpanID)
+	r.Equal("allow", *proxy.Attribute("decision").StringValue)
+	r.True(*proxy.Attribute("allow").BoolValue)
+	r.Zero(proxy.Status.Code)
+
+	r.Equal("dial", dial.Name)
+	r.Equal(SpanKindClient, dial.Kind)
+	r.Equal(proxy.TraceID, dial.TraceID)
+	r.Equal(proxy.SpanID, dial.ParentSpanID)
+	r.Equal("443", *dial.Attribute("net.peer.port").IntValue)
+	r.Equal("1099511627776", *dial.Attribute("bytes").IntValue)
+	r.Equal(otlpStatusError, dial.Status.Code)
+	r.Equal(context.DeadlineExceeded.Error(), dial.Status.Message)
+
+	tracer.Start("last", SpanContext{}).End()
+	r.NoError(tracer.Shutdown(context.Background()))
+	spans = c.Spans()
+	r.Len(spans, 3)
+	r.Empty(spans[2].ParentSpanID)
+	r.Len(spans[2].TraceID, 32)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("proxy", SpanContext{})
+	require.Nil(t, span)
+
+	span.Child("dial", SpanKindClient).SetAttribute("k", "v")
+	span.SetError(context.Canceled)
+	span.End()
+	require.False(t, span.Context().IsValid())
+	require.NoError(t, tracer.Shutdown(context.Background()))
+}
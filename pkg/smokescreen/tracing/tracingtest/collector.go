@@ -0,0 +1,152 @@
+// Package tracingtest provides a stand-in OTLP/HTTP collector for tests of
+// code exporting traces with package tracing.
+package tracingtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Collector is an OTLP/HTTP collector which records the spans it receives
+// on /v1/traces.
+type Collector struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers []http.Header
+	spans   []Span
+	service string
+}
+
+// Span is a span as exported in OTLP/JSON.
+type Span struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Attributes   []KeyValue `json:"attributes"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// KeyValue is an attribute of a span or resource.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value Value  `json:"value"`
+}
+
+// Value is an attribute value; one of its fields is set. Integers are
+// exported as strings.
+type Value struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *string  `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+}
+
+// String returns the value as text, or "" for a nil value.
+func (v *Value) String() string {
+	switch {
+	case v == nil:
+		return ""
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return *v.IntValue
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	}
+	return ""
+}
+
+// Attribute returns the value of the attribute key of s, or nil.
+func (s *Span) Attribute(key string) *Value {
+	for i := range s.Attributes {
+		if s.Attributes[i].Key == key {
+			return &s.Attributes[i].Value
+		}
+	}
+	return nil
+}
+
+// NewCollector starts a Collector, which the caller should Close.
+func NewCollector() *Collector {
+	c := &Collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []KeyValue `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []Span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = append(c.headers, r.Header)
+		for _, rs := range req.ResourceSpans {
+			for _, kv := range rs.Resource.Attributes {
+				if kv.Key == "service.name" {
+					c.service = kv.Value.String()
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	return c
+}
+
+// Endpoint returns the URL to export traces to.
+func (c *Collector) Endpoint() string {
+	return c.URL + "/v1/traces"
+}
+
+// Spans returns the spans received, in the order they were received.
+func (c *Collector) Spans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span(nil), c.spans...)
+}
+
+// Span returns the first span received named name, or nil.
+func (c *Collector) Span(name string) *Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.spans {
+		if c.spans[i].Name == name {
+			s := c.spans[i]
+			return &s
+		}
+	}
+	return nil
+}
+
+// Headers returns the headers of the export requests received.
+func (c *Collector) Headers() []http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]http.Header(nil), c.headers...)
+}
+
+// ServiceName returns the service.name resource attribute last received.
+func (c *Collector) ServiceName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.service
+}
@@ -0,0 +1,136 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing"
+	"github.com/stripe/smokescreen/pkg/smokescreen/tracing/tracingtest"
+)
+
+func TestTracingConnect(t *testing.T) {
+	r := require.New(t)
+
+	collector := tracingtest.NewCollector()
+	defer collector.Close()
+
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+	r.NoError(cfg.SetupTracing(tracing.Config{Endpoint: collector.Endpoint()}))
+	logHook := proxyLogHook(cfg)
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+	client.Transport.(*http.Transport).ProxyConnectHeader = http.Header{
+		"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+
+	resp, err := client.Get(remote.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusOK, resp.StatusCode)
+	client.CloseIdleConnections()
+
+	r.Eventually(func() bool {
+		r.NoError(cfg.Tracer.Flush(context.Background()))
+		return collector.Span("smokescreen.tunnel") != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	root := collector.Span("smokescreen.proxy")
+	r.NotNil(root)
+	r.Equal("4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	r.Equal("00f067aa0ba902b7", root.ParentSpanID)
+	r.Equal("test-local-srv", root.Attribute(spanAttrRole).String())
+	r.Equal("security", root.Attribute(spanAttrProject).String())
+	r.Equal("allow", root.Attribute(spanAttrDecision).String())
+	r.Equal(connectProxy, root.Attribute(spanAttrProxyType).String())
+
+	for _, name := range []string{"smokescreen.acl", "smokescreen.dns", "smokescreen.dial", "smokescreen.tunnel"} {
+		span := collector.Span(name)
+		r.NotNil(span, name)
+		r.Equal(root.TraceID, span.TraceID, name)
+		r.Equal(root.SpanID, span.ParentSpanID, name)
+	}
+	r.Equal("allow", collector.Span("smokescreen.acl").Attribute(spanAttrDecision).String())
+	r.Equal(remote.Listener.Addr().String(), collector.Span("smokescreen.dial").Attribute(spanAttrPeerAddr).String())
+
+	tunnel := collector.Span("smokescreen.tunnel")
+	for _, attr := range []string{spanAttrBytesIn, spanAttrBytesOut} {
+		r.NotNil(tunnel.Attribute(attr), attr)
+		r.NotEqual("0", tunnel.Attribute(attr).String(), attr)
+	}
+
+	entry := findCanonicalProxyDecision(logHook.AllEntries())
+	r.NotNil(entry)
+	r.Equal(root.TraceID, entry.Data[LogFieldOtelTraceID])
+}
+
+func TestTracingDeny(t *testing.T) {
+	r := require.New(t)
+
+	collector := tracingtest.NewCollector()
+	defer collector.Close()
+
+	cfg, err := testConfig("test-local-srv")
+	r.NoError(err)
+	r.NoError(cfg.SetupTracing(tracing.Config{Endpoint: collector.Endpoint()}))
+
+	proxy := proxyServer(cfg)
+	defer proxy.Close()
+	client, err := proxyClient(proxy.URL)
+	r.NoError(err)
+
+	resp, err := client.Get("http://127.0.0.1:1")
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+
+	r.NoError(cfg.Tracer.Flush(context.Background()))
+	root := collector.Span("smokescreen.proxy")
+	r.NotNil(root)
+	r.Empty(root.ParentSpanID)
+	r.Equal("deny", root.Attribute(spanAttrDecision).String())
+	r.Equal("407", root.Attribute("http.status_code").String())
+	r.Equal("allow", collector.Span("smokescreen.acl").Attribute(spanAttrDecision).String())
+	r.NotNil(collector.Span("smokescreen.dns"))
+	r.Nil(collector.Span("smokescreen.dial"))
+}
+
+func TestTracingFromConfigFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	r.NoError(ioutil.WriteFile(path, []byte(`
+tracing:
+  otlp_endpoint: http://127.0.0.1:4318/v1/traces
+  service_name: egress
+  headers:
+    Authorization: Bearer abc123
+`), 0600))
+
+	conf, err := LoadConfig(path)
+	r.NoError(err)
+	r.NotNil(conf.Tracer)
+	r.NoError(conf.Tracer.Shutdown(context.Background()))
+
+	r.NoError(ioutil.WriteFile(path, []byte("tracing: {service_name: egress}\n"), 0600))
+	_, err = LoadConfig(path)
+	r.Error(err)
+}
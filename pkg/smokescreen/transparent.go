@@ -0,0 +1,147 @@
+package smokescreen
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/stripe/goproxy"
+)
+
+const (
+	// TransparentModeRedirect recovers the destination of connections
+	// redirected with iptables REDIRECT or DNAT from SO_ORIGINAL_DST.
+	TransparentModeRedirect = "redirect"
+
+	// TransparentModeTProxy accepts connections diverted with iptables TPROXY,
+	// whose local address is the original destination.
+	TransparentModeTProxy = "tproxy"
+
+	// Clients must send enough data to identify the destination hostname within
+	// this time.
+	transparentPeekTimeout = 10 * time.Second
+
+	LogFieldOriginalDst = "original_destination"
+)
+
+// TransparentServer proxies connections which were redirected to smokescreen
+// without the client's knowledge. The destination hostname is taken from the
+// TLS ClientHello SNI or the HTTP Host header, and the destination port from
+// the connection's original destination. Connections are then subject to the
+// same ACL and address checks as CONNECT requests.
+type TransparentServer struct {
+	connServer
+}
+
+func NewTransparentServer(config *Config) *TransparentServer {
+	s := &TransparentServer{}
+	s.config = config
+	s.name = "transparent"
+	s.handle = s.handleConn
+	return s
+}
+
+func (s *TransparentServer) handleConn(conn net.Conn) {
+	config := s.config
+	logger := config.Log.WithField(LogFieldInRemoteAddr, conn.RemoteAddr().String())
+
+	dst, err := transparentDestination(config, conn)
+	if err != nil {
+		logger.Warnf("transparent proxy could not determine destination: %v", err)
+		conn.Close()
+		return
+	}
+
+	// Refuse connections addressed to the listener itself; proxying them
+	// would loop back into smokescreen.
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && config.TransparentMode != TransparentModeTProxy {
+		if local.IP.Equal(dst.IP) && local.Port == dst.Port {
+			logger.Warn("transparent proxy received a connection which was not redirected")
+			conn.Close()
+			return
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	host, replay, err := peekHostname(bufio.NewReader(conn))
+	if err != nil {
+		logger.Warnf("transparent proxy could not read client handshake: %v", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Without a hostname the ACL is checked against the original destination
+	// address.
+	if host == "" {
+		host = dst.IP.String()
+	}
+
+	hostPort := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	req := tunnelRequest(hostPort, "TCP", conn.RemoteAddr(), nil)
+	sctx := newContext(config, transparentProxy, req)
+	sctx.logger = sctx.logger.WithField(LogFieldOriginalDst, dst.String())
+	pctx := &goproxy.ProxyCtx{Req: req, UserData: sctx}
+
+	destination, err := handleConnect(config, pctx)
+	logProxy(config, pctx)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), goproxy.ProxyContextKey, pctx)
+	target, err := dialContext(ctx, "tcp", destination)
+	if err != nil {
+		sctx.logger.WithField(LogFieldError, err.Error()).Error("Failed to connect to remote host")
+		conn.Close()
+		return
+	}
+
+	spliceConns(config, pctx, &bufferedConn{Conn: conn, r: replay}, target)
+}
+
+// transparentDestination is overridden in tests.
+var transparentDestination = originalDestination
+
+func originalDestination(config *Config, conn net.Conn) (*net.TCPAddr, error) {
+	if config.TransparentMode == TransparentModeTProxy {
+		addr, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected local address type %T", conn.LocalAddr())
+		}
+		return addr, nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	return redirectedDestination(tcpConn)
+}
+
+func findTransparentListener(config *Config) (net.Listener, error) {
+	address := fmt.Sprintf("%s:%d", config.TransparentIp, config.TransparentPort)
+	if config.TransparentMode == TransparentModeTProxy {
+		return listenTransparent(address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// SetTransparentMode validates and sets how the transparent listener recovers
+// the original destination of connections. An empty mode selects
+// TransparentModeRedirect.
+func (config *Config) SetTransparentMode(mode string) error {
+	switch mode {
+	case "":
+		mode = TransparentModeRedirect
+	case TransparentModeRedirect, TransparentModeTProxy:
+	default:
+		return fmt.Errorf("invalid transparent mode: %v", mode)
+	}
+	config.TransparentMode = mode
+	return nil
+}
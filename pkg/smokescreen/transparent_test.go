@@ -0,0 +1,105 @@
+//go:build !nounit
+// +build !nounit
+
+package smokescreen
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// transparentTestServer starts a transparent listener which treats every
+// connection as having been redirected from dst.
+func transparentTestServer(t *testing.T, cfg *Config, dst *net.TCPAddr) string {
+	old := transparentDestination
+	transparentDestination = func(*Config, net.Conn) (*net.TCPAddr, error) { return dst, nil }
+	t.Cleanup(func() { transparentDestination = old })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewTransparentServer(cfg)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func TestTransparentProxy(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+	dst := remote.Listener.Addr().(*net.TCPAddr)
+
+	t.Run("allowed by Host header", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-open-srv")
+		r.NoError(err)
+		r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+		logHook := proxyLogHook(cfg)
+
+		addr := transparentTestServer(t, cfg, dst)
+		conn, err := net.Dial("tcp", addr)
+		r.NoError(err)
+
+		req, err := http.NewRequest("GET", "http://localhost/", nil)
+		r.NoError(err)
+		r.NoError(req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		r.NoError(err)
+		r.Equal(http.StatusOK, resp.StatusCode)
+
+		conn.Close()
+		cfg.ConnTracker.Wg.Wait()
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(transparentProxy, entry.Data[LogFieldProxyType])
+		r.Equal(true, entry.Data[LogFieldAllow])
+		r.Equal(dst.String(), entry.Data[LogFieldOriginalDst])
+		r.Contains(entry.Data[LogFieldRequestedHost], "localhost:")
+		r.NotNil(findCanonicalProxyClose(logHook.AllEntries()))
+	})
+
+	t.Run("denied by ACL", func(t *testing.T) {
+		r := require.New(t)
+
+		cfg, err := testConfig("test-trusted-srv")
+		r.NoError(err)
+		r.NoError(cfg.SetAllowAddresses([]string{"127.0.0.1"}))
+		logHook := proxyLogHook(cfg)
+
+		addr := transparentTestServer(t, cfg, dst)
+		conn, err := net.Dial("tcp", addr)
+		r.NoError(err)
+		defer conn.Close()
+
+		req, err := http.NewRequest("GET", "http://notlocalhost.example/", nil)
+		r.NoError(err)
+		r.NoError(req.Write(conn))
+		_, err = http.ReadResponse(bufio.NewReader(conn), req)
+		r.Error(err)
+
+		entry := findCanonicalProxyDecision(logHook.AllEntries())
+		r.NotNil(entry)
+		r.Equal(false, entry.Data[LogFieldAllow])
+		r.Equal(transparentProxy, entry.Data[LogFieldProxyType])
+	})
+}
+
+func TestSetTransparentMode(t *testing.T) {
+	r := require.New(t)
+
+	conf := NewConfig()
+	r.NoError(conf.SetTransparentMode(""))
+	r.Equal(TransparentModeRedirect, conf.TransparentMode)
+	r.NoError(conf.SetTransparentMode(TransparentModeTProxy))
+	r.Equal(TransparentModeTProxy, conf.TransparentMode)
+	r.Error(conf.SetTransparentMode("nat"))
+}
@@ -0,0 +1,111 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/stripe/goproxy"
+)
+
+// connServer is the accept loop shared by listeners which handle raw TCP
+// connections rather than HTTP requests.
+type connServer struct {
+	config *Config
+	name   string
+	handle func(net.Conn)
+
+	mu       sync.Mutex
+	ln       net.Listener
+	shutdown bool
+}
+
+// Serve accepts connections on ln until Close is called.
+func (s *connServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.config.Log.Warnf("%s accept error: %v", s.name, err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting new connections. Established tunnels are tracked by
+// the ConnTracker and are not affected.
+func (s *connServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// tunnelRequest builds the request used for role extraction and ACL checks of
+// tunnels which did not arrive as an HTTP CONNECT request.
+func tunnelRequest(hostPort, proto string, remote net.Addr, state *tls.ConnectionState) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: hostPort},
+		Host:       hostPort,
+		Proto:      proto,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: remote.String(),
+		TLS:        state,
+	}
+}
+
+// spliceConns copies data between the proxy client and the proxy target until
+// either side closes, reporting errors to the target's InstrumentedConn the
+// same way goproxy does for CONNECT tunnels.
+func spliceConns(config *Config, pctx *goproxy.ProxyCtx, client, target net.Conn) {
+	if config.IdleTimeout != 0 {
+		client = NewTimeoutConn(client, config.IdleTimeout)
+	}
+	go func() {
+		_, err := io.Copy(target, client)
+		if err != nil && pctx.ConnErrorHandler != nil && !errors.Is(err, net.ErrClosed) {
+			pctx.ConnErrorHandler(err)
+		}
+		target.Close()
+	}()
+	go func() {
+		io.Copy(client, target)
+		client.Close()
+	}()
+}
+
+// bufferedConn is a net.Conn which reads through r, so bytes buffered or
+// peeked while parsing a handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}